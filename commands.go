@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+// Sub-commands, run as: mp4reader [-i input.mp4] <command> [command flags]
+var commands = map[string]func(args []string) error{
+	"concat":     runConcat,
+	"cut":        runCut,
+	"dash":       runDash,
+	"defragment": runDefragment,
+	"diff":       runDiff,
+	"extract":    runExtract,
+	"faststart":  runFaststart,
+	"flv":        runFlv,
+	"fragment":   runFragment,
+	"framehash":  runFrameHash,
+	"frames":     runFrames,
+	"hls":        runHls,
+	"mkv":        runMkv,
+	"mux":        runMux,
+	"remux":      runRemux,
+	"ts":         runTs,
+	"validate":   runValidate,
+}
+
+func commandNames() []string {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// openInput opens an mp4 for a sub-command. The parser's diagnostics go to
+// stderr so that stdout only carries the command's output.
+func openInput(path string) (*mp4.File, error) {
+	if path == "" {
+		return nil, fmt.Errorf("No input file, use -i input_file.mp4")
+	}
+	mp4.Log = os.Stderr
+	return mp4.Open(path)
+}
+
+// createOutput returns stdout if path is empty, otherwise the created file.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// getTrak returns the track with the given index.
+func getTrak(f *mp4.File, index int) (*mp4.TrakBox, error) {
+	traks := f.Moov.GetTraks()
+	if index < 0 || index >= len(traks) {
+		return nil, fmt.Errorf("Track %d out of range, file has %d tracks", index, len(traks))
+	}
+	return traks[index], nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runConcat(args []string) error {
+	fs := flag.NewFlagSet("concat", flag.ExitOnError)
+	output := fs.String("o", "", "-o output_file.mp4")
+	gaps := fs.Bool("gaps", false, "-gaps keep the time between recordings, based on their creation time")
+	fs.Parse(args)
+
+	inputs := fs.Args()
+	if inputFile != "" {
+		inputs = append([]string{inputFile}, inputs...)
+	}
+	if len(inputs) < 2 || *output == "" {
+		return fmt.Errorf("Usage: concat -o output.mp4 [-gaps] a.mp4 b.mp4 ...")
+	}
+	files := []*mp4.File{}
+	for _, input := range inputs {
+		if filepath.Clean(input) == filepath.Clean(*output) {
+			return fmt.Errorf("Output must differ from the inputs, the media data is copied from them")
+		}
+		f, err := openInput(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return mp4.Concat(out, files, mp4.ConcatOptions{Keep_gaps: *gaps})
+}
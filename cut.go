@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runCut(args []string) error {
+	fs := flag.NewFlagSet("cut", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file.mp4, must differ from the input")
+	start := fs.String("start", "0", "-start time the output starts at, as [[hh:]mm:]ss[.frac]")
+	end := fs.String("end", "", "-end time the output ends at, as [[hh:]mm:]ss[.frac], the end of the input if empty")
+	fs.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("No output file, use -o output_file.mp4")
+	}
+	if a, b := filepath.Clean(*input), filepath.Clean(*output); a == b {
+		return fmt.Errorf("Output must differ from the input, the media data is copied from it")
+	}
+	from, err := parseTime(*start)
+	if err != nil {
+		return err
+	}
+	to := time.Duration(0)
+	if *end != "" {
+		if to, err = parseTime(*end); err != nil {
+			return err
+		}
+		if to <= from {
+			return fmt.Errorf("End %v is not after start %v", *end, *start)
+		}
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteCut(out, from, to)
+}
+
+// parseTime parses a time given as seconds, mm:ss or hh:mm:ss, each with
+// an optional fraction of a second.
+func parseTime(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("Invalid time %q", s)
+	}
+	seconds := 0.0
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || i < len(parts)-1 && v != float64(int(v)) {
+			return 0, fmt.Errorf("Invalid time %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return time.Duration(math.Round(seconds * float64(time.Second))), nil
+}
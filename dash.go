@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runDash(args []string) error {
+	fs := flag.NewFlagSet("dash", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o directory receiving "+mp4.DASH_MANIFEST+" and a directory per representation")
+	duration := fs.Float64("duration", 4, "-duration target segment duration in seconds, segments start at video keyframes")
+	template := fs.String("template", "timeline", "-template segment addressing, timeline (SegmentTimeline) or number ($Number$ with the average duration)")
+	fs.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("No output directory, use -o directory")
+	}
+	opts := mp4.DASHOptions{Duration: time.Duration(*duration * float64(time.Second))}
+	switch *template {
+	case "timeline":
+	case "number":
+		opts.Number_template = true
+	default:
+		return fmt.Errorf("Unknown segment template %q, use timeline or number", *template)
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = f.WriteDASH(createUnder(*output), opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v written\n", filepath.Join(*output, mp4.DASH_MANIFEST))
+	return nil
+}
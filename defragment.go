@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func runDefragment(args []string) error {
+	fs := flag.NewFlagSet("defragment", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4, a fragmented MP4, or an init segment followed by its media segments")
+	output := fs.String("o", "", "-o output_file.mp4, must differ from the input")
+	fs.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("No output file, use -o output_file.mp4")
+	}
+	if a, b := filepath.Clean(*input), filepath.Clean(*output); a == b {
+		return fmt.Errorf("Output must differ from the input, the media data is copied from it")
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteDefragmented(out)
+}
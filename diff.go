@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i first_file.mp4, or give both files as arguments")
+	samples := fs.Bool("samples", false, "-samples also compare sample tables and per-sample timing")
+	payload := fs.Bool("payload", false, "-payload also compare per-sample payload hashes")
+	max := fs.Int("max", 10, "-max number of divergent samples reported per track")
+	format := fs.String("format", "text", "-format text or json")
+	fs.Parse(args)
+
+	var pathA, pathB string
+	switch {
+	case fs.NArg() == 2:
+		pathA, pathB = fs.Arg(0), fs.Arg(1)
+	case fs.NArg() == 1 && *input != "":
+		pathA, pathB = *input, fs.Arg(0)
+	default:
+		return fmt.Errorf("Usage: diff [flags] a.mp4 b.mp4")
+	}
+
+	a, err := openInput(pathA)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := openInput(pathB)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	diffs := mp4.Diff(a, b, mp4.DiffOptions{
+		Samples:     *samples,
+		Payload:     *payload,
+		Max_samples: *max,
+	})
+
+	switch *format {
+	case "text":
+		if len(diffs) > 0 {
+			fmt.Println(mp4.FormatDifferences(diffs))
+		}
+	case "json":
+		data, err := json.MarshalIndent(diffs, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		return fmt.Errorf("Unknown format %v, use text or json", *format)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("%v and %v differ", pathA, pathB)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runExtract(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file, stdout if empty; the directory receiving the images for jpeg")
+	track := fs.Int("track", 0, "-track index of the track to extract")
+	format := fs.String("format", "", "-format annexb, ivf, obu, ogg, wav, ac3, eac3, jpeg, srt, vtt or ttml, the default of the codec if empty")
+	timestamps := fs.Bool("timestamps", false, "-timestamps with jpeg, also write "+mp4.JPEG_TIMESTAMPS_FILE+" listing the presentation time of each image")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *format == mp4.EXTRACT_JPEG || *format == "" && f.ExtractFormat(*track) == mp4.EXTRACT_JPEG {
+		if *output == "" {
+			return fmt.Errorf("No output directory, use -o directory")
+		}
+		return f.WriteJPEGs(createUnder(*output), *track, *timestamps)
+	}
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.Extract(out, *track, *format)
+}
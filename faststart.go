@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func runFaststart(args []string) error {
+	fs := flag.NewFlagSet("faststart", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file.mp4, must differ from the input")
+	fs.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("No output file, use -o output_file.mp4")
+	}
+	if a, b := filepath.Clean(*input), filepath.Clean(*output); a == b {
+		return fmt.Errorf("Output must differ from the input, the media data is copied from it")
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if f.IsFaststart() {
+		fmt.Fprintf(os.Stderr, "%v already has moov before mdat\n", *input)
+	}
+
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteFaststart(out)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+)
+
+func runFlv(args []string) error {
+	fs := flag.NewFlagSet("flv", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file.flv, stdout if empty")
+	track := fs.Int("track", -1, "-track index of the track to keep, the first video and audio tracks if -1")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var traks []int
+	if *track >= 0 {
+		traks = []int{*track}
+	}
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteFLV(out, traks)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+// Names of the files written to a segment directory
+const (
+	INIT_SEGMENT  = "init.mp4"
+	MEDIA_SEGMENT = "segment_%d.m4s"
+)
+
+func runFragment(args []string) error {
+	fs := flag.NewFlagSet("fragment", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file.mp4, a single fragmented file")
+	segments := fs.String("segments", "", "-segments directory receiving "+INIT_SEGMENT+" and one "+MEDIA_SEGMENT+" file per fragment")
+	duration := fs.Float64("duration", 2, "-duration target fragment duration in seconds, fragments start at video keyframes")
+	track := fs.Int("track", -1, "-track index of the track to keep, all tracks if -1")
+	sidx := fs.Bool("sidx", false, "-sidx add a sidx segment index")
+	mfra := fs.Bool("mfra", false, "-mfra end the file with an mfra random access index, single file only")
+	fs.Parse(args)
+
+	if (*output == "") == (*segments == "") {
+		return fmt.Errorf("Need either -o output_file.mp4 or -segments directory")
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	opts := mp4.FragmentOptions{
+		Duration: time.Duration(*duration * float64(time.Second)),
+		Sidx:     *sidx,
+		Mfra:     *mfra,
+	}
+	if *track >= 0 {
+		opts.Tracks = []int{*track}
+	}
+
+	var written []mp4.Segment
+	if *output != "" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		written, err = f.WriteFragmented(out, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		written, err = writeSegments(f, *segments, opts)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d fragments written\n", len(written))
+	return nil
+}
+
+// writeSegments writes the init and media segments of f to dir.
+func writeSegments(f *mp4.File, dir string, opts mp4.FragmentOptions) ([]mp4.Segment, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	init, err := os.Create(filepath.Join(dir, INIT_SEGMENT))
+	if err != nil {
+		return nil, err
+	}
+	defer init.Close()
+	return f.WriteSegments(init, func(number int) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, fmt.Sprintf(MEDIA_SEGMENT, number)))
+	}, opts)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func runFrameHash(args []string) error {
+	fs := flag.NewFlagSet("framehash", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	track := fs.Int("track", -1, "-track index of the track to hash, all tracks if -1")
+	hash := fs.String("hash", "md5", "-hash md5, sha256 or crc32")
+	format := fs.String("format", "framehash", "-format framehash (like ffmpeg framemd5/framehash) or framecrc (Adler-32, like ffmpeg framecrc)")
+	output := fs.String("o", "", "-o output file, stdout if empty")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	traks := f.AllTraks()
+	if *track >= 0 {
+		traks = []int{*track}
+	}
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	switch *format {
+	case "framehash":
+		return f.WriteFrameHash(out, *hash, traks)
+	case "framecrc":
+		return f.WriteFrameCRC(out, traks)
+	}
+	return fmt.Errorf("Unknown format %v, use framehash or framecrc", *format)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runFrames(args []string) error {
+	fs := flag.NewFlagSet("frames", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	track := fs.Int("track", 0, "-track index of the track to list")
+	format := fs.String("format", "csv", "-format csv or json")
+	output := fs.String("o", "", "-o output file, stdout if empty")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	trak, err := getTrak(f, *track)
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	frames := trak.GetFrames()
+	switch *format {
+	case "csv":
+		return mp4.WriteFramesCSV(out, frames)
+	case "json":
+		return mp4.WriteFramesJSON(out, frames)
+	}
+	return fmt.Errorf("Unknown format %v, use csv or json", *format)
+}
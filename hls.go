@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runHls(args []string) error {
+	fs := flag.NewFlagSet("hls", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o directory receiving "+mp4.HLS_MASTER_PLAYLIST+" and a directory per rendition")
+	duration := fs.Float64("duration", 6, "-duration target segment duration in seconds, segments start at video keyframes")
+	format := fs.String("format", "fmp4", "-format segment format, fmp4 or ts")
+	fs.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("No output directory, use -o directory")
+	}
+	opts := mp4.HLSOptions{Duration: time.Duration(*duration * float64(time.Second))}
+	switch *format {
+	case "fmp4":
+	case "ts":
+		opts.TS = true
+	default:
+		return fmt.Errorf("Unknown segment format %q, use fmp4 or ts", *format)
+	}
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = f.WriteHLS(createUnder(*output), opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%v written\n", filepath.Join(*output, mp4.HLS_MASTER_PLAYLIST))
+	return nil
+}
+
+// createUnder returns a function creating files by slash separated paths
+// relative to dir, making their directories as needed.
+func createUnder(dir string) func(name string) (io.WriteCloser, error) {
+	return func(name string) (io.WriteCloser, error) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		return os.Create(path)
+	}
+}
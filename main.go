@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -12,18 +13,37 @@ import (
 )
 
 var inputFile string
+var jsonOutput bool
 var f mp4.File
 
 func init() {
 	flag.StringVar(&inputFile, "i", "", "-i input_file.mp4")
+	flag.BoolVar(&jsonOutput, "json", false, "-json print streams, format and box tree as JSON")
 	flag.Parse()
 }
 
 func main() {
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %v, available commands: %v\n", flag.Arg(0), commandNames())
+			os.Exit(2)
+		}
+		if err := cmd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if inputFile == "" {
 		flag.Usage()
 		return
 	}
+	if jsonOutput {
+		// keep stdout clean for the JSON document
+		mp4.Log = os.Stderr
+	}
 	f, err := mp4.Open(inputFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -31,6 +51,11 @@ func main() {
 	}
 	defer f.Close()
 
+	if jsonOutput {
+		PrintJSON(f)
+		return
+	}
+
 	// f.PrintInfo()
 	out, err := os.OpenFile("./out.264", os.O_WRONLY, 777)
 	if err != nil {
@@ -71,6 +96,15 @@ func main() {
 	SampleTo264(samples, stop, out)
 }
 
+func PrintJSON(f *mp4.File) {
+	data, err := json.MarshalIndent(f, "", "    ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
 func GetAVCC(f *mp4.File) AVCC {
 	stsd := f.Moov.Traks[0].Mdia.Minf.Stbl.Stsd
 	fmt.Printf("%x\n", stsd.Other_data)
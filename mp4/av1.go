@@ -0,0 +1,180 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+)
+
+// AV1 OBU types
+const (
+	AV1_OBU_SEQUENCE_HEADER        = 1
+	AV1_OBU_TEMPORAL_DELIMITER     = 2
+	AV1_OBU_FRAME_HEADER           = 3
+	AV1_OBU_TILE_GROUP             = 4
+	AV1_OBU_METADATA               = 5
+	AV1_OBU_FRAME                  = 6
+	AV1_OBU_REDUNDANT_FRAME_HEADER = 7
+	AV1_OBU_PADDING                = 15
+)
+
+// av1OBU is an OBU split out of a sample.
+type av1OBU struct {
+	obu_type uint8
+	header   []byte // obu_header and obu_extension_header
+	payload  []byte
+}
+
+// readLEB128 reads an unsigned LEB128 value of at most 8 bytes. It returns
+// the value and the number of bytes read.
+func readLEB128(data []byte) (uint64, int, error) {
+	v := uint64(0)
+	for i := 0; i < 8; i++ {
+		if i >= len(data) {
+			return 0, 0, fmt.Errorf("LEB128 value truncated")
+		}
+		v |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("LEB128 value longer than 8 bytes")
+}
+
+func appendLEB128(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+// splitOBUs splits low overhead bitstream format data into OBUs. An OBU
+// without obu_size runs to the end of the data.
+func splitOBUs(data []byte) ([]av1OBU, error) {
+	obus := []av1OBU{}
+	for offset := 0; offset < len(data); {
+		h := data[offset]
+		if h&0x80 != 0 {
+			return nil, fmt.Errorf("OBU forbidden bit set at %d", offset)
+		}
+		header_size := 1
+		if h&0x04 != 0 {
+			header_size = 2 // obu_extension_flag
+		}
+		if offset+header_size > len(data) {
+			return nil, fmt.Errorf("OBU header truncated at %d", offset)
+		}
+		obu := av1OBU{obu_type: h >> 3 & 15, header: data[offset : offset+header_size]}
+		offset += header_size
+		size := uint64(len(data) - offset)
+		if h&0x02 != 0 { // obu_has_size_field
+			v, n, err := readLEB128(data[offset:])
+			if err != nil {
+				return nil, fmt.Errorf("OBU size at %d: %v", offset, err)
+			}
+			offset += n
+			if v > uint64(len(data)-offset) {
+				return nil, fmt.Errorf("OBU of %d bytes overruns the data at %d", v, offset)
+			}
+			size = v
+		}
+		obu.payload = data[offset : offset+int(size)]
+		offset += int(size)
+		obus = append(obus, obu)
+	}
+	return obus, nil
+}
+
+// appendOBU appends an OBU in the low overhead format, with its size.
+func appendOBU(buf []byte, obu av1OBU) []byte {
+	buf = append(buf, obu.header[0]|0x02)
+	buf = append(buf, obu.header[1:]...)
+	buf = appendLEB128(buf, uint64(len(obu.payload)))
+	return append(buf, obu.payload...)
+}
+
+// av1TemporalUnit returns the OBUs of a sample as a temporal unit: a
+// temporal delimiter, then the sequence header of the configuration on sync
+// samples that do not carry one.
+func av1TemporalUnit(entry *SampleEntry, data []byte, sync bool) ([]av1OBU, error) {
+	obus, err := splitOBUs(data)
+	if err != nil {
+		return nil, err
+	}
+	unit := []av1OBU{{obu_type: AV1_OBU_TEMPORAL_DELIMITER, header: []byte{AV1_OBU_TEMPORAL_DELIMITER << 3}}}
+	has_sequence_header := false
+	for _, obu := range obus {
+		has_sequence_header = has_sequence_header || obu.obu_type == AV1_OBU_SEQUENCE_HEADER
+	}
+	if sync && !has_sequence_header && entry.Av1c != nil {
+		config, err := splitOBUs(entry.Av1c.Config_obus)
+		if err != nil {
+			return nil, fmt.Errorf("av1C configOBUs: %v", err)
+		}
+		for _, obu := range config {
+			if obu.obu_type == AV1_OBU_SEQUENCE_HEADER {
+				unit = append(unit, obu)
+			}
+		}
+	}
+	for _, obu := range obus {
+		if obu.obu_type != AV1_OBU_TEMPORAL_DELIMITER {
+			unit = append(unit, obu)
+		}
+	}
+	return unit, nil
+}
+
+// appendAnnexBTemporalUnit appends a temporal unit in the length delimited
+// format of AV1 Annex B: the unit, then each of its frames, then each OBU
+// prefixed by its length. A frame unit starts at every frame header but the
+// first.
+func appendAnnexBTemporalUnit(buf []byte, unit []av1OBU) []byte {
+	frames := [][]byte{}
+	var frame []byte
+	has_header := false
+	for _, obu := range unit {
+		if obu.obu_type == AV1_OBU_FRAME_HEADER || obu.obu_type == AV1_OBU_FRAME {
+			if has_header {
+				frames = append(frames, frame)
+				frame = nil
+			}
+			has_header = true
+		}
+		raw := appendOBU(nil, obu)
+		frame = append(appendLEB128(frame, uint64(len(raw))), raw...)
+	}
+	frames = append(frames, frame)
+
+	body := []byte{}
+	for _, frame := range frames {
+		body = append(appendLEB128(body, uint64(len(frame))), frame...)
+	}
+	return append(appendLEB128(buf, uint64(len(body))), body...)
+}
+
+// WriteOBU writes an AV1 track as a raw OBU stream, in the low overhead
+// bitstream format (Section 5) or the length delimited format of Annex B.
+// Every temporal unit starts with a temporal delimiter and keyframes with
+// the sequence header.
+func (f *File) WriteOBU(w io.Writer, trak int, annexb bool) error {
+	return f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+		if entry.Av1c == nil {
+			return fmt.Errorf("Not an AV1 track")
+		}
+		unit, err := av1TemporalUnit(entry, data, s.Sync)
+		if err != nil {
+			return err
+		}
+		buf := []byte{}
+		if annexb {
+			buf = appendAnnexBTemporalUnit(buf, unit)
+		} else {
+			for _, obu := range unit {
+				buf = appendOBU(buf, obu)
+			}
+		}
+		_, err = w.Write(buf)
+		return err
+	})
+}
@@ -0,0 +1,133 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var (
+	testTD  = []byte{AV1_OBU_TEMPORAL_DELIMITER<<3 | 2, 0}
+	testSH  = []byte{AV1_OBU_SEQUENCE_HEADER<<3 | 2, 3, 0, 0, 0}
+	testFH  = []byte{AV1_OBU_FRAME_HEADER<<3 | 2, 1, 9}
+	testTG  = []byte{AV1_OBU_TILE_GROUP<<3 | 2, 2, 7, 7}
+	testFrm = []byte{AV1_OBU_FRAME<<3 | 2, 3, 1, 2, 3}
+)
+
+// testAV1Movie returns an av01 track whose first sample is a keyframe
+// without a sequence header, and whose second one is a frame header and a
+// tile group.
+func testAV1Movie(marker byte) testMovie {
+	av1c := testBox("av1C", []byte{marker | 1, 1<<5 | 8, 1<<7 | 1<<6 | 1<<3 | 1<<2 | 1, 1<<4 | 3}, testSH)
+	return testMovie{
+		timescale: 90000, delta: 3000, sync: []uint32{1},
+		samples: [][]byte{testFrm, append(append([]byte{}, testFH...), testTG...)},
+		entry:   testVisualEntry("av01", av1c),
+	}
+}
+
+func TestAv1CParse(t *testing.T) {
+	for _, marker := range []byte{0x80, 0} {
+		m := testAV1Movie(marker)
+		data := m.build()
+		f := openBytes(t, data)
+		c := f.Moov.Traks[0].GetSampleEntry(1).Av1c
+		if c == nil {
+			t.Fatalf("Marker 0x%x: no av1C parsed", marker)
+		}
+		if c.Version != 1 || c.Seq_profile != 1 || c.Seq_level_idx_0 != 8 || c.Seq_tier_0 != 1 || c.BitDepth() != 10 ||
+			c.Chroma_subsampling_x != 1 || c.Chroma_subsampling_y != 1 || c.Chroma_sample_position != 1 ||
+			c.Initial_presentation_delay_present != 1 || c.Initial_presentation_delay_minus_one != 3 || !bytes.Equal(c.Config_obus, testSH) {
+			t.Errorf("Marker 0x%x: av1C = %+v", marker, c)
+		}
+		if got := f.Moov.Traks[0].GetSampleEntry(1).CodecString(); got != "av01.1.08H.10" {
+			t.Errorf("Codec string %v, want av01.1.08H.10", got)
+		}
+		out := &bytes.Buffer{}
+		if err := f.Write(out); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("Marker 0x%x: file not written back unchanged, %v", marker, err)
+		}
+	}
+}
+
+func TestWriteOBU(t *testing.T) {
+	m := testAV1Movie(0x80)
+	f := openBytes(t, m.build())
+
+	// The sequence header of av1C goes in front of the keyframe
+	want := bytes.Join([][]byte{testTD, testSH, testFrm, testTD, testFH, testTG}, nil)
+	out := &bytes.Buffer{}
+	if err := f.WriteOBU(out, 0, false); err != nil {
+		t.Fatalf("WriteOBU: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("OBU stream\n%x, want\n%x", out.Bytes(), want)
+	}
+
+	out.Reset()
+	if err := f.WriteOBU(out, 0, true); err != nil {
+		t.Fatalf("WriteOBU Annex B: %v", err)
+	}
+	want = bytes.Join([][]byte{
+		{1 + 15}, {1 + 2 + 1 + 5 + 1 + 5}, {2}, testTD, {5}, testSH, {5}, testFrm,
+		{1 + 12}, {1 + 2 + 1 + 3 + 1 + 4}, {2}, testTD, {3}, testFH, {4}, testTG,
+	}, nil)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Annex B stream\n%x, want\n%x", out.Bytes(), want)
+	}
+}
+
+func TestAnnexBFrameUnits(t *testing.T) {
+	unit := []av1OBU{}
+	for _, raw := range [][]byte{testTD, testSH, testFH, testTG, testFH, testTG, testFrm} {
+		obus, err := splitOBUs(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit = append(unit, obus...)
+	}
+	// A frame unit per frame header or frame, the temporal delimiter and
+	// sequence header in the first one
+	frames := [][]byte{
+		bytes.Join([][]byte{{2}, testTD, {5}, testSH, {3}, testFH, {4}, testTG}, nil),
+		bytes.Join([][]byte{{3}, testFH, {4}, testTG}, nil),
+		bytes.Join([][]byte{{5}, testFrm}, nil),
+	}
+	body := []byte{}
+	for _, frame := range frames {
+		body = append(append(body, byte(len(frame))), frame...)
+	}
+	want := append([]byte{byte(len(body))}, body...)
+	if got := appendAnnexBTemporalUnit(nil, unit); !bytes.Equal(got, want) {
+		t.Errorf("Temporal unit\n%x, want\n%x", got, want)
+	}
+}
+
+func TestWriteIVFAV1(t *testing.T) {
+	m := testAV1Movie(0x80)
+	f := openBytes(t, m.build())
+	out := &bytes.Buffer{}
+	if err := f.WriteIVF(out, 0); err != nil {
+		t.Fatalf("WriteIVF: %v", err)
+	}
+	data := out.Bytes()
+	if len(data) < IVF_HEADER_SIZE || string(data[:4]) != "DKIF" || string(data[8:12]) != "AV01" {
+		t.Fatalf("IVF header %x", data[:IVF_HEADER_SIZE])
+	}
+	le := binary.LittleEndian
+	if le.Uint16(data[12:]) != 320 || le.Uint16(data[14:]) != 240 || le.Uint32(data[16:]) != 90000 || le.Uint32(data[20:]) != 1 || le.Uint32(data[24:]) != 2 {
+		t.Errorf("IVF header %x", data[:IVF_HEADER_SIZE])
+	}
+	frames := [][]byte{bytes.Join([][]byte{testTD, testSH, testFrm}, nil), bytes.Join([][]byte{testTD, testFH, testTG}, nil)}
+	pos := IVF_HEADER_SIZE
+	for i, want := range frames {
+		size, pts := int(le.Uint32(data[pos:])), le.Uint64(data[pos+4:])
+		if pts != uint64(i)*3000 || !bytes.Equal(data[pos+12:pos+12+size], want) {
+			t.Errorf("Frame %d at %d: %x, want %x at %d", i, pts, data[pos+12:pos+12+size], want, i*3000)
+		}
+		pos += 12 + size
+	}
+	if pos != len(data) {
+		t.Errorf("IVF has %d bytes, want %d", len(data), pos)
+	}
+}
@@ -0,0 +1,88 @@
+package mp4
+
+import "fmt"
+
+// bitReader reads MSB-first bit fields such as the ones found in
+// AudioSpecificConfig or H.264/H.265 parameter sets.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) readBits(n int) (uint32, error) {
+	if n > 32 {
+		return 0, fmt.Errorf("Can not read %d bits at once", n)
+	}
+	if r.pos+n > len(r.data)*8 {
+		return 0, fmt.Errorf("Bit stream too short, need %d bits at %d, have %d", n, r.pos, len(r.data)*8)
+	}
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) readFlag() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+func (r *bitReader) skipBits(n int) error {
+	if r.pos+n > len(r.data)*8 {
+		return fmt.Errorf("Bit stream too short, can not skip %d bits at %d", n, r.pos)
+	}
+	r.pos += n
+	return nil
+}
+
+// readUE reads an unsigned Exp-Golomb code.
+func (r *bitReader) readUE() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("Invalid Exp-Golomb code at %d", r.pos)
+		}
+	}
+	v, err := r.readBits(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+// readSE reads a signed Exp-Golomb code.
+func (r *bitReader) readSE() (int32, error) {
+	v, err := r.readUE()
+	if v&1 == 1 {
+		return int32(v/2) + 1, err
+	}
+	return -int32(v / 2), err
+}
+
+// bitWriter appends MSB-first bit fields.
+type bitWriter struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (w *bitWriter) writeBits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.pos/8] |= byte(v>>uint(i)&1) << (7 - uint(w.pos%8))
+		w.pos++
+	}
+}
@@ -0,0 +1,74 @@
+package mp4
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// CodecString returns the RFC 6381 codecs parameter of the entry as used in
+// HLS and DASH manifests, e.g. "avc1.64001f" or "mp4a.40.2". Formats it
+// knows no parameters for are returned as their four character code.
+func (b *SampleEntry) CodecString() string {
+	switch {
+	case b.Avcc != nil:
+		return fmt.Sprintf("%s.%02x%02x%02x", b.Name, b.Avcc.Profile, b.Avcc.Profile_compatibility, b.Avcc.Level)
+	case b.Hvcc != nil:
+		return b.Name + "." + b.Hvcc.codecString()
+	case b.Av1c != nil:
+		tier := "M"
+		if b.Av1c.Seq_tier_0 == 1 {
+			tier = "H"
+		}
+		return fmt.Sprintf("%s.%d.%02d%s.%02d", b.Name, b.Av1c.Seq_profile, b.Av1c.Seq_level_idx_0, tier, b.Av1c.BitDepth())
+	case b.Vpcc != nil:
+		v := b.Vpcc
+		if v.Version == 0 {
+			// No colour fields, the optional ones can be left out
+			return fmt.Sprintf("%s.%02d.%02d.%02d", b.Name, v.Profile, v.Level, v.Bit_depth)
+		}
+		return fmt.Sprintf("%s.%02d.%02d.%02d.%02d.%02d.%02d.%02d.%02d", b.Name, v.Profile, v.Level, v.Bit_depth,
+			v.Chroma_subsampling, v.Colour_primaries, v.Transfer_characteristics, v.Matrix_coefficients, v.Video_full_range_flag)
+	case b.Dops != nil:
+		return "opus"
+	case b.Esds != nil:
+		oti := b.Esds.Object_type_indication
+		if oti != 0x40 {
+			return fmt.Sprintf("%s.%02x", b.Name, oti)
+		}
+		if asc, err := b.Esds.AudioSpecificConfig(); err == nil {
+			return fmt.Sprintf("%s.40.%d", b.Name, asc.Object_type)
+		}
+		return b.Name + ".40"
+	}
+	return b.Name
+}
+
+// codecString returns the HEVC codecs parameter after the format, as laid
+// out in ISO/IEC 14496-15 annex E: profile space and profile, compatibility
+// flags in reverse bit order, tier and level, then the constraint bytes
+// without the trailing zero ones.
+func (b *HvcCBox) codecString() string {
+	s := ""
+	if b.General_profile_space > 0 {
+		s += string(rune('A' + b.General_profile_space - 1))
+	}
+	s += fmt.Sprintf("%d.%X.", b.General_profile_idc, bits.Reverse32(b.General_profile_compatibility_flags))
+	if b.General_tier_flag == 1 {
+		s += "H"
+	} else {
+		s += "L"
+	}
+	s += fmt.Sprintf("%d", b.General_level_idc)
+	constraints := []string{}
+	for i := 5; i >= 0; i-- {
+		constraints = append(constraints, fmt.Sprintf("%X", uint8(b.General_constraint_indicator_flags>>(8*i))))
+	}
+	for len(constraints) > 0 && constraints[len(constraints)-1] == "0" {
+		constraints = constraints[:len(constraints)-1]
+	}
+	if len(constraints) > 0 {
+		s += "." + strings.Join(constraints, ".")
+	}
+	return s
+}
@@ -0,0 +1,215 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ConcatOptions sets how the files passed to Concat are laid out in time.
+type ConcatOptions struct {
+	// Keep the gaps between recordings, placing each file at the offset of
+	// its mvhd creation time from the first one with an edit per file and
+	// an empty edit per gap. Otherwise each file starts where the previous
+	// one ends.
+	Keep_gaps bool
+}
+
+// checkConcat reports why the tracks of f cannot be appended to the ones
+// of first, or returns nil.
+func checkConcat(first, f *File) error {
+	if len(f.Moov.Traks) != len(first.Moov.Traks) {
+		return fmt.Errorf("%d tracks instead of %d", len(f.Moov.Traks), len(first.Moov.Traks))
+	}
+	for i, trak := range f.Moov.Traks {
+		if missing := trak.missingTables(); missing != "" {
+			return fmt.Errorf("Track %d is missing the %v box", i, missing)
+		}
+		ref := first.Moov.Traks[i]
+		if trak.GetHandlerType() != ref.GetHandlerType() {
+			return fmt.Errorf("Track %d is %v instead of %v", i, trak.GetHandlerType(), ref.GetHandlerType())
+		}
+		if trak.Mdia.Mdhd.Timescale != ref.Mdia.Mdhd.Timescale {
+			return fmt.Errorf("Track %d has timescale %d instead of %d", i, trak.Mdia.Mdhd.Timescale, ref.Mdia.Mdhd.Timescale)
+		}
+		want := ref.GetSampleEntry(1)
+		for _, entry := range trak.Mdia.Minf.Stbl.Stsd.Entries {
+			switch {
+			case want == nil || entry.Name != want.Name:
+				return fmt.Errorf("Track %d has %v samples, not the ones of the first file", i, entry.Name)
+			case entry.Kind() == "vide" && (entry.Width != want.Width || entry.Height != want.Height):
+				return fmt.Errorf("Track %d is %dx%d instead of %dx%d", i, entry.Width, entry.Height, want.Width, want.Height)
+			case entry.Kind() == "soun" && (entry.Sample_rate != want.Sample_rate || entry.Channel_count != want.Channel_count):
+				return fmt.Errorf("Track %d has %d channels at %d Hz instead of %d at %d Hz", i,
+					entry.Channel_count, entry.Sample_rate>>16, want.Channel_count, want.Sample_rate>>16)
+			}
+		}
+	}
+	return nil
+}
+
+// addEntry returns the 1-based index of entry in entries, appending it if
+// no entry encodes to the same bytes.
+func addEntry(entries *[]*SampleEntry, encoded *[][]byte, entry *SampleEntry) (uint32, error) {
+	buf := &bytes.Buffer{}
+	if err := entry.Write(buf); err != nil {
+		return 0, err
+	}
+	for i, e := range *encoded {
+		if bytes.Equal(e, buf.Bytes()) {
+			return uint32(i + 1), nil
+		}
+	}
+	*entries = append(*entries, entry)
+	*encoded = append(*encoded, buf.Bytes())
+	return uint32(len(*entries)), nil
+}
+
+// Concat appends the samples of files one after the other and writes them
+// to w as a single file. The files must have the same tracks with the same
+// codecs; sample descriptions which differ otherwise, e.g. in their SPS and
+// PPS, become extra sample description entries. The moov box of the first
+// file is reused and updated in place.
+func Concat(w io.WriteSeeker, files []*File, opts ConcatOptions) error {
+	if len(files) == 0 {
+		return fmt.Errorf("No file to concatenate")
+	}
+	first := files[0]
+	for i, f := range files {
+		if f.Moov == nil || f.Moov.Mvhd == nil {
+			return fmt.Errorf("File %d: No moov box", i)
+		}
+		if err := checkConcat(first, f); err != nil {
+			return fmt.Errorf("File %d: %v", i, err)
+		}
+	}
+
+	// Start of each file on the output timeline, in seconds
+	starts := make([]float64, len(files))
+	end := 0.0
+	for i, f := range files {
+		mvhd := f.Moov.Mvhd
+		starts[i] = end
+		if opts.Keep_gaps && i > 0 {
+			created, first_created := mvhd.Creation_time, first.Moov.Mvhd.Creation_time
+			if created == 0 || first_created == 0 {
+				logf("File %d has no creation time, appending it without a gap\n", i)
+			} else if at := float64(int64(created) - int64(first_created)); at < end {
+				logf("File %d was created %.3fs before the end of the previous one, appending it without a gap\n", i, end-at)
+			} else {
+				starts[i] = at
+			}
+		}
+		end = starts[i] + float64(mvhd.Duration)/float64(mvhd.Timescale)
+	}
+
+	movie_timescale := first.Moov.Mvhd.Timescale
+	tracks := make([]*trackSpec, len(first.Moov.Traks))
+	samples := make([][]sourceSample, len(first.Moov.Traks))
+	for i, trak := range first.Moov.Traks {
+		stsd := trak.Mdia.Minf.Stbl.Stsd
+		timescale := trak.Mdia.Mdhd.Timescale
+		t := &trackSpec{Timescale: timescale, Media_time: trak.editMediaTime()}
+		tracks[i] = t
+		entries, encoded := []*SampleEntry{}, [][]byte{}
+
+		next_dts := int64(0) // decoding time the next sample must start at or after
+		shown_end := int64(0)
+		presented := uint64(0) // end of the edits so far in the movie timescale
+		for k, f := range files {
+			src := f.Moov.Traks[i]
+			sdi := []uint32{}
+			for _, entry := range src.Mdia.Minf.Stbl.Stsd.Entries {
+				index, err := addEntry(&entries, &encoded, entry)
+				if err != nil {
+					return err
+				}
+				sdi = append(sdi, index)
+			}
+			if len(src.Samples) == 0 {
+				continue
+			}
+
+			shift := next_dts - int64(src.Samples[0].Start_time)
+			if !opts.Keep_gaps {
+				// Keep the presentation time of the file start at starts[k]
+				shift = int64(starts[k]*float64(timescale)+0.5) + int64(t.Media_time) - src.GetMediaTime()
+				shift -= int64(src.Samples[0].Start_time)
+				if n := len(samples[i]); n > 0 {
+					// The previous sample lasts until this file starts
+					last := &samples[i][n-1]
+					if shift <= int64(last.Start_time) {
+						logf("File %d track %d overlaps the previous file by %d ticks, delaying it\n", k, i, next_dts-shift)
+						shift = int64(last.Start_time) + int64(last.Duration)
+					}
+					duration := shift - int64(last.Start_time)
+					if duration > math.MaxUint32 {
+						return fmt.Errorf("File %d track %d: The previous sample would last %d ticks, more than 32 bits", k, i, duration)
+					}
+					last.Duration = uint32(duration)
+				} else if shift < next_dts {
+					shift = next_dts
+				}
+			}
+			file_start, file_end := int64(src.Samples[0].Start_time)+shift, int64(0)
+			for _, s := range src.Samples {
+				if s.Sample_description_index < 1 || int(s.Sample_description_index) > len(sdi) {
+					return fmt.Errorf("File %d track %d: Sample description %d out of range", k, i, s.Sample_description_index)
+				}
+				s.Sample_description_index = sdi[s.Sample_description_index-1]
+				dts := int64(s.Start_time) + shift
+				if dts > math.MaxUint32 {
+					return fmt.Errorf("File %d track %d: Decoding time %d does not fit 32 bits", k, i, dts)
+				}
+				s.Start_time = uint32(dts)
+				samples[i] = append(samples[i], sourceSample{f, s})
+				if pts := int64(s.Start_time) + int64(int32(s.Cto)); pts+int64(s.Duration) > file_end {
+					file_end = pts + int64(s.Duration)
+				}
+			}
+			if file_end > shown_end {
+				shown_end = file_end
+			}
+			last := samples[i][len(samples[i])-1]
+			next_dts = int64(last.Start_time) + int64(last.Duration)
+
+			if opts.Keep_gaps {
+				// An empty edit up to the file start, then its samples
+				if at := uint64(math.Round(starts[k] * float64(movie_timescale))); at > presented {
+					t.Edits = append(t.Edits, trackEdit{Duration: at - presented, Media_time: -1})
+					presented = at
+				}
+				media_time := src.GetMediaTime() + shift
+				if media_time < file_start {
+					media_time = file_start
+				}
+				if file_end > media_time {
+					duration := uint64(file_end-media_time) * uint64(movie_timescale) / uint64(timescale)
+					t.Edits = append(t.Edits, trackEdit{Duration: duration, Media_time: media_time})
+					presented += duration
+				}
+			}
+		}
+		if len(entries) > len(stsd.Entries) {
+			logf("Track %d gets %d sample descriptions\n", i, len(entries))
+		}
+		stsd.Entries = entries
+		if t.Media_time != 0 && shown_end > int64(t.Media_time) {
+			t.Presentation_duration = uint64(shown_end - int64(t.Media_time))
+		}
+	}
+
+	mdat, err := newMdatWriter(w, first.Ftyp)
+	if err != nil {
+		return err
+	}
+	if err = mdat.copyInterleaved(tracks, samples); err != nil {
+		return err
+	}
+	if err = mdat.finish(); err != nil {
+		return err
+	}
+	applyTracks(first.Moov, tracks, movie_timescale)
+	return first.Moov.Write(w)
+}
@@ -0,0 +1,54 @@
+package mp4
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConcatKeepGaps(t *testing.T) {
+	files := []*File{}
+	for _, created := range []uint64{3600, 3603} {
+		m := testMovie{time: created, timescale: 90000, delta: 3000, samples: testSamples(30)}
+		files = append(files, openBytes(t, m.build()))
+	}
+	path := filepath.Join(t.TempDir(), "concat.mp4")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Concat(out, files, ConcatOptions{Keep_gaps: true}); err != nil {
+		t.Fatalf("Concat: %v", err)
+	}
+	out.Close()
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	trak := f.Moov.Traks[0]
+	for k, s := range trak.Samples {
+		if s.Duration != 3000 || s.Start_time != uint32(k)*3000 {
+			t.Fatalf("Sample %d starts at %d and lasts %d, want %d and 3000", k, s.Start_time, s.Duration, k*3000)
+		}
+	}
+	// 1 s of the first file, a 2 s gap, then 1 s of the second one
+	want := []struct {
+		duration   uint64
+		media_time int64
+	}{{1000, 0}, {2000, -1}, {1000, 90000}}
+	elst := trak.Edts.Elst
+	if len(elst.Media_time) != len(want) {
+		t.Fatalf("elst = %v %v, want %v", elst.Segment_duration, elst.Media_time, want)
+	}
+	for i, e := range want {
+		if elst.Segment_duration[i] != e.duration || elst.Media_time[i] != e.media_time {
+			t.Errorf("elst = %v %v, want %v", elst.Segment_duration, elst.Media_time, want)
+			break
+		}
+	}
+	if f.Moov.Mvhd.Duration != 4000 || trak.Tkhd.Duration != 4000 {
+		t.Errorf("mvhd/tkhd duration = %d/%d, want 4000", f.Moov.Mvhd.Duration, trak.Tkhd.Duration)
+	}
+}
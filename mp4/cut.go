@@ -0,0 +1,113 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// cutRange returns the decoding order range [first, last] of the samples
+// needed to present the media times [start, end) of the track: from the
+// sync sample at or before the first sample shown, so it can be decoded,
+// to the last sample shown. ok is false if no sample is shown.
+func (b *TrakBox) cutRange(start, end int64) (first, last int, ok bool) {
+	first, last = len(b.Samples), -1
+	for i, s := range b.Samples {
+		pts := int64(s.Start_time) + int64(int32(s.Cto))
+		if pts+int64(s.Duration) <= start || pts >= end {
+			continue
+		}
+		if i < first {
+			first = i
+		}
+		last = i
+	}
+	if last < 0 {
+		return 0, 0, false
+	}
+	for first > 0 && !b.Samples[first].Sync {
+		first--
+	}
+	return first, last, true
+}
+
+// durationToMedia converts d to units of timescale, rounding down. Whole
+// seconds and the remainder are converted apart so that hours of media in a
+// large timescale do not overflow.
+func durationToMedia(d time.Duration, timescale uint32) int64 {
+	seconds, rest := int64(d/time.Second), int64(d%time.Second)
+	return seconds*int64(timescale) + rest*int64(timescale)/int64(time.Second)
+}
+
+// WriteCut writes the part of the file presented from start to end to w, 0
+// meaning the end of the file. No sample is re-encoded: each track starts
+// at the sync sample preceding start and an edit list hides the samples
+// shown before start. The sample tables of f are replaced in place.
+func (f *File) WriteCut(w io.WriteSeeker, start, end time.Duration) error {
+	if f.Moov == nil || f.Moov.Mvhd == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if start < 0 || end != 0 && end <= start {
+		return fmt.Errorf("Invalid range %v to %v", start, end)
+	}
+	movie_timescale := f.Moov.Mvhd.Timescale
+	tracks := make([]*trackSpec, len(f.Moov.Traks))
+	samples := make([][]sourceSample, len(f.Moov.Traks))
+	empty := 0
+	for i, trak := range f.Moov.Traks {
+		if trak.missingTables() != "" {
+			return fmt.Errorf("Track %d is missing the %v box", i, trak.missingTables())
+		}
+		timescale := trak.Mdia.Mdhd.Timescale
+		tracks[i] = &trackSpec{Timescale: timescale}
+		media_start := trak.GetMediaTime() + durationToMedia(start, timescale)
+		media_end := int64(math.MaxInt64)
+		if end != 0 {
+			media_end = trak.GetMediaTime() + durationToMedia(end, timescale)
+		}
+		first, last, ok := trak.cutRange(media_start, media_end)
+		if !ok {
+			logf("Track %d has no sample in the range\n", i)
+			empty++
+			continue
+		}
+
+		base := int64(trak.Samples[first].Start_time)
+		shown_end := int64(0)
+		for _, s := range trak.Samples[first : last+1] {
+			if pts := int64(s.Start_time) + int64(int32(s.Cto)); pts+int64(s.Duration) > shown_end {
+				shown_end = pts + int64(s.Duration)
+			}
+			s.Start_time -= uint32(base)
+			samples[i] = append(samples[i], sourceSample{f, s})
+		}
+		if media_start < base {
+			media_start = base
+		}
+		if media_end < shown_end {
+			shown_end = media_end
+		}
+		tracks[i].Media_time = uint64(media_start - base)
+		tracks[i].Presentation_duration = uint64(shown_end - media_start)
+	}
+
+	if empty == len(tracks) && end == 0 {
+		return fmt.Errorf("No sample after %v", start)
+	} else if empty == len(tracks) {
+		return fmt.Errorf("No sample between %v and %v", start, end)
+	}
+
+	mdat, err := newMdatWriter(w, f.Ftyp)
+	if err != nil {
+		return err
+	}
+	if err = mdat.copyInterleaved(tracks, samples); err != nil {
+		return err
+	}
+	if err = mdat.finish(); err != nil {
+		return err
+	}
+	applyTracks(f.Moov, tracks, movie_timescale)
+	return f.Moov.Write(w)
+}
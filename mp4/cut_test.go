@@ -0,0 +1,95 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteCut(t *testing.T) {
+	samples := testSamples(10)
+	m := &testMovie{timescale: 30000, samples: samples, delta: 3000, sync: []uint32{1, 6}}
+	f := openBytes(t, m.build())
+	// 650 ms falls in sample 7, decoded from the sync sample 6
+	c := writeAndOpen(t, "cut.mp4", func(out *os.File) error {
+		return f.WriteCut(out, 650*time.Millisecond, 850*time.Millisecond)
+	})
+
+	trak := c.Moov.Traks[0]
+	if len(trak.Samples) != 4 {
+		t.Fatalf("%d samples, want 4", len(trak.Samples))
+	}
+	for i, s := range trak.Samples {
+		if s.Start_time != uint32(i*3000) {
+			t.Errorf("Sample %d starts at %d, want %d", i+1, s.Start_time, i*3000)
+		}
+		data := make([]byte, s.Size)
+		if _, err := c.ReadAt(data, int64(s.Offset)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, samples[5+i]) {
+			t.Errorf("Sample %d = %x, want %x", i+1, data, samples[5+i])
+		}
+	}
+	stbl := trak.Mdia.Minf.Stbl
+	if stts := stbl.Stts; !reflect.DeepEqual(stts.Sample_count, []uint32{4}) || !reflect.DeepEqual(stts.Sample_delta, []uint32{3000}) {
+		t.Errorf("stts counts %v deltas %v, want [4] [3000]", stts.Sample_count, stts.Sample_delta)
+	}
+	if stbl.Stss == nil || !reflect.DeepEqual(stbl.Stss.Sample_number, []uint32{1}) {
+		t.Errorf("stss = %+v, want sample 1 only", stbl.Stss)
+	}
+	// The edit skips the 150 ms decoded before 650 ms and ends at 850 ms
+	if trak.Edts == nil || trak.Edts.Elst == nil {
+		t.Fatal("No edit list")
+	}
+	elst := trak.Edts.Elst
+	if !reflect.DeepEqual(elst.Media_time, []int64{4500}) || !reflect.DeepEqual(elst.Segment_duration, []uint64{200}) {
+		t.Errorf("Edit media times %v durations %v, want [4500] [200]", elst.Media_time, elst.Segment_duration)
+	}
+	if got := c.Moov.Mvhd.Duration; got != 200 {
+		t.Errorf("Movie duration = %d, want 200", got)
+	}
+}
+
+func TestWriteCutLargeTimescale(t *testing.T) {
+	// 10 samples of a second: a day in nanoseconds times the timescale
+	// overflows 64 bits
+	m := &testMovie{timescale: 400000000, samples: testSamples(10), delta: 400000000}
+	f := openBytes(t, m.build())
+	out, err := os.Create(filepath.Join(t.TempDir(), "empty.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := f.WriteCut(out, 24*time.Hour, 0); err == nil || err.Error() != "No sample after 24h0m0s" {
+		t.Errorf("WriteCut after the end: %v", err)
+	}
+	c := writeAndOpen(t, "cut.mp4", func(out *os.File) error { return f.WriteCut(out, 8*time.Second, 24*time.Hour) })
+	trak := c.Moov.Traks[0]
+	if len(trak.Samples) != 2 {
+		t.Fatalf("%d samples, want 2", len(trak.Samples))
+	}
+	if got := c.Moov.Mvhd.Duration; got != 2000 {
+		t.Errorf("Movie duration = %d, want 2000", got)
+	}
+}
+
+func TestDurationToMedia(t *testing.T) {
+	tests := []struct {
+		d         time.Duration
+		timescale uint32
+		want      int64
+	}{
+		{1500 * time.Millisecond, 1000, 1500},
+		{time.Second / 3, 90000, 29999},
+		{100 * time.Hour, 4000000000, 100 * 3600 * 4000000000},
+	}
+	for _, tt := range tests {
+		if got := durationToMedia(tt.d, tt.timescale); got != tt.want {
+			t.Errorf("durationToMedia(%v, %d) = %d, want %d", tt.d, tt.timescale, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package mp4
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DASHOptions sets how a file is packaged for MPEG-DASH.
+type DASHOptions struct {
+	// Target segment duration. Segments start at keyframes of the first
+	// video track, so they last at least this long.
+	Duration time.Duration
+	// Address segments by $Number$ with their average duration instead of
+	// listing each of them in a SegmentTimeline. Players then locate them
+	// by time only approximately when the keyframe interval varies.
+	Number_template bool
+}
+
+// Names of the files written by WriteDASH, relative to the manifest.
+const (
+	DASH_MANIFEST      = "manifest.mpd"
+	DASH_INIT_SEGMENT  = "$RepresentationID$/init.mp4"
+	DASH_MEDIA_SEGMENT = "$RepresentationID$/segment_$Number$.m4s"
+)
+
+// MPD elements of ISO/IEC 23009-1, only the attributes written here.
+type mpdManifest struct {
+	XMLName                     xml.Name  `xml:"urn:mpeg:dash:schema:mpd:2011 MPD"`
+	Profiles                    string    `xml:"profiles,attr"`
+	Type                        string    `xml:"type,attr"`
+	Media_presentation_duration string    `xml:"mediaPresentationDuration,attr"`
+	Max_segment_duration        string    `xml:"maxSegmentDuration,attr"`
+	Min_buffer_time             string    `xml:"minBufferTime,attr"`
+	Period                      mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Id              string              `xml:"id,attr"`
+	Start           string              `xml:"start,attr"`
+	Adaptation_sets []*mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	Id                int                  `xml:"id,attr"`
+	Content_type      string               `xml:"contentType,attr"`
+	Mime_type         string               `xml:"mimeType,attr"`
+	Lang              string               `xml:"lang,attr,omitempty"`
+	Segment_alignment bool                 `xml:"segmentAlignment,attr"`
+	Start_with_sap    int                  `xml:"startWithSAP,attr"`
+	Representations   []*mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	Id                          string             `xml:"id,attr"`
+	Codecs                      string             `xml:"codecs,attr"`
+	Bandwidth                   int64              `xml:"bandwidth,attr"`
+	Width                       uint16             `xml:"width,attr,omitempty"`
+	Height                      uint16             `xml:"height,attr,omitempty"`
+	Frame_rate                  string             `xml:"frameRate,attr,omitempty"`
+	Sar                         string             `xml:"sar,attr,omitempty"`
+	Audio_sampling_rate         uint32             `xml:"audioSamplingRate,attr,omitempty"`
+	Audio_channel_configuration *mpdDescriptor     `xml:"AudioChannelConfiguration"`
+	Segment_template            mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdDescriptor struct {
+	Scheme_id_uri string `xml:"schemeIdUri,attr"`
+	Value         string `xml:"value,attr"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale                uint32              `xml:"timescale,attr"`
+	Initialization           string              `xml:"initialization,attr"`
+	Media                    string              `xml:"media,attr"`
+	Start_number             int                 `xml:"startNumber,attr"`
+	Duration                 uint64              `xml:"duration,attr,omitempty"`
+	Presentation_time_offset int64               `xml:"presentationTimeOffset,attr,omitempty"`
+	Segment_timeline         *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	S []mpdS `xml:"S"`
+}
+
+// mpdS is a run of R+1 segments of duration D, starting at T if set.
+type mpdS struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// mpdDuration formats seconds as an xs:duration.
+func mpdDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
+
+// segmentTimeline lists the segments by presentation time, merging runs
+// of contiguous segments of equal duration.
+func segmentTimeline(segments []Segment) *mpdSegmentTimeline {
+	timeline := &mpdSegmentTimeline{}
+	next := uint64(0)
+	for i, seg := range segments {
+		if n := len(timeline.S); n > 0 && seg.Presentation_time == next && timeline.S[n-1].D == seg.Duration {
+			timeline.S[n-1].R++
+		} else {
+			s := mpdS{D: seg.Duration}
+			if i == 0 || seg.Presentation_time != next {
+				t := seg.Presentation_time
+				s.T = &t
+			}
+			timeline.S = append(timeline.S, s)
+		}
+		next = seg.Presentation_time + seg.Duration
+	}
+	return timeline
+}
+
+// dashRepresentation describes a track packaged as a representation.
+func dashRepresentation(trak *TrakBox, id string, segments []Segment, opts DASHOptions) *mpdRepresentation {
+	peak, _ := bandwidth(segments)
+	r := &mpdRepresentation{Id: id, Bandwidth: peak}
+	codecs := []string{}
+	for _, entry := range trak.Mdia.Minf.Stbl.Stsd.Entries {
+		codecs = appendUnique(codecs, entry.CodecString())
+	}
+	r.Codecs = strings.Join(codecs, ",")
+
+	entry := trak.GetSampleEntry(1)
+	switch trak.GetHandlerType() {
+	case "vide":
+		r.Width, r.Height = entry.Width, entry.Height
+		if rate := trak.stream(0).R_frame_rate; rate != "0/0" {
+			r.Frame_rate = strings.TrimSuffix(rate, "/1")
+		}
+		if entry.Pasp != nil && entry.Pasp.H_spacing > 0 && entry.Pasp.V_spacing > 0 {
+			r.Sar = fmt.Sprintf("%d:%d", entry.Pasp.H_spacing, entry.Pasp.V_spacing)
+		}
+	case "soun":
+		r.Audio_sampling_rate = uint32(entry.Sample_rate) >> 16
+		if entry.Esds != nil {
+			if asc, err := entry.Esds.AudioSpecificConfig(); err == nil && asc.Sampling_frequency > 0 {
+				r.Audio_sampling_rate = asc.Sampling_frequency
+			}
+		}
+		if channels := audioChannels(entry); channels > 0 {
+			r.Audio_channel_configuration = &mpdDescriptor{
+				Scheme_id_uri: "urn:mpeg:dash:23003:3:audio_channel_configuration:2011",
+				Value:         fmt.Sprintf("%d", channels),
+			}
+		}
+	}
+
+	template := mpdSegmentTemplate{
+		Timescale:      trak.Mdia.Mdhd.Timescale,
+		Initialization: DASH_INIT_SEGMENT,
+		Media:          DASH_MEDIA_SEGMENT,
+		Start_number:   1,
+		// The edit list of the init segment is not applied by every
+		// player, so the offset carries it too
+		Presentation_time_offset: int64(trak.editMediaTime()),
+	}
+	if opts.Number_template {
+		total := uint64(0)
+		for _, seg := range segments {
+			total += seg.Duration
+		}
+		template.Duration = (total + uint64(len(segments))/2) / uint64(len(segments))
+	} else {
+		template.Segment_timeline = segmentTimeline(segments)
+	}
+	r.Segment_template = template
+	return r
+}
+
+// WriteDASH packages the audio and video tracks of the file for MPEG-DASH
+// on demand as CMAF segments and a static MPD. Every file is opened with
+// create, named by its path relative to the manifest. Each track is a
+// representation in its own track_<index> directory, grouped into an
+// adaptation set per track type and language.
+func (f *File) WriteDASH(create func(name string) (io.WriteCloser, error), opts DASHOptions) error {
+	if f.Moov == nil || f.Moov.Mvhd == nil {
+		return fmt.Errorf("No moov box")
+	}
+	manifest := mpdManifest{
+		Profiles: "urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019",
+		Type:     "static",
+		Period:   mpdPeriod{Id: "0", Start: mpdDuration(0)},
+	}
+	if f.Moov.Mvhd.Timescale > 0 {
+		manifest.Media_presentation_duration = mpdDuration(float64(f.Moov.Mvhd.Duration) / float64(f.Moov.Mvhd.Timescale))
+	}
+	longest := 0.0
+	sets := map[string]*mpdAdaptationSet{}
+	for i, trak := range f.Moov.Traks {
+		kind := trak.GetHandlerType()
+		content_type := map[string]string{"vide": "video", "soun": "audio"}[kind]
+		switch {
+		case content_type == "":
+			logf("Track %d skipped: %v tracks are not packaged\n", i, kind)
+			continue
+		case len(trak.Samples) == 0 || trak.GetSampleEntry(1) == nil:
+			logf("Track %d skipped: no samples\n", i)
+			continue
+		}
+
+		id := fmt.Sprintf("track_%d", i)
+		resolve := func(pattern string, number int) string {
+			name := strings.ReplaceAll(pattern, "$RepresentationID$", id)
+			return strings.ReplaceAll(name, "$Number$", fmt.Sprintf("%d", number))
+		}
+		init, err := create(resolve(DASH_INIT_SEGMENT, 0))
+		if err != nil {
+			return err
+		}
+		segments, err := f.WriteSegments(init, func(number int) (io.WriteCloser, error) {
+			return create(resolve(DASH_MEDIA_SEGMENT, number))
+		}, FragmentOptions{Duration: opts.Duration, Tracks: []int{i}})
+		if e := init.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return fmt.Errorf("Track %d: %v", i, err)
+		}
+		for _, seg := range segments {
+			if d := float64(seg.Duration) / float64(seg.Timescale); d > longest {
+				longest = d
+			}
+		}
+
+		lang := manifestLanguage(trak)
+		set := sets[content_type+lang]
+		if set == nil {
+			set = &mpdAdaptationSet{
+				Id:                len(manifest.Period.Adaptation_sets),
+				Content_type:      content_type,
+				Mime_type:         content_type + "/mp4",
+				Lang:              lang,
+				Segment_alignment: true,
+				Start_with_sap:    1,
+			}
+			sets[content_type+lang] = set
+			manifest.Period.Adaptation_sets = append(manifest.Period.Adaptation_sets, set)
+		}
+		set.Representations = append(set.Representations, dashRepresentation(trak, id, segments, opts))
+	}
+	if len(manifest.Period.Adaptation_sets) == 0 {
+		return fmt.Errorf("No audio or video track to package")
+	}
+	manifest.Max_segment_duration = mpdDuration(longest)
+	manifest.Min_buffer_time = mpdDuration(longest)
+
+	w, err := create(DASH_MANIFEST)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, xml.Header)
+	if err == nil {
+		e := xml.NewEncoder(w)
+		e.Indent("", "  ")
+		err = e.Encode(manifest)
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\n")
+	}
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
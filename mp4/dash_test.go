@@ -0,0 +1,75 @@
+package mp4
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+)
+
+func TestSegmentTimeline(t *testing.T) {
+	segments := []Segment{
+		{Presentation_time: 0, Duration: 100},
+		{Presentation_time: 100, Duration: 100},
+		{Presentation_time: 200, Duration: 50},
+		{Presentation_time: 300, Duration: 50}, // after a gap
+	}
+	got, err := xml.Marshal(segmentTimeline(segments))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<mpdSegmentTimeline><S t="0" d="100" r="1"></S><S d="50"></S><S t="300" d="50"></S></mpdSegmentTimeline>`
+	if string(got) != want {
+		t.Errorf("Timeline = %s, want %s", got, want)
+	}
+}
+
+func TestWriteDASH(t *testing.T) {
+	_, _, _, file := testH264AACFile()
+	f := openBytes(t, file)
+	for _, number := range []bool{false, true} {
+		files := testFiles{}
+		if err := f.WriteDASH(files.create, DASHOptions{Duration: 100 * time.Millisecond, Number_template: number}); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"track_0/init.mp4", "track_0/segment_1.m4s", "track_0/segment_2.m4s", "track_1/init.mp4", "track_1/segment_2.m4s"} {
+			if files[name] == nil {
+				t.Errorf("%v not written", name)
+			}
+		}
+		var mpd mpdManifest
+		if err := xml.Unmarshal(files[DASH_MANIFEST].Bytes(), &mpd); err != nil {
+			t.Fatalf("Parsing the manifest: %v", err)
+		}
+		if mpd.Type != "static" || mpd.Media_presentation_duration != "PT0.640S" || mpd.Max_segment_duration != "PT0.491S" {
+			t.Errorf("MPD type %v duration %v max segment %v", mpd.Type, mpd.Media_presentation_duration, mpd.Max_segment_duration)
+		}
+		sets := mpd.Period.Adaptation_sets
+		if len(sets) != 2 || sets[0].Content_type != "video" || sets[1].Content_type != "audio" {
+			t.Fatalf("Adaptation sets %+v", sets)
+		}
+		video, audio := sets[0].Representations[0], sets[1].Representations[0]
+		if video.Id != "track_0" || video.Codecs != "avc1.42c01e" || video.Width != 320 || video.Height != 240 || video.Frame_rate != "30" {
+			t.Errorf("Video representation %+v", video)
+		}
+		if audio.Codecs != "mp4a.40.2" || audio.Audio_sampling_rate != 48000 || audio.Audio_channel_configuration == nil || audio.Audio_channel_configuration.Value != "2" {
+			t.Errorf("Audio representation %+v", audio)
+		}
+		// The video edit list starts 3000 in
+		template := video.Segment_template
+		if template.Timescale != 90000 || template.Presentation_time_offset != 3000 || template.Start_number != 1 {
+			t.Errorf("Video segment template %+v", template)
+		}
+		if number {
+			if template.Duration != 15000 || template.Segment_timeline != nil {
+				t.Errorf("Video segment duration %d, timeline %+v, want 15000 and none", template.Duration, template.Segment_timeline)
+			}
+			continue
+		}
+		if s := template.Segment_timeline; s == nil || len(s.S) != 1 || s.S[0].T == nil || *s.S[0].T != 3000 || s.S[0].D != 15000 || s.S[0].R != 1 {
+			t.Errorf("Video segment timeline %+v", s)
+		}
+		if s := audio.Segment_template.Segment_timeline; s == nil || len(s.S) != 2 || s.S[0].D != 7*1024 || s.S[1].D != 23*1024 {
+			t.Errorf("Audio segment timeline %+v", s)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Brands that promise movie fragments or segments.
+var fragmentBrands = map[string]bool{"dash": true, "msdh": true, "msix": true, "cmfc": true, "cmf2": true, "cmfs": true, "cmff": true}
+
+// progressiveFtyp returns a copy of ftyp without the brands of fragmented
+// files.
+func progressiveFtyp(ftyp *FtypBox) *FtypBox {
+	out := *ftyp
+	out.Compatible_brands = nil
+	for _, brand := range ftyp.Compatible_brands {
+		if !fragmentBrands[brand] {
+			out.Compatible_brands = append(out.Compatible_brands, brand)
+		}
+	}
+	if fragmentBrands[out.Major_brand] {
+		out.Major_brand = "isom"
+	}
+	if len(out.Compatible_brands) == 0 {
+		out.Compatible_brands = []string{"isom"}
+	}
+	return &out
+}
+
+// WriteDefragmented writes a fragmented file as a regular one, the samples
+// of the moov and moof boxes of each track in a single set of sample tables
+// and all the media data in one mdat. Decoding times start from 0, gaps
+// between fragments lengthen the sample before them. Tracks starting after
+// the first one are delayed by an empty edit. The moov box of f is updated
+// in place.
+func (f *File) WriteDefragmented(w io.WriteSeeker) error {
+	if f.Moov == nil || f.Moov.Mvhd == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if len(f.Moofs) == 0 {
+		logln("No movie fragments, copying the samples of the moov box")
+	}
+	movie_timescale := f.Moov.Mvhd.Timescale
+	tracks := make([]*trackSpec, len(f.Moov.Traks))
+	samples := make([][]sourceSample, len(f.Moov.Traks))
+	starts := make([]float64, len(f.Moov.Traks)) // in seconds of the presentation timeline of the input
+	earliest := math.Inf(1)
+	for i, trak := range f.Moov.Traks {
+		if missing := trak.missingTables(); missing != "" {
+			return fmt.Errorf("Track %d is missing the %v box", i, missing)
+		}
+		tracks[i] = &trackSpec{Timescale: trak.Mdia.Mdhd.Timescale}
+		if len(trak.Samples) == 0 {
+			continue
+		}
+		base := int64(trak.Samples[0].Start_time)
+		shown_end := int64(0)
+		for j, s := range trak.Samples {
+			if j+1 < len(trak.Samples) {
+				if gap := int64(trak.Samples[j+1].Start_time) - int64(s.Start_time); gap > 0 {
+					s.Duration = uint32(gap)
+				}
+			}
+			s.Start_time -= uint32(base)
+			if pts := int64(s.Start_time) + int64(int32(s.Cto)); pts+int64(s.Duration) > shown_end {
+				shown_end = pts + int64(s.Duration)
+			}
+			samples[i] = append(samples[i], sourceSample{f, s})
+		}
+		if media_time := trak.GetMediaTime() - base; media_time > 0 {
+			tracks[i].Media_time = uint64(media_time)
+			if shown_end > media_time {
+				tracks[i].Presentation_duration = uint64(shown_end - media_time)
+			}
+		} else {
+			// The first sample is presented -media_time after the edit starts
+			starts[i] = float64(-media_time) / float64(trak.Mdia.Mdhd.Timescale)
+		}
+		earliest = math.Min(earliest, starts[i])
+	}
+	for i, t := range tracks {
+		if len(samples[i]) > 0 {
+			t.Delay = uint64(math.Round((starts[i] - earliest) * float64(movie_timescale)))
+		}
+	}
+
+	mdat, err := newMdatWriter(w, progressiveFtyp(f.Ftyp))
+	if err != nil {
+		return err
+	}
+	if err = mdat.copyInterleaved(tracks, samples); err != nil {
+		return err
+	}
+	if err = mdat.finish(); err != nil {
+		return err
+	}
+	f.Moov.Mvex = nil
+	applyTracks(f.Moov, tracks, movie_timescale)
+	return f.Moov.Write(w)
+}
@@ -0,0 +1,131 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testTraf is the run of a track in a movie fragment.
+type testTraf struct {
+	track_id uint32
+	tfdt     uint64
+	delta    uint32
+	samples  [][]byte
+}
+
+// buildFragmented returns a fragmented file with the tracks in its moov box
+// and a moof and mdat pair for each fragment.
+func buildFragmented(tracks []testTrack, fragments [][]testTraf) []byte {
+	traks, trexs := [][]byte{}, [][]byte{}
+	for _, t := range tracks {
+		t.stbl = testStbl(testSampleEntry(t.handler, t.timescale), nil, 0, nil, nil, 0, false)
+		traks = append(traks, testTrak(0, 0, t))
+		trexs = append(trexs, testFullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	moov := testBox("moov", append([][]byte{testMvhd(0, 0, 0, uint32(len(tracks)+1))}, append(traks, testBox("mvex", trexs...))...)...)
+	out := [][]byte{testBox("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfc")), moov}
+
+	for n, fragment := range fragments {
+		moof := func(moof_size int) []byte {
+			trafs := [][]byte{testFullBox("mfhd", 0, 0, u32(uint32(n+1)))}
+			offset := moof_size + 8
+			for _, traf := range fragment {
+				tfhd := testFullBox("tfhd", 0, TFHD_DEFAULT_BASE_IS_MOOF|TFHD_DEFAULT_SAMPLE_DURATION, u32(traf.track_id), u32(traf.delta))
+				tfdt := testFullBox("tfdt", 1, 0, u64(traf.tfdt))
+				run := [][]byte{u32(uint32(len(traf.samples))), u32(uint32(offset))}
+				for _, s := range traf.samples {
+					run = append(run, u32(uint32(len(s))))
+					offset += len(s)
+				}
+				trafs = append(trafs, testBox("traf", tfhd, tfdt, testFullBox("trun", 0, TRUN_DATA_OFFSET|TRUN_SAMPLE_SIZE, run...)))
+			}
+			return testBox("moof", trafs...)
+		}
+		data := [][]byte{}
+		for _, traf := range fragment {
+			data = append(data, traf.samples...)
+		}
+		out = append(out, moof(len(moof(0))), testBox("mdat", data...))
+	}
+	return bytes.Join(out, nil)
+}
+
+func TestDefragmentLargeTfdt(t *testing.T) {
+	const seconds = 1 << 28 // wall clock based decoding times
+	video, audio := testSamples(6), testSamples(8)
+	tracks := []testTrack{
+		{id: 1, handler: "vide", timescale: 90000},
+		{id: 2, handler: "soun", timescale: 48000},
+	}
+	// Audio starts half a second after video
+	fragments := [][]testTraf{
+		{{1, 90000 * seconds, 3000, video[:3]}, {2, 48000*seconds + 24000, 1024, audio[:4]}},
+		{{1, 90000*seconds + 9000, 3000, video[3:]}, {2, 48000*seconds + 24000 + 4096, 1024, audio[4:]}},
+	}
+	f := openBytes(t, buildFragmented(tracks, fragments))
+	if got := f.Moov.Traks[0].GetStartPts(); got != 90000*seconds {
+		t.Errorf("Start pts of the fragmented video = %d, want %d", got, int64(90000*seconds))
+	}
+
+	path := filepath.Join(t.TempDir(), "defragmented.mp4")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.WriteDefragmented(out); err != nil {
+		t.Fatalf("WriteDefragmented: %v", err)
+	}
+	out.Close()
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+
+	for i, want := range [][][]byte{video, audio} {
+		trak := d.Moov.Traks[i]
+		if len(trak.Samples) != len(want) {
+			t.Fatalf("Track %d has %d samples, want %d", i, len(trak.Samples), len(want))
+		}
+		delta := uint32(3000)
+		if i == 1 {
+			delta = 1024
+		}
+		for k, s := range trak.Samples {
+			if s.Start_time != uint32(k)*delta {
+				t.Errorf("Track %d sample %d decoding time = %d, want %d", i, k, s.Start_time, uint32(k)*delta)
+			}
+			data := make([]byte, s.Size)
+			if _, err := d.ReadAt(data, int64(s.Offset)); err != nil || !bytes.Equal(data, want[k]) {
+				t.Errorf("Track %d sample %d data differs", i, k)
+			}
+		}
+	}
+	if d.Moov.Traks[0].Edts != nil {
+		t.Errorf("Video track has an edit list")
+	}
+	if edts := d.Moov.Traks[1].Edts; edts == nil || edts.Elst == nil {
+		t.Errorf("Audio track has no edit list")
+	} else if elst := edts.Elst; elst.Version != 0 || len(elst.Media_time) != 2 || elst.Media_time[0] != -1 || elst.Segment_duration[0] != 500 || elst.Media_time[1] != 0 {
+		t.Errorf("Audio edit list = %v %v, want a 500 ms empty edit", elst.Segment_duration, elst.Media_time)
+	}
+}
+
+func TestFragmentDecodingTimeOverflow(t *testing.T) {
+	tracks := []testTrack{{id: 1, handler: "vide", timescale: 90000}}
+	fragments := [][]testTraf{
+		{{1, 1 << 40, 3000, testSamples(2)}},
+		{{1, 1<<40 + 1<<32, 3000, testSamples(2)}},
+	}
+	path := filepath.Join(t.TempDir(), "overflow.mp4")
+	if err := os.WriteFile(path, buildFragmented(tracks, fragments), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if err == nil {
+		f.Close()
+		t.Fatalf("Open succeeded with decoding times 2^32 apart")
+	}
+}
@@ -0,0 +1,261 @@
+package mp4
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Difference is one field that differs between two files. Path names the
+// box and field, e.g. "moov/trak[0]/mdia/mdhd.Timescale". Summaries which
+// are not a single field carry a Message instead of A and B.
+type Difference struct {
+	Path    string `json:"path"`
+	A       string `json:"a,omitempty"`
+	B       string `json:"b,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (d Difference) String() string {
+	if d.Message != "" {
+		return fmt.Sprintf("%v: %v", d.Path, d.Message)
+	}
+	return fmt.Sprintf("%v: %v != %v", d.Path, d.A, d.B)
+}
+
+// DiffOptions selects what Diff compares besides the box fields.
+type DiffOptions struct {
+	Samples     bool // compare the sample tables and per-sample timing
+	Payload     bool // compare a hash of every sample's data
+	Max_samples int  // number of divergent samples reported per track, 0 means 10
+}
+
+// Fields which legitimately change when boxes move around in the file.
+var diffIgnoredFields = map[string]bool{
+	"StcoBox.Chunk_offset": true,
+	"StsdBox.Other_data":   true, // compared entry by entry instead
+	"TrakBox.Chunks":       true,
+	"TrakBox.Samples":      true,
+}
+
+// Sample table boxes whose entry lists are only compared with DiffOptions.Samples.
+var sampleTableTypes = map[string]bool{
+	"SttsBox": true,
+	"StssBox": true,
+	"StscBox": true,
+	"StszBox": true,
+	"StcoBox": true,
+	"CttsBox": true,
+}
+
+var boxPtrType = reflect.TypeOf(&Box{})
+
+type differ struct {
+	opts  DiffOptions
+	diffs []Difference
+}
+
+func (d *differ) report(path string, a, b interface{}) {
+	d.diffs = append(d.diffs, Difference{Path: path, A: fmt.Sprintf("%v", a), B: fmt.Sprintf("%v", b)})
+}
+
+// Diff compares two parsed files box by box and field by field, ignoring
+// box positions and chunk offsets. Tracks are matched by index.
+func Diff(a, b *File, opts DiffOptions) []Difference {
+	if opts.Max_samples <= 0 {
+		opts.Max_samples = 10
+	}
+	d := &differ{opts: opts}
+	d.diffValue("ftyp", reflect.ValueOf(a.Ftyp), reflect.ValueOf(b.Ftyp))
+	d.diffValue("moov", reflect.ValueOf(a.Moov), reflect.ValueOf(b.Moov))
+
+	if (opts.Samples || opts.Payload) && a.Moov != nil && b.Moov != nil {
+		for i := 0; i < len(a.Moov.Traks) && i < len(b.Moov.Traks); i++ {
+			d.diffSamples(fmt.Sprintf("moov/trak[%d]", i), a.Moov.Traks[i], b.Moov.Traks[i])
+		}
+	}
+	return d.diffs
+}
+
+// embedsBox reports whether t is a pointer to a struct embedding *Box.
+func embedsBox(t reflect.Type) bool {
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.Elem().FieldByName("Box")
+	return ok && f.Anonymous && f.Type == boxPtrType
+}
+
+func boxName(v reflect.Value, field string) string {
+	if !v.IsNil() {
+		if box := v.Elem().FieldByName("Box"); !box.IsNil() {
+			return box.Interface().(*Box).Name
+		}
+	}
+	return strings.ToLower(field)
+}
+
+func (d *differ) diffValue(path string, a, b reflect.Value) {
+	switch a.Kind() {
+	case reflect.Ptr:
+		if a.IsNil() && b.IsNil() {
+			return
+		}
+		if a.IsNil() || b.IsNil() {
+			d.report(path, presence(a), presence(b))
+			return
+		}
+		d.diffValue(path, a.Elem(), b.Elem())
+	case reflect.Struct:
+		d.diffStruct(path, a, b)
+	case reflect.Slice:
+		d.diffSlice(path, a, b)
+	case reflect.Array:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			d.report(path, a.Interface(), b.Interface())
+		}
+	default:
+		if a.Interface() != b.Interface() {
+			d.report(path, a.Interface(), b.Interface())
+		}
+	}
+}
+
+func presence(v reflect.Value) string {
+	if v.IsNil() {
+		return "missing"
+	}
+	return "present"
+}
+
+func (d *differ) diffStruct(path string, a, b reflect.Value) {
+	t := a.Type()
+	if t == reflect.TypeOf(SampleEntry{}) {
+		entryA, entryB := a.Addr().Interface().(*SampleEntry), b.Addr().Interface().(*SampleEntry)
+		if entryA.Name != entryB.Name {
+			d.report(path+".format", entryA.Name, entryB.Name)
+			return
+		}
+		if entryA.Kind() == "" {
+			// Unknown formats are compared as opaque bytes
+			d.diffBytes(path+".data", entryA.ReadBoxData(), entryB.ReadBoxData())
+			return
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous || field.PkgPath != "" || diffIgnoredFields[t.Name()+"."+field.Name] {
+			continue
+		}
+		if sampleTableTypes[t.Name()] && field.Type.Kind() == reflect.Slice && !d.opts.Samples {
+			continue
+		}
+		fa, fb := a.Field(i), b.Field(i)
+		switch {
+		case embedsBox(field.Type):
+			d.diffValue(path+"/"+boxName(fa, field.Name), fa, fb)
+		case field.Type.Kind() == reflect.Slice && embedsBox(field.Type.Elem()):
+			d.diffBoxes(path, field.Name, fa, fb)
+		default:
+			d.diffValue(path+"."+field.Name, fa, fb)
+		}
+	}
+}
+
+// diffBoxes compares lists of boxes such as the traks of a moov.
+func (d *differ) diffBoxes(path, field string, a, b reflect.Value) {
+	if a.Len() != b.Len() {
+		d.report(path+"."+field+".length", a.Len(), b.Len())
+	}
+	for i := 0; i < a.Len() && i < b.Len(); i++ {
+		name := fmt.Sprintf("%v[%d]", boxName(a.Index(i), field), i)
+		d.diffValue(path+"/"+name, a.Index(i), b.Index(i))
+	}
+}
+
+func (d *differ) diffSlice(path string, a, b reflect.Value) {
+	if a.Type().Elem().Kind() == reflect.Uint8 {
+		d.diffBytes(path, a.Bytes(), b.Bytes())
+		return
+	}
+	if a.Len() != b.Len() {
+		d.report(path+".length", a.Len(), b.Len())
+	}
+	for i := 0; i < a.Len() && i < b.Len(); i++ {
+		before := len(d.diffs)
+		d.diffValue(fmt.Sprintf("%v[%d]", path, i), a.Index(i), b.Index(i))
+		if len(d.diffs) > before {
+			// Report only the first divergent element of long tables
+			return
+		}
+	}
+}
+
+func (d *differ) diffBytes(path string, a, b []byte) {
+	if bytes.Equal(a, b) {
+		return
+	}
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	d.report(path, fmt.Sprintf("%d bytes", len(a)), fmt.Sprintf("%d bytes, first difference at byte %d", len(b), i))
+}
+
+// diffSamples compares the built sample tables of two tracks and, if asked,
+// the sample payloads, reporting the first divergent samples.
+func (d *differ) diffSamples(path string, a, b *TrakBox) {
+	if len(a.Samples) != len(b.Samples) {
+		d.report(path+".samples.length", len(a.Samples), len(b.Samples))
+	}
+	divergent, first := 0, -1
+	for i := 0; i < len(a.Samples) && i < len(b.Samples); i++ {
+		sa, sb := a.Samples[i], b.Samples[i]
+		sample := fmt.Sprintf("%v.samples[%d]", path, i)
+		// Collect into a separate differ so only the first samples get reported
+		sd := &differ{opts: d.opts}
+		if d.opts.Samples {
+			// Offsets are left out, they move with the boxes
+			sd.diffValue(sample+".size", reflect.ValueOf(sa.Size), reflect.ValueOf(sb.Size))
+			sd.diffValue(sample+".dts", reflect.ValueOf(sa.Start_time), reflect.ValueOf(sb.Start_time))
+			sd.diffValue(sample+".duration", reflect.ValueOf(sa.Duration), reflect.ValueOf(sb.Duration))
+			sd.diffValue(sample+".cto", reflect.ValueOf(int32(sa.Cto)), reflect.ValueOf(int32(sb.Cto)))
+			sd.diffValue(sample+".keyframe", reflect.ValueOf(sa.Sync), reflect.ValueOf(sb.Sync))
+			sd.diffValue(sample+".sample_description_index", reflect.ValueOf(sa.Sample_description_index), reflect.ValueOf(sb.Sample_description_index))
+		}
+		if d.opts.Payload {
+			ha := md5.Sum(a.File.ReadBytesAt(int64(sa.Size), int64(sa.Offset)))
+			hb := md5.Sum(b.File.ReadBytesAt(int64(sb.Size), int64(sb.Offset)))
+			if ha != hb {
+				sd.report(sample+".md5", fmt.Sprintf("%x", ha), fmt.Sprintf("%x", hb))
+			}
+		}
+		if len(sd.diffs) == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if divergent < d.opts.Max_samples {
+			d.diffs = append(d.diffs, sd.diffs...)
+		}
+		divergent++
+	}
+	if divergent > d.opts.Max_samples {
+		d.diffs = append(d.diffs, Difference{
+			Path:    path + ".samples",
+			Message: fmt.Sprintf("%d divergent samples, first at %d, only %d reported", divergent, first, d.opts.Max_samples),
+		})
+	}
+}
+
+// FormatDifferences renders differences one per line.
+func FormatDifferences(diffs []Difference) string {
+	lines := []string{}
+	for _, d := range diffs {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,62 @@
+package mp4
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffMovedBoxes(t *testing.T) {
+	a := openBytes(t, (&testMovie{timescale: 1000, samples: testSamples(5), delta: 40}).build())
+	// A largesize mdat moves the samples by 8 bytes
+	b := openBytes(t, (&testMovie{timescale: 1000, samples: testSamples(5), delta: 40, mdat: "large"}).build())
+	if diffs := Diff(a, b, DiffOptions{Samples: true, Payload: true}); len(diffs) != 0 {
+		t.Errorf("Diff of moved boxes:\n%v", FormatDifferences(diffs))
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	a := openBytes(t, (&testMovie{timescale: 1000, samples: testSamples(5), delta: 40}).build())
+	b := openBytes(t, (&testMovie{timescale: 2000, samples: testSamples(5), delta: 80}).build())
+	diffs := Diff(a, b, DiffOptions{})
+	found := false
+	for _, d := range diffs {
+		if d.String() == "moov/trak[0]/mdia/mdhd.Timescale: 1000 != 2000" {
+			found = true
+		}
+		if strings.Contains(d.Path, "stts") || strings.Contains(d.Path, "samples") {
+			t.Errorf("Sample table compared without DiffOptions.Samples: %v", d)
+		}
+	}
+	if !found {
+		t.Errorf("Timescale difference not reported:\n%v", FormatDifferences(diffs))
+	}
+
+	diffs = Diff(a, b, DiffOptions{Samples: true})
+	want := "moov/trak[0].samples[1].dts: 40 != 80"
+	if !strings.Contains(FormatDifferences(diffs), want) {
+		t.Errorf("Diff with samples does not report %q:\n%v", want, FormatDifferences(diffs))
+	}
+}
+
+func TestDiffPayload(t *testing.T) {
+	samples := testSamples(15)
+	a := openBytes(t, (&testMovie{timescale: 1000, samples: samples, delta: 40}).build())
+	changed := append([][]byte{}, samples...)
+	changed[2] = append([]byte{}, samples[2]...)
+	changed[2][0]++
+	b := openBytes(t, (&testMovie{timescale: 1000, samples: changed, delta: 40}).build())
+	diffs := Diff(a, b, DiffOptions{Payload: true})
+	if len(diffs) != 1 || diffs[0].Path != "moov/trak[0].samples[2].md5" {
+		t.Errorf("Diff of one changed sample:\n%v", FormatDifferences(diffs))
+	}
+
+	for i := range changed {
+		changed[i] = append([]byte{}, samples[i]...)
+		changed[i][1]++
+	}
+	b = openBytes(t, (&testMovie{timescale: 1000, samples: changed, delta: 40}).build())
+	diffs = Diff(a, b, DiffOptions{Payload: true, Max_samples: 2})
+	if len(diffs) != 3 || diffs[2].String() != "moov/trak[0].samples: 15 divergent samples, first at 0, only 2 reported" {
+		t.Errorf("Diff of every sample changed:\n%v", FormatDifferences(diffs))
+	}
+}
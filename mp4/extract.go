@@ -0,0 +1,152 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+)
+
+// Elementary stream formats of Extract
+const (
+	EXTRACT_ANNEXB = "annexb" // H.264/H.265 byte stream, AV1 length delimited OBUs
+	EXTRACT_IVF    = "ivf"    // AV1 and VP9 in IVF frames
+	EXTRACT_OBU    = "obu"    // AV1 low overhead bitstream format
+	EXTRACT_OGG    = "ogg"    // Opus in Ogg pages
+	EXTRACT_WAV    = "wav"    // PCM and G.711 in RIFF/WAVE
+	EXTRACT_AC3    = "ac3"    // AC-3 sync frames
+	EXTRACT_EAC3   = "eac3"   // E-AC-3 sync frames
+	EXTRACT_JPEG   = "jpeg"   // motion JPEG as a JPEG file per sample, see WriteJPEGs
+	EXTRACT_SRT    = "srt"    // timed text as SubRip
+	EXTRACT_VTT    = "vtt"    // timed text as WebVTT
+	EXTRACT_TTML   = "ttml"   // timed text as a TTML document
+)
+
+// eachSample reads the samples of a track in decoding order and calls fn
+// with each one and its sample description.
+func (f *File) eachSample(trak int, fn func(entry *SampleEntry, s Sample, data []byte) error) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	for _, s := range t.Samples {
+		entry := t.GetSampleEntry(s.Sample_description_index)
+		if entry == nil {
+			return fmt.Errorf("Sample description %d not found", s.Sample_description_index)
+		}
+		data := make([]byte, s.Size)
+		if _, err := f.ReadAt(data, int64(s.Offset)); err != nil {
+			return fmt.Errorf("Reading sample at %d: %v", s.Offset, err)
+		}
+		if err := fn(entry, s, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultExtractFormat returns the format a track is extracted in when none
+// is given.
+func defaultExtractFormat(entry *SampleEntry) string {
+	switch {
+	case entry.Avcc != nil, entry.Hvcc != nil:
+		return EXTRACT_ANNEXB
+	case entry.Av1c != nil, entry.Vpcc != nil:
+		return EXTRACT_IVF
+	case entry.Dops != nil:
+		return EXTRACT_OGG
+	case entry.Dac3 != nil:
+		return EXTRACT_AC3
+	case entry.Dec3 != nil:
+		return EXTRACT_EAC3
+	case entry.Name == "jpeg", entry.Name == "mjpa", entry.Name == "mjpb":
+		return EXTRACT_JPEG
+	case entry.Name == "tx3g":
+		return EXTRACT_SRT
+	case entry.Name == "wvtt":
+		return EXTRACT_VTT
+	case entry.Name == "stpp":
+		return EXTRACT_TTML
+	}
+	if _, err := entry.PCMFormat(); err == nil {
+		return EXTRACT_WAV
+	}
+	return ""
+}
+
+// ExtractFormat returns the format a track is extracted in by default, ""
+// if it has none.
+func (f *File) ExtractFormat(trak int) string {
+	if f.Moov == nil || f.checkTraks([]int{trak}) != nil {
+		return ""
+	}
+	if entry := f.Moov.Traks[trak].GetSampleEntry(1); entry != nil {
+		return defaultExtractFormat(entry)
+	}
+	return ""
+}
+
+// Extract writes a track as an elementary stream in the given format, or
+// in the default one of its codec if format is empty: H.264 and H.265 as
+// an Annex-B byte stream with parameter sets on keyframes, AV1 and VP9 as
+// IVF, Opus as Ogg, PCM as WAVE, AC-3 and E-AC-3 as their raw sync frames,
+// and timed text as SubRip, WebVTT or TTML.
+func (f *File) Extract(w io.Writer, trak int, format string) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	entry := f.Moov.Traks[trak].GetSampleEntry(1)
+	if entry == nil {
+		return fmt.Errorf("Track %d has no sample description", trak)
+	}
+	if format == "" {
+		format = defaultExtractFormat(entry)
+	}
+	av1 := entry.Av1c != nil
+	timed_text := entry.Kind() == "text" || entry.Kind() == "subt"
+	switch {
+	case format == EXTRACT_ANNEXB && (entry.Avcc != nil || entry.Hvcc != nil):
+		return f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+			if entry.Avcc == nil && entry.Hvcc == nil {
+				return fmt.Errorf("Sample description %d changes the codec", s.Sample_description_index)
+			}
+			data, err := annexBSample(entry, data, s.Sync)
+			if err != nil {
+				return fmt.Errorf("Sample at %d: %v", s.Offset, err)
+			}
+			_, err = w.Write(data)
+			return err
+		})
+	case format == EXTRACT_ANNEXB && av1:
+		return f.WriteOBU(w, trak, true)
+	case format == EXTRACT_OBU && av1:
+		return f.WriteOBU(w, trak, false)
+	case format == EXTRACT_IVF && (av1 || entry.Vpcc != nil):
+		return f.WriteIVF(w, trak)
+	case format == EXTRACT_OGG && entry.Dops != nil:
+		return f.WriteOgg(w, trak)
+	case format == EXTRACT_WAV:
+		return f.WriteWAV(w, trak)
+	case (format == EXTRACT_SRT || format == EXTRACT_VTT || format == EXTRACT_TTML) && timed_text:
+		return f.WriteSubtitles(w, trak, format)
+	case format == EXTRACT_JPEG:
+		return fmt.Errorf("Track %d: JPEG images are written as files, see WriteJPEGs", trak)
+	case format == EXTRACT_AC3 && entry.Dac3 != nil, format == EXTRACT_EAC3 && entry.Dec3 != nil:
+		// Samples are whole sync frames
+		return f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+			if entry.Dac3 == nil && entry.Dec3 == nil {
+				return fmt.Errorf("Sample description %d changes the codec", s.Sample_description_index)
+			}
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if format == "" {
+		return fmt.Errorf("Track %d: no elementary stream format for %v", trak, entry.Name)
+	}
+	return fmt.Errorf("Track %d: %v cannot be extracted as %v", trak, entry.Name, format)
+}
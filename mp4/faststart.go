@@ -0,0 +1,105 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// IsFaststart reports whether the moov box comes before every mdat box, so
+// playback can start before the whole file is downloaded.
+func (f *File) IsFaststart() bool {
+	for _, b := range f.boxes {
+		switch b.Name {
+		case "moov":
+			return true
+		case "mdat":
+			return false
+		}
+	}
+	return false
+}
+
+// faststartLayout returns the top-level boxes with moov moved right after
+// the file type box.
+func (f *File) faststartLayout() []boxWriter {
+	layout := []boxWriter{}
+	insert := 0
+	for _, b := range f.topBoxes() {
+		if b == boxWriter(f.Moov) {
+			continue
+		}
+		layout = append(layout, b)
+		if name := b.box().Name; name == "ftyp" || name == "styp" {
+			insert = len(layout)
+		}
+	}
+	layout = append(layout[:insert], append([]boxWriter{f.Moov}, layout[insert:]...)...)
+	return layout
+}
+
+// WriteFaststart writes the file with the moov box ahead of the media data
+// and every chunk offset shifted to match. stco boxes whose offsets no
+// longer fit in 32 bits become co64 boxes. The media data is streamed from
+// the original file. The chunk offsets of f are updated in place.
+func (f *File) WriteFaststart(w io.Writer) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	original := make([][]uint64, len(f.Moov.Traks))
+	for i, trak := range f.Moov.Traks {
+		if stco := trak.Mdia.Minf.Stbl.Stco; stco != nil {
+			original[i] = append([]uint64{}, stco.Chunk_offset...)
+		}
+	}
+
+	layout := f.faststartLayout()
+	// Promoting to co64 grows moov, which moves the media data further, so
+	// repeat until no more stco box needs promoting.
+	for changed := true; changed; {
+		changed = false
+		moved := map[*Box]int64{} // new start of each box copied from the file
+		pos := int64(0)
+		for _, b := range layout {
+			if b != boxWriter(f.Moov) {
+				moved[b.box()] = pos
+			}
+			pos += b.EncodedSize()
+		}
+		for i, trak := range f.Moov.Traks {
+			stco := trak.Mdia.Minf.Stbl.Stco
+			if stco == nil {
+				continue
+			}
+			for j, offset := range original[i] {
+				shifted, err := f.shiftOffset(offset, moved)
+				if err != nil {
+					return fmt.Errorf("Track %d chunk %d: %v", i, j+1, err)
+				}
+				stco.Chunk_offset[j] = shifted
+				if shifted > math.MaxUint32 && stco.Name == "stco" {
+					stco.Box.Name = "co64"
+					changed = true
+				}
+			}
+		}
+	}
+
+	for _, b := range layout {
+		if err := b.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shiftOffset maps a file offset into the top-level box holding it to the
+// same place in that box's new position.
+func (f *File) shiftOffset(offset uint64, moved map[*Box]int64) (uint64, error) {
+	for b, start := range moved {
+		if int64(offset) >= b.Start && int64(offset) < b.Start+b.Size {
+			return uint64(int64(offset) - b.Start + start), nil
+		}
+	}
+	return 0, fmt.Errorf("offset %d is not inside any box", offset)
+}
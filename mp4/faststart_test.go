@@ -0,0 +1,98 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFaststart(t *testing.T) {
+	samples := testSamples(5)
+	f := openBytes(t, (&testMovie{timescale: 1000, samples: samples, delta: 40}).build())
+	if f.IsFaststart() {
+		t.Fatal("moov after mdat reported as faststart")
+	}
+	fs := writeAndOpen(t, "faststart.mp4", func(out *os.File) error { return f.WriteFaststart(out) })
+	if !fs.IsFaststart() {
+		t.Error("Output is not faststart")
+	}
+	trak := fs.Moov.Traks[0]
+	if len(trak.Samples) != len(samples) {
+		t.Fatalf("%d samples, want %d", len(trak.Samples), len(samples))
+	}
+	for i, s := range trak.Samples {
+		data := make([]byte, s.Size)
+		if _, err := fs.ReadAt(data, int64(s.Offset)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, samples[i]) {
+			t.Errorf("Sample %d = %x, want %x", i+1, data, samples[i])
+		}
+	}
+	if name := trak.Mdia.Minf.Stbl.Stco.Name; name != "stco" {
+		t.Errorf("Chunk offsets in %v, want stco", name)
+	}
+}
+
+// prefixWriter keeps the first limit bytes written and fails after them.
+type prefixWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if p.buf.Len()+len(b) > p.limit {
+		return 0, fmt.Errorf("Limit of %d bytes reached", p.limit)
+	}
+	return p.buf.Write(b)
+}
+
+func TestWriteFaststartCo64(t *testing.T) {
+	// A sparse file whose samples end just below 4 GiB: moving moov
+	// ahead of them pushes their offsets past 32 bits
+	samples := testSamples(3)
+	data := bytes.Join(samples, nil)
+	ftyp := testBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	mdat_size := uint64(math.MaxUint32 - 200)
+	offset := uint64(len(ftyp)) + mdat_size - uint64(len(data))
+	m := &testMovie{timescale: 1000, samples: samples, delta: 40}
+
+	path := filepath.Join(t.TempDir(), "large.mp4")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(append(ftyp, append(u32(uint32(mdat_size)), "mdat"...)...))
+	if err == nil {
+		_, err = file.WriteAt(data, int64(offset))
+	}
+	if err == nil {
+		_, err = file.WriteAt(m.moov(offset), int64(offset)+int64(len(data)))
+	}
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	// Only ftyp and moov are kept, the media data is not copied
+	out := &prefixWriter{limit: 4096}
+	if err = f.WriteFaststart(out); err == nil {
+		t.Fatal("WriteFaststart copied the media data")
+	}
+	stco := f.Moov.Traks[0].Mdia.Minf.Stbl.Stco
+	moov_size := uint64(f.Moov.EncodedSize())
+	if stco.Name != "co64" || stco.Chunk_offset[0] != offset+moov_size {
+		t.Errorf("Chunk offsets in %v at %d, want co64 at %d", stco.Name, stco.Chunk_offset[0], offset+moov_size)
+	}
+	if out.buf.Len() != len(ftyp)+int(moov_size) || !bytes.Contains(out.buf.Bytes(), append(u32(1), u64(offset+moov_size)...)) {
+		t.Errorf("Written moov does not hold the co64 offset %d", offset+moov_size)
+	}
+}
@@ -0,0 +1,327 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// FLV tag types
+const (
+	FLV_TAG_AUDIO  = 8
+	FLV_TAG_VIDEO  = 9
+	FLV_TAG_SCRIPT = 18
+)
+
+// FLV codec ids: the video CodecID and the audio SoundFormat. H.265 has
+// none and is written as an Enhanced RTMP FourCC instead.
+const (
+	FLV_CODEC_AVC   = 7
+	FLV_SOUND_MP3   = 2
+	FLV_SOUND_AAC   = 10
+	FLV_FOURCC_HEVC = "hvc1"
+)
+
+// AVCPacketType, and PacketType of the Enhanced RTMP video tags
+const (
+	FLV_SEQUENCE_HEADER = 0
+	FLV_CODED_FRAMES    = 1
+	FLV_SEQUENCE_END    = 2
+)
+
+// flvStream is a track written as audio or video tags.
+type flvStream struct {
+	trak   *TrakBox
+	tag    uint8 // FLV_TAG_AUDIO or FLV_TAG_VIDEO
+	codec  uint8 // CodecID or SoundFormat, 0 for H.265
+	header uint8 // first byte of the audio tags
+}
+
+// flvCodec returns the tag type and codec id carrying the samples of entry.
+func flvCodec(entry *SampleEntry) (tag, codec uint8, err error) {
+	switch {
+	case entry == nil:
+		return 0, 0, fmt.Errorf("No sample description")
+	case entry.Avcc != nil:
+		return FLV_TAG_VIDEO, FLV_CODEC_AVC, nil
+	case entry.Hvcc != nil:
+		return FLV_TAG_VIDEO, 0, nil
+	case entry.Esds != nil:
+		switch entry.Esds.Object_type_indication {
+		case 0x40, 0x66, 0x67, 0x68:
+			return FLV_TAG_AUDIO, FLV_SOUND_AAC, nil
+		case 0x69, 0x6b:
+			return FLV_TAG_AUDIO, FLV_SOUND_MP3, nil
+		}
+		return 0, 0, fmt.Errorf("Object type 0x%02x cannot be carried in FLV", entry.Esds.Object_type_indication)
+	}
+	return 0, 0, fmt.Errorf("%v cannot be carried in FLV", entry.Name)
+}
+
+// audioHeader returns the first byte of the audio tags: sound format,
+// rate, size and type. AAC always signals 44 kHz stereo.
+func (st *flvStream) audioHeader(entry *SampleEntry) uint8 {
+	if st.codec == FLV_SOUND_AAC {
+		return FLV_SOUND_AAC<<4 | 3<<2 | 1<<1 | 1
+	}
+	rate := uint8(3)
+	switch uint32(entry.Sample_rate) >> 16 {
+	case 5512:
+		rate = 0
+	case 11025:
+		rate = 1
+	case 22050:
+		rate = 2
+	}
+	stereo := uint8(0)
+	if entry.Channel_count > 1 {
+		stereo = 1
+	}
+	return st.codec<<4 | rate<<2 | 1<<1 | stereo
+}
+
+// videoHeader returns the start of a video tag up to its payload.
+func (st *flvStream) videoHeader(keyframe bool, packet_type uint8, cto int32) []byte {
+	frame := uint8(2) // inter frame
+	if keyframe {
+		frame = 1
+	}
+	var buf []byte
+	if st.codec == FLV_CODEC_AVC {
+		buf = []byte{frame<<4 | FLV_CODEC_AVC, packet_type}
+	} else {
+		buf = append([]byte{0x80 | frame<<4 | packet_type}, FLV_FOURCC_HEVC...)
+		if packet_type != FLV_CODED_FRAMES {
+			return buf
+		}
+	}
+	return append(buf, byte(cto>>16), byte(cto>>8), byte(cto))
+}
+
+// sequenceHeader returns the tag carrying the decoder configuration of a
+// sample entry, or nil if the codec has none.
+func (st *flvStream) sequenceHeader(entry *SampleEntry) []byte {
+	switch {
+	case st.tag == FLV_TAG_AUDIO && st.codec == FLV_SOUND_AAC:
+		return append([]byte{st.header, FLV_SEQUENCE_HEADER}, entry.Esds.Decoder_specific_info...)
+	case st.tag == FLV_TAG_VIDEO && entry.Avcc != nil:
+		return append(st.videoHeader(true, FLV_SEQUENCE_HEADER, 0), entry.Avcc.payload()...)
+	case st.tag == FLV_TAG_VIDEO && entry.Hvcc != nil:
+		return append(st.videoHeader(true, FLV_SEQUENCE_HEADER, 0), entry.Hvcc.payload()...)
+	}
+	return nil
+}
+
+// writeFLVTag writes a tag and the PreviousTagSize following it.
+func writeFLVTag(w io.Writer, tag_type uint8, timestamp int64, data []byte) error {
+	size := len(data)
+	if size >= 1<<24 {
+		return fmt.Errorf("FLV tag of %d bytes too large", size)
+	}
+	buf := []byte{tag_type, byte(size >> 16), byte(size >> 8), byte(size),
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp), byte(timestamp >> 24),
+		0, 0, 0} // StreamID
+	buf = append(buf, data...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(11+size))
+	_, err := w.Write(buf)
+	return err
+}
+
+// AMF0 encoding of the onMetaData script data
+func amfString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func amfNumber(buf []byte, name string, v float64) []byte {
+	buf = append(amfString(buf, name), 0x00)
+	return binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+}
+
+func amfBool(buf []byte, name string, v bool) []byte {
+	b := byte(0)
+	if v {
+		b = 1
+	}
+	return append(amfString(buf, name), 0x01, b)
+}
+
+// flvMetadata returns the onMetaData script tag describing the streams.
+func (f *File) flvMetadata(streams []*flvStream) []byte {
+	props := []byte{}
+	count := uint32(0)
+	number := func(name string, v float64) {
+		props = amfNumber(props, name, v)
+		count++
+	}
+	if mvhd := f.Moov.Mvhd; mvhd != nil && mvhd.Timescale > 0 {
+		number("duration", float64(mvhd.Duration)/float64(mvhd.Timescale))
+	}
+	for _, st := range streams {
+		entry := st.trak.GetSampleEntry(1)
+		if st.tag == FLV_TAG_VIDEO {
+			number("width", float64(entry.Width))
+			number("height", float64(entry.Height))
+			if duration := st.trak.GetDuration(); duration > 0 {
+				number("framerate", float64(len(st.trak.Samples))*float64(st.trak.Mdia.Mdhd.Timescale)/float64(duration))
+			}
+			if st.codec == FLV_CODEC_AVC {
+				number("videocodecid", FLV_CODEC_AVC)
+			} else {
+				number("videocodecid", float64(binary.BigEndian.Uint32([]byte(FLV_FOURCC_HEVC))))
+			}
+			continue
+		}
+		number("audiocodecid", float64(st.codec))
+		rate := uint32(entry.Sample_rate) >> 16
+		if entry.Esds != nil {
+			if asc, err := entry.Esds.AudioSpecificConfig(); err == nil && asc.Sampling_frequency > 0 {
+				rate = asc.Sampling_frequency
+			}
+		}
+		number("audiosamplerate", float64(rate))
+		number("audiosamplesize", 16)
+		props = amfBool(props, "stereo", audioChannels(entry) == 2)
+		count++
+	}
+
+	buf := amfString([]byte{0x02}, "onMetaData")
+	buf = binary.BigEndian.AppendUint32(append(buf, 0x08), count) // ECMA array
+	buf = append(buf, props...)
+	return append(buf, 0, 0, 0x09) // object end
+}
+
+// WriteFLV writes a video and an audio track as FLV: the header, an
+// onMetaData script tag, the sequence headers and a tag per sample, timed
+// in milliseconds with the composition offsets of the samples. H.264 and
+// AAC or MP3 use the legacy codec ids, H.265 the Enhanced RTMP ones. With
+// traks nil the first video and audio tracks FLV can carry are written.
+func (f *File) WriteFLV(w io.Writer, traks []int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	explicit := traks != nil
+	if !explicit {
+		traks = f.mediaTraks(false)
+	} else if err := f.checkTraks(traks); err != nil {
+		return err
+	}
+	var video, audio *flvStream
+	for _, i := range traks {
+		trak := f.Moov.Traks[i]
+		tag, codec, err := flvCodec(trak.GetSampleEntry(1))
+		if err == nil && len(trak.Samples) == 0 {
+			err = fmt.Errorf("no samples")
+		}
+		if err != nil {
+			if explicit {
+				return fmt.Errorf("Track %d: %v", i, err)
+			}
+			logf("Track %d skipped: %v\n", i, err)
+			continue
+		}
+		st := &flvStream{trak: trak, tag: tag, codec: codec}
+		slot := &video
+		if tag == FLV_TAG_AUDIO {
+			slot = &audio
+		}
+		if *slot != nil {
+			if explicit {
+				return fmt.Errorf("Track %d: FLV carries a single %v track", i, trak.GetHandlerType())
+			}
+			logf("Track %d skipped: FLV carries a single %v track\n", i, trak.GetHandlerType())
+			continue
+		}
+		*slot = st
+	}
+	streams := []*flvStream{}
+	flags := byte(0)
+	if video != nil {
+		streams = append(streams, video)
+		flags |= 0x01
+	}
+	if audio != nil {
+		streams = append(streams, audio)
+		flags |= 0x04
+	}
+	if len(streams) == 0 {
+		return fmt.Errorf("No track FLV can carry")
+	}
+
+	// Millisecond timestamps, shifted so that none is negative
+	type tag struct {
+		stream   *flvStream
+		dts, pts int64
+		sample   Sample
+	}
+	tags := []tag{}
+	shift := int64(0)
+	for _, st := range streams {
+		scale := float64(st.trak.Mdia.Mdhd.Timescale)
+		media_time := st.trak.GetMediaTime()
+		ms := func(t int64) int64 { return int64(math.Round(float64(t-media_time) * 1000 / scale)) }
+		for _, s := range st.trak.Samples {
+			dts := ms(int64(s.Start_time))
+			tags = append(tags, tag{st, dts, ms(int64(s.Start_time) + int64(int32(s.Cto))), s})
+			if -dts > shift {
+				shift = -dts
+			}
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].dts < tags[j].dts })
+
+	header := []byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if err := writeFLVTag(w, FLV_TAG_SCRIPT, 0, f.flvMetadata(streams)); err != nil {
+		return err
+	}
+	described := map[*flvStream]uint32{} // sample description of the last sequence header
+	last := int64(0)
+	for _, t := range tags {
+		st, s := t.stream, t.sample
+		entry := st.trak.GetSampleEntry(s.Sample_description_index)
+		if entry == nil {
+			return fmt.Errorf("Sample description %d not found", s.Sample_description_index)
+		}
+		if st.tag == FLV_TAG_AUDIO {
+			st.header = st.audioHeader(entry)
+		}
+		dts := t.dts + shift
+		if described[st] != s.Sample_description_index {
+			if tag, codec, err := flvCodec(entry); err != nil || tag != st.tag || codec != st.codec {
+				return fmt.Errorf("Sample description %d changes the codec", s.Sample_description_index)
+			}
+			if seq := st.sequenceHeader(entry); seq != nil {
+				if err := writeFLVTag(w, st.tag, dts, seq); err != nil {
+					return err
+				}
+			}
+			described[st] = s.Sample_description_index
+		}
+
+		data := make([]byte, s.Size)
+		if _, err := f.ReadAt(data, int64(s.Offset)); err != nil {
+			return fmt.Errorf("Reading sample at %d: %v", s.Offset, err)
+		}
+		var prefix []byte
+		if st.tag == FLV_TAG_VIDEO {
+			prefix = st.videoHeader(s.Sync, FLV_CODED_FRAMES, int32(t.pts-t.dts))
+		} else if st.codec == FLV_SOUND_AAC {
+			prefix = []byte{st.header, FLV_CODED_FRAMES}
+		} else {
+			prefix = []byte{st.header}
+		}
+		if err := writeFLVTag(w, st.tag, dts, append(prefix, data...)); err != nil {
+			return err
+		}
+		last = dts
+	}
+	if video != nil {
+		return writeFLVTag(w, FLV_TAG_VIDEO, last, video.videoHeader(true, FLV_SEQUENCE_END, 0))
+	}
+	return nil
+}
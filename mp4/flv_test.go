@@ -0,0 +1,103 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// testFLVTag is a tag read back from an FLV stream.
+type testFLVTag struct {
+	tag_type  uint8
+	timestamp int64
+	data      []byte
+}
+
+func readFLVTags(t *testing.T, flv []byte) []testFLVTag {
+	t.Helper()
+	if len(flv) < 13 || string(flv[:3]) != "FLV" || binary.BigEndian.Uint32(flv[5:]) != 9 {
+		t.Fatalf("Invalid FLV header %x", flv[:13])
+	}
+	tags := []testFLVTag{}
+	for pos := 13; pos < len(flv); {
+		if pos+11 > len(flv) {
+			t.Fatalf("Tag header truncated at %d", pos)
+		}
+		h := flv[pos : pos+11]
+		size := int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+		end := pos + 11 + size
+		if end+4 > len(flv) {
+			t.Fatalf("Tag at %d truncated", pos)
+		}
+		if prev := binary.BigEndian.Uint32(flv[end:]); prev != uint32(11+size) {
+			t.Errorf("PreviousTagSize %d after the tag at %d, want %d", prev, pos, 11+size)
+		}
+		timestamp := int64(h[7])<<24 | int64(h[4])<<16 | int64(h[5])<<8 | int64(h[6])
+		tags = append(tags, testFLVTag{h[0], timestamp, flv[pos+11 : end]})
+		pos = end + 4
+	}
+	return tags
+}
+
+func TestWriteFLV(t *testing.T) {
+	video, audio, cto, file := testH264AACFile()
+	f := openBytes(t, file)
+	var buf bytes.Buffer
+	if err := f.WriteFLV(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if flags := buf.Bytes()[4]; flags != 0x05 {
+		t.Errorf("Header flags %x, want audio and video", flags)
+	}
+	tags := readFLVTags(t, buf.Bytes())
+
+	script := tags[0]
+	width := amfNumber(nil, "width", 320)
+	if script.tag_type != FLV_TAG_SCRIPT || !bytes.HasPrefix(script.data, amfString([]byte{0x02}, "onMetaData")) || !bytes.Contains(script.data, width) {
+		t.Errorf("First tag %d %x, want onMetaData", script.tag_type, script.data)
+	}
+	// The video edit starts 33 ms in, later tags are shifted by as much
+	avcc := f.Moov.Traks[0].GetSampleEntry(1).Avcc.payload()
+	if seq := tags[1]; seq.tag_type != FLV_TAG_VIDEO || seq.timestamp != 0 || !bytes.Equal(seq.data, append([]byte{0x17, FLV_SEQUENCE_HEADER, 0, 0, 0}, avcc...)) {
+		t.Errorf("Video sequence header %d at %d: %x", seq.tag_type, seq.timestamp, seq.data)
+	}
+
+	frames, samples, last := 0, 0, int64(0)
+	for _, tag := range tags[2 : len(tags)-1] {
+		if tag.timestamp < last {
+			t.Errorf("Tag at %d after %d", tag.timestamp, last)
+		}
+		last = tag.timestamp
+		switch {
+		case tag.tag_type == FLV_TAG_AUDIO && tag.data[1] == FLV_SEQUENCE_HEADER:
+			if !bytes.Equal(tag.data, []byte{0xaf, 0, 0x11, 0x90}) || tag.timestamp != 33 {
+				t.Errorf("Audio sequence header at %d: %x", tag.timestamp, tag.data)
+			}
+		case tag.tag_type == FLV_TAG_AUDIO:
+			want := int64(math.Round(float64(samples*1024)/48)) + 33
+			if tag.timestamp != want || !bytes.Equal(tag.data, append([]byte{0xaf, FLV_CODED_FRAMES}, audio[samples]...)) {
+				t.Errorf("Audio frame %d at %d: %x, want at %d", samples, tag.timestamp, tag.data, want)
+			}
+			samples++
+		case tag.tag_type == FLV_TAG_VIDEO:
+			// Presentation and decoding times are rounded apart
+			want := int64(math.Round(float64(frames*3000-3000)/90)) + 33
+			pts := int64(math.Round(float64(frames*3000+int(cto[frames])-3000)/90)) + 33
+			header := []byte{0x27, FLV_CODED_FRAMES, 0, 0, byte(pts - want)}
+			if frames%5 == 0 {
+				header[0] = 0x17
+			}
+			if tag.timestamp != want || !bytes.Equal(tag.data, append(header, video[frames]...)) {
+				t.Errorf("Video frame %d at %d: %x, want at %d", frames, tag.timestamp, tag.data[:5], want)
+			}
+			frames++
+		}
+	}
+	if frames != len(video) || samples != len(audio) {
+		t.Errorf("%d video and %d audio tags, want %d and %d", frames, samples, len(video), len(audio))
+	}
+	if end := tags[len(tags)-1]; end.tag_type != FLV_TAG_VIDEO || !bytes.Equal(end.data, []byte{0x17, FLV_SEQUENCE_END, 0, 0, 0}) {
+		t.Errorf("Last tag %d: %x, want the end of sequence", end.tag_type, end.data)
+	}
+}
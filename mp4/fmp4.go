@@ -0,0 +1,804 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// tfhd flags
+const (
+	TFHD_BASE_DATA_OFFSET         = 0x000001
+	TFHD_SAMPLE_DESCRIPTION_INDEX = 0x000002
+	TFHD_DEFAULT_SAMPLE_DURATION  = 0x000008
+	TFHD_DEFAULT_SAMPLE_SIZE      = 0x000010
+	TFHD_DEFAULT_SAMPLE_FLAGS     = 0x000020
+	TFHD_DURATION_IS_EMPTY        = 0x010000
+	TFHD_DEFAULT_BASE_IS_MOOF     = 0x020000
+)
+
+// trun flags
+const (
+	TRUN_DATA_OFFSET        = 0x000001
+	TRUN_FIRST_SAMPLE_FLAGS = 0x000004
+	TRUN_SAMPLE_DURATION    = 0x000100
+	TRUN_SAMPLE_SIZE        = 0x000200
+	TRUN_SAMPLE_FLAGS       = 0x000400
+	TRUN_SAMPLE_CTO         = 0x000800
+)
+
+// Sample flags of sync samples, which depend on no other sample, and of
+// other samples.
+const (
+	SAMPLE_FLAGS_SYNC     = uint32(0x02000000)
+	SAMPLE_FLAGS_NON_SYNC = uint32(0x01010000)
+)
+
+// sampleFlagsSync reports whether sample flags mark a sync sample, i.e.
+// sample_is_non_sync_sample is not set.
+func sampleFlagsSync(flags uint32) bool {
+	return flags&0x10000 == 0
+}
+
+func flags24(f [3]byte) uint32 {
+	return uint32(f[0])<<16 | uint32(f[1])<<8 | uint32(f[2])
+}
+
+func makeFlags24(v uint32) [3]byte {
+	return [3]byte{byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// fieldReader reads consecutive big-endian fields, keeping the first error
+// so that a box can be parsed without checking every field.
+type fieldReader struct {
+	name string
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *fieldReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("%v box truncated: need %d bytes at %d, have %d", r.name, n, r.pos, len(r.data))
+		return make([]byte, n)
+	}
+	r.pos += n
+	return r.data[r.pos-n : r.pos]
+}
+
+func (r *fieldReader) u8() uint8   { return r.next(1)[0] }
+func (r *fieldReader) u16() uint16 { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *fieldReader) u32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *fieldReader) u64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+
+// versioned reads a field that is 64-bit in version 1 boxes.
+func (r *fieldReader) versioned(version uint8) uint64 {
+	if version == 1 {
+		return r.u64()
+	}
+	return uint64(r.u32())
+}
+
+// fullBox reads the version and flags of a full box.
+func (r *fieldReader) fullBox() (uint8, [3]byte) {
+	version := r.u8()
+	var flags [3]byte
+	copy(flags[:], r.next(3))
+	return version, flags
+}
+
+// MvexBox announces that the movie continues in movie fragments.
+type MvexBox struct {
+	*Box
+	Mehd *MehdBox
+	Trex []*TrexBox
+}
+
+func (b *MvexBox) parse() (err error) {
+	boxes := readSubBoxes(b.File, b.Start, b.Size)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		switch subBox.Name {
+		case "mehd":
+			b.Mehd = &MehdBox{Box: subBox}
+			err = b.Mehd.parse()
+		case "trex":
+			trex := &TrexBox{Box: subBox}
+			err = trex.parse()
+			b.Trex = append(b.Trex, trex)
+		default:
+			logf("Unhandled Mvex Sub-Box: %v \n", subBox.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTrex returns the fragment defaults of a track, or nil if there are none.
+func (b *MvexBox) GetTrex(track_id uint32) *TrexBox {
+	for _, trex := range b.Trex {
+		if trex.Track_id == track_id {
+			return trex
+		}
+	}
+	return nil
+}
+
+type MehdBox struct {
+	*Box
+	Version           uint8
+	Flags             [3]byte
+	Fragment_duration uint64
+}
+
+func (b *MehdBox) parse() error {
+	r := &fieldReader{name: "mehd", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Fragment_duration = r.versioned(b.Version)
+	return r.err
+}
+
+// TrexBox holds the defaults of the track fragments of a track.
+type TrexBox struct {
+	*Box
+	Version                          uint8
+	Flags                            [3]byte
+	Track_id                         uint32
+	Default_sample_description_index uint32
+	Default_sample_duration          uint32
+	Default_sample_size              uint32
+	Default_sample_flags             uint32
+}
+
+func (b *TrexBox) parse() error {
+	r := &fieldReader{name: "trex", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Track_id = r.u32()
+	b.Default_sample_description_index = r.u32()
+	b.Default_sample_duration = r.u32()
+	b.Default_sample_size = r.u32()
+	b.Default_sample_flags = r.u32()
+	return r.err
+}
+
+// MoofBox is a movie fragment, describing the samples of the mdat box
+// following it.
+type MoofBox struct {
+	*Box
+	Mfhd  *MfhdBox
+	Trafs []*TrafBox
+}
+
+func (b *MoofBox) parse() (err error) {
+	boxes := readSubBoxes(b.File, b.Start, b.Size)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		switch subBox.Name {
+		case "mfhd":
+			b.Mfhd = &MfhdBox{Box: subBox}
+			err = b.Mfhd.parse()
+		case "traf":
+			traf := &TrafBox{Box: subBox}
+			err = traf.parse()
+			b.Trafs = append(b.Trafs, traf)
+		default:
+			logf("Unhandled Moof Sub-Box: %v \n", subBox.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MfhdBox struct {
+	*Box
+	Version         uint8
+	Flags           [3]byte
+	Sequence_number uint32
+}
+
+func (b *MfhdBox) parse() error {
+	r := &fieldReader{name: "mfhd", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Sequence_number = r.u32()
+	return r.err
+}
+
+// TrafBox is the part of a movie fragment about one track.
+type TrafBox struct {
+	*Box
+	Tfhd  *TfhdBox
+	Tfdt  *TfdtBox
+	Truns []*TrunBox
+}
+
+func (b *TrafBox) parse() (err error) {
+	boxes := readSubBoxes(b.File, b.Start, b.Size)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		switch subBox.Name {
+		case "tfhd":
+			b.Tfhd = &TfhdBox{Box: subBox}
+			err = b.Tfhd.parse()
+		case "tfdt":
+			b.Tfdt = &TfdtBox{Box: subBox}
+			err = b.Tfdt.parse()
+		case "trun":
+			trun := &TrunBox{Box: subBox}
+			err = trun.parse()
+			b.Truns = append(b.Truns, trun)
+		default:
+			logf("Unhandled Traf Sub-Box: %v \n", subBox.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TfhdBox holds the track of a track fragment and the defaults of its
+// samples. Fields are only present if the matching TFHD_* flag is set.
+type TfhdBox struct {
+	*Box
+	Version                  uint8
+	Flags                    [3]byte
+	Track_id                 uint32
+	Base_data_offset         uint64
+	Sample_description_index uint32
+	Default_sample_duration  uint32
+	Default_sample_size      uint32
+	Default_sample_flags     uint32
+}
+
+func (b *TfhdBox) parse() error {
+	r := &fieldReader{name: "tfhd", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Track_id = r.u32()
+	flags := flags24(b.Flags)
+	if flags&TFHD_BASE_DATA_OFFSET != 0 {
+		b.Base_data_offset = r.u64()
+	}
+	if flags&TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+		b.Sample_description_index = r.u32()
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+		b.Default_sample_duration = r.u32()
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+		b.Default_sample_size = r.u32()
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+		b.Default_sample_flags = r.u32()
+	}
+	return r.err
+}
+
+// TfdtBox holds the decoding time of the first sample of a track fragment.
+type TfdtBox struct {
+	*Box
+	Version                uint8
+	Flags                  [3]byte
+	Base_media_decode_time uint64
+}
+
+func (b *TfdtBox) parse() error {
+	r := &fieldReader{name: "tfdt", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Base_media_decode_time = r.versioned(b.Version)
+	return r.err
+}
+
+// TrunSample is one sample of a track run. Fields whose TRUN_* flag is not
+// set are 0 and take the track fragment defaults.
+type TrunSample struct {
+	Duration, Size, Flags, Cto uint32
+}
+
+// TrunBox is a run of contiguous samples of a track fragment.
+type TrunBox struct {
+	*Box
+	Version            uint8
+	Flags              [3]byte
+	Data_offset        int32
+	First_sample_flags uint32
+	Samples            []TrunSample
+}
+
+func (b *TrunBox) parse() error {
+	r := &fieldReader{name: "trun", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	count := r.u32()
+	flags := flags24(b.Flags)
+	if flags&TRUN_DATA_OFFSET != 0 {
+		b.Data_offset = int32(r.u32())
+	}
+	if flags&TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		b.First_sample_flags = r.u32()
+	}
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		s := TrunSample{}
+		if flags&TRUN_SAMPLE_DURATION != 0 {
+			s.Duration = r.u32()
+		}
+		if flags&TRUN_SAMPLE_SIZE != 0 {
+			s.Size = r.u32()
+		}
+		if flags&TRUN_SAMPLE_FLAGS != 0 {
+			s.Flags = r.u32()
+		}
+		if flags&TRUN_SAMPLE_CTO != 0 {
+			s.Cto = r.u32()
+		}
+		if r.err == nil {
+			b.Samples = append(b.Samples, s)
+		}
+	}
+	return r.err
+}
+
+// SidxReference is one subsegment, or nested sidx box, of a segment index.
+type SidxReference struct {
+	Reference_type      uint8 // 1 for a sidx box, 0 for media
+	Referenced_size     uint32
+	Subsegment_duration uint32
+	Starts_with_sap     bool
+	Sap_type            uint8
+	Sap_delta_time      uint32
+}
+
+// SidxBox indexes the byte ranges and durations of subsegments.
+type SidxBox struct {
+	*Box
+	Version                    uint8
+	Flags                      [3]byte
+	Reference_id               uint32
+	Timescale                  uint32
+	Earliest_presentation_time uint64
+	First_offset               uint64
+	References                 []SidxReference
+}
+
+func (b *SidxBox) parse() error {
+	r := &fieldReader{name: "sidx", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Reference_id = r.u32()
+	b.Timescale = r.u32()
+	b.Earliest_presentation_time = r.versioned(b.Version)
+	b.First_offset = r.versioned(b.Version)
+	r.u16() // reserved
+	count := r.u16()
+	for i := uint16(0); i < count && r.err == nil; i++ {
+		size, duration, sap := r.u32(), r.u32(), r.u32()
+		b.References = append(b.References, SidxReference{
+			Reference_type:      uint8(size >> 31),
+			Referenced_size:     size & 0x7fffffff,
+			Subsegment_duration: duration,
+			Starts_with_sap:     sap>>31 == 1,
+			Sap_type:            uint8(sap >> 28 & 7),
+			Sap_delta_time:      sap & 0x0fffffff,
+		})
+	}
+	return r.err
+}
+
+// MfraBox is the random access index at the end of a fragmented file.
+type MfraBox struct {
+	*Box
+	Tfra []*TfraBox
+	Mfro *MfroBox
+}
+
+func (b *MfraBox) parse() (err error) {
+	boxes := readSubBoxes(b.File, b.Start, b.Size)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		switch subBox.Name {
+		case "tfra":
+			tfra := &TfraBox{Box: subBox}
+			err = tfra.parse()
+			b.Tfra = append(b.Tfra, tfra)
+		case "mfro":
+			b.Mfro = &MfroBox{Box: subBox}
+			err = b.Mfro.parse()
+		default:
+			logf("Unhandled Mfra Sub-Box: %v \n", subBox.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TfraEntry locates a sync sample: the moof holding it and its position
+// within that moof, 1-based.
+type TfraEntry struct {
+	Time, Moof_offset                       uint64
+	Traf_number, Trun_number, Sample_number uint32
+}
+
+// TfraBox lists the sync samples of a track in a fragmented file.
+type TfraBox struct {
+	*Box
+	Version  uint8
+	Flags    [3]byte
+	Track_id uint32
+	// Size minus one of the traf, trun and sample numbers, 2 bits each
+	Length_sizes uint32
+	Entries      []TfraEntry
+}
+
+func (b *TfraBox) parse() error {
+	r := &fieldReader{name: "tfra", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Track_id = r.u32()
+	b.Length_sizes = r.u32()
+	count := r.u32()
+	number := func(shift uint) uint32 {
+		switch b.Length_sizes >> shift & 3 {
+		case 0:
+			return uint32(r.u8())
+		case 1:
+			return uint32(r.u16())
+		case 2:
+			v := r.next(3)
+			return uint32(v[0])<<16 | uint32(v[1])<<8 | uint32(v[2])
+		}
+		return r.u32()
+	}
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		e := TfraEntry{Time: r.versioned(b.Version), Moof_offset: r.versioned(b.Version)}
+		e.Traf_number = number(4)
+		e.Trun_number = number(2)
+		e.Sample_number = number(0)
+		b.Entries = append(b.Entries, e)
+	}
+	return r.err
+}
+
+// MfroBox holds the size of the mfra box it ends, so that readers can find
+// it from the end of the file.
+type MfroBox struct {
+	*Box
+	Version   uint8
+	Flags     [3]byte
+	Mfra_size uint32
+}
+
+func (b *MfroBox) parse() error {
+	r := &fieldReader{name: "mfro", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Mfra_size = r.u32()
+	return r.err
+}
+
+func (b *MvexBox) boxes() []boxWriter {
+	current := []boxWriter{b.Mehd}
+	for _, trex := range b.Trex {
+		current = append(current, trex)
+	}
+	return childWriters(b.children, []string{"mehd", "trex"}, current...)
+}
+
+func (b *MvexBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MvexBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *MehdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return appendVersioned(buf, b.Version, b.Fragment_duration)
+}
+
+func (b *MehdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *MehdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *TrexBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Track_id)
+	buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_description_index)
+	buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_duration)
+	buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_size)
+	return binary.BigEndian.AppendUint32(buf, b.Default_sample_flags)
+}
+
+func (b *TrexBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TrexBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MoofBox) boxes() []boxWriter {
+	current := []boxWriter{b.Mfhd}
+	for _, traf := range b.Trafs {
+		current = append(current, traf)
+	}
+	return childWriters(b.children, []string{"mfhd", "traf"}, current...)
+}
+
+func (b *MoofBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MoofBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *MfhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return binary.BigEndian.AppendUint32(buf, b.Sequence_number)
+}
+
+func (b *MfhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *MfhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *TrafBox) boxes() []boxWriter {
+	current := []boxWriter{b.Tfhd, b.Tfdt}
+	for _, trun := range b.Truns {
+		current = append(current, trun)
+	}
+	return childWriters(b.children, []string{"tfhd", "tfdt", "trun"}, current...)
+}
+
+func (b *TrafBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *TrafBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *TfhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Track_id)
+	flags := flags24(b.Flags)
+	if flags&TFHD_BASE_DATA_OFFSET != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, b.Base_data_offset)
+	}
+	if flags&TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_description_index)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_duration)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_size)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, b.Default_sample_flags)
+	}
+	return buf
+}
+
+func (b *TfhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TfhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *TfdtBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return appendVersioned(buf, b.Version, b.Base_media_decode_time)
+}
+
+func (b *TfdtBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TfdtBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *TrunBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Samples)))
+	flags := flags24(b.Flags)
+	if flags&TRUN_DATA_OFFSET != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(b.Data_offset))
+	}
+	if flags&TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, b.First_sample_flags)
+	}
+	for _, s := range b.Samples {
+		if flags&TRUN_SAMPLE_DURATION != 0 {
+			buf = binary.BigEndian.AppendUint32(buf, s.Duration)
+		}
+		if flags&TRUN_SAMPLE_SIZE != 0 {
+			buf = binary.BigEndian.AppendUint32(buf, s.Size)
+		}
+		if flags&TRUN_SAMPLE_FLAGS != 0 {
+			buf = binary.BigEndian.AppendUint32(buf, s.Flags)
+		}
+		if flags&TRUN_SAMPLE_CTO != 0 {
+			buf = binary.BigEndian.AppendUint32(buf, s.Cto)
+		}
+	}
+	return buf
+}
+
+func (b *TrunBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TrunBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *SidxBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Reference_id)
+	buf = binary.BigEndian.AppendUint32(buf, b.Timescale)
+	buf = appendVersioned(buf, b.Version, b.Earliest_presentation_time)
+	buf = appendVersioned(buf, b.Version, b.First_offset)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b.References)))
+	for _, ref := range b.References {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(ref.Reference_type)<<31|ref.Referenced_size&0x7fffffff)
+		buf = binary.BigEndian.AppendUint32(buf, ref.Subsegment_duration)
+		sap := uint32(ref.Sap_type&7)<<28 | ref.Sap_delta_time&0x0fffffff
+		if ref.Starts_with_sap {
+			sap |= 1 << 31
+		}
+		buf = binary.BigEndian.AppendUint32(buf, sap)
+	}
+	return buf
+}
+
+func (b *SidxBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *SidxBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MfraBox) boxes() []boxWriter {
+	current := []boxWriter{}
+	for _, tfra := range b.Tfra {
+		current = append(current, tfra)
+	}
+	current = append(current, b.Mfro)
+	return childWriters(b.children, []string{"tfra", "mfro"}, current...)
+}
+
+func (b *MfraBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MfraBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *TfraBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Track_id)
+	buf = binary.BigEndian.AppendUint32(buf, b.Length_sizes)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Entries)))
+	number := func(buf []byte, v uint32, shift uint) []byte {
+		size := int(b.Length_sizes>>shift&3) + 1
+		for i := size - 1; i >= 0; i-- {
+			buf = append(buf, byte(v>>(8*i)))
+		}
+		return buf
+	}
+	for _, e := range b.Entries {
+		buf = appendVersioned(buf, b.Version, e.Time)
+		buf = appendVersioned(buf, b.Version, e.Moof_offset)
+		buf = number(buf, e.Traf_number, 4)
+		buf = number(buf, e.Trun_number, 2)
+		buf = number(buf, e.Sample_number, 0)
+	}
+	return buf
+}
+
+func (b *TfraBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TfraBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MfroBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return binary.BigEndian.AppendUint32(buf, b.Mfra_size)
+}
+
+func (b *MfroBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *MfroBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+// addFragmentSamples appends the samples described by the moof boxes to the
+// tracks they belong to, each track run becoming a chunk. Tracks without
+// samples in the moov box are rebased onto the tfdt of their first
+// fragment, which live captures often set from the wall clock.
+func (f *File) addFragmentSamples() error {
+	traks := map[uint32]*TrakBox{}
+	next_dts := map[*TrakBox]uint64{}
+	rebase := map[*TrakBox]bool{} // tracks whose first fragment is still to come
+	for _, trak := range f.Moov.Traks {
+		if trak.Tkhd == nil || trak.missingTables() != "" {
+			continue
+		}
+		traks[trak.Tkhd.Track_id] = trak
+		if n := len(trak.Samples); n > 0 {
+			next_dts[trak] = uint64(trak.Samples[n-1].Start_time) + uint64(trak.Samples[n-1].Duration)
+		} else {
+			rebase[trak] = true
+		}
+	}
+
+	for _, moof := range f.Moofs {
+		data_end := uint64(moof.Start) // end of the data of the previous traf
+		for i, traf := range moof.Trafs {
+			if traf.Tfhd == nil {
+				return fmt.Errorf("traf %d of the moof at %d has no tfhd", i, moof.Start)
+			}
+			tfhd := traf.Tfhd
+			trak := traks[tfhd.Track_id]
+			if trak == nil {
+				return fmt.Errorf("traf %d of the moof at %d refers to unknown track_ID %d", i, moof.Start, tfhd.Track_id)
+			}
+			defaults := &TrexBox{Default_sample_description_index: 1}
+			if f.Moov.Mvex != nil {
+				if trex := f.Moov.Mvex.GetTrex(tfhd.Track_id); trex != nil {
+					defaults = trex
+				}
+			}
+			flags := flags24(tfhd.Flags)
+			sdi, duration, size, sample_flags := defaults.Default_sample_description_index, defaults.Default_sample_duration, defaults.Default_sample_size, defaults.Default_sample_flags
+			if flags&TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+				sdi = tfhd.Sample_description_index
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+				duration = tfhd.Default_sample_duration
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+				size = tfhd.Default_sample_size
+			}
+			if flags&TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+				sample_flags = tfhd.Default_sample_flags
+			}
+			base := uint64(moof.Start)
+			if flags&TFHD_BASE_DATA_OFFSET != 0 {
+				base = tfhd.Base_data_offset
+			} else if flags&TFHD_DEFAULT_BASE_IS_MOOF == 0 && i > 0 {
+				base = data_end
+			}
+			dts := next_dts[trak]
+			if traf.Tfdt != nil {
+				dts = traf.Tfdt.Base_media_decode_time
+				if rebase[trak] {
+					trak.decode_time_base = dts
+				}
+				if dts < trak.decode_time_base {
+					return fmt.Errorf("tfdt %d of the moof at %d is before the first fragment of track_ID %d at %d", dts, moof.Start, tfhd.Track_id, trak.decode_time_base)
+				}
+				dts -= trak.decode_time_base
+			}
+			delete(rebase, trak)
+
+			pos := base
+			for _, trun := range traf.Truns {
+				trun_flags := flags24(trun.Flags)
+				if trun_flags&TRUN_DATA_OFFSET != 0 {
+					pos = uint64(int64(base) + int64(trun.Data_offset))
+				}
+				trak.Chunks = append(trak.Chunks, Chunk{
+					Sample_description_index: sdi,
+					Start_sample:             uint32(len(trak.Samples) + 1),
+					Sample_count:             uint32(len(trun.Samples)),
+					Offset:                   pos,
+				})
+				for k, ts := range trun.Samples {
+					if dts > math.MaxUint32 {
+						return fmt.Errorf("Decoding time %d of track_ID %d in the moof at %d does not fit 32 bits, %d after its first fragment", dts+trak.decode_time_base, tfhd.Track_id, moof.Start, dts)
+					}
+					s := Sample{
+						Size: size, Start_time: uint32(dts), Duration: duration, Offset: pos,
+						Chunk: uint32(len(trak.Chunks)), Sample_description_index: sdi,
+					}
+					fl := sample_flags
+					if trun_flags&TRUN_SAMPLE_DURATION != 0 {
+						s.Duration = ts.Duration
+					}
+					if trun_flags&TRUN_SAMPLE_SIZE != 0 {
+						s.Size = ts.Size
+					}
+					if trun_flags&TRUN_SAMPLE_FLAGS != 0 {
+						fl = ts.Flags
+					} else if k == 0 && trun_flags&TRUN_FIRST_SAMPLE_FLAGS != 0 {
+						fl = trun.First_sample_flags
+					}
+					if trun_flags&TRUN_SAMPLE_CTO != 0 {
+						s.Cto = ts.Cto
+					}
+					s.Sync = sampleFlagsSync(fl)
+					trak.Samples = append(trak.Samples, s)
+					pos += uint64(s.Size)
+					dts += uint64(s.Duration)
+				}
+			}
+			data_end = pos
+			next_dts[trak] = dts
+		}
+	}
+	return nil
+}
@@ -0,0 +1,567 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// FragmentOptions sets how a file is cut into movie fragments.
+type FragmentOptions struct {
+	// Target segment duration. Segments start at sync samples of the first
+	// video track of the file, so they last at least this long; 0 starts
+	// one at every sync sample.
+	Duration time.Duration
+	// Start a fragment at every sync sample of that video track, so that
+	// each keyframe can be fetched on its own, and group the fragments
+	// into segments of Duration. Otherwise a segment is a single fragment.
+	Fragment_gops bool
+	Sidx          bool  // index the fragments with sidx boxes
+	Mfra          bool  // end the file with an mfra random access index
+	Tracks        []int // tracks to keep, all of them if nil
+}
+
+// Segment describes a written segment. Times are decoding times of the
+// reference track, the first video track kept.
+type Segment struct {
+	Number    int // from 1
+	Time      uint64
+	Duration  uint64
+	Timescale uint32
+	// Earliest presentation time, which differs from Time when samples
+	// are reordered
+	Presentation_time uint64
+	Offset            int64 // position in the output, 0 for segment files
+	Size              int64 // in bytes, styp and sidx boxes included
+	Keyframes         []Keyframe
+}
+
+// Keyframe is a fragment starting with a sync sample of the reference
+// track. Offset and Size cover the moof box, the mdat header and that
+// sample, which is all a player needs to show it.
+type Keyframe struct {
+	Time     uint64
+	Duration uint64 // until the next fragment
+	Offset   int64  // position in the output or segment file
+	Size     int64
+}
+
+// fragment is a moof box and the samples of the mdat box following it.
+type fragment struct {
+	moof        *MoofBox
+	samples     []Sample
+	data_size   int64
+	time        uint64 // decoding time of the reference track
+	duration    uint64
+	offset      int64 // set once the position in the output is known
+	first_pts   int64 // earliest presentation time of the reference track
+	sync        bool  // whether the reference track starts with a sync sample
+	first_trafs []int // index of the first traf of each track, -1 if none
+}
+
+func (fg *fragment) mdatHeaderSize() int64 {
+	if BOX_HEADER_SIZE+fg.data_size > math.MaxUint32 {
+		return 2 * BOX_HEADER_SIZE
+	}
+	return BOX_HEADER_SIZE
+}
+
+func (fg *fragment) size() int64 {
+	return fg.moof.EncodedSize() + fg.mdatHeaderSize() + fg.data_size
+}
+
+// fragmenter splits the tracks of a file into fragments aligned on the
+// sync samples of a video track.
+type fragmenter struct {
+	f     *File
+	opts  FragmentOptions
+	traks []*TrakBox
+	ref   int // index in traks of the reference track
+	// trun flags and version of each track, with composition offsets if
+	// any of its samples has one
+	trun_flags    []uint32
+	trun_versions []uint8
+	// spans[k][t] is the range of samples of track t in fragment k
+	spans [][][2]int
+	// segments[n] is the range of fragments of segment n
+	segments [][2]int
+}
+
+func (f *File) newFragmenter(opts FragmentOptions) (*fragmenter, error) {
+	if f.Moov == nil || f.Moov.Mvhd == nil {
+		return nil, fmt.Errorf("No moov box")
+	}
+	fr := &fragmenter{f: f, opts: opts, ref: -1}
+	indexes := opts.Tracks
+	if indexes == nil {
+		indexes = f.AllTraks()
+	}
+	if err := f.checkTraks(indexes); err != nil {
+		return nil, err
+	}
+	for _, i := range indexes {
+		trak := f.Moov.Traks[i]
+		if missing := trak.missingTables(); missing != "" {
+			return nil, fmt.Errorf("Track %d is missing the %v box", i, missing)
+		}
+		if fr.ref < 0 && trak.GetHandlerType() == "vide" {
+			fr.ref = len(fr.traks)
+		}
+		trun_flags := uint32(TRUN_DATA_OFFSET | TRUN_SAMPLE_DURATION | TRUN_SAMPLE_SIZE | TRUN_SAMPLE_FLAGS)
+		version := uint8(0)
+		for _, s := range trak.Samples {
+			if s.Cto != 0 {
+				trun_flags |= TRUN_SAMPLE_CTO
+			}
+			if int32(s.Cto) < 0 {
+				version = 1
+			}
+		}
+		fr.traks = append(fr.traks, trak)
+		fr.trun_flags = append(fr.trun_flags, trun_flags)
+		fr.trun_versions = append(fr.trun_versions, version)
+	}
+	if len(fr.traks) == 0 {
+		return nil, fmt.Errorf("No track to fragment")
+	}
+	if fr.ref < 0 {
+		fr.ref = 0
+	}
+	if len(fr.traks[fr.ref].Samples) == 0 {
+		return nil, fmt.Errorf("Reference track %d has no samples", fr.ref)
+	}
+
+	// Boundaries follow the video even when it is not kept, so that the
+	// segments of separately packaged tracks line up
+	lead := fr.traks[fr.ref]
+	for _, trak := range f.Moov.Traks {
+		if trak.GetHandlerType() == "vide" && len(trak.Samples) > 0 && trak.missingTables() == "" {
+			lead = trak
+			break
+		}
+	}
+	gops := opts.Fragment_gops && lead.GetHandlerType() == "vide"
+
+	// Fragment boundaries, in seconds of presentation timeline
+	bounds := []float64{math.Inf(-1)}
+	fr.segments = [][2]int{{0, 1}}
+	start := fr.seconds(lead, lead.Samples[0])
+	for _, s := range lead.Samples[1:] {
+		if !s.Sync {
+			continue
+		}
+		t := fr.seconds(lead, s)
+		next := t-start >= opts.Duration.Seconds()-1e-9
+		if !next && !gops {
+			continue
+		}
+		k := len(bounds)
+		bounds = append(bounds, t)
+		if next {
+			fr.segments = append(fr.segments, [2]int{k, k + 1})
+			start = t
+		} else {
+			fr.segments[len(fr.segments)-1][1] = k + 1
+		}
+	}
+	fr.spans = make([][][2]int, len(bounds))
+	for k := range fr.spans {
+		fr.spans[k] = make([][2]int, len(fr.traks))
+	}
+	for t, trak := range fr.traks {
+		k := 0
+		for i, s := range trak.Samples {
+			for k+1 < len(bounds) && fr.seconds(trak, s) >= bounds[k+1]-1e-9 {
+				k++
+				fr.spans[k][t] = [2]int{i, i}
+			}
+			fr.spans[k][t][1] = i + 1
+		}
+		for k++; k < len(bounds); k++ {
+			fr.spans[k][t] = [2]int{len(trak.Samples), len(trak.Samples)}
+		}
+	}
+	return fr, nil
+}
+
+// seconds returns the decoding time of a sample shifted by the edit list,
+// so that the tracks line up.
+func (fr *fragmenter) seconds(trak *TrakBox, s Sample) float64 {
+	return float64(int64(s.Start_time)-trak.GetMediaTime()) / float64(trak.Mdia.Mdhd.Timescale)
+}
+
+// init returns the ftyp and moov boxes of the init segment: the moov box of
+// the file with empty sample tables and an mvex box. The file is left
+// unchanged.
+func (fr *fragmenter) init() (*FtypBox, *MoovBox) {
+	brands := []string{"iso6", "mp41", "dash"}
+	if len(fr.traks) == 1 {
+		brands = append(brands, "cmfc")
+	}
+	ftyp := &FtypBox{Box: newBox("ftyp"), Major_brand: "iso6", Minor_version: "\x00\x00\x00\x00", Compatible_brands: brands}
+
+	moov := *fr.f.Moov
+	mvhd := *moov.Mvhd
+	mvhd.Duration = 0
+	moov.Mvhd = &mvhd
+	moov.Traks = nil
+	moov.Mvex = &MvexBox{Box: newBox("mvex"), Mehd: &MehdBox{
+		Box:               newBox("mehd"),
+		Fragment_duration: uint64(fr.f.Moov.Mvhd.Duration),
+	}}
+	for _, trak := range fr.traks {
+		moov.Traks = append(moov.Traks, initTrak(trak))
+		moov.Mvex.Trex = append(moov.Mvex.Trex, &TrexBox{
+			Box:                              newBox("trex"),
+			Track_id:                         trak.Tkhd.Track_id,
+			Default_sample_description_index: 1,
+		})
+	}
+	return ftyp, &moov
+}
+
+// initTrak returns a copy of trak without samples, keeping its edit list
+// media time and sample descriptions.
+func initTrak(trak *TrakBox) *TrakBox {
+	t := *trak
+	tkhd := *trak.Tkhd
+	tkhd.Duration = 0
+	t.Tkhd = &tkhd
+	mdia := *trak.Mdia
+	mdhd := *mdia.Mdhd
+	mdhd.Duration = 0
+	mdia.Mdhd = &mdhd
+	minf := *mdia.Minf
+	spec := &trackSpec{Timescale: mdhd.Timescale, Media_time: trak.editMediaTime()}
+	minf.Stbl = spec.stbl()
+	minf.Stbl.Stsd = trak.Mdia.Minf.Stbl.Stsd
+	mdia.Minf = &minf
+	t.Mdia = &mdia
+	// A zero segment duration lasts until the end of the fragments
+	t.Edts = spec.edts(1)
+	t.Chunks, t.Samples = nil, nil
+	return &t
+}
+
+// refTimes returns the decoding time, duration and earliest presentation
+// time of the reference track in fragment k. The presentation time is -1
+// if the track has no samples there.
+func (fr *fragmenter) refTimes(k int) (start, duration uint64, first_pts int64) {
+	ref := fr.traks[fr.ref]
+	span := fr.spans[k][fr.ref]
+	if span[0] == len(ref.Samples) {
+		last := ref.Samples[len(ref.Samples)-1]
+		return uint64(last.Start_time) + uint64(last.Duration), 0, -1
+	}
+	first_pts = -1
+	for _, s := range ref.Samples[span[0]:span[1]] {
+		duration += uint64(s.Duration)
+		if pts := int64(s.Start_time) + int64(int32(s.Cto)); first_pts < 0 || pts < first_pts {
+			first_pts = pts
+		}
+	}
+	return uint64(ref.Samples[span[0]].Start_time), duration, first_pts
+}
+
+// fragment builds the moof box of fragment k. Each track gets a traf box
+// per run of samples sharing a sample description, the reference track
+// first so that its first sample starts the mdat box.
+func (fr *fragmenter) fragment(k int) *fragment {
+	fg := &fragment{moof: &MoofBox{
+		Box:  newBox("moof"),
+		Mfhd: &MfhdBox{Box: newBox("mfhd"), Sequence_number: uint32(k + 1)},
+	}}
+	fg.time, fg.duration, fg.first_pts = fr.refTimes(k)
+	order := []int{fr.ref}
+	fg.first_trafs = make([]int, len(fr.traks))
+	for t := range fr.traks {
+		fg.first_trafs[t] = -1
+		if t != fr.ref {
+			order = append(order, t)
+		}
+	}
+	truns := []*TrunBox{}
+	for _, t := range order {
+		trak := fr.traks[t]
+		span := fr.spans[k][t]
+		samples := trak.Samples[span[0]:span[1]]
+		if len(samples) == 0 {
+			continue
+		}
+		fg.first_trafs[t] = len(fg.moof.Trafs)
+		if t == fr.ref {
+			fg.sync = samples[0].Sync
+		}
+
+		var traf *TrafBox
+		var trun *TrunBox
+		for i, s := range samples {
+			if i == 0 || s.Sample_description_index != samples[i-1].Sample_description_index {
+				tfhd_flags := uint32(TFHD_DEFAULT_BASE_IS_MOOF)
+				if s.Sample_description_index != 1 {
+					tfhd_flags |= TFHD_SAMPLE_DESCRIPTION_INDEX
+				}
+				trun = &TrunBox{Box: newBox("trun"), Version: fr.trun_versions[t], Flags: makeFlags24(fr.trun_flags[t])}
+				traf = &TrafBox{
+					Box: newBox("traf"),
+					Tfhd: &TfhdBox{
+						Box:                      newBox("tfhd"),
+						Flags:                    makeFlags24(tfhd_flags),
+						Track_id:                 trak.Tkhd.Track_id,
+						Sample_description_index: s.Sample_description_index,
+					},
+					Tfdt:  &TfdtBox{Box: newBox("tfdt"), Version: 1, Base_media_decode_time: uint64(s.Start_time)},
+					Truns: []*TrunBox{trun},
+				}
+				fg.moof.Trafs = append(fg.moof.Trafs, traf)
+				truns = append(truns, trun)
+			}
+			flags := SAMPLE_FLAGS_NON_SYNC
+			if s.Sync {
+				flags = SAMPLE_FLAGS_SYNC
+			}
+			trun.Samples = append(trun.Samples, TrunSample{Duration: s.Duration, Size: s.Size, Flags: flags, Cto: s.Cto})
+			fg.samples = append(fg.samples, s)
+			fg.data_size += int64(s.Size)
+		}
+	}
+
+	// Data offsets are relative to the moof box, whose size does not depend
+	// on their values
+	offset := fg.moof.EncodedSize() + fg.mdatHeaderSize()
+	for _, trun := range truns {
+		trun.Data_offset = int32(offset)
+		for _, s := range trun.Samples {
+			offset += int64(s.Size)
+		}
+	}
+	return fg
+}
+
+// fragments builds every fragment.
+func (fr *fragmenter) fragments() []*fragment {
+	frags := []*fragment{}
+	for k := range fr.spans {
+		frags = append(frags, fr.fragment(k))
+	}
+	return frags
+}
+
+// segment describes segment n made of frags, whose offset must be set.
+func (fr *fragmenter) segment(n int, frags []*fragment) Segment {
+	seg := Segment{Number: n + 1, Time: frags[0].time, Timescale: fr.traks[fr.ref].Mdia.Mdhd.Timescale}
+	first_pts := int64(-1)
+	for _, fg := range frags {
+		seg.Duration += fg.duration
+		if fg.first_pts >= 0 && (first_pts < 0 || fg.first_pts < first_pts) {
+			first_pts = fg.first_pts
+		}
+		seg.Size += fg.size()
+		if fg.sync {
+			seg.Keyframes = append(seg.Keyframes, Keyframe{
+				Time:     fg.time,
+				Duration: fg.duration,
+				Offset:   fg.offset,
+				Size:     fg.moof.EncodedSize() + fg.mdatHeaderSize() + int64(fg.samples[0].Size),
+			})
+		}
+	}
+	seg.Presentation_time = seg.Time
+	if first_pts >= 0 {
+		seg.Presentation_time = uint64(first_pts)
+	}
+	return seg
+}
+
+// sidx returns a segment index of frags, which follow it directly.
+func (fr *fragmenter) sidx(frags []*fragment) *SidxBox {
+	ref := fr.traks[fr.ref]
+	sidx := &SidxBox{
+		Box:          newBox("sidx"),
+		Version:      1,
+		Reference_id: ref.Tkhd.Track_id,
+		Timescale:    ref.Mdia.Mdhd.Timescale,
+	}
+	if len(frags) > 0 && frags[0].first_pts > 0 {
+		sidx.Earliest_presentation_time = uint64(frags[0].first_pts)
+	}
+	for _, fg := range frags {
+		ref := SidxReference{
+			Referenced_size:     uint32(fg.size()),
+			Subsegment_duration: uint32(fg.duration),
+			Starts_with_sap:     fg.sync,
+		}
+		if fg.sync {
+			ref.Sap_type = 1
+		}
+		sidx.References = append(sidx.References, ref)
+	}
+	return sidx
+}
+
+// mfra returns the random access index of frags, whose offset must be set.
+func (fr *fragmenter) mfra(frags []*fragment) *MfraBox {
+	mfra := &MfraBox{Box: newBox("mfra"), Mfro: &MfroBox{Box: newBox("mfro")}}
+	for t, trak := range fr.traks {
+		tfra := &TfraBox{Box: newBox("tfra"), Version: 1, Track_id: trak.Tkhd.Track_id}
+		for k, fg := range frags {
+			span := fr.spans[k][t]
+			if fg.first_trafs[t] < 0 || !trak.Samples[span[0]].Sync {
+				continue
+			}
+			s := trak.Samples[span[0]]
+			tfra.Entries = append(tfra.Entries, TfraEntry{
+				Time:          uint64(int64(s.Start_time) + int64(int32(s.Cto))),
+				Moof_offset:   uint64(fg.offset),
+				Traf_number:   uint32(fg.first_trafs[t] + 1),
+				Trun_number:   1,
+				Sample_number: 1,
+			})
+		}
+		mfra.Tfra = append(mfra.Tfra, tfra)
+	}
+	mfra.Mfro.Mfra_size = uint32(mfra.EncodedSize())
+	return mfra
+}
+
+// writeFragment writes the moof and mdat boxes of a fragment, copying the
+// sample data from the file.
+func (fr *fragmenter) writeFragment(w io.Writer, fg *fragment) error {
+	if err := fg.moof.Write(w); err != nil {
+		return err
+	}
+	header := []byte{}
+	if fg.mdatHeaderSize() > BOX_HEADER_SIZE {
+		header = binary.BigEndian.AppendUint32(header, 1)
+		header = append(header, "mdat"...)
+		header = binary.BigEndian.AppendUint64(header, uint64(2*BOX_HEADER_SIZE+fg.data_size))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, uint32(BOX_HEADER_SIZE+fg.data_size))
+		header = append(header, "mdat"...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, s := range fg.samples {
+		if _, err := io.Copy(w, io.NewSectionReader(fr.f, int64(s.Offset), int64(s.Size))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInit writes the init segment and returns its size.
+func (fr *fragmenter) writeInit(w io.Writer) (int64, error) {
+	ftyp, moov := fr.init()
+	if err := ftyp.Write(w); err != nil {
+		return 0, err
+	}
+	return ftyp.EncodedSize() + moov.EncodedSize(), moov.Write(w)
+}
+
+// WriteFragmented writes the file to w as a fragmented MP4: an init segment
+// followed by moof and mdat pairs, with an optional sidx box in front of
+// them and mfra box after them. It returns where each segment was written.
+func (f *File) WriteFragmented(w io.Writer, opts FragmentOptions) ([]Segment, error) {
+	fr, err := f.newFragmenter(opts)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := fr.writeInit(w)
+	if err != nil {
+		return nil, err
+	}
+	frags := fr.fragments()
+	if opts.Sidx {
+		sidx := fr.sidx(frags)
+		if err = sidx.Write(w); err != nil {
+			return nil, err
+		}
+		pos += sidx.EncodedSize()
+	}
+	for _, fg := range frags {
+		fg.offset = pos
+		if err = fr.writeFragment(w, fg); err != nil {
+			return nil, err
+		}
+		pos += fg.size()
+	}
+	segments := []Segment{}
+	for n, span := range fr.segments {
+		seg := fr.segment(n, frags[span[0]:span[1]])
+		seg.Offset = frags[span[0]].offset
+		segments = append(segments, seg)
+	}
+	if opts.Mfra {
+		if err = fr.mfra(frags).Write(w); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// WriteSegments writes the init segment of the file to init and each
+// segment to its own file, opened with create and made of styp, an
+// optional sidx box, then moof and mdat pairs. It returns the segments
+// written.
+func (f *File) WriteSegments(init io.Writer, create func(number int) (io.WriteCloser, error), opts FragmentOptions) ([]Segment, error) {
+	if opts.Mfra {
+		return nil, fmt.Errorf("An mfra box needs a single output file")
+	}
+	fr, err := f.newFragmenter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fr.writeInit(init); err != nil {
+		return nil, err
+	}
+	frags := fr.fragments()
+	segments := []Segment{}
+	for n, span := range fr.segments {
+		group := frags[span[0]:span[1]]
+		boxes := []boxWriter{&FtypBox{
+			Box:               newBox("styp"),
+			Major_brand:       "msdh",
+			Minor_version:     "\x00\x00\x00\x00",
+			Compatible_brands: []string{"msdh", "msix"},
+		}}
+		if opts.Sidx {
+			boxes = append(boxes, fr.sidx(group))
+		}
+		pos := int64(0)
+		for _, b := range boxes {
+			pos += b.EncodedSize()
+		}
+		for _, fg := range group {
+			fg.offset = pos
+			pos += fg.size()
+		}
+		seg := fr.segment(n, group)
+		seg.Size = pos
+
+		out, err := create(seg.Number)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range boxes {
+			if err == nil {
+				err = b.Write(out)
+			}
+		}
+		for _, fg := range group {
+			if err == nil {
+				err = fr.writeFragment(out, fg)
+			}
+		}
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
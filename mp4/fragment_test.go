@@ -0,0 +1,44 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func testFrameHash(t *testing.T, f *File) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := f.WriteFrameHash(buf, "md5", f.AllTraks()); err != nil {
+		t.Fatalf("WriteFrameHash: %v", err)
+	}
+	return buf.String()
+}
+
+func TestFragmentDefragmentFrameHash(t *testing.T) {
+	src := openBytes(t, testAVFile())
+	want := testFrameHash(t, src)
+
+	fragmented := writeAndOpen(t, "fragmented.mp4", func(out *os.File) error {
+		_, err := src.WriteFragmented(out, FragmentOptions{Fragment_gops: true, Sidx: true, Mfra: true})
+		return err
+	})
+	names := []string{}
+	for _, box := range fragmented.boxes {
+		names = append(names, box.Name)
+	}
+	if len(fragmented.Moofs) != 4 || names[2] != "sidx" || names[len(names)-1] != "mfra" {
+		t.Errorf("Fragmented file boxes are %v, want 4 moof boxes after a sidx box and an mfra box", names)
+	}
+	if got := testFrameHash(t, fragmented); got != want {
+		t.Errorf("Fragmented framehash:\n%s\nwant:\n%s", got, want)
+	}
+
+	defragmented := writeAndOpen(t, "defragmented.mp4", func(out *os.File) error { return fragmented.WriteDefragmented(out) })
+	if len(defragmented.Moofs) != 0 {
+		t.Errorf("Defragmented file has %d moof boxes", len(defragmented.Moofs))
+	}
+	if got := testFrameHash(t, defragmented); got != want {
+		t.Errorf("Defragmented framehash:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,239 @@
+package mp4
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"sort"
+)
+
+// Hash names as printed in the "#hash:" header by ffmpeg's framehash muxer.
+var frameHashNames = map[string]string{
+	"md5":    "MD5",
+	"sha256": "SHA256",
+	"crc32":  "CRC32",
+}
+
+func newFrameHash(name string) (hash.Hash, error) {
+	switch name {
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("Unknown hash %v, use md5, sha256 or crc32", name)
+}
+
+var channelLayoutNames = map[int]string{
+	1: "mono",
+	2: "stereo",
+	3: "3.0",
+	4: "4.0",
+	5: "5.0",
+	6: "5.1",
+	8: "7.1",
+}
+
+// frameHashRow is one sample in the order ffmpeg would write it.
+type frameHashRow struct {
+	stream    int
+	timescale uint32
+	dts, pts  int64
+	sample    Sample
+}
+
+// GetExtradata returns the codec configuration ffmpeg exposes as extradata:
+// the avcC or hvcC payload, or the AAC AudioSpecificConfig.
+func (b *SampleEntry) GetExtradata() []byte {
+	switch {
+	case b.Avcc != nil:
+		return b.Avcc.ReadBoxData()
+	case b.Hvcc != nil:
+		return b.Hvcc.ReadBoxData()
+	case b.Av1c != nil:
+		return b.Av1c.ReadBoxData()
+	case b.Esds != nil:
+		return b.Esds.Decoder_specific_info
+	case b.Dops != nil:
+		return b.Dops.OpusHead()
+	}
+	return nil
+}
+
+// frameHashRows collects the samples of the selected tracks, shifted by the
+// edit list like ffmpeg's mov demuxer does, and interleaved by decoding time
+// like ffmpeg's muxing interleaver does.
+func (f *File) frameHashRows(traks []int) []frameHashRow {
+	rows := []frameHashRow{}
+	for stream, index := range traks {
+		trak := f.Moov.Traks[index]
+		shift := trak.GetMediaTime()
+		for _, s := range trak.Samples {
+			rows = append(rows, frameHashRow{
+				stream:    stream,
+				timescale: trak.Mdia.Mdhd.Timescale,
+				dts:       int64(s.Start_time) - shift,
+				pts:       int64(s.Start_time) + int64(int32(s.Cto)) - shift,
+				sample:    s,
+			})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a := new(big.Int).Mul(big.NewInt(rows[i].dts), big.NewInt(int64(rows[j].timescale)))
+		b := new(big.Int).Mul(big.NewInt(rows[j].dts), big.NewInt(int64(rows[i].timescale)))
+		if c := a.Cmp(b); c != 0 {
+			return c < 0
+		}
+		return rows[i].stream < rows[j].stream
+	})
+	return rows
+}
+
+// writeFrameHashStreams writes the per stream header lines shared by the
+// framehash and framecrc layouts.
+func (f *File) writeFrameHashStreams(w io.Writer, traks []int) {
+	for stream, index := range traks {
+		trak := f.Moov.Traks[index]
+		info := trak.stream(stream)
+		fmt.Fprintf(w, "#tb %d: %s\n", stream, formatRational(1, uint64(trak.Mdia.Mdhd.Timescale)))
+		fmt.Fprintf(w, "#media_type %d: %s\n", stream, info.Codec_type)
+		codec := info.Codec_name
+		if codec == "" {
+			codec = "none"
+		}
+		fmt.Fprintf(w, "#codec_id %d: %s\n", stream, codec)
+		switch info.Codec_type {
+		case "audio":
+			layout, ok := channelLayoutNames[info.Channels]
+			if !ok {
+				layout = fmt.Sprintf("%d channels", info.Channels)
+			}
+			fmt.Fprintf(w, "#sample_rate %d: %s\n", stream, info.Sample_rate)
+			fmt.Fprintf(w, "#channel_layout_name %d: %s\n", stream, layout)
+		case "video":
+			sar := "0/1"
+			if entry := trak.GetSampleEntry(1); entry != nil && entry.Pasp != nil {
+				sar = fmt.Sprintf("%d/%d", entry.Pasp.H_spacing, entry.Pasp.V_spacing)
+			}
+			fmt.Fprintf(w, "#dimensions %d: %dx%d\n", stream, info.Width, info.Height)
+			fmt.Fprintf(w, "#sar %d: %s\n", stream, sar)
+		}
+	}
+}
+
+func (f *File) checkTraks(traks []int) error {
+	for _, index := range traks {
+		if index < 0 || index >= len(f.Moov.Traks) {
+			return fmt.Errorf("Track %d out of range, file has %d tracks", index, len(f.Moov.Traks))
+		}
+	}
+	return nil
+}
+
+// AllTraks returns the indexes of every track.
+func (f *File) AllTraks() []int {
+	traks := []int{}
+	for i := range f.Moov.Traks {
+		traks = append(traks, i)
+	}
+	return traks
+}
+
+// WriteFrameHash writes a per-sample hash of the given tracks in the layout
+// of ffmpeg's framehash/framemd5 muxers (format version 2), so the output
+// can be compared with "ffmpeg -i in.mp4 -c copy -f framemd5 -".
+func (f *File) WriteFrameHash(w io.Writer, hashName string, traks []int) error {
+	h, err := newFrameHash(hashName)
+	if err != nil {
+		return err
+	}
+	if err = f.checkTraks(traks); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "#format: frame checksums\n")
+	fmt.Fprintf(w, "#version: 2\n")
+	fmt.Fprintf(w, "#hash: %s\n", frameHashNames[hashName])
+	for stream, index := range traks {
+		if entry := f.Moov.Traks[index].GetSampleEntry(1); entry != nil {
+			if extradata := entry.GetExtradata(); len(extradata) > 0 {
+				h.Reset()
+				h.Write(extradata)
+				fmt.Fprintf(w, "#extradata %d, %31d, %x\n", stream, len(extradata), h.Sum(nil))
+			}
+		}
+	}
+	f.writeFrameHashStreams(w, traks)
+	fmt.Fprintf(w, "#stream#, dts,        pts, duration,     size, hash\n")
+
+	for _, row := range f.frameHashRows(traks) {
+		h.Reset()
+		h.Write(f.ReadBytesAt(int64(row.sample.Size), int64(row.sample.Offset)))
+		line := fmt.Sprintf("%d, %10d, %10d, %8d, %8d, %x", row.stream, row.dts, row.pts, row.sample.Duration, row.sample.Size, h.Sum(nil))
+		if _, err = fmt.Fprintln(w, line+frameFlags(row.sample)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFrameCRC writes an Adler-32 checksum per sample of the given tracks
+// in the layout of ffmpeg's framecrc muxer.
+func (f *File) WriteFrameCRC(w io.Writer, traks []int) error {
+	if err := f.checkTraks(traks); err != nil {
+		return err
+	}
+	for stream, index := range traks {
+		if entry := f.Moov.Traks[index].GetSampleEntry(1); entry != nil {
+			if extradata := entry.GetExtradata(); len(extradata) > 0 {
+				fmt.Fprintf(w, "#extradata %d: %8d, 0x%08x\n", stream, len(extradata), adler32Zero(extradata))
+			}
+		}
+	}
+	f.writeFrameHashStreams(w, traks)
+
+	for _, row := range f.frameHashRows(traks) {
+		data := f.ReadBytesAt(int64(row.sample.Size), int64(row.sample.Offset))
+		line := fmt.Sprintf("%d, %10d, %10d, %8d, %8d, 0x%08x", row.stream, row.dts, row.pts, row.sample.Duration, row.sample.Size, adler32Zero(data))
+		if _, err := fmt.Fprintln(w, line+frameFlags(row.sample)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// frameFlags mirrors the ", F=0x0" suffix ffmpeg prints for packets which
+// are not keyframes.
+func frameFlags(s Sample) string {
+	if s.Sync {
+		return ""
+	}
+	return ", F=0x0"
+}
+
+// adler32Zero computes Adler-32 starting from 0 rather than the usual 1,
+// which is what ffmpeg's framecrc muxer does.
+func adler32Zero(data []byte) uint32 {
+	const mod = 65521
+	a, b := uint32(0), uint32(0)
+	for len(data) > 0 {
+		n := len(data)
+		if n > 5552 {
+			n = 5552
+		}
+		for _, c := range data[:n] {
+			a += uint32(c)
+			b += a
+		}
+		a %= mod
+		b %= mod
+		data = data[n:]
+	}
+	return b<<16 | a
+}
@@ -0,0 +1,64 @@
+package mp4
+
+import (
+	"bytes"
+	"hash/adler32"
+	"testing"
+)
+
+func TestWriteFrameCRC(t *testing.T) {
+	// The edit shifts the times back by 40
+	m := &testMovie{timescale: 1000, samples: testSamples(3), delta: 40, sync: []uint32{1}, cto: []uint32{80, 0, 40}, edits: []testEdit{{120, 40}}}
+	f := openBytes(t, m.build())
+	var buf bytes.Buffer
+	if err := f.WriteFrameCRC(&buf, f.AllTraks()); err != nil {
+		t.Fatal(err)
+	}
+	want := "#tb 0: 1/1000\n" +
+		"#media_type 0: video\n" +
+		"#codec_id 0: mpeg4\n" +
+		"#dimensions 0: 320x240\n" +
+		"#sar 0: 0/1\n" +
+		"0,        -40,         40,       40,       10, 0x00a5002d\n" +
+		"0,          0,          0,       40,       11, 0x08da018c, F=0x0\n" +
+		"0,         40,         80,       40,       12, 0x1402032a, F=0x0\n"
+	if buf.String() != want {
+		t.Errorf("framecrc =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestAdler32Zero(t *testing.T) {
+	// Adler-32 starting from 0 instead of 1 misses 1 in the first sum and
+	// the length in the second
+	const mod = 65521
+	long := bytes.Repeat([]byte{0xff}, 20000)
+	for _, data := range [][]byte{nil, []byte("abc"), long} {
+		sum := adler32.Checksum(data)
+		a := (sum&0xffff + mod - 1) % mod
+		b := (sum>>16 + mod - uint32(len(data))%mod) % mod
+		if got := adler32Zero(data); got != b<<16|a {
+			t.Errorf("adler32Zero of %d bytes = %08x, want %08x", len(data), got, b<<16|a)
+		}
+	}
+	if got := adler32Zero([]byte("abc")); got != 0x024a0126 {
+		t.Errorf("adler32Zero(abc) = %08x, want 024a0126", got)
+	}
+}
+
+func TestFrameHashInterleave(t *testing.T) {
+	f := openBytes(t, testAVFile())
+	rows := f.frameHashRows(f.AllTraks())
+	if len(rows) != 50 {
+		t.Fatalf("%d rows, want 50", len(rows))
+	}
+	for i := 1; i < len(rows); i++ {
+		a, b := rows[i-1], rows[i]
+		if a.dts*int64(b.timescale) > b.dts*int64(a.timescale) {
+			t.Errorf("Row %d at %d/%d follows %d/%d", i, b.dts, b.timescale, a.dts, a.timescale)
+		}
+	}
+	// The video edit starts 3000 in
+	if rows[0].stream != 0 || rows[0].dts != -3000 {
+		t.Errorf("First row stream %d dts %d, want video at -3000", rows[0].stream, rows[0].dts)
+	}
+}
@@ -0,0 +1,99 @@
+package mp4
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Frame is one row of the per-sample listing of a track. Times are in the
+// track's mdhd timescale (ticks) and in seconds.
+type Frame struct {
+	Index                    int     `json:"index"`
+	Chunk                    uint32  `json:"chunk"`
+	Offset                   uint64  `json:"offset"`
+	Size                     uint32  `json:"size"`
+	Dts                      int64   `json:"dts"`
+	Pts                      int64   `json:"pts"`
+	Duration                 uint32  `json:"duration"`
+	Dts_time                 float64 `json:"dts_time"`
+	Pts_time                 float64 `json:"pts_time"`
+	Duration_time            float64 `json:"duration_time"`
+	Keyframe                 bool    `json:"keyframe"`
+	Sample_description_index uint32  `json:"sample_description_index"`
+}
+
+var frameColumns = []string{
+	"index", "chunk", "offset", "size", "dts", "pts", "duration",
+	"dts_time", "pts_time", "duration_time", "keyframe", "sample_description_index",
+}
+
+// GetFrames returns one Frame per sample of the track, in decoding order.
+func (b *TrakBox) GetFrames() []Frame {
+	timescale := float64(b.Mdia.Mdhd.Timescale)
+	if timescale == 0 {
+		timescale = 1
+	}
+	frames := make([]Frame, len(b.Samples))
+	for i, s := range b.Samples {
+		dts := int64(s.Start_time)
+		// ctts version 1 offsets are signed
+		pts := dts + int64(int32(s.Cto))
+		frames[i] = Frame{
+			Index:                    i,
+			Chunk:                    s.Chunk,
+			Offset:                   s.Offset,
+			Size:                     s.Size,
+			Dts:                      dts,
+			Pts:                      pts,
+			Duration:                 s.Duration,
+			Dts_time:                 float64(dts) / timescale,
+			Pts_time:                 float64(pts) / timescale,
+			Duration_time:            float64(s.Duration) / timescale,
+			Keyframe:                 s.Sync,
+			Sample_description_index: s.Sample_description_index,
+		}
+	}
+	return frames
+}
+
+// WriteFramesCSV writes the frames as CSV with a header row.
+func WriteFramesCSV(w io.Writer, frames []Frame) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(frameColumns); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		keyframe := "0"
+		if f.Keyframe {
+			keyframe = "1"
+		}
+		record := []string{
+			fmt.Sprintf("%d", f.Index),
+			fmt.Sprintf("%d", f.Chunk),
+			fmt.Sprintf("%d", f.Offset),
+			fmt.Sprintf("%d", f.Size),
+			fmt.Sprintf("%d", f.Dts),
+			fmt.Sprintf("%d", f.Pts),
+			fmt.Sprintf("%d", f.Duration),
+			formatSeconds(f.Dts_time),
+			formatSeconds(f.Pts_time),
+			formatSeconds(f.Duration_time),
+			keyframe,
+			fmt.Sprintf("%d", f.Sample_description_index),
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteFramesJSON writes the frames as a JSON array.
+func WriteFramesJSON(w io.Writer, frames []Frame) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(frames)
+}
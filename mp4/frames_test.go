@@ -0,0 +1,39 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGetFrames(t *testing.T) {
+	// The second sample has a negative composition offset
+	m := &testMovie{timescale: 1000, samples: testSamples(3), delta: 40, sync: []uint32{1}, cto: []uint32{80, 0xffffffd8, 0}}
+	f := openBytes(t, m.build())
+	frames := f.Moov.Traks[0].GetFrames()
+
+	var csv bytes.Buffer
+	if err := WriteFramesCSV(&csv, frames); err != nil {
+		t.Fatal(err)
+	}
+	want := "index,chunk,offset,size,dts,pts,duration,dts_time,pts_time,duration_time,keyframe,sample_description_index\n" +
+		"0,1,36,10,0,80,40,0.000000,0.080000,0.040000,1,1\n" +
+		"1,1,46,11,40,0,40,0.040000,0.000000,0.040000,0,1\n" +
+		"2,1,57,12,80,80,40,0.080000,0.080000,0.040000,0,1\n"
+	if csv.String() != want {
+		t.Errorf("CSV =\n%s\nwant\n%s", csv.String(), want)
+	}
+
+	var js bytes.Buffer
+	if err := WriteFramesJSON(&js, frames); err != nil {
+		t.Fatal(err)
+	}
+	decoded := []Frame{}
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatalf("Decoding the JSON: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, frames) {
+		t.Errorf("JSON frames = %+v, want %+v", decoded, frames)
+	}
+}
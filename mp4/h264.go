@@ -0,0 +1,351 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// H.264 NAL unit types
+const (
+	H264_NAL_SLICE     = 1
+	H264_NAL_IDR_SLICE = 5
+	H264_NAL_SEI       = 6
+	H264_NAL_SPS       = 7
+	H264_NAL_PPS       = 8
+	H264_NAL_AUD       = 9
+	H264_NAL_FILLER    = 12
+)
+
+func h264NalType(nal []byte) uint8 {
+	if len(nal) == 0 {
+		return 0
+	}
+	return nal[0] & 31
+}
+
+// splitAnnexB splits an Annex-B byte stream on its 3 or 4 byte start codes.
+func splitAnnexB(data []byte) [][]byte {
+	nals := [][]byte{}
+	start := -1
+	for i := 0; i+3 <= len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				nals = appendNal(nals, data[start:i])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 {
+		nals = appendNal(nals, data[start:])
+	}
+	return nals
+}
+
+// appendNal appends nal without the trailing zero bytes, which belong to
+// the next start code or are trailing_zero_8bits.
+func appendNal(nals [][]byte, nal []byte) [][]byte {
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// annexBReader reads the NAL units of an Annex-B stream one by one without
+// loading the whole stream.
+type annexBReader struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func newAnnexBReader(r io.Reader) *annexBReader {
+	return &annexBReader{r: r}
+}
+
+var startCode = []byte{0, 0, 1}
+
+// next returns the next NAL unit, or io.EOF at the end of the stream.
+func (a *annexBReader) next() ([]byte, error) {
+	for {
+		// buf always starts just after a start code, except before the first one
+		if i := bytes.Index(a.buf, startCode); i >= 0 {
+			nal := bytes.TrimRight(a.buf[:i], "\x00")
+			a.buf = a.buf[i+3:]
+			if len(nal) > 0 {
+				return append([]byte{}, nal...), nil
+			}
+			continue
+		}
+		if a.eof {
+			nal := bytes.TrimRight(a.buf, "\x00")
+			a.buf = nil
+			if len(nal) > 0 {
+				return nal, nil
+			}
+			return nil, io.EOF
+		}
+		chunk := make([]byte, 1<<20)
+		n, err := a.r.Read(chunk)
+		a.buf = append(a.buf, chunk[:n]...)
+		if err == io.EOF {
+			a.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit.
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// H264SPS holds the sequence parameter set fields needed to describe and
+// order the pictures of a stream.
+type H264SPS struct {
+	Profile_idc                       uint8
+	Constraint_set_flags              uint8
+	Level_idc                         uint8
+	Seq_parameter_set_id              uint32
+	Chroma_format_idc                 uint32
+	Separate_colour_plane_flag        bool
+	Bit_depth_luma_minus8             uint32
+	Bit_depth_chroma_minus8           uint32
+	Log2_max_frame_num_minus4         uint32
+	Pic_order_cnt_type                uint32
+	Log2_max_pic_order_cnt_lsb_minus4 uint32
+	Frame_mbs_only_flag               bool
+	Width, Height                     uint32
+}
+
+// Profiles whose SPS carries chroma format and bit depth.
+var h264HighProfiles = map[uint8]bool{100: true, 110: true, 122: true, 244: true, 44: true, 83: true, 86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true}
+
+// ParseH264SPS parses a SPS NAL unit, header byte included.
+func ParseH264SPS(nal []byte) (*H264SPS, error) {
+	if len(nal) < 4 || h264NalType(nal) != H264_NAL_SPS {
+		return nil, fmt.Errorf("Not a SPS NAL unit")
+	}
+	sps := &H264SPS{Profile_idc: nal[1], Constraint_set_flags: nal[2], Level_idc: nal[3], Chroma_format_idc: 1}
+	r := newBitReader(unescapeRBSP(nal[4:]))
+	var err error
+	// ue reads an Exp-Golomb field, keeping the first error
+	ue := func() uint32 {
+		v, e := r.readUE()
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+	bits := func(n int) uint32 {
+		v, e := r.readBits(n)
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+
+	sps.Seq_parameter_set_id = ue()
+	if h264HighProfiles[sps.Profile_idc] {
+		sps.Chroma_format_idc = ue()
+		if sps.Chroma_format_idc == 3 {
+			sps.Separate_colour_plane_flag = bits(1) == 1
+		}
+		sps.Bit_depth_luma_minus8 = ue()
+		sps.Bit_depth_chroma_minus8 = ue()
+		bits(1) // qpprime_y_zero_transform_bypass_flag
+		// seq_scaling_matrix_present_flag
+		if bits(1) == 1 {
+			lists := 8
+			if sps.Chroma_format_idc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists && err == nil; i++ {
+				if bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					delta, e := r.readSE()
+					if e != nil {
+						return nil, e
+					}
+					next = (last + delta + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	sps.Log2_max_frame_num_minus4 = ue()
+	sps.Pic_order_cnt_type = ue()
+	switch sps.Pic_order_cnt_type {
+	case 0:
+		sps.Log2_max_pic_order_cnt_lsb_minus4 = ue()
+	case 1:
+		bits(1) // delta_pic_order_always_zero_flag
+		if _, e := r.readSE(); e != nil {
+			return nil, e
+		}
+		if _, e := r.readSE(); e != nil {
+			return nil, e
+		}
+		cycle := ue()
+		for i := uint32(0); i < cycle && err == nil; i++ {
+			if _, e := r.readSE(); e != nil {
+				return nil, e
+			}
+		}
+	}
+	ue()    // max_num_ref_frames
+	bits(1) // gaps_in_frame_num_value_allowed_flag
+	width_mbs := ue() + 1
+	height_map_units := ue() + 1
+	sps.Frame_mbs_only_flag = bits(1) == 1
+	if !sps.Frame_mbs_only_flag {
+		bits(1) // mb_adaptive_frame_field_flag
+	}
+	bits(1) // direct_8x8_inference_flag
+	var crop [4]uint32
+	if bits(1) == 1 { // frame_cropping_flag
+		for i := range crop {
+			crop[i] = ue()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SPS truncated: %v", err)
+	}
+
+	frame_height_mbs := height_map_units
+	if !sps.Frame_mbs_only_flag {
+		frame_height_mbs *= 2
+	}
+	crop_x, crop_y := uint32(1), uint32(1)
+	if !sps.Frame_mbs_only_flag {
+		crop_y = 2
+	}
+	if !sps.Separate_colour_plane_flag {
+		switch sps.Chroma_format_idc {
+		case 1:
+			crop_x, crop_y = 2, crop_y*2
+		case 2:
+			crop_x = 2
+		}
+	}
+	sps.Width = width_mbs*16 - crop_x*(crop[0]+crop[1])
+	sps.Height = frame_height_mbs*16 - crop_y*(crop[2]+crop[3])
+	return sps, nil
+}
+
+// h264ParameterSetId returns the seq_parameter_set_id of a SPS or the
+// pic_parameter_set_id of a PPS, and for a PPS the id of its SPS.
+func h264ParameterSetId(nal []byte) (id, sps_id uint32, err error) {
+	start := 1
+	if h264NalType(nal) == H264_NAL_SPS {
+		start = 4
+	}
+	if len(nal) <= start {
+		return 0, 0, fmt.Errorf("Parameter set truncated")
+	}
+	r := newBitReader(unescapeRBSP(nal[start:]))
+	if id, err = r.readUE(); err != nil || h264NalType(nal) == H264_NAL_SPS {
+		return id, 0, err
+	}
+	sps_id, err = r.readUE()
+	return id, sps_id, err
+}
+
+// h264SliceHeader holds the leading slice header fields.
+type h264SliceHeader struct {
+	first_mb_in_slice uint32
+	pps_id            uint32
+	pic_order_cnt_lsb uint32
+	has_pic_order_lsb bool
+	nal_ref_idc       uint8
+	idr               bool
+}
+
+// parseH264SliceHeader reads the slice header up to pic_order_cnt_lsb.
+// spsFor returns the SPS of a PPS id.
+func parseH264SliceHeader(nal []byte, spsFor func(pps_id uint32) *H264SPS) (*h264SliceHeader, error) {
+	if len(nal) < 2 {
+		return nil, fmt.Errorf("Slice truncated")
+	}
+	h := &h264SliceHeader{nal_ref_idc: nal[0] >> 5 & 3, idr: h264NalType(nal) == H264_NAL_IDR_SLICE}
+	// The header is short, avoid unescaping the whole slice
+	head := nal[1:]
+	if len(head) > 64 {
+		head = head[:64]
+	}
+	r := newBitReader(unescapeRBSP(head))
+	var err error
+	if h.first_mb_in_slice, err = r.readUE(); err != nil {
+		return nil, err
+	}
+	if _, err = r.readUE(); err != nil { // slice_type
+		return nil, err
+	}
+	if h.pps_id, err = r.readUE(); err != nil {
+		return nil, err
+	}
+	sps := spsFor(h.pps_id)
+	if sps == nil {
+		return h, nil
+	}
+	if sps.Separate_colour_plane_flag {
+		if err = r.skipBits(2); err != nil {
+			return nil, err
+		}
+	}
+	// frame_num
+	if err = r.skipBits(int(sps.Log2_max_frame_num_minus4 + 4)); err != nil {
+		return nil, err
+	}
+	if !sps.Frame_mbs_only_flag {
+		field, err := r.readFlag()
+		if err != nil {
+			return nil, err
+		}
+		if field { // bottom_field_flag
+			if err = r.skipBits(1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if h.idr { // idr_pic_id
+		if _, err = r.readUE(); err != nil {
+			return nil, err
+		}
+	}
+	if sps.Pic_order_cnt_type == 0 {
+		if h.pic_order_cnt_lsb, err = r.readBits(int(sps.Log2_max_pic_order_cnt_lsb_minus4 + 4)); err != nil {
+			return nil, err
+		}
+		h.has_pic_order_lsb = true
+	}
+	return h, nil
+}
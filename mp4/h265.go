@@ -0,0 +1,196 @@
+package mp4
+
+import "fmt"
+
+// H.265 NAL unit types
+const (
+	H265_NAL_BLA_W_LP = 16 // first IRAP picture type
+	H265_NAL_CRA      = 21 // last IRAP picture type
+	H265_NAL_VPS      = 32
+	H265_NAL_SPS      = 33
+	H265_NAL_PPS      = 34
+	H265_NAL_AUD      = 35
+	H265_NAL_FILLER   = 38
+)
+
+func h265NalType(nal []byte) uint8 {
+	if len(nal) == 0 {
+		return 0
+	}
+	return (nal[0] >> 1) & 63
+}
+
+// H265SPS holds the sequence parameter set fields needed to describe a
+// stream in an hvcC box.
+type H265SPS struct {
+	Max_sub_layers_minus1               uint8
+	Temporal_id_nesting_flag            uint8
+	General_profile_space               uint8
+	General_tier_flag                   uint8
+	General_profile_idc                 uint8
+	General_profile_compatibility_flags uint32
+	General_constraint_indicator_flags  uint64 // 48 bits
+	General_level_idc                   uint8
+	Seq_parameter_set_id                uint32
+	Chroma_format_idc                   uint32
+	Bit_depth_luma_minus8               uint32
+	Bit_depth_chroma_minus8             uint32
+	Width, Height                       uint32
+}
+
+// ParseH265SPS parses a SPS NAL unit, header bytes included, up to the
+// bit depths.
+func ParseH265SPS(nal []byte) (*H265SPS, error) {
+	if len(nal) < 3 || h265NalType(nal) != H265_NAL_SPS {
+		return nil, fmt.Errorf("Not a SPS NAL unit")
+	}
+	sps := &H265SPS{}
+	r := newBitReader(unescapeRBSP(nal[2:]))
+	var err error
+	// ue reads an Exp-Golomb field, keeping the first error
+	ue := func() uint32 {
+		v, e := r.readUE()
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+	bits := func(n int) uint32 {
+		v, e := r.readBits(n)
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+
+	bits(4) // sps_video_parameter_set_id
+	sps.Max_sub_layers_minus1 = uint8(bits(3))
+	sps.Temporal_id_nesting_flag = uint8(bits(1))
+	// profile_tier_level(1, sps_max_sub_layers_minus1)
+	sps.General_profile_space = uint8(bits(2))
+	sps.General_tier_flag = uint8(bits(1))
+	sps.General_profile_idc = uint8(bits(5))
+	sps.General_profile_compatibility_flags = bits(32)
+	sps.General_constraint_indicator_flags = uint64(bits(16))<<32 | uint64(bits(32))
+	sps.General_level_idc = uint8(bits(8))
+	sub_layers := int(sps.Max_sub_layers_minus1)
+	profile_present := make([]bool, sub_layers)
+	level_present := make([]bool, sub_layers)
+	for i := 0; i < sub_layers; i++ {
+		profile_present[i] = bits(1) == 1
+		level_present[i] = bits(1) == 1
+	}
+	if sub_layers > 0 {
+		for i := sub_layers; i < 8; i++ {
+			bits(2) // reserved_zero_2bits
+		}
+	}
+	for i := 0; i < sub_layers && err == nil; i++ {
+		if profile_present[i] {
+			if e := r.skipBits(88); e != nil {
+				return nil, e
+			}
+		}
+		if level_present[i] {
+			bits(8)
+		}
+	}
+
+	sps.Seq_parameter_set_id = ue()
+	sps.Chroma_format_idc = ue()
+	separate_colour_plane := false
+	if sps.Chroma_format_idc == 3 {
+		separate_colour_plane = bits(1) == 1
+	}
+	width, height := ue(), ue()
+	var window [4]uint32
+	if bits(1) == 1 { // conformance_window_flag
+		for i := range window {
+			window[i] = ue()
+		}
+	}
+	sps.Bit_depth_luma_minus8 = ue()
+	sps.Bit_depth_chroma_minus8 = ue()
+	if err != nil {
+		return nil, fmt.Errorf("SPS truncated: %v", err)
+	}
+
+	sub_width, sub_height := uint32(1), uint32(1)
+	if !separate_colour_plane {
+		switch sps.Chroma_format_idc {
+		case 1:
+			sub_width, sub_height = 2, 2
+		case 2:
+			sub_width = 2
+		}
+	}
+	sps.Width = width - sub_width*(window[0]+window[1])
+	sps.Height = height - sub_height*(window[2]+window[3])
+	return sps, nil
+}
+
+// h265ParameterSetId returns the id of a VPS, SPS or PPS NAL unit.
+func h265ParameterSetId(nal []byte) (uint32, error) {
+	if len(nal) < 3 {
+		return 0, fmt.Errorf("Parameter set truncated")
+	}
+	switch h265NalType(nal) {
+	case H265_NAL_VPS:
+		return uint32(nal[2] >> 4), nil
+	case H265_NAL_SPS:
+		sps, err := ParseH265SPS(nal)
+		if err != nil {
+			return 0, err
+		}
+		return sps.Seq_parameter_set_id, nil
+	}
+	return newBitReader(unescapeRBSP(nal[2:])).readUE()
+}
+
+// h265SampleEntry builds the hvc1 sample entry of a stream from its
+// parameter sets, the first SPS describing the stream. With in_band set the
+// stream repeats or changes them and the entry is hev1.
+func h265SampleEntry(vps, sps_order, pps [][]byte, in_band bool) (*SampleEntry, *H265SPS, error) {
+	sps, err := ParseH265SPS(sps_order[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	name, complete := "hvc1", uint8(1)
+	if in_band {
+		name, complete = "hev1", 0
+	}
+	hvcc := &HvcCBox{
+		Box:                                 newBox("hvcC"),
+		Configuration_version:               1,
+		General_profile_space:               sps.General_profile_space,
+		General_tier_flag:                   sps.General_tier_flag,
+		General_profile_idc:                 sps.General_profile_idc,
+		General_profile_compatibility_flags: sps.General_profile_compatibility_flags,
+		General_constraint_indicator_flags:  sps.General_constraint_indicator_flags,
+		General_level_idc:                   sps.General_level_idc,
+		Chroma_format_idc:                   uint8(sps.Chroma_format_idc),
+		Bit_depth_luma_minus8:               uint8(sps.Bit_depth_luma_minus8),
+		Bit_depth_chroma_minus8:             uint8(sps.Bit_depth_chroma_minus8),
+		Num_temporal_layers:                 sps.Max_sub_layers_minus1 + 1,
+		Temporal_id_nested:                  sps.Temporal_id_nesting_flag,
+		Length_size_minus_one:               3,
+	}
+	for i, nals := range [][][]byte{vps, sps_order, pps} {
+		hvcc.Arrays = append(hvcc.Arrays, HvcCArray{
+			Array_completeness: complete,
+			Nal_unit_type:      uint8(H265_NAL_VPS + i),
+			Nalus:              nals,
+		})
+	}
+	return &SampleEntry{
+		Box:                  newBox(name),
+		Data_reference_index: 1,
+		Width:                uint16(sps.Width),
+		Height:               uint16(sps.Height),
+		Horizresolution:      0x480000, // 72 dpi
+		Vertresolution:       0x480000,
+		Frame_count:          1,
+		Depth:                0x18,
+		Hvcc:                 hvcc,
+	}, sps, nil
+}
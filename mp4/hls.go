@@ -0,0 +1,405 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+	"time"
+)
+
+// HLSOptions sets how a file is packaged for HTTP Live Streaming.
+type HLSOptions struct {
+	// Target segment duration. Segments start at keyframes of the first
+	// video track, so they last at least this long.
+	Duration time.Duration
+	TS       bool // MPEG-TS segments instead of fragmented MP4
+}
+
+// Names of the files written by WriteHLS. The master playlist is at the
+// top, the other files in the directory of their rendition.
+const (
+	HLS_MASTER_PLAYLIST = "master.m3u8"
+	HLS_MEDIA_PLAYLIST  = "playlist.m3u8"
+	HLS_IFRAME_PLAYLIST = "iframes.m3u8"
+	HLS_INIT_SEGMENT    = "init.mp4"
+	HLS_FMP4_SEGMENT    = "segment_%d.m4s"
+	HLS_TS_SEGMENT      = "segment_%d.ts"
+)
+
+// hlsRendition is a media playlist, its segments and the tracks in them.
+type hlsRendition struct {
+	dir      string
+	traks    []*TrakBox
+	segment  string // segment file name pattern
+	init     bool   // whether the segments need the init segment
+	segments []Segment
+}
+
+// create opens the files of the rendition's segments.
+func (r *hlsRendition) create(create func(name string) (io.WriteCloser, error)) func(number int) (io.WriteCloser, error) {
+	return func(number int) (io.WriteCloser, error) {
+		return create(path.Join(r.dir, fmt.Sprintf(r.segment, number)))
+	}
+}
+
+func (r *hlsRendition) version() int {
+	if r.init {
+		return 7
+	}
+	return 4
+}
+
+// video returns the first video track of the rendition, nil if none.
+func (r *hlsRendition) video() *TrakBox {
+	for _, trak := range r.traks {
+		if trak.GetHandlerType() == "vide" {
+			return trak
+		}
+	}
+	return nil
+}
+
+// codecs returns the codecs parameter of every sample description.
+func (r *hlsRendition) codecs() []string {
+	codecs := []string{}
+	for _, trak := range r.traks {
+		for _, entry := range trak.Mdia.Minf.Stbl.Stsd.Entries {
+			codecs = appendUnique(codecs, entry.CodecString())
+		}
+	}
+	return codecs
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, s := range list {
+			found = found || s == item
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// bitRate returns size bytes over duration units of timescale in bits per
+// second, rounded up.
+func bitRate(size int64, duration uint64, timescale uint32) int64 {
+	if duration == 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(size) * 8 * float64(timescale) / float64(duration)))
+}
+
+// bandwidth returns the peak segment bit rate and the average bit rate.
+func bandwidth(segments []Segment) (peak, average int64) {
+	size, duration := int64(0), 0.0
+	for _, seg := range segments {
+		if rate := bitRate(seg.Size, seg.Duration, seg.Timescale); rate > peak {
+			peak = rate
+		}
+		size += seg.Size
+		duration += float64(seg.Duration) / float64(seg.Timescale)
+	}
+	if duration > 0 {
+		average = int64(math.Ceil(float64(size) * 8 / duration))
+	}
+	return peak, average
+}
+
+// iframeBandwidth returns the peak bit rate of the keyframes.
+func (r *hlsRendition) iframeBandwidth() (peak int64) {
+	for _, seg := range r.segments {
+		for _, key := range seg.Keyframes {
+			if rate := bitRate(key.Size, key.Duration, seg.Timescale); rate > peak {
+				peak = rate
+			}
+		}
+	}
+	return peak
+}
+
+// targetDuration returns the EXT-X-TARGETDURATION of durations in seconds:
+// none of them may exceed it once rounded to the nearest integer.
+func targetDuration(durations []float64) int {
+	target := 1
+	for _, d := range durations {
+		if t := int(math.Round(d)); t > target {
+			target = t
+		}
+	}
+	return target
+}
+
+// playlist returns the media playlist of the rendition, or its I-frame
+// playlist addressing the keyframes by byte range.
+func (r *hlsRendition) playlist(iframes bool) string {
+	type entry struct {
+		duration float64
+		tags     string
+	}
+	entries := []entry{}
+	durations := []float64{}
+	for _, seg := range r.segments {
+		name := fmt.Sprintf(r.segment, seg.Number)
+		if !iframes {
+			d := float64(seg.Duration) / float64(seg.Timescale)
+			entries = append(entries, entry{d, name})
+			durations = append(durations, d)
+			continue
+		}
+		for _, key := range seg.Keyframes {
+			d := float64(key.Duration) / float64(seg.Timescale)
+			entries = append(entries, entry{d, fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n%s", key.Size, key.Offset, name)})
+			durations = append(durations, d)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n", r.version())
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration(durations))
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	if iframes {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if r.init {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", HLS_INIT_SEGMENT)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n%s\n", e.duration, e.tags)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// streamInf returns the attributes of a variant stream playing r, and the
+// audio renditions with it, if any.
+func (r *hlsRendition) streamInf(audio []*hlsRendition) string {
+	peak, average := bandwidth(r.segments)
+	codecs := r.codecs()
+	if len(audio) > 0 {
+		audio_peak, audio_average := int64(0), int64(0)
+		for _, a := range audio {
+			p, avg := bandwidth(a.segments)
+			if p > audio_peak {
+				audio_peak = p
+			}
+			if avg > audio_average {
+				audio_average = avg
+			}
+			codecs = appendUnique(codecs, a.codecs()...)
+		}
+		peak += audio_peak
+		average += audio_average
+	}
+	attrs := fmt.Sprintf("BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=%q", peak, average, strings.Join(codecs, ","))
+	if video := r.video(); video != nil {
+		attrs += hlsResolution(video)
+		if d := video.GetDuration(); d > 0 {
+			attrs += fmt.Sprintf(",FRAME-RATE=%.3f", float64(len(video.Samples))*float64(video.Mdia.Mdhd.Timescale)/float64(d))
+		}
+	}
+	if len(audio) > 0 {
+		attrs += `,AUDIO="audio"`
+	}
+	return attrs
+}
+
+// hlsResolution returns the RESOLUTION attribute of a video track.
+func hlsResolution(trak *TrakBox) string {
+	if entry := trak.GetSampleEntry(1); entry != nil && entry.Width > 0 && entry.Height > 0 {
+		return fmt.Sprintf(",RESOLUTION=%dx%d", entry.Width, entry.Height)
+	}
+	return ""
+}
+
+// manifestLanguage returns the language code of a track, "" if undefined.
+func manifestLanguage(trak *TrakBox) string {
+	if lang := trak.Mdia.Mdhd.GetLanguage(); lang != "und" && strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") == "" {
+		return lang
+	}
+	return ""
+}
+
+// audioChannels returns the channel count of an audio entry, preferring
+// the AAC decoder configuration over the sample entry field.
+func audioChannels(entry *SampleEntry) int {
+	if entry == nil {
+		return 0
+	}
+	if entry.Esds != nil {
+		if asc, err := entry.Esds.AudioSpecificConfig(); err == nil && asc.Channel_configuration > 0 {
+			return int(asc.Channel_configuration)
+		}
+	}
+	switch {
+	case entry.Dops != nil:
+		return int(entry.Dops.Output_channel_count)
+	case entry.Dac3 != nil:
+		return entry.Dac3.Channels()
+	case entry.Dec3 != nil:
+		return entry.Dec3.Channels()
+	}
+	return int(entry.Channel_count)
+}
+
+// media returns the EXT-X-MEDIA tag of an audio rendition.
+func (r *hlsRendition) media(n int) string {
+	trak := r.traks[0]
+	attrs := fmt.Sprintf(",NAME=\"audio_%d\"", n+1)
+	if lang := manifestLanguage(trak); lang != "" {
+		attrs += fmt.Sprintf(",LANGUAGE=%q", lang)
+	}
+	if n == 0 {
+		attrs += ",DEFAULT=YES,AUTOSELECT=YES"
+	} else {
+		attrs += ",DEFAULT=NO,AUTOSELECT=YES"
+	}
+	if channels := audioChannels(trak.GetSampleEntry(1)); channels > 0 {
+		attrs += fmt.Sprintf(",CHANNELS=\"%d\"", channels)
+	}
+	return fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\"%s,URI=%q\n", attrs, path.Join(r.dir, HLS_MEDIA_PLAYLIST))
+}
+
+// master returns the master playlist. Video renditions become variant
+// streams using the audio renditions as alternatives; without video each
+// audio rendition is a variant stream of its own.
+func master(video, audio []*hlsRendition) string {
+	var b strings.Builder
+	version := 4
+	for _, r := range append(append([]*hlsRendition{}, video...), audio...) {
+		if r.version() > version {
+			version = r.version()
+		}
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-INDEPENDENT-SEGMENTS\n", version)
+	if len(video) == 0 {
+		for _, r := range audio {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s\n", r.streamInf(nil), path.Join(r.dir, HLS_MEDIA_PLAYLIST))
+		}
+		return b.String()
+	}
+	for n, r := range audio {
+		b.WriteString(r.media(n))
+	}
+	for _, r := range video {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s\n", r.streamInf(audio), path.Join(r.dir, HLS_MEDIA_PLAYLIST))
+	}
+	for _, r := range video {
+		v := r.video()
+		entry := v.GetSampleEntry(1)
+		fmt.Fprintf(&b, "#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,CODECS=%q%s,URI=%q\n",
+			r.iframeBandwidth(), entry.CodecString(), hlsResolution(v), path.Join(r.dir, HLS_IFRAME_PLAYLIST))
+	}
+	return b.String()
+}
+
+// writeText creates the named file with the given content.
+func writeText(create func(name string) (io.WriteCloser, error), name, text string) error {
+	w, err := create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, text)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// mediaTraks returns the indexes of the audio and video tracks with
+// samples, only those MPEG-TS can carry if ts is set. The others are
+// logged as skipped.
+func (f *File) mediaTraks(ts bool) []int {
+	indexes := []int{}
+	for i, trak := range f.Moov.Traks {
+		kind := trak.GetHandlerType()
+		entry := trak.GetSampleEntry(1)
+		switch {
+		case kind != "vide" && kind != "soun":
+			logf("Track %d skipped: %v tracks are not packaged\n", i, kind)
+		case len(trak.Samples) == 0 || entry == nil:
+			logf("Track %d skipped: no samples\n", i)
+		default:
+			if _, _, err := tsStreamType(entry); err != nil && ts {
+				logf("Track %d skipped: %v\n", i, err)
+				continue
+			}
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// WriteHLS packages the audio and video tracks of the file for HTTP Live
+// Streaming on demand. Every file is opened with create, named by its path
+// relative to the master playlist. In fragmented MP4 each track is a
+// rendition in its own track_<index> directory, the audio ones grouped as
+// alternatives of the video; in MPEG-TS the tracks are muxed into a single
+// rendition in the stream directory. Video renditions also get an I-frame
+// playlist addressing their keyframes by byte range.
+func (f *File) WriteHLS(create func(name string) (io.WriteCloser, error), opts HLSOptions) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	indexes := f.mediaTraks(opts.TS)
+	if len(indexes) == 0 {
+		return fmt.Errorf("No audio or video track to package")
+	}
+	fragment := FragmentOptions{Duration: opts.Duration, Fragment_gops: true}
+
+	video, audio := []*hlsRendition{}, []*hlsRendition{}
+	renditions := []*hlsRendition{}
+	if opts.TS {
+		r := &hlsRendition{dir: "stream", segment: HLS_TS_SEGMENT}
+		for _, i := range indexes {
+			r.traks = append(r.traks, f.Moov.Traks[i])
+		}
+		fragment.Tracks = indexes
+		var err error
+		if r.segments, err = f.writeTSSegments(r.create(create), fragment); err != nil {
+			return err
+		}
+		renditions = append(renditions, r)
+	} else {
+		for _, i := range indexes {
+			r := &hlsRendition{
+				dir:     fmt.Sprintf("track_%d", i),
+				traks:   []*TrakBox{f.Moov.Traks[i]},
+				segment: HLS_FMP4_SEGMENT,
+				init:    true,
+			}
+			init, err := create(path.Join(r.dir, HLS_INIT_SEGMENT))
+			if err != nil {
+				return err
+			}
+			fragment.Tracks = []int{i}
+			r.segments, err = f.WriteSegments(init, r.create(create), fragment)
+			if e := init.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				return fmt.Errorf("Track %d: %v", i, err)
+			}
+			renditions = append(renditions, r)
+		}
+	}
+
+	for _, r := range renditions {
+		if err := writeText(create, path.Join(r.dir, HLS_MEDIA_PLAYLIST), r.playlist(false)); err != nil {
+			return err
+		}
+		if r.video() == nil {
+			audio = append(audio, r)
+			continue
+		}
+		video = append(video, r)
+		if err := writeText(create, path.Join(r.dir, HLS_IFRAME_PLAYLIST), r.playlist(true)); err != nil {
+			return err
+		}
+	}
+	return writeText(create, HLS_MASTER_PLAYLIST, master(video, audio))
+}
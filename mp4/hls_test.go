@@ -0,0 +1,124 @@
+package mp4
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFiles collects the files written through create.
+type testFiles map[string]*bytes.Buffer
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (files testFiles) create(name string) (io.WriteCloser, error) {
+	files[name] = &bytes.Buffer{}
+	return nopWriteCloser{files[name]}, nil
+}
+
+func (files testFiles) names() []string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWriteHLS(t *testing.T) {
+	_, _, _, file := testH264AACFile()
+	f := openBytes(t, file)
+	files := testFiles{}
+	// Segments start at every keyframe, 5 frames apart
+	if err := f.WriteHLS(files.create, HLSOptions{Duration: 100 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"master.m3u8",
+		"track_0/iframes.m3u8", "track_0/init.mp4", "track_0/playlist.m3u8", "track_0/segment_1.m4s", "track_0/segment_2.m4s",
+		"track_1/init.mp4", "track_1/playlist.m3u8", "track_1/segment_1.m4s", "track_1/segment_2.m4s"}
+	if !reflect.DeepEqual(files.names(), names) {
+		t.Fatalf("Files %v, want %v", files.names(), names)
+	}
+
+	want := map[string]string{
+		"master.m3u8": `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="audio_1",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="track_1/playlist.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=29676,AVERAGE-BANDWIDTH=26089,CODECS="avc1.42c01e,mp4a.40.2",RESOLUTION=320x240,FRAME-RATE=30.000,AUDIO="audio"
+track_0/playlist.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=9408,CODECS="avc1.42c01e",RESOLUTION=320x240,URI="track_0/iframes.m3u8"
+`,
+		"track_0/playlist.m3u8": `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:0.166667,
+segment_1.m4s
+#EXTINF:0.166667,
+segment_2.m4s
+#EXT-X-ENDLIST
+`,
+		// Audio is split at the decoding time of the second keyframe
+		"track_1/playlist.m3u8": `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:1
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:0.149333,
+segment_1.m4s
+#EXTINF:0.490667,
+segment_2.m4s
+#EXT-X-ENDLIST
+`,
+	}
+	for name, text := range want {
+		if got := files[name].String(); got != text {
+			t.Errorf("%v =\n%s\nwant\n%s", name, got, text)
+		}
+	}
+	// The I-frame playlist addresses the keyframe starting each segment
+	iframes := files["track_0/iframes.m3u8"].String()
+	if !strings.Contains(iframes, "#EXT-X-I-FRAMES-ONLY\n") || strings.Count(iframes, "#EXT-X-BYTERANGE:") != 2 {
+		t.Errorf("I-frame playlist:\n%s", iframes)
+	}
+	for _, name := range []string{"track_0/segment_1.m4s", "track_1/segment_2.m4s"} {
+		if data := files[name].Bytes(); len(data) < 8 || !bytes.Contains(data[:64], []byte("moof")) {
+			t.Errorf("%v does not start with a fragment", name)
+		}
+	}
+}
+
+func TestWriteHLSTS(t *testing.T) {
+	_, _, _, file := testH264AACFile()
+	f := openBytes(t, file)
+	files := testFiles{}
+	if err := f.WriteHLS(files.create, HLSOptions{Duration: 100 * time.Millisecond, TS: true}); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"master.m3u8", "stream/iframes.m3u8", "stream/playlist.m3u8", "stream/segment_1.ts", "stream/segment_2.ts"}
+	if !reflect.DeepEqual(files.names(), names) {
+		t.Fatalf("Files %v, want %v", files.names(), names)
+	}
+	master := files["master.m3u8"].String()
+	for _, want := range []string{"#EXT-X-VERSION:4\n", `CODECS="avc1.42c01e,mp4a.40.2",RESOLUTION=320x240`, "\nstream/playlist.m3u8\n", `URI="stream/iframes.m3u8"`} {
+		if !strings.Contains(master, want) {
+			t.Errorf("Master playlist does not contain %q:\n%s", want, master)
+		}
+	}
+	if playlist := files["stream/playlist.m3u8"].String(); strings.Contains(playlist, "EXT-X-MAP") || strings.Count(playlist, ".ts\n") != 2 {
+		t.Errorf("Media playlist:\n%s", playlist)
+	}
+	for _, name := range names[3:] {
+		if data := files[name].Bytes(); len(data) == 0 || len(data)%TS_PACKET_SIZE != 0 || data[0] != TS_SYNC_BYTE {
+			t.Errorf("%v is not a transport stream", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const IVF_HEADER_SIZE = 32
+
+// ivfFourcc returns the IVF codec FourCC of a sample entry.
+func ivfFourcc(entry *SampleEntry) (string, error) {
+	switch {
+	case entry.Av1c != nil:
+		return "AV01", nil
+	case entry.Vpcc != nil:
+		return "VP90", nil
+	}
+	return "", fmt.Errorf("%v cannot be written as IVF", entry.Name)
+}
+
+// WriteIVF writes a video track as IVF: the 32-byte header, then a frame
+// per sample with its presentation time in the media timescale. AV1
+// samples are written as temporal units with the sequence header on
+// keyframes.
+func (f *File) WriteIVF(w io.Writer, trak int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	first := t.GetSampleEntry(1)
+	if first == nil {
+		return fmt.Errorf("Track %d has no sample description", trak)
+	}
+	fourcc, err := ivfFourcc(first)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, IVF_HEADER_SIZE)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], IVF_HEADER_SIZE)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint16(header[12:], first.Width)
+	binary.LittleEndian.PutUint16(header[14:], first.Height)
+	binary.LittleEndian.PutUint32(header[16:], t.Mdia.Mdhd.Timescale) // time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(t.Samples)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	media_time := t.GetMediaTime()
+	return f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+		if name, err := ivfFourcc(entry); err != nil || name != fourcc {
+			return fmt.Errorf("Sample description %d changes the codec", s.Sample_description_index)
+		}
+		if entry.Av1c != nil {
+			unit, err := av1TemporalUnit(entry, data, s.Sync)
+			if err != nil {
+				return fmt.Errorf("Sample at %d: %v", s.Offset, err)
+			}
+			data = nil
+			for _, obu := range unit {
+				data = appendOBU(data, obu)
+			}
+		}
+		frame := make([]byte, 12, 12+len(data))
+		binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+		binary.LittleEndian.PutUint64(frame[4:], uint64(int64(s.Start_time)+int64(int32(s.Cto))-media_time))
+		_, err := w.Write(append(frame, data...))
+		return err
+	})
+}
@@ -0,0 +1,61 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestVpcCVersions(t *testing.T) {
+	tests := []struct {
+		name  string
+		vpcc  []byte
+		codec string
+	}{
+		{"version 1", testFullBox("vpcC", 1, 0, []byte{2, 31, 10<<4 | 1<<1 | 1, 9, 16, 9}, u16(0)), "vp09.02.31.10.01.09.16.09.01"},
+		{"version 0", testFullBox("vpcC", 0, 0, []byte{2, 31, 10<<4 | 5, 1<<4 | 3<<1 | 1}, u16(0)), "vp09.02.31.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(3), entry: testVisualEntry("vp09", tt.vpcc)}
+			data := m.build()
+			f := openBytes(t, data)
+			entry := f.Moov.Traks[0].GetSampleEntry(1)
+			v := entry.Vpcc
+			if v == nil || v.Profile != 2 || v.Level != 31 || v.Bit_depth != 10 || v.Chroma_subsampling != 1 || v.Video_full_range_flag != 1 {
+				t.Fatalf("vpcC = %+v", v)
+			}
+			if got := entry.CodecString(); got != tt.codec {
+				t.Errorf("Codec string %v, want %v", got, tt.codec)
+			}
+			out := &bytes.Buffer{}
+			if err := f.Write(out); err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("File not written back unchanged, %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteIVFVP9(t *testing.T) {
+	samples := testSamples(3)
+	vpcc := testFullBox("vpcC", 1, 0, []byte{0, 10, 8 << 4, 2, 2, 2}, u16(0))
+	m := testMovie{timescale: 30, delta: 1, samples: samples, entry: testVisualEntry("vp09", vpcc), edits: []testEdit{{100, 1}}}
+	out := &bytes.Buffer{}
+	if err := openBytes(t, m.build()).WriteIVF(out, 0); err != nil {
+		t.Fatalf("WriteIVF: %v", err)
+	}
+	data := out.Bytes()
+	le := binary.LittleEndian
+	if string(data[:4]) != "DKIF" || string(data[8:12]) != "VP90" || le.Uint32(data[16:]) != 30 || le.Uint32(data[24:]) != 3 {
+		t.Fatalf("IVF header %x", data[:IVF_HEADER_SIZE])
+	}
+	pos := IVF_HEADER_SIZE
+	for i, want := range samples {
+		size, pts := int(le.Uint32(data[pos:])), int64(le.Uint64(data[pos+4:]))
+		// Presentation times start at the edit list media time
+		if pts != int64(i)-1 || !bytes.Equal(data[pos+12:pos+12+size], want) {
+			t.Errorf("Frame %d at %d: %x, want %x at %d", i, pts, data[pos+12:pos+12+size], want, i-1)
+		}
+		pos += 12 + size
+	}
+}
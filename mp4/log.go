@@ -0,0 +1,20 @@
+package mp4
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Log receives the parser's diagnostic output (boxes found, unhandled
+// boxes, ...). Point it at os.Stderr or ioutil.Discard when stdout is
+// used for machine readable output.
+var Log io.Writer = os.Stdout
+
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(Log, format, a...)
+}
+
+func logln(a ...interface{}) {
+	fmt.Fprintln(Log, a...)
+}
@@ -0,0 +1,285 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// JPEG markers
+const (
+	JPEG_SOF0 = 0xc0
+	JPEG_DHT  = 0xc4
+	JPEG_SOI  = 0xd8
+	JPEG_EOI  = 0xd9
+	JPEG_SOS  = 0xda
+	JPEG_DQT  = 0xdb
+	JPEG_APP1 = 0xe1
+)
+
+const JPEG_TIMESTAMPS_FILE = "timestamps.txt"
+
+// jpegDefaultDHT is a DHT segment with the example Huffman tables of ITU-T
+// T.81 annex K.3, which motion JPEG leaves out.
+var jpegDefaultDHT = func() []byte {
+	tables := []struct {
+		class_id uint8
+		bits     [16]byte
+		values   []byte
+	}{
+		{0x00, [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{0x10, [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}, []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+		{0x01, [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{0x11, [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}, []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+	}
+	body := []byte{}
+	for _, t := range tables {
+		body = append(append(append(body, t.class_id), t.bits[:]...), t.values...)
+	}
+	return appendJPEGSegment(nil, JPEG_DHT, body)
+}()
+
+func appendJPEGSegment(buf []byte, marker byte, body []byte) []byte {
+	buf = append(buf, 0xff, marker)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(2+len(body)))
+	return append(buf, body...)
+}
+
+// mjpegFieldHeader holds the offsets of the QuickTime motion JPEG field
+// header, relative to the start of the field. MJPEG-A carries it in an
+// APP1 segment, MJPEG-B at the start of the field instead of markers.
+type mjpegFieldHeader struct {
+	field_size, padded_field_size, next_field uint32
+	dqt, dht, sof, sos, sod                   uint32
+}
+
+func parseMJPEGFieldHeader(data []byte) (*mjpegFieldHeader, error) {
+	if len(data) < 40 || string(data[4:8]) != "mjpg" {
+		return nil, fmt.Errorf("No mjpg field header")
+	}
+	v := make([]uint32, 8)
+	for i := range v {
+		v[i] = binary.BigEndian.Uint32(data[8+4*i:])
+	}
+	return &mjpegFieldHeader{v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]}, nil
+}
+
+// jpegSOSOffset returns the offset of the SOS marker of a JPEG image and
+// whether a DHT segment precedes it.
+func jpegSOSOffset(data []byte) (int, bool, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != JPEG_SOI {
+		return 0, false, fmt.Errorf("No JPEG start of image")
+	}
+	has_dht := false
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xff {
+			return 0, false, fmt.Errorf("No JPEG marker at %d", offset)
+		}
+		marker := data[offset+1]
+		if marker == 0xff { // fill byte
+			offset++
+			continue
+		}
+		if marker == JPEG_SOS {
+			return offset, has_dht, nil
+		}
+		has_dht = has_dht || marker == JPEG_DHT
+		offset += 2 + int(binary.BigEndian.Uint16(data[offset+2:]))
+	}
+	return 0, false, fmt.Errorf("No JPEG start of scan")
+}
+
+// jpegWithDHT returns a JPEG image with the default Huffman tables inserted
+// before the scan if it has none.
+func jpegWithDHT(data []byte) ([]byte, error) {
+	sos, has_dht, err := jpegSOSOffset(data)
+	if err != nil || has_dht {
+		return data, err
+	}
+	buf := append(append([]byte{}, data[:sos]...), jpegDefaultDHT...)
+	return append(buf, data[sos:]...), nil
+}
+
+// mjpegAFields splits an MJPEG-A sample into its fields, each a JPEG image.
+// A sample without the APP1 field header is a single image.
+func mjpegAFields(data []byte) ([][]byte, error) {
+	fields := [][]byte{}
+	for len(fields) < 2 {
+		if len(data) < 4 || data[0] != 0xff || data[1] != JPEG_SOI {
+			return nil, fmt.Errorf("No JPEG start of image in field %d", len(fields)+1)
+		}
+		field := data
+		next := uint32(0)
+		if data[2] == 0xff && data[3] == JPEG_APP1 {
+			if h, err := parseMJPEGFieldHeader(data[6:]); err == nil {
+				if h.field_size > 0 && int(h.field_size) <= len(data) {
+					field = data[:h.field_size]
+				}
+				next = h.next_field
+			}
+		}
+		fields = append(fields, field)
+		if next == 0 || int(next) >= len(data) {
+			break
+		}
+		data = data[next:]
+	}
+	return fields, nil
+}
+
+// mjpegBFields converts the fields of an MJPEG-B sample to JPEG images:
+// the segments the field header points at get their markers back, the
+// default Huffman tables are used if it has none and the scan data gets
+// the byte stuffing MJPEG-B leaves out.
+func mjpegBFields(data []byte) ([][]byte, error) {
+	fields := [][]byte{}
+	for len(fields) < 2 {
+		h, err := parseMJPEGFieldHeader(data)
+		if err != nil {
+			return nil, fmt.Errorf("Field %d: %v", len(fields)+1, err)
+		}
+		end := int(h.field_size)
+		if end == 0 || end > len(data) {
+			end = len(data)
+		}
+		segment := func(marker byte, offset uint32) ([]byte, error) {
+			if offset == 0 {
+				return nil, nil
+			}
+			if int(offset)+2 > end {
+				return nil, fmt.Errorf("Field %d: segment 0x%02x at %d overruns the field", len(fields)+1, marker, offset)
+			}
+			n := int(binary.BigEndian.Uint16(data[offset:]))
+			if n < 2 || int(offset)+n > end {
+				return nil, fmt.Errorf("Field %d: segment 0x%02x at %d overruns the field", len(fields)+1, marker, offset)
+			}
+			return append([]byte{0xff, marker}, data[offset:int(offset)+n]...), nil
+		}
+		image := []byte{0xff, JPEG_SOI}
+		for _, s := range []struct {
+			marker byte
+			offset uint32
+		}{{JPEG_DQT, h.dqt}, {JPEG_DHT, h.dht}, {JPEG_SOF0, h.sof}, {JPEG_SOS, h.sos}} {
+			seg, err := segment(s.marker, s.offset)
+			if err != nil {
+				return nil, err
+			}
+			if seg == nil && s.marker == JPEG_DHT {
+				seg = jpegDefaultDHT
+			}
+			if seg == nil && (s.marker == JPEG_SOF0 || s.marker == JPEG_SOS) {
+				return nil, fmt.Errorf("Field %d: no segment 0x%02x", len(fields)+1, s.marker)
+			}
+			image = append(image, seg...)
+		}
+		if h.sod == 0 || int(h.sod) > end {
+			return nil, fmt.Errorf("Field %d: start of data %d out of the field", len(fields)+1, h.sod)
+		}
+		for _, b := range data[h.sod:end] {
+			image = append(image, b)
+			if b == 0xff {
+				image = append(image, 0)
+			}
+		}
+		fields = append(fields, append(image, 0xff, JPEG_EOI))
+		if h.next_field == 0 || int(h.next_field) >= len(data) {
+			break
+		}
+		data = data[h.next_field:]
+	}
+	return fields, nil
+}
+
+// jpegFields returns the JPEG images of a motion JPEG sample, one per
+// field.
+func jpegFields(entry *SampleEntry, data []byte) ([][]byte, error) {
+	var fields [][]byte
+	var err error
+	switch entry.Name {
+	case "mjpb":
+		return mjpegBFields(data)
+	case "mjpa":
+		if fields, err = mjpegAFields(data); err != nil {
+			return nil, err
+		}
+	case "jpeg":
+		fields = [][]byte{data}
+	default:
+		return nil, fmt.Errorf("%v is not motion JPEG", entry.Name)
+	}
+	for i := range fields {
+		if fields[i], err = jpegWithDHT(fields[i]); err != nil {
+			return nil, fmt.Errorf("Field %d: %v", i+1, err)
+		}
+	}
+	return fields, nil
+}
+
+// WriteJPEGs writes each sample of a motion JPEG track (jpeg, mjpa or mjpb)
+// as frame_000123.jpg, numbered in decoding order, through create. The
+// second field of an interlaced sample goes to frame_000123_field2.jpg.
+// With timestamps, timestamps.txt lists each file and its presentation
+// time in seconds.
+func (f *File) WriteJPEGs(create func(name string) (io.WriteCloser, error), trak int, timestamps bool) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	timescale := float64(t.Mdia.Mdhd.Timescale)
+	media_time := t.GetMediaTime()
+	list := &strings.Builder{}
+	list.WriteString("# file pts_time\n")
+
+	number := 0
+	err := f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+		fields, err := jpegFields(entry, data)
+		if err != nil {
+			return fmt.Errorf("Sample %d: %v", number, err)
+		}
+		pts := float64(int64(s.Start_time)+int64(int32(s.Cto))-media_time) / timescale
+		for i, image := range fields {
+			name := fmt.Sprintf("frame_%06d.jpg", number)
+			if i > 0 {
+				name = fmt.Sprintf("frame_%06d_field%d.jpg", number, i+1)
+			}
+			if err := writeText(create, name, string(image)); err != nil {
+				return err
+			}
+			fmt.Fprintf(list, "%s %.6f\n", name, pts)
+		}
+		number++
+		return nil
+	})
+	if err != nil || !timestamps {
+		return err
+	}
+	return writeText(create, JPEG_TIMESTAMPS_FILE, list.String())
+}
@@ -0,0 +1,92 @@
+package mp4
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// testMJPEGHeader returns a QuickTime motion JPEG field header.
+func testMJPEGHeader(size, next, dqt, dht, sof, sos, sod uint32) []byte {
+	return bytes.Join([][]byte{u32(0), []byte("mjpg"), u32(size), u32(size), u32(next), u32(dqt), u32(dht), u32(sof), u32(sos), u32(sod)}, nil)
+}
+
+var (
+	testDQT = []byte{0x00, 0x06, 0x00, 0x01, 0x02, 0x03}
+	testSOF = []byte{0x00, 0x05, 0x08, 0x00, 0x01}
+	testSOS = []byte{0x00, 0x04, 0x01, 0x02}
+)
+
+// testMJPEGBField returns an MJPEG-B field: the header, the segments
+// without their markers and the scan data without byte stuffing.
+func testMJPEGBField(next uint32, scan []byte) []byte {
+	size := uint32(40 + len(testDQT) + len(testSOF) + len(testSOS) + len(scan))
+	header := testMJPEGHeader(size, next, 40, 0, 46, 51, 55)
+	return bytes.Join([][]byte{header, testDQT, testSOF, testSOS, scan}, nil)
+}
+
+func TestWriteJPEGs(t *testing.T) {
+	jpeg := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	soi, eoi := []byte{0xff, JPEG_SOI}, []byte{0xff, JPEG_EOI}
+	dqt, sof, sos := append([]byte{0xff, JPEG_DQT}, testDQT...), append([]byte{0xff, JPEG_SOF0}, testSOF...), append([]byte{0xff, JPEG_SOS}, testSOS...)
+	dht := []byte{0xff, JPEG_DHT, 0x00, 0x03, 0x00}
+
+	// MJPEG-A fields carry their header in APP1, the second one here has
+	// its own Huffman tables
+	app1 := append([]byte{0xff, JPEG_APP1, 0x00, 42}, testMJPEGHeader(56, 56, 0, 0, 0, 0, 0)...)
+	mjpa_field1 := jpeg(soi, app1, sos, []byte{0x12, 0x34}, eoi)
+	mjpa_field2 := jpeg(soi, dht, sos, []byte{0x56, 0x78}, eoi)
+
+	tests := []struct {
+		name    string
+		entry   string
+		samples [][]byte
+		want    map[string][]byte
+	}{
+		{
+			name:  "mjpb",
+			entry: "mjpb",
+			samples: [][]byte{
+				append(testMJPEGBField(59, []byte{0x12, 0xff, 0x34, 0xff}), testMJPEGBField(0, []byte{0xff, 0xff, 0x00, 0x56})...),
+				testMJPEGBField(0, []byte{0x78}),
+			},
+			want: map[string][]byte{
+				"frame_000000.jpg":        jpeg(soi, dqt, jpegDefaultDHT, sof, sos, []byte{0x12, 0xff, 0x00, 0x34, 0xff, 0x00}, eoi),
+				"frame_000000_field2.jpg": jpeg(soi, dqt, jpegDefaultDHT, sof, sos, []byte{0xff, 0x00, 0xff, 0x00, 0x00, 0x56}, eoi),
+				"frame_000001.jpg":        jpeg(soi, dqt, jpegDefaultDHT, sof, sos, []byte{0x78}, eoi),
+			},
+		},
+		{
+			name:    "mjpa",
+			entry:   "mjpa",
+			samples: [][]byte{append(append([]byte{}, mjpa_field1...), mjpa_field2...), mjpa_field2},
+			want: map[string][]byte{
+				"frame_000000.jpg":        jpeg(mjpa_field1[:46], jpegDefaultDHT, mjpa_field1[46:]),
+				"frame_000000_field2.jpg": mjpa_field2,
+				"frame_000001.jpg":        mjpa_field2,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMovie{timescale: 600, delta: 20, samples: tt.samples, entry: testVisualEntry(tt.entry)}
+			files := testFiles{}
+			if err := openBytes(t, m.build()).WriteJPEGs(files.create, 0, true); err != nil {
+				t.Fatalf("WriteJPEGs: %v", err)
+			}
+			names := []string{"frame_000000.jpg", "frame_000000_field2.jpg", "frame_000001.jpg", JPEG_TIMESTAMPS_FILE}
+			if !reflect.DeepEqual(files.names(), names) {
+				t.Fatalf("Files %v, want %v", files.names(), names)
+			}
+			for name, want := range tt.want {
+				if got := files[name].Bytes(); !bytes.Equal(got, want) {
+					t.Errorf("%v\n%x\nwant\n%x", name, got, want)
+				}
+			}
+			timestamps := "# file pts_time\nframe_000000.jpg 0.000000\nframe_000000_field2.jpg 0.000000\nframe_000001.jpg 0.033333\n"
+			if got := files[JPEG_TIMESTAMPS_FILE].String(); got != timestamps {
+				t.Errorf("Timestamps\n%v\nwant\n%v", got, timestamps)
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Matroska element ids, marker bits included
+const (
+	MKV_EBML                  = 0x1A45DFA3
+	MKV_EBML_VERSION          = 0x4286
+	MKV_EBML_READ_VERSION     = 0x42F7
+	MKV_EBML_MAX_ID_LENGTH    = 0x42F2
+	MKV_EBML_MAX_SIZE_LENGTH  = 0x42F3
+	MKV_DOC_TYPE              = 0x4282
+	MKV_DOC_TYPE_VERSION      = 0x4287
+	MKV_DOC_TYPE_READ_VERSION = 0x4285
+
+	MKV_SEGMENT       = 0x18538067
+	MKV_SEEK_HEAD     = 0x114D9B74
+	MKV_SEEK          = 0x4DBB
+	MKV_SEEK_ID       = 0x53AB
+	MKV_SEEK_POSITION = 0x53AC
+
+	MKV_INFO            = 0x1549A966
+	MKV_TIMESTAMP_SCALE = 0x2AD7B1
+	MKV_DURATION        = 0x4489
+	MKV_MUXING_APP      = 0x4D80
+	MKV_WRITING_APP     = 0x5741
+
+	MKV_TRACKS             = 0x1654AE6B
+	MKV_TRACK_ENTRY        = 0xAE
+	MKV_TRACK_NUMBER       = 0xD7
+	MKV_TRACK_UID          = 0x73C5
+	MKV_TRACK_TYPE         = 0x83
+	MKV_FLAG_LACING        = 0x9C
+	MKV_LANGUAGE           = 0x22B59C
+	MKV_CODEC_ID           = 0x86
+	MKV_CODEC_PRIVATE      = 0x63A2
+	MKV_DEFAULT_DURATION   = 0x23E383
+	MKV_VIDEO              = 0xE0
+	MKV_PIXEL_WIDTH        = 0xB0
+	MKV_PIXEL_HEIGHT       = 0xBA
+	MKV_DISPLAY_WIDTH      = 0x54B0
+	MKV_DISPLAY_HEIGHT     = 0x54BA
+	MKV_AUDIO              = 0xE1
+	MKV_SAMPLING_FREQUENCY = 0xB5
+	MKV_CHANNELS           = 0x9F
+	MKV_BIT_DEPTH          = 0x6264
+
+	MKV_CLUSTER      = 0x1F43B675
+	MKV_TIMESTAMP    = 0xE7
+	MKV_SIMPLE_BLOCK = 0xA3
+
+	MKV_CUES                 = 0x1C53BB6B
+	MKV_CUE_POINT            = 0xBB
+	MKV_CUE_TIME             = 0xB3
+	MKV_CUE_TRACK_POSITIONS  = 0xB7
+	MKV_CUE_TRACK            = 0xF7
+	MKV_CUE_CLUSTER_POSITION = 0xF1
+)
+
+const (
+	// Longest cluster without a video keyframe, in milliseconds
+	MKV_CLUSTER_DURATION = 5000
+	MKV_TRACK_TYPE_VIDEO = 1
+	MKV_TRACK_TYPE_AUDIO = 2
+)
+
+// Codec ids WebM players accept, the file is written as webm when every
+// track uses one of them.
+var webmCodecs = map[string]bool{"V_VP8": true, "V_VP9": true, "V_AV1": true, "A_VORBIS": true, "A_OPUS": true}
+
+// appendEBMLId appends an element id, its marker bits telling its length.
+func appendEBMLId(buf []byte, id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return append(buf, byte(id>>24), byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<16:
+		return append(buf, byte(id>>16), byte(id>>8), byte(id))
+	case id >= 1<<8:
+		return append(buf, byte(id>>8), byte(id))
+	}
+	return append(buf, byte(id))
+}
+
+// appendEBMLSize appends a data size as the shortest variable size integer.
+func appendEBMLSize(buf []byte, size uint64) []byte {
+	n := 1
+	for n < 8 && size >= 1<<(7*n)-1 { // all ones is reserved for unknown sizes
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size >> (8 * i))
+		if i == n-1 {
+			b |= 0x80 >> (n - 1)
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+// ebmlHeaderSize returns the length of an element header.
+func ebmlHeaderSize(id uint32, size uint64) int64 {
+	return int64(len(appendEBMLSize(appendEBMLId(nil, id), size)))
+}
+
+func appendEBMLElement(buf []byte, id uint32, body []byte) []byte {
+	buf = appendEBMLSize(appendEBMLId(buf, id), uint64(len(body)))
+	return append(buf, body...)
+}
+
+func appendEBMLUint(buf []byte, id uint32, v uint64) []byte {
+	body := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		body = append([]byte{byte(v)}, body...)
+	}
+	return appendEBMLElement(buf, id, body)
+}
+
+func appendEBMLFloat(buf []byte, id uint32, v float64) []byte {
+	return appendEBMLElement(buf, id, binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
+
+func appendEBMLString(buf []byte, id uint32, s string) []byte {
+	return appendEBMLElement(buf, id, []byte(s))
+}
+
+// mkvCodec returns the Matroska codec id and CodecPrivate of entry.
+func mkvCodec(entry *SampleEntry) (codec string, private []byte, err error) {
+	switch {
+	case entry == nil:
+		return "", nil, fmt.Errorf("No sample description")
+	case entry.Avcc != nil:
+		return "V_MPEG4/ISO/AVC", entry.Avcc.payload(), nil
+	case entry.Hvcc != nil:
+		return "V_MPEGH/ISO/HEVC", entry.Hvcc.payload(), nil
+	case entry.Av1c != nil:
+		return "V_AV1", entry.Av1c.payload(), nil
+	case entry.Vpcc != nil:
+		return "V_VP9", nil, nil
+	case entry.Dops != nil:
+		return "A_OPUS", entry.Dops.OpusHead(), nil
+	case entry.Dac3 != nil:
+		return "A_AC3", nil, nil
+	case entry.Dec3 != nil:
+		return "A_EAC3", nil, nil
+	case entry.Esds != nil:
+		switch entry.Esds.Object_type_indication {
+		case 0x40, 0x66, 0x67, 0x68:
+			return "A_AAC", entry.Esds.Decoder_specific_info, nil
+		case 0x69, 0x6b:
+			return "A_MPEG/L3", nil, nil
+		}
+		return "", nil, fmt.Errorf("Object type 0x%02x cannot be written to Matroska", entry.Esds.Object_type_indication)
+	}
+	return "", nil, fmt.Errorf("%v cannot be written to Matroska", entry.Name)
+}
+
+// mkvTrack is a track written as Matroska blocks.
+type mkvTrack struct {
+	trak    *TrakBox
+	number  int
+	video   bool
+	codec   string
+	private []byte
+}
+
+// entry returns the TrackEntry element of the track.
+func (t *mkvTrack) entry() []byte {
+	sample_entry := t.trak.GetSampleEntry(1)
+	body := appendEBMLUint(nil, MKV_TRACK_NUMBER, uint64(t.number))
+	body = appendEBMLUint(body, MKV_TRACK_UID, uint64(t.number))
+	kind := uint64(MKV_TRACK_TYPE_AUDIO)
+	if t.video {
+		kind = MKV_TRACK_TYPE_VIDEO
+	}
+	body = appendEBMLUint(body, MKV_TRACK_TYPE, kind)
+	body = appendEBMLUint(body, MKV_FLAG_LACING, 0)
+	lang := manifestLanguage(t.trak)
+	if lang == "" {
+		lang = "und"
+	}
+	body = appendEBMLString(body, MKV_LANGUAGE, lang)
+	body = appendEBMLString(body, MKV_CODEC_ID, t.codec)
+	if len(t.private) > 0 {
+		body = appendEBMLElement(body, MKV_CODEC_PRIVATE, t.private)
+	}
+
+	if t.video {
+		// Constant frame rate
+		samples := t.trak.Samples
+		constant := len(samples) > 1
+		for _, s := range samples {
+			constant = constant && s.Duration == samples[0].Duration
+		}
+		if constant && samples[0].Duration > 0 {
+			body = appendEBMLUint(body, MKV_DEFAULT_DURATION, uint64(samples[0].Duration)*1e9/uint64(t.trak.Mdia.Mdhd.Timescale))
+		}
+		video := appendEBMLUint(nil, MKV_PIXEL_WIDTH, uint64(sample_entry.Width))
+		video = appendEBMLUint(video, MKV_PIXEL_HEIGHT, uint64(sample_entry.Height))
+		if pasp := sample_entry.Pasp; pasp != nil && pasp.H_spacing > 0 && pasp.V_spacing > 0 && pasp.H_spacing != pasp.V_spacing {
+			video = appendEBMLUint(video, MKV_DISPLAY_WIDTH, uint64(sample_entry.Width)*uint64(pasp.H_spacing)/uint64(pasp.V_spacing))
+			video = appendEBMLUint(video, MKV_DISPLAY_HEIGHT, uint64(sample_entry.Height))
+		}
+		return appendEBMLElement(nil, MKV_TRACK_ENTRY, appendEBMLElement(body, MKV_VIDEO, video))
+	}
+
+	rate := float64(uint32(sample_entry.Sample_rate) >> 16)
+	if sample_entry.Esds != nil {
+		if asc, err := sample_entry.Esds.AudioSpecificConfig(); err == nil && asc.Sampling_frequency > 0 {
+			rate = float64(asc.Sampling_frequency)
+		}
+	}
+	audio := appendEBMLFloat(nil, MKV_SAMPLING_FREQUENCY, rate)
+	audio = appendEBMLUint(audio, MKV_CHANNELS, uint64(audioChannels(sample_entry)))
+	if sample_entry.Sample_size > 0 {
+		audio = appendEBMLUint(audio, MKV_BIT_DEPTH, uint64(sample_entry.Sample_size))
+	}
+	return appendEBMLElement(nil, MKV_TRACK_ENTRY, appendEBMLElement(body, MKV_AUDIO, audio))
+}
+
+// mkvBlock is a sample written as a SimpleBlock.
+type mkvBlock struct {
+	track    *mkvTrack
+	dts, pts int64 // milliseconds
+	Sample
+}
+
+// size returns the length of the SimpleBlock element.
+func (b *mkvBlock) size() int64 {
+	body := uint64(4 + b.Size) // track number, relative timestamp and flags
+	return ebmlHeaderSize(MKV_SIMPLE_BLOCK, body) + int64(body)
+}
+
+// mkvCluster is a run of blocks starting at a video keyframe when there is
+// a video track.
+type mkvCluster struct {
+	time     int64
+	blocks   []mkvBlock
+	keyframe bool
+	offset   int64 // from the start of the segment data
+}
+
+// header returns the cluster element header and its Timestamp element.
+func (c *mkvCluster) header() []byte {
+	timestamp := appendEBMLUint(nil, MKV_TIMESTAMP, uint64(c.time))
+	size := int64(len(timestamp))
+	for i := range c.blocks {
+		size += c.blocks[i].size()
+	}
+	buf := appendEBMLSize(appendEBMLId(nil, MKV_CLUSTER), uint64(size))
+	return append(buf, timestamp...)
+}
+
+// size returns the length of the cluster element.
+func (c *mkvCluster) size() int64 {
+	size := int64(len(c.header()))
+	for i := range c.blocks {
+		size += c.blocks[i].size()
+	}
+	return size
+}
+
+// WriteMKV remuxes the given tracks, or every audio and video track
+// Matroska can carry if traks is nil, into a Matroska file, or WebM if
+// every codec allows it. Clusters start at the keyframes of the first video
+// track and are indexed by Cues at the end of the segment. Timestamps are
+// in milliseconds.
+func (f *File) WriteMKV(w io.Writer, traks []int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	explicit := traks != nil
+	if !explicit {
+		traks = f.mediaTraks(false)
+	} else if err := f.checkTraks(traks); err != nil {
+		return err
+	}
+	tracks := []*mkvTrack{}
+	var lead *mkvTrack // the first video track, clusters follow its keyframes
+	doc_type := "webm"
+	for _, i := range traks {
+		trak := f.Moov.Traks[i]
+		codec, private, err := mkvCodec(trak.GetSampleEntry(1))
+		if err == nil && len(trak.Samples) == 0 {
+			err = fmt.Errorf("no samples")
+		}
+		if err != nil {
+			if explicit {
+				return fmt.Errorf("Track %d: %v", i, err)
+			}
+			logf("Track %d skipped: %v\n", i, err)
+			continue
+		}
+		for n, entry := range trak.Mdia.Minf.Stbl.Stsd.Entries[1:] {
+			other, other_private, _ := mkvCodec(entry)
+			if other != codec {
+				return fmt.Errorf("Track %d: sample descriptions of different codecs", i)
+			}
+			if !bytes.Equal(other_private, private) {
+				logf("Track %d: sample description %d has another CodecPrivate, Matroska keeps the first one\n", i, n+2)
+			}
+		}
+		t := &mkvTrack{trak: trak, number: len(tracks) + 1, video: trak.GetHandlerType() == "vide", codec: codec, private: private}
+		if t.video && lead == nil {
+			lead = t
+		}
+		if !webmCodecs[codec] {
+			doc_type = "matroska"
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("No track Matroska can carry")
+	}
+
+	// Blocks in decoding order, timed so that none is presented before 0
+	blocks := []mkvBlock{}
+	shift := int64(0)
+	for _, t := range tracks {
+		scale := float64(t.trak.Mdia.Mdhd.Timescale)
+		media_time := t.trak.GetMediaTime()
+		ms := func(v int64) int64 { return int64(math.Round(float64(v-media_time) * 1000 / scale)) }
+		for _, s := range t.trak.Samples {
+			b := mkvBlock{t, ms(int64(s.Start_time)), ms(int64(s.Start_time) + int64(int32(s.Cto))), s}
+			if -b.pts > shift {
+				shift = -b.pts
+			}
+			blocks = append(blocks, b)
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool { return blocks[i].dts < blocks[j].dts })
+
+	clusters := []*mkvCluster{}
+	var c *mkvCluster
+	for _, b := range blocks {
+		b.pts += shift
+		keyframe := b.track == lead && b.Sync
+		if c != nil {
+			relative := b.pts - c.time
+			switch {
+			case relative < math.MinInt16 || relative > math.MaxInt16:
+				c = nil
+			case keyframe && len(c.blocks) > 0:
+				c = nil
+			case lead == nil && relative >= MKV_CLUSTER_DURATION:
+				c = nil
+			}
+		}
+		if c == nil {
+			c = &mkvCluster{time: b.pts, keyframe: keyframe || lead == nil}
+			clusters = append(clusters, c)
+		}
+		c.blocks = append(c.blocks, b)
+	}
+
+	// Segment layout: SeekHead, Info, Tracks, Clusters, Cues
+	info := appendEBMLUint(nil, MKV_TIMESTAMP_SCALE, 1000000)
+	info = appendEBMLString(info, MKV_MUXING_APP, "mp4reader")
+	info = appendEBMLString(info, MKV_WRITING_APP, "mp4reader")
+	if mvhd := f.Moov.Mvhd; mvhd != nil && mvhd.Timescale > 0 {
+		info = appendEBMLFloat(info, MKV_DURATION, float64(mvhd.Duration)*1000/float64(mvhd.Timescale))
+	}
+	info = appendEBMLElement(nil, MKV_INFO, info)
+	track_entries := []byte{}
+	for _, t := range tracks {
+		track_entries = append(track_entries, t.entry()...)
+	}
+	track_entries = appendEBMLElement(nil, MKV_TRACKS, track_entries)
+
+	seek := func(positions []int64) []byte {
+		body := []byte{}
+		for i, id := range []uint32{MKV_INFO, MKV_TRACKS, MKV_CUES} {
+			entry := appendEBMLElement(nil, MKV_SEEK_ID, appendEBMLId(nil, id))
+			// Fixed length positions keep the SeekHead size known up front
+			entry = appendEBMLElement(entry, MKV_SEEK_POSITION, binary.BigEndian.AppendUint64(nil, uint64(positions[i])))
+			body = appendEBMLElement(body, MKV_SEEK, entry)
+		}
+		return appendEBMLElement(nil, MKV_SEEK_HEAD, body)
+	}
+	pos := int64(len(seek([]int64{0, 0, 0})))
+	info_pos := pos
+	pos += int64(len(info))
+	tracks_pos := pos
+	pos += int64(len(track_entries))
+	for _, c := range clusters {
+		c.offset = pos
+		pos += c.size()
+	}
+	cues := []byte{}
+	for _, c := range clusters {
+		if !c.keyframe {
+			continue
+		}
+		number := uint64(1)
+		if lead != nil {
+			number = uint64(lead.number)
+		}
+		positions := appendEBMLUint(nil, MKV_CUE_TRACK, number)
+		positions = appendEBMLUint(positions, MKV_CUE_CLUSTER_POSITION, uint64(c.offset))
+		point := appendEBMLUint(nil, MKV_CUE_TIME, uint64(c.time))
+		point = appendEBMLElement(point, MKV_CUE_TRACK_POSITIONS, positions)
+		cues = appendEBMLElement(cues, MKV_CUE_POINT, point)
+	}
+	cues = appendEBMLElement(nil, MKV_CUES, cues)
+	cues_pos := pos
+	pos += int64(len(cues))
+
+	header := appendEBMLUint(nil, MKV_EBML_VERSION, 1)
+	header = appendEBMLUint(header, MKV_EBML_READ_VERSION, 1)
+	header = appendEBMLUint(header, MKV_EBML_MAX_ID_LENGTH, 4)
+	header = appendEBMLUint(header, MKV_EBML_MAX_SIZE_LENGTH, 8)
+	header = appendEBMLString(header, MKV_DOC_TYPE, doc_type)
+	header = appendEBMLUint(header, MKV_DOC_TYPE_VERSION, 4)
+	header = appendEBMLUint(header, MKV_DOC_TYPE_READ_VERSION, 2)
+	head := appendEBMLElement(nil, MKV_EBML, header)
+	head = appendEBMLSize(appendEBMLId(head, MKV_SEGMENT), uint64(pos))
+	head = append(head, seek([]int64{info_pos, tracks_pos, cues_pos})...)
+	head = append(head, info...)
+	head = append(head, track_entries...)
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+
+	for _, c := range clusters {
+		if _, err := w.Write(c.header()); err != nil {
+			return err
+		}
+		for _, b := range c.blocks {
+			data := make([]byte, b.Size)
+			if _, err := f.ReadAt(data, int64(b.Offset)); err != nil {
+				return fmt.Errorf("Reading sample at %d: %v", b.Offset, err)
+			}
+			flags := byte(0)
+			if b.Sync {
+				flags = 0x80
+			}
+			relative := b.pts - c.time
+			block := appendEBMLSize(appendEBMLId(nil, MKV_SIMPLE_BLOCK), uint64(4+len(data)))
+			block = append(block, 0x80|byte(b.track.number), byte(relative>>8), byte(relative), flags)
+			if _, err := w.Write(append(block, data...)); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.Write(cues)
+	return err
+}
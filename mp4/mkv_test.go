@@ -0,0 +1,192 @@
+package mp4
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// ebmlElement is an element read back from a Matroska file, offset is that
+// of its header.
+type ebmlElement struct {
+	id     uint32
+	offset int
+	data   []byte
+}
+
+// readEBMLVint reads a variable size integer, keeping the marker bits when
+// marker is set as element ids do.
+func readEBMLVint(data []byte, marker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	n := 1
+	for data[0]&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if len(data) < n {
+		return 0, 0
+	}
+	v := uint64(data[0])
+	if !marker {
+		v &^= 0x80 >> (n - 1)
+	}
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, n
+}
+
+// readEBML splits data into its elements, offsets counted from base.
+func readEBML(t *testing.T, data []byte, base int) []ebmlElement {
+	t.Helper()
+	elements := []ebmlElement{}
+	for pos := 0; pos < len(data); {
+		id, n := readEBMLVint(data[pos:], true)
+		size, m := readEBMLVint(data[pos+n:], false)
+		if n == 0 || m == 0 || pos+n+m+int(size) > len(data) {
+			t.Fatalf("Bad element at %d: %x", base+pos, data[pos:])
+		}
+		elements = append(elements, ebmlElement{uint32(id), base + pos, data[pos+n+m : pos+n+m+int(size)]})
+		pos += n + m + int(size)
+	}
+	return elements
+}
+
+func ebmlUint(data []byte) (v uint64) {
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func TestEBMLEncoding(t *testing.T) {
+	sizes := []struct {
+		size uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xfe}},
+		{127, []byte{0x40, 0x7f}}, // 0xff would be an unknown size
+		{16382, []byte{0x7f, 0xfe}},
+		{16383, []byte{0x20, 0x3f, 0xff}},
+		{1 << 21, []byte{0x10, 0x20, 0x00, 0x00}},
+	}
+	for _, tt := range sizes {
+		if got := appendEBMLSize(nil, tt.size); !bytes.Equal(got, tt.want) {
+			t.Errorf("Size %d written %x, want %x", tt.size, got, tt.want)
+		}
+	}
+	ids := []struct {
+		id   uint32
+		want []byte
+	}{
+		{MKV_SIMPLE_BLOCK, []byte{0xa3}},
+		{MKV_EBML_VERSION, []byte{0x42, 0x86}},
+		{MKV_TIMESTAMP_SCALE, []byte{0x2a, 0xd7, 0xb1}},
+		{MKV_EBML, []byte{0x1a, 0x45, 0xdf, 0xa3}},
+	}
+	for _, tt := range ids {
+		if got := appendEBMLId(nil, tt.id); !bytes.Equal(got, tt.want) {
+			t.Errorf("Id %x written %x, want %x", tt.id, got, tt.want)
+		}
+	}
+	if got := appendEBMLUint(nil, MKV_TRACK_NUMBER, 0); !bytes.Equal(got, []byte{0xd7, 0x81, 0}) {
+		t.Errorf("Uint 0 written %x", got)
+	}
+	if got := appendEBMLUint(nil, MKV_TIMESTAMP, 0x1234); !bytes.Equal(got, []byte{0xe7, 0x82, 0x12, 0x34}) {
+		t.Errorf("Uint 0x1234 written %x", got)
+	}
+}
+
+func TestWriteMKV(t *testing.T) {
+	video, audio, cto, data := testH264AACFile()
+	out := &bytes.Buffer{}
+	if err := openBytes(t, data).WriteMKV(out, nil); err != nil {
+		t.Fatalf("WriteMKV: %v", err)
+	}
+	top := readEBML(t, out.Bytes(), 0)
+	if len(top) != 2 || top[0].id != MKV_EBML || top[1].id != MKV_SEGMENT {
+		t.Fatalf("Top level elements %+v", top)
+	}
+	for _, e := range readEBML(t, top[0].data, 0) {
+		if e.id == MKV_DOC_TYPE && string(e.data) != "matroska" {
+			t.Errorf("DocType %q, want matroska", e.data)
+		}
+	}
+
+	// Positions are relative to the start of the segment data
+	segment := readEBML(t, top[1].data, 0)
+	at := map[int]uint32{}
+	clusters := []ebmlElement{}
+	for _, e := range segment {
+		at[e.offset] = e.id
+		if e.id == MKV_CLUSTER {
+			clusters = append(clusters, e)
+		}
+	}
+	if segment[0].id != MKV_SEEK_HEAD {
+		t.Fatalf("Segment starts with %x", segment[0].id)
+	}
+	for _, seek := range readEBML(t, segment[0].data, 0) {
+		fields := readEBML(t, seek.data, 0)
+		id, pos := uint32(ebmlUint(fields[0].data)), int(ebmlUint(fields[1].data))
+		if at[pos] != id {
+			t.Errorf("SeekHead points %x at %d, found %x", id, pos, at[pos])
+		}
+	}
+
+	// Clusters start at the video keyframes, timestamps in milliseconds
+	ms := func(v, timescale int64) int64 { return int64(math.Round(float64(v) * 1000 / float64(timescale))) }
+	blocks := map[byte][][]byte{}
+	times := []int64{}
+	for i, c := range clusters {
+		elements := readEBML(t, c.data, 0)
+		time := int64(ebmlUint(elements[0].data))
+		times = append(times, time)
+		for j, e := range elements[1:] {
+			track, relative, flags := e.data[0]&0x7f, int64(int16(uint16(e.data[1])<<8|uint16(e.data[2]))), e.data[3]
+			n := len(blocks[track])
+			var pts int64
+			var sync bool
+			if track == 1 {
+				pts, sync = ms(int64(n*3000+int(cto[n])-3000), 90000), n%5 == 0
+			} else {
+				pts, sync = ms(int64(n*1024), 48000), true
+			}
+			if time+relative != pts || (flags&0x80 != 0) != sync {
+				t.Errorf("Cluster %d block %d, track %d sample %d: pts %d flags %x, want %d %v", i, j, track, n, time+relative, flags, pts, sync)
+			}
+			if j == 0 && (track != 1 || !sync) {
+				t.Errorf("Cluster %d starts with track %d sample %d", i, track, n)
+			}
+			blocks[track] = append(blocks[track], e.data[4:])
+		}
+	}
+	if len(times) != 2 || times[0] != 0 || times[1] != 167 {
+		t.Errorf("Cluster times %v, want [0 167]", times)
+	}
+	for track, want := range map[byte][][]byte{1: video, 2: audio} {
+		if got := blocks[track]; !bytes.Equal(bytes.Join(got, nil), bytes.Join(want, nil)) || len(got) != len(want) {
+			t.Errorf("Track %d: %d blocks, want %d samples", track, len(got), len(want))
+		}
+	}
+
+	// One cue per cluster, pointing at it
+	cues := segment[len(segment)-1]
+	if cues.id != MKV_CUES {
+		t.Fatalf("Segment ends with %x", cues.id)
+	}
+	points := readEBML(t, cues.data, 0)
+	if len(points) != len(clusters) {
+		t.Fatalf("%d cue points for %d clusters", len(points), len(clusters))
+	}
+	for i, p := range points {
+		fields := readEBML(t, p.data, 0)
+		positions := readEBML(t, fields[1].data, 0)
+		time, track, pos := int64(ebmlUint(fields[0].data)), ebmlUint(positions[0].data), int(ebmlUint(positions[1].data))
+		if time != times[i] || track != 1 || pos != clusters[i].offset {
+			t.Errorf("Cue %d: time %d track %d at %d, want %d 1 at %d", i, time, track, pos, times[i], clusters[i].offset)
+		}
+	}
+}
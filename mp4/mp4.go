@@ -12,7 +12,7 @@ const (
 
 func Open(path string) (f *File, err error) {
 	// fmt.Println(flag.Args())
-	fmt.Println(path)
+	logln(path)
 
 	file, err := os.OpenFile(path, os.O_RDONLY, 0400)
 	if err != nil {
@@ -20,6 +20,14 @@ func Open(path string) (f *File, err error) {
 		return nil, err
 	}
 
+	if isTS(file) {
+		logln("MPEG-TS input, remuxing to MP4")
+		if file, err = remuxTS(file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, err
+		}
+	}
+
 	f = &File{
 		File: file,
 	}
@@ -27,18 +35,42 @@ func Open(path string) (f *File, err error) {
 	return f, f.parse()
 }
 
+// isTS reports whether the file starts with two MPEG-TS packets.
+func isTS(file *os.File) bool {
+	buf := make([]byte, TS_PACKET_SIZE+1)
+	n, _ := file.ReadAt(buf, 0)
+	return n == len(buf) && buf[0] == TS_SYNC_BYTE && buf[TS_PACKET_SIZE] == TS_SYNC_BYTE
+}
+
+// remuxTS closes a transport stream file and returns an unlinked temporary
+// file holding its streams as MP4, so that it is read like any other input.
+func remuxTS(file *os.File) (*os.File, error) {
+	defer file.Close()
+	tmp, err := os.CreateTemp("", "mp4reader-*.mp4")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	if err = MuxTS(file, tmp); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("%v: %v", file.Name(), err)
+	}
+	return tmp, nil
+}
+
 func (f *File) parse() error {
 	info, err := f.Stat()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
-	fmt.Printf("File size: %v \n", info.Size)
+	logf("File size: %v \n", info.Size())
 	f.Size = info.Size()
 
 	// Loop through top-level Boxes
 	boxes := readBoxes(f, int64(0), f.Size)
 	for box := range boxes {
+		f.boxes = append(f.boxes, box)
 		switch box.Name {
 		case "ftyp":
 			f.Ftyp = &FtypBox{Box: box}
@@ -47,24 +79,32 @@ func (f *File) parse() error {
 			f.Moov = &MoovBox{Box: box}
 			f.Moov.parse()
 		case "mdat":
-			f.Mdat = box
+			if f.Mdat == nil {
+				f.Mdat = box
+			}
+		case "moof":
+			moof := &MoofBox{Box: box}
+			if err := moof.parse(); err != nil {
+				logln(err)
+			}
+			f.Moofs = append(f.Moofs, moof)
 		default:
-			fmt.Printf("Unhandled Box: %v \n", box.Name)
+			logf("Unhandled Box: %v \n", box.Name)
 		}
 	}
 
-	// Make sure we have all 3 required boxes
-	if f.Ftyp == nil || f.Moov == nil || f.Mdat == nil {
+	// Make sure we have all 3 required boxes, an init segment has no mdat
+	if f.Ftyp == nil || f.Moov == nil || f.Mdat == nil && f.Moov.Mvex == nil {
 		return fmt.Errorf("Missing a required box (ftyp, moov, or mdat)")
 	}
 
 	// Build chunk & sample tables
-	fmt.Println("Building trak tables...")
+	logln("Building trak tables...")
 	if err = f.buildTrakTables(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return err
 	}
-	fmt.Println("Chunk and Sample tables built.")
+	logln("Chunk and Sample tables built.")
 
 	return nil
 }
@@ -84,95 +124,180 @@ func (f *File) GetSample(index int) []Sample {
 	return f.Moov.GetTraks()[index].GetSample()
 }
 
-func (f *File) buildTrakTables() error {
-	for _, trak := range f.Moov.Traks {
-		trak.Chunks = make([]Chunk, trak.Mdia.Minf.Stbl.Stco.Entry_count)
-		for i, offset := range trak.Mdia.Minf.Stbl.Stco.Chunk_offset {
-			trak.Chunks[i].Offset = offset
+func (f *File) buildTrakTables() (err error) {
+	for i, trak := range f.Moov.Traks {
+		if missing := trak.missingTables(); missing != "" {
+			// Keep going so the other tracks stay usable, report the first problem
+			if err == nil {
+				err = fmt.Errorf("Track %d is missing the %v box", i, missing)
+			}
+			continue
+		}
+		trak.buildTables()
+	}
+	if len(f.Moofs) > 0 {
+		if e := f.addFragmentSamples(); err == nil {
+			err = e
 		}
+	}
+	return err
+}
+
+// missingTables returns the name of the first box required to build the
+// chunk and sample tables that the track lacks, or "" if it has all of them.
+func (b *TrakBox) missingTables() string {
+	switch {
+	case b.Mdia == nil:
+		return "mdia"
+	case b.Mdia.Mdhd == nil:
+		return "mdhd"
+	case b.Mdia.Minf == nil:
+		return "minf"
+	case b.Mdia.Minf.Stbl == nil:
+		return "stbl"
+	case b.Mdia.Minf.Stbl.Stts == nil:
+		return "stts"
+	case b.Mdia.Minf.Stbl.Stsc == nil:
+		return "stsc"
+	case b.Mdia.Minf.Stbl.Stsz == nil:
+		return "stsz"
+	case b.Mdia.Minf.Stbl.Stco == nil:
+		return "stco"
+	}
+	return ""
+}
 
-		sample_num := uint32(1)
-		next_chunk_id := 1
-		for i := 0; i < int(trak.Mdia.Minf.Stbl.Stsc.Entry_count); i++ {
-			if i+1 < int(trak.Mdia.Minf.Stbl.Stsc.Entry_count) {
-				next_chunk_id = int(trak.Mdia.Minf.Stbl.Stsc.First_chunk[i+1])
-			} else {
-				next_chunk_id = len(trak.Chunks)
-			}
-			first_chunk_id := trak.Mdia.Minf.Stbl.Stsc.First_chunk[i]
-			n_samples := trak.Mdia.Minf.Stbl.Stsc.Samples_per_chunk[i]
-			sdi := trak.Mdia.Minf.Stbl.Stsc.Sample_description_index[i]
-			for j := int(first_chunk_id - 1); j < next_chunk_id; j++ {
-				trak.Chunks[j].Sample_count = n_samples
-				trak.Chunks[j].Sample_description_index = sdi
-				trak.Chunks[j].Start_sample = sample_num
-				sample_num += n_samples
+// buildTables fills in Chunks and Samples from the sample tables. Entries
+// which are inconsistent with each other are ignored rather than trusted.
+func (b *TrakBox) buildTables() {
+	stbl := b.Mdia.Minf.Stbl
+	b.Chunks = make([]Chunk, len(stbl.Stco.Chunk_offset))
+	for i, offset := range stbl.Stco.Chunk_offset {
+		b.Chunks[i].Offset = offset
+	}
+
+	sample_num := uint32(1)
+	next_chunk_id := 1
+	for i := 0; i < len(stbl.Stsc.First_chunk); i++ {
+		// next_chunk_id is the 0-based index of the first chunk of the next entry
+		if i+1 < len(stbl.Stsc.First_chunk) {
+			next_chunk_id = int(stbl.Stsc.First_chunk[i+1]) - 1
+		} else {
+			next_chunk_id = len(b.Chunks)
+		}
+		if next_chunk_id > len(b.Chunks) {
+			next_chunk_id = len(b.Chunks)
+		}
+		first_chunk_id := stbl.Stsc.First_chunk[i]
+		n_samples := stbl.Stsc.Samples_per_chunk[i]
+		sdi := stbl.Stsc.Sample_description_index[i]
+		for j := int(first_chunk_id) - 1; j < next_chunk_id; j++ {
+			if j < 0 {
+				continue
 			}
+			b.Chunks[j].Sample_count = n_samples
+			b.Chunks[j].Sample_description_index = sdi
+			b.Chunks[j].Start_sample = sample_num
+			sample_num += n_samples
 		}
+	}
 
-		sample_count := int(trak.Mdia.Minf.Stbl.Stsz.Sample_count)
-		trak.Samples = make([]Sample, sample_count)
-		sample_size := trak.Mdia.Minf.Stbl.Stsz.Sample_size
-		for i := 0; i < sample_count; i++ {
-			if sample_size == uint32(0) {
-				trak.Samples[i].Size = trak.Mdia.Minf.Stbl.Stsz.Entry_size[i]
-			} else {
-				trak.Samples[i].Size = sample_size
-			}
+	sample_count := int(stbl.Stsz.Sample_count)
+	sample_size := stbl.Stsz.Sample_size
+	if sample_size == uint32(0) && len(stbl.Stsz.Entry_size) < sample_count {
+		sample_count = len(stbl.Stsz.Entry_size)
+	}
+	b.Samples = make([]Sample, sample_count)
+	for i := 0; i < sample_count; i++ {
+		if sample_size == uint32(0) {
+			b.Samples[i].Size = stbl.Stsz.Entry_size[i]
+		} else {
+			b.Samples[i].Size = sample_size
 		}
+	}
 
-		// Calculate file offset for each sample
-		sample_id := 0
-		for i := 0; i < len(trak.Chunks); i++ {
-			sample_offset := trak.Chunks[i].Offset
-			for j := 0; j < int(trak.Chunks[i].Sample_count); j++ {
-				sample_offset += trak.Samples[sample_id].Size
-				sample_id++
-			}
+	// Calculate file offset and chunk for each sample
+	sample_id := 0
+	for i := 0; i < len(b.Chunks); i++ {
+		sample_offset := b.Chunks[i].Offset
+		for j := 0; j < int(b.Chunks[i].Sample_count) && sample_id < sample_count; j++ {
+			b.Samples[sample_id].Offset = sample_offset
+			b.Samples[sample_id].Chunk = uint32(i + 1)
+			b.Samples[sample_id].Sample_description_index = b.Chunks[i].Sample_description_index
+			sample_offset += uint64(b.Samples[sample_id].Size)
+			sample_id++
 		}
+	}
 
-		// Calculate decoding time for each sample
-		sample_id, sample_time := 0, uint32(0)
-		for i := 0; i < int(trak.Mdia.Minf.Stbl.Stts.Entry_count); i++ {
-			sample_duration := trak.Mdia.Minf.Stbl.Stts.Sample_delta[i]
-			for j := 0; j < int(trak.Mdia.Minf.Stbl.Stts.Sample_count[i]); j++ {
-				trak.Samples[sample_id].Start_time = sample_time
-				trak.Samples[sample_id].Duration = sample_duration
-				sample_time += sample_duration
-				sample_id++
+	// Mark sync samples; every sample is a sync sample if there is no stss
+	if stbl.Stss != nil {
+		for _, n := range stbl.Stss.Sample_number {
+			if n >= 1 && int(n) <= sample_count {
+				b.Samples[n-1].Sync = true
 			}
 		}
-		// Calculate decoding to composition time offset, if ctts table exists
-		if trak.Mdia.Minf.Stbl.Ctts != nil {
-			sample_id = 0
-			for i := 0; i < int(trak.Mdia.Minf.Stbl.Ctts.Entry_count); i++ {
-				count := int(trak.Mdia.Minf.Stbl.Ctts.Sample_count[i])
-				cto := trak.Mdia.Minf.Stbl.Ctts.Sample_offset[i]
-				for j := 0; j < count; j++ {
-					trak.Samples[sample_id].Cto = cto
-					sample_id++
-				}
+	} else {
+		for i := range b.Samples {
+			b.Samples[i].Sync = true
+		}
+	}
+
+	// Calculate decoding time for each sample
+	sample_id, sample_time := 0, uint32(0)
+	for i := 0; i < len(stbl.Stts.Sample_count); i++ {
+		sample_duration := stbl.Stts.Sample_delta[i]
+		for j := 0; j < int(stbl.Stts.Sample_count[i]) && sample_id < sample_count; j++ {
+			b.Samples[sample_id].Start_time = sample_time
+			b.Samples[sample_id].Duration = sample_duration
+			sample_time += sample_duration
+			sample_id++
+		}
+	}
+	// Calculate decoding to composition time offset, if ctts table exists
+	if stbl.Ctts != nil {
+		sample_id = 0
+		for i := 0; i < len(stbl.Ctts.Sample_count); i++ {
+			count := int(stbl.Ctts.Sample_count[i])
+			cto := stbl.Ctts.Sample_offset[i]
+			for j := 0; j < count && sample_id < sample_count; j++ {
+				b.Samples[sample_id].Cto = cto
+				sample_id++
 			}
 		}
 	}
-	return nil
 }
 
 func readBoxes(f *File, start int64, n int64) (boxes chan *Box) {
 	boxes = make(chan *Box, 100)
 	go func() {
-		for offset := start; offset < start+n; {
-			size, name := f.ReadBoxAt(offset)
-			fmt.Printf("Box found:\nType: %v \nSize (bytes): %v \n", name, size)
+		for offset := start; offset+BOX_HEADER_SIZE <= start+n; {
+			size32, name := f.ReadBoxAt(offset)
+			size := int64(size32)
+			switch size32 {
+			case 1:
+				// 64-bit largesize follows the type
+				if large := f.ReadBytesAt(8, offset+BOX_HEADER_SIZE); len(large) == 8 {
+					size = int64(binary.BigEndian.Uint64(large))
+				}
+			case 0:
+				// The box extends to the end of its container
+				size = start + n - offset
+			}
+			logf("Box found:\nType: %v \nSize (bytes): %v \n", name, size)
+			if size < BOX_HEADER_SIZE {
+				// Padding or a truncated box; nothing sensible follows.
+				logf("Invalid box size %v at %v, stop reading\n", size, offset)
+				break
+			}
 
 			box := &Box{
 				Name:  name,
-				Size:  int64(size),
+				Size:  size,
 				Start: offset,
 				File:  f,
 			}
 			boxes <- box
-			offset += int64(size)
+			offset += size
 		}
 		close(boxes)
 	}()
@@ -185,10 +310,13 @@ func readSubBoxes(f *File, start int64, n int64) (boxes chan *Box) {
 
 type File struct {
 	*os.File
-	Ftyp *FtypBox
-	Moov *MoovBox
-	Mdat *Box
-	Size int64
+	Ftyp  *FtypBox
+	Moov  *MoovBox
+	Mdat  *Box // the first mdat box
+	Moofs []*MoofBox
+	Size  int64
+
+	boxes []*Box // top-level boxes in file order
 }
 
 func (f *File) ReadBoxAt(offset int64) (boxSize uint32, boxType string) {
@@ -204,7 +332,7 @@ func (f *File) ReadBoxAt(offset int64) (boxSize uint32, boxType string) {
 func (f *File) ReadBytesAt(n int64, offset int64) (word []byte) {
 	buf := make([]byte, n)
 	if _, error := f.ReadAt(buf, offset); error != nil {
-		fmt.Println(error)
+		logln(error)
 		return
 	}
 	return buf
@@ -222,6 +350,8 @@ type Box struct {
 	Name        string
 	Size, Start int64
 	File        *File
+
+	children []*Box // sub-boxes in file order, filled in by the container parsers
 }
 
 // func (b *Box) Name() string { return b.Name }
@@ -233,7 +363,7 @@ type Box struct {
 // func (b *Box) Start() int64 { return b.Start }
 
 func (b *Box) parse() error {
-	fmt.Printf("Default parser called; skip parsing. (%v)\n", b.Name)
+	logf("Default parser called; skip parsing. (%v)\n", b.Name)
 	return nil
 }
 
@@ -266,6 +396,7 @@ type MoovBox struct {
 	Mvhd  *MvhdBox
 	Iods  *IodsBox
 	Traks []*TrakBox
+	Mvex  *MvexBox
 	Udta  *UdtaBox
 }
 
@@ -276,6 +407,7 @@ func (b *MoovBox) GetTraks() []*TrakBox {
 func (b *MoovBox) parse() error {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "mvhd":
 			b.Mvhd = &MvhdBox{Box: subBox}
@@ -287,11 +419,14 @@ func (b *MoovBox) parse() error {
 			trak := &TrakBox{Box: subBox}
 			trak.parse()
 			b.Traks = append(b.Traks, trak)
+		case "mvex":
+			b.Mvex = &MvexBox{Box: subBox}
+			b.Mvex.parse()
 		case "udta":
 			b.Udta = &UdtaBox{Box: subBox}
 			b.Udta.parse()
 		default:
-			fmt.Printf("Unhandled Moov Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Moov Sub-Box: %v \n", subBox.Name)
 		}
 	}
 	return nil
@@ -299,34 +434,61 @@ func (b *MoovBox) parse() error {
 
 type MvhdBox struct {
 	*Box
-	Version                                                              uint8
-	Flags                                                                [3]byte
-	Creation_time, Modification_time, Timescale, Duration, Next_track_id uint32
-	Rate                                                                 Fixed32
-	Volume                                                               Fixed16
-	Other_data                                                           []byte
+	Version                                    uint8
+	Flags                                      [3]byte
+	Creation_time, Modification_time, Duration uint64 // 64-bit in version 1
+	Timescale, Next_track_id                   uint32
+	Rate                                       Fixed32
+	Volume                                     Fixed16
+	Other_data                                 []byte
 }
 
 func (b *MvhdBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 4 || len(data) < 26+versionedSize(data[0], 3) {
+		return fmt.Errorf("mvhd box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
-	b.Creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.Modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.Timescale = binary.BigEndian.Uint32(data[12:16])
-	b.Duration = binary.BigEndian.Uint32(data[16:20])
-	b.Rate, err = MakeFixed32(data[20:24])
+	offset := 4
+	b.Creation_time, offset = readVersioned(data, offset, b.Version)
+	b.Modification_time, offset = readVersioned(data, offset, b.Version)
+	b.Timescale = binary.BigEndian.Uint32(data[offset : offset+4])
+	b.Duration, offset = readVersioned(data, offset+4, b.Version)
+	b.Rate, err = MakeFixed32(data[offset : offset+4])
 	if err != nil {
 		return err
 	}
-	b.Volume, err = MakeFixed16(data[24:26])
+	b.Volume, err = MakeFixed16(data[offset+4 : offset+6])
 	if err != nil {
 		return err
 	}
-	b.Other_data = data[26:]
+	b.Other_data = data[offset+6:]
+	// Skip 10 bytes reserved, 36 bytes matrix and 24 bytes pre_defined
+	if len(b.Other_data) >= 74 {
+		b.Next_track_id = binary.BigEndian.Uint32(b.Other_data[70:74])
+	}
 	return nil
 }
 
+// versionedSize returns the size of n fields which are 64-bit in version 1
+// of a full box and 32-bit otherwise.
+func versionedSize(version uint8, n int) int {
+	if version == 1 {
+		return 8 * n
+	}
+	return 4 * n
+}
+
+// readVersioned reads a time or duration field that is 64-bit in version 1
+// boxes.
+func readVersioned(data []byte, offset int, version uint8) (uint64, int) {
+	if version == 1 {
+		return binary.BigEndian.Uint64(data[offset : offset+8]), offset + 8
+	}
+	return uint64(binary.BigEndian.Uint32(data[offset : offset+4])), offset + 4
+}
+
 type IodsBox struct {
 	*Box
 	Data []byte
@@ -344,6 +506,11 @@ type TrakBox struct {
 	Edts    *EdtsBox
 	Chunks  []Chunk
 	Samples []Sample
+
+	// Decoding time of the first fragment of a track whose samples all
+	// come from movie fragments, removed from their decoding times so that
+	// those fit 32 bits
+	decode_time_base uint64
 }
 
 func (b *TrakBox) PrintChunk() {
@@ -360,6 +527,24 @@ func (b *TrakBox) GetSample() []Sample {
 	return b.Samples
 }
 
+// GetSampleEntry returns the stsd entry with the given 1-based sample
+// description index, or nil if there is none.
+func (b *TrakBox) GetSampleEntry(index uint32) *SampleEntry {
+	stsd := b.Mdia.Minf.Stbl.Stsd
+	if stsd == nil || index < 1 || int(index) > len(stsd.Entries) {
+		return nil
+	}
+	return stsd.Entries[index-1]
+}
+
+// GetHandlerType returns the track's media handler type, e.g. "vide" or "soun".
+func (b *TrakBox) GetHandlerType() string {
+	if b.Mdia == nil || b.Mdia.Hdlr == nil {
+		return ""
+	}
+	return b.Mdia.Hdlr.Handler_type
+}
+
 func (b *TrakBox) PrintSample() {
 	for k, v := range b.Samples {
 		fmt.Printf("Sample %d, offset %d, size %d, duration %d, start_time %d, cto: %d\n", k, v.Offset, v.Size, v.Duration, v.Start_time, v.Cto)
@@ -369,6 +554,7 @@ func (b *TrakBox) PrintSample() {
 func (b *TrakBox) parse() error {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "tkhd":
 			b.Tkhd = &TkhdBox{Box: subBox}
@@ -380,7 +566,7 @@ func (b *TrakBox) parse() error {
 			b.Edts = &EdtsBox{Box: subBox}
 			b.Edts.parse()
 		default:
-			fmt.Printf("Unhandled Trak Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Trak Sub-Box: %v \n", subBox.Name)
 		}
 	}
 	return nil
@@ -388,25 +574,31 @@ func (b *TrakBox) parse() error {
 
 type TkhdBox struct {
 	*Box
-	Version                                              uint8
-	Flags                                                [3]byte
-	Creation_time, Modification_time, Track_id, Duration uint32
-	Layer, Alternate_group                               uint16 // This should really be int16 but not sure how to parse
-	Volume                                               Fixed16
-	Matrix                                               []byte
-	Width, Height                                        Fixed32
+	Version                                    uint8
+	Flags                                      [3]byte
+	Creation_time, Modification_time, Duration uint64 // 64-bit in version 1
+	Track_id                                   uint32
+	Layer, Alternate_group                     uint16 // This should really be int16 but not sure how to parse
+	Volume                                     Fixed16
+	Matrix                                     []byte
+	Width, Height                              Fixed32
 }
 
 func (b *TkhdBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 4 || len(data) < 72+versionedSize(data[0], 3) {
+		return fmt.Errorf("tkhd box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
-	b.Creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.Modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.Track_id = binary.BigEndian.Uint32(data[12:16])
+	offset := 4
+	b.Creation_time, offset = readVersioned(data, offset, b.Version)
+	b.Modification_time, offset = readVersioned(data, offset, b.Version)
+	b.Track_id = binary.BigEndian.Uint32(data[offset : offset+4])
 	// Skip 4 bytes for reserved space (uint32)
-	b.Duration = binary.BigEndian.Uint32(data[20:24])
+	b.Duration, offset = readVersioned(data, offset+8, b.Version)
 	// Skip 8 bytes for reserved space (2 uint32)
+	data = data[offset-24:]
 	b.Layer = binary.BigEndian.Uint16(data[32:34])
 	b.Alternate_group = binary.BigEndian.Uint16(data[34:36])
 	b.Volume, err = MakeFixed16(data[36:38])
@@ -434,12 +626,13 @@ type EdtsBox struct {
 func (b *EdtsBox) parse() (err error) {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "elst":
 			b.Elst = &ElstBox{Box: subBox}
 			err = b.Elst.parse()
 		default:
-			fmt.Printf("Unhandled Edts Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Edts Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -453,26 +646,36 @@ type ElstBox struct {
 	Version                                 uint8
 	Flags                                   [3]byte
 	Entry_count                             uint32
-	Segment_duration, Media_time            []uint32
+	Segment_duration                        []uint64
+	Media_time                              []int64  // -1 for an empty edit
 	Media_rate_integer, Media_rate_fraction []uint16 // This should really be int16 but not sure how to parse
 }
 
 func (b *ElstBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("elst box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
-		sd := binary.BigEndian.Uint32(data[(8 + 12*i):(12 + 12*i)])
-		mt := binary.BigEndian.Uint32(data[(12 + 12*i):(16 + 12*i)])
-		mri := binary.BigEndian.Uint16(data[(16 + 12*i):(18 + 12*i)])
-		mrf := binary.BigEndian.Uint16(data[(18 + 12*i):(20 + 12*i)])
+	entry_size := 4 + versionedSize(b.Version, 2)
+	n, err := tableEntries("elst", data, 8, entry_size, b.Entry_count)
+	for i := 0; i < n; i++ {
+		offset := 8 + entry_size*i
+		sd, offset := readVersioned(data, offset, b.Version)
+		mt, offset := readVersioned(data, offset, b.Version)
+		if b.Version != 1 {
+			mt = uint64(int32(mt)) // sign extended, so -1 stays -1
+		}
+		mri := binary.BigEndian.Uint16(data[offset : offset+2])
+		mrf := binary.BigEndian.Uint16(data[offset+2 : offset+4])
 		b.Segment_duration = append(b.Segment_duration, sd)
-		b.Media_time = append(b.Media_time, mt)
+		b.Media_time = append(b.Media_time, int64(mt))
 		b.Media_rate_integer = append(b.Media_rate_integer, mri)
 		b.Media_rate_fraction = append(b.Media_rate_fraction, mrf)
 	}
-	return nil
+	return err
 }
 
 type MdiaBox struct {
@@ -485,6 +688,7 @@ type MdiaBox struct {
 func (b *MdiaBox) parse() error {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "mdhd":
 			b.Mdhd = &MdhdBox{Box: subBox}
@@ -496,7 +700,7 @@ func (b *MdiaBox) parse() error {
 			b.Minf = &MinfBox{Box: subBox}
 			b.Minf.parse()
 		default:
-			fmt.Printf("Unhandled Mdia Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Mdia Sub-Box: %v \n", subBox.Name)
 		}
 	}
 	return nil
@@ -504,22 +708,29 @@ func (b *MdiaBox) parse() error {
 
 type MdhdBox struct {
 	*Box
-	Version                                               uint8
-	Flags                                                 [3]byte
-	Creation_time, Modification_time, Timescale, Duration uint32
-	Language                                              uint16 // Combine 1-bit padding w/ 15-bit language data
+	Version                                    uint8
+	Flags                                      [3]byte
+	Creation_time, Modification_time, Duration uint64 // 64-bit in version 1
+	Timescale                                  uint32
+	Language                                   uint16 // Combine 1-bit padding w/ 15-bit language data
+	Pre_defined                                uint16 // QuickTime quality
 }
 
 func (b *MdhdBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 4 || len(data) < 12+versionedSize(data[0], 3) {
+		return fmt.Errorf("mdhd box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
-	b.Creation_time = binary.BigEndian.Uint32(data[4:8])
-	b.Modification_time = binary.BigEndian.Uint32(data[8:12])
-	b.Timescale = binary.BigEndian.Uint32(data[12:16])
-	b.Duration = binary.BigEndian.Uint32(data[16:20])
+	offset := 4
+	b.Creation_time, offset = readVersioned(data, offset, b.Version)
+	b.Modification_time, offset = readVersioned(data, offset, b.Version)
+	b.Timescale = binary.BigEndian.Uint32(data[offset : offset+4])
+	b.Duration, offset = readVersioned(data, offset+4, b.Version)
 	// language includes 1 padding bit
-	b.Language = binary.BigEndian.Uint16(data[20:22])
+	b.Language = binary.BigEndian.Uint16(data[offset : offset+2])
+	b.Pre_defined = binary.BigEndian.Uint16(data[offset+2 : offset+4])
 	return nil
 }
 
@@ -529,15 +740,19 @@ type HdlrBox struct {
 	Flags                    [3]byte
 	Pre_defined              uint32
 	Handler_type, Track_name string
+	Reserved                 [12]byte // QuickTime component manufacturer, flags and flags mask
 }
 
 func (b *HdlrBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 24 {
+		return fmt.Errorf("hdlr box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Pre_defined = binary.BigEndian.Uint32(data[4:8])
 	b.Handler_type = string(data[8:12])
-	// Skip 12 bytes for reserved space (3 uint32)
+	copy(b.Reserved[:], data[12:24])
 	b.Track_name = string(data[24:])
 	return nil
 }
@@ -554,6 +769,7 @@ type MinfBox struct {
 func (b *MinfBox) parse() (err error) {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "vmhd":
 			b.Vmhd = &VmhdBox{Box: subBox}
@@ -571,7 +787,7 @@ func (b *MinfBox) parse() (err error) {
 			b.Hdlr = &HdlrBox{Box: subBox}
 			err = b.Hdlr.parse()
 		default:
-			fmt.Printf("Unhandled Minf Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Minf Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -628,6 +844,7 @@ type StblBox struct {
 func (b *StblBox) parse() (err error) {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "stsd":
 			b.Stsd = &StsdBox{Box: subBox}
@@ -644,14 +861,14 @@ func (b *StblBox) parse() (err error) {
 		case "stsz":
 			b.Stsz = &StszBox{Box: subBox}
 			err = b.Stsz.parse()
-		case "stco":
+		case "stco", "co64":
 			b.Stco = &StcoBox{Box: subBox}
 			err = b.Stco.parse()
 		case "ctts":
 			b.Ctts = &CttsBox{Box: subBox}
 			err = b.Ctts.parse()
 		default:
-			fmt.Printf("Unhandled Stbl Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Stbl Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -666,6 +883,7 @@ type StsdBox struct {
 	Flags       [3]byte
 	Entry_count uint32
 	Other_data  []byte
+	Entries     []*SampleEntry
 }
 
 func (b *StsdBox) parse() (err error) {
@@ -674,7 +892,16 @@ func (b *StsdBox) parse() (err error) {
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
 	b.Other_data = data[8:]
-	fmt.Println("stsd box parsing not yet finished")
+	boxes := readBoxes(b.File, b.Start+BOX_HEADER_SIZE+8, b.Size-BOX_HEADER_SIZE-8)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		entry := &SampleEntry{Box: subBox, stsd_version: b.Version}
+		if err := entry.parse(); err != nil {
+			logf("Sample entry %v kept as read: %v\n", subBox.Name, err)
+			entry.raw = true
+		}
+		b.Entries = append(b.Entries, entry)
+	}
 	return nil
 }
 
@@ -689,16 +916,20 @@ type SttsBox struct {
 
 func (b *SttsBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("stts box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
+	n, err := tableEntries("stts", data, 8, 8, b.Entry_count)
+	for i := 0; i < n; i++ {
 		s_count := binary.BigEndian.Uint32(data[(8 + 8*i):(12 + 8*i)])
 		s_delta := binary.BigEndian.Uint32(data[(12 + 8*i):(16 + 8*i)])
 		b.Sample_count = append(b.Sample_count, s_count)
 		b.Sample_delta = append(b.Sample_delta, s_delta)
 	}
-	return nil
+	return err
 }
 
 type StssBox struct {
@@ -711,14 +942,18 @@ type StssBox struct {
 
 func (b *StssBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("stss box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
+	n, err := tableEntries("stss", data, 8, 4, b.Entry_count)
+	for i := 0; i < n; i++ {
 		sample := binary.BigEndian.Uint32(data[(8 + 4*i):(12 + 4*i)])
 		b.Sample_number = append(b.Sample_number, sample)
 	}
-	return nil
+	return err
 }
 
 type StscBox struct {
@@ -733,10 +968,14 @@ type StscBox struct {
 
 func (b *StscBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("stsc box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
+	n, err := tableEntries("stsc", data, 8, 12, b.Entry_count)
+	for i := 0; i < n; i++ {
 		fc := binary.BigEndian.Uint32(data[(8 + 12*i):(12 + 12*i)])
 		spc := binary.BigEndian.Uint32(data[(12 + 12*i):(16 + 12*i)])
 		sdi := binary.BigEndian.Uint32(data[(16 + 12*i):(20 + 12*i)])
@@ -744,7 +983,7 @@ func (b *StscBox) parse() (err error) {
 		b.Samples_per_chunk = append(b.Samples_per_chunk, spc)
 		b.Sample_description_index = append(b.Sample_description_index, sdi)
 	}
-	return nil
+	return err
 }
 
 type StszBox struct {
@@ -758,37 +997,56 @@ type StszBox struct {
 
 func (b *StszBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 12 {
+		return fmt.Errorf("stsz box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Sample_size = binary.BigEndian.Uint32(data[4:8])
 	b.Sample_count = binary.BigEndian.Uint32(data[8:12])
 	if b.Sample_size == uint32(0) {
-		for i := 0; i < int(b.Sample_count); i++ {
+		var n int
+		n, err = tableEntries("stsz", data, 12, 4, b.Sample_count)
+		for i := 0; i < n; i++ {
 			entry := binary.BigEndian.Uint32(data[(12 + 4*i):(16 + 4*i)])
 			b.Entry_size = append(b.Entry_size, entry)
 		}
 	}
-	return nil
+	return err
 }
 
+// StcoBox holds the chunk offsets of either a stco box or its 64-bit
+// variant, co64.
 type StcoBox struct {
 	*Box
 	Version      uint8
 	Flags        [3]byte
 	Entry_count  uint32
-	Chunk_offset []uint32
+	Chunk_offset []uint64
 }
 
 func (b *StcoBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("stco box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
+	if b.Name == "co64" {
+		n, err := tableEntries("co64", data, 8, 8, b.Entry_count)
+		for i := 0; i < n; i++ {
+			chunk := binary.BigEndian.Uint64(data[(8 + 8*i):(16 + 8*i)])
+			b.Chunk_offset = append(b.Chunk_offset, chunk)
+		}
+		return err
+	}
+	n, err := tableEntries("stco", data, 8, 4, b.Entry_count)
+	for i := 0; i < n; i++ {
 		chunk := binary.BigEndian.Uint32(data[(8 + 4*i):(12 + 4*i)])
-		b.Chunk_offset = append(b.Chunk_offset, chunk)
+		b.Chunk_offset = append(b.Chunk_offset, uint64(chunk))
 	}
-	return nil
+	return err
 }
 
 type CttsBox struct {
@@ -802,16 +1060,20 @@ type CttsBox struct {
 
 func (b *CttsBox) parse() (err error) {
 	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("ctts box too short: %d bytes", len(data))
+	}
 	b.Version = data[0]
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
-	for i := 0; i < int(b.Entry_count); i++ {
+	n, err := tableEntries("ctts", data, 8, 8, b.Entry_count)
+	for i := 0; i < n; i++ {
 		s_count := binary.BigEndian.Uint32(data[(8 + 8*i):(12 + 8*i)])
 		s_offset := binary.BigEndian.Uint32(data[(12 + 8*i):(16 + 8*i)])
 		b.Sample_count = append(b.Sample_count, s_count)
 		b.Sample_offset = append(b.Sample_offset, s_offset)
 	}
-	return nil
+	return err
 }
 
 type DinfBox struct {
@@ -822,12 +1084,13 @@ type DinfBox struct {
 func (b *DinfBox) parse() (err error) {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "dref":
 			b.Dref = &DrefBox{Box: subBox}
 			err = b.Dref.parse()
 		default:
-			fmt.Printf("Unhandled Dinf Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Dinf Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -850,7 +1113,7 @@ func (b *DrefBox) parse() (err error) {
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	b.Entry_count = binary.BigEndian.Uint32(data[4:8])
 	b.Other_data = data[8:]
-	fmt.Println("dref box parsing not yet finished")
+	logln("dref box parsing not yet finished")
 	return nil
 }
 
@@ -862,12 +1125,13 @@ type UdtaBox struct {
 func (b *UdtaBox) parse() (err error) {
 	boxes := readSubBoxes(b.File, b.Start, b.Size)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "meta":
 			b.Meta = &MetaBox{Box: subBox}
 			err = b.Meta.parse()
 		default:
-			fmt.Printf("Unhandled Udta Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Udta Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -889,12 +1153,13 @@ func (b *MetaBox) parse() (err error) {
 	b.Flags = [3]byte{data[1], data[2], data[3]}
 	boxes := readSubBoxes(b.File, b.Start+4, b.Size-4)
 	for subBox := range boxes {
+		b.children = append(b.children, subBox)
 		switch subBox.Name {
 		case "hdlr":
 			b.Hdlr = &HdlrBox{Box: subBox}
 			err = b.Hdlr.parse()
 		default:
-			fmt.Printf("Unhandled Meta Sub-Box: %v \n", subBox.Name)
+			logf("Unhandled Meta Sub-Box: %v \n", subBox.Name)
 		}
 		if err != nil {
 			return err
@@ -903,6 +1168,19 @@ func (b *MetaBox) parse() (err error) {
 	return nil
 }
 
+// tableEntries returns how many of the count entries of entrySize bytes
+// following the header actually fit in data, with an error if some don't.
+func tableEntries(name string, data []byte, header, entrySize int, count uint32) (int, error) {
+	fit := (len(data) - header) / entrySize
+	if fit < 0 {
+		fit = 0
+	}
+	if int64(count) > int64(fit) {
+		return fit, fmt.Errorf("%v box truncated: %d entries, room for %d", name, count, fit)
+	}
+	return int(count), nil
+}
+
 // An 8.8 Fixed Point Decimal notation
 type Fixed16 uint16
 
@@ -912,7 +1190,7 @@ func (f Fixed16) String() string {
 
 func MakeFixed16(bytes []byte) (Fixed16, error) {
 	if len(bytes) != 2 {
-		return Fixed16(0), fmt.Errorf("Invalid number of bytes for Fixed16. Need 2, got " + string(len(bytes)))
+		return Fixed16(0), fmt.Errorf("Invalid number of bytes for Fixed16. Need 2, got %d", len(bytes))
 	}
 	return Fixed16(binary.BigEndian.Uint16(bytes)), nil
 }
@@ -926,16 +1204,17 @@ func (f Fixed32) String() string {
 
 func MakeFixed32(bytes []byte) (Fixed32, error) {
 	if len(bytes) != 4 {
-		return Fixed32(0), fmt.Errorf("Invalid number of bytes for Fixed32. Need 4, got " + string(len(bytes)))
+		return Fixed32(0), fmt.Errorf("Invalid number of bytes for Fixed32. Need 4, got %d", len(bytes))
 	}
 	return Fixed32(binary.BigEndian.Uint32(bytes)), nil
 }
 
 type Chunk struct {
-	Sample_description_index, Start_sample, Sample_count, Offset uint32
+	Sample_description_index, Start_sample, Sample_count uint32
+	Offset                                               uint64
 }
 
-func (c *Chunk) GetOffset() uint32 {
+func (c *Chunk) GetOffset() uint64 {
 	return c.Offset
 }
 
@@ -944,7 +1223,10 @@ func (c *Chunk) GetStartSample() uint32 {
 }
 
 type Sample struct {
-	Size, Offset, Start_time, Duration, Cto uint32
+	Size, Start_time, Duration, Cto uint32
+	Offset                          uint64
+	Chunk, Sample_description_index uint32 // 1-based, as in stsc
+	Sync                            bool
 }
 
 func (s *Sample) GetSize() uint32 {
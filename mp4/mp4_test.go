@@ -0,0 +1,303 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	Log = io.Discard
+	os.Exit(m.Run())
+}
+
+func testBox(name string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	buf := binary.BigEndian.AppendUint32(nil, uint32(BOX_HEADER_SIZE+int64(len(body))))
+	return append(append(buf, name...), body...)
+}
+
+func testFullBox(name string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return testBox(name, append([][]byte{header}, payload...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// versioned returns a field that is 64-bit in version 1 boxes.
+func versioned(version uint8, v uint64) []byte {
+	if version == 1 {
+		return u64(v)
+	}
+	return u32(uint32(v))
+}
+
+type testEdit struct {
+	duration   uint64
+	media_time int64
+}
+
+// testMovie describes a single track file built by build.
+type testMovie struct {
+	handler   string // "vide" if empty
+	version   uint8  // of mvhd, tkhd, mdhd and elst
+	time      uint64 // creation and modification time
+	timescale uint32
+	samples   [][]byte
+	delta     uint32   // duration of every sample
+	sync      []uint32 // stss entries, every sample is sync if nil
+	edits     []testEdit
+	co64      bool
+	mdat      string // "" for a plain mdat before moov, "large" for a largesize one, "zero" for a size 0 one at the end
+	entry     []byte // sample entry, mp4v or mp4a if nil
+	cto       []uint32
+	moov_tail [][]byte // boxes after the trak, e.g. udta
+}
+
+func (m *testMovie) duration() uint64 {
+	return uint64(len(m.samples)) * uint64(m.delta)
+}
+
+var testMatrix = bytes.Join([][]byte{u32(0x10000), u32(0), u32(0), u32(0), u32(0x10000), u32(0), u32(0), u32(0), u32(0x40000000)}, nil)
+
+// testMvhd returns an mvhd box with a timescale of 1000.
+func testMvhd(version uint8, time, duration uint64, next_track_id uint32) []byte {
+	return testFullBox("mvhd", version, 0, versioned(version, time), versioned(version, time), u32(1000), versioned(version, duration),
+		u32(0x10000), u16(0x100), make([]byte, 10), testMatrix, make([]byte, 24), u32(next_track_id))
+}
+
+// testTrack describes a track built by testTrak.
+type testTrack struct {
+	id        uint32
+	handler   string // "vide" or "soun"
+	timescale uint32
+	duration  uint64 // in the track timescale
+	edits     []testEdit
+	stbl      []byte
+}
+
+func testTrak(v uint8, time uint64, t testTrack) []byte {
+	movie_duration := t.duration * 1000 / uint64(t.timescale)
+	tkhd := testFullBox("tkhd", v, 3, versioned(v, time), versioned(v, time), u32(t.id), u32(0), versioned(v, movie_duration),
+		make([]byte, 8), u16(0), u16(0), u16(0), u16(0), testMatrix, u32(320<<16), u32(240<<16))
+	var edts []byte
+	if t.edits != nil {
+		entries := [][]byte{u32(uint32(len(t.edits)))}
+		for _, e := range t.edits {
+			entries = append(entries, versioned(v, e.duration), versioned(v, uint64(e.media_time)), u16(1), u16(0))
+		}
+		edts = testBox("edts", testFullBox("elst", v, 0, entries...))
+	}
+	mdhd := testFullBox("mdhd", v, 0, versioned(v, time), versioned(v, time), u32(t.timescale), versioned(v, t.duration), u16(0x55c4), u16(0))
+	name, media_header := "VideoHandler\x00", testFullBox("vmhd", 0, 1, make([]byte, 8))
+	if t.handler == "soun" {
+		name, media_header = "SoundHandler\x00", testFullBox("smhd", 0, 0, make([]byte, 4))
+	}
+	hdlr := testFullBox("hdlr", 0, 0, u32(0), []byte(t.handler), make([]byte, 12), []byte(name))
+	dinf := testBox("dinf", testFullBox("dref", 0, 0, u32(1), testFullBox("url ", 0, 1)))
+	minf := testBox("minf", media_header, dinf, t.stbl)
+	return testBox("trak", tkhd, edts, testBox("mdia", mdhd, hdlr, minf))
+}
+
+// testSampleEntry returns an mp4v entry for video and an mp4a one for audio.
+func testSampleEntry(handler string, timescale uint32) []byte {
+	if handler == "soun" {
+		return testAudioEntry("mp4a", timescale)
+	}
+	return testVisualEntry("mp4v")
+}
+
+// testVisualEntry returns a 320x240 visual sample entry.
+func testVisualEntry(name string, children ...[]byte) []byte {
+	return testBox(name, append([][]byte{make([]byte, 6), u16(1), make([]byte, 16), u16(320), u16(240), u32(0x480000), u32(0x480000),
+		u32(0), u16(1), make([]byte, 32), u16(0x18), u16(0xffff)}, children...)...)
+}
+
+// testAudioEntry returns a stereo 16-bit audio sample entry.
+func testAudioEntry(name string, sample_rate uint32, children ...[]byte) []byte {
+	return testBox(name, append([][]byte{make([]byte, 6), u16(1), make([]byte, 8), u16(2), u16(16), u32(0), u32(sample_rate << 16)}, children...)...)
+}
+
+// testStbl returns sample tables holding the samples in a single chunk,
+// with a ctts box if cto is not nil.
+func testStbl(entry []byte, samples [][]byte, delta uint32, sync, cto []uint32, chunk_offset uint64, co64 bool) []byte {
+	stsd := testFullBox("stsd", 0, 0, u32(1), entry)
+	if len(samples) == 0 {
+		return testBox("stbl", stsd, testFullBox("stts", 0, 0, u32(0)), testFullBox("stsc", 0, 0, u32(0)),
+			testFullBox("stsz", 0, 0, u32(0), u32(0)), testFullBox("stco", 0, 0, u32(0)))
+	}
+	stts := testFullBox("stts", 0, 0, u32(1), u32(uint32(len(samples))), u32(delta))
+	stsc := testFullBox("stsc", 0, 0, u32(1), u32(1), u32(uint32(len(samples))), u32(1))
+	sizes := [][]byte{u32(0), u32(uint32(len(samples)))}
+	for _, s := range samples {
+		sizes = append(sizes, u32(uint32(len(s))))
+	}
+	stsz := testFullBox("stsz", 0, 0, sizes...)
+	stco := testFullBox("stco", 0, 0, u32(1), u32(uint32(chunk_offset)))
+	if co64 {
+		stco = testFullBox("co64", 0, 0, u32(1), u64(chunk_offset))
+	}
+	var ctts []byte
+	if cto != nil {
+		entries := [][]byte{u32(uint32(len(cto)))}
+		for _, c := range cto {
+			entries = append(entries, u32(1), u32(c))
+		}
+		ctts = testFullBox("ctts", 0, 0, entries...)
+	}
+	var stss []byte
+	if sync != nil {
+		entries := [][]byte{u32(uint32(len(sync)))}
+		for _, s := range sync {
+			entries = append(entries, u32(s))
+		}
+		stss = testFullBox("stss", 0, 0, entries...)
+	}
+	return testBox("stbl", stsd, stts, ctts, stss, stsc, stsz, stco)
+}
+
+func (m *testMovie) moov(data_offset uint64) []byte {
+	handler := m.handler
+	if handler == "" {
+		handler = "vide"
+	}
+	entry := m.entry
+	if entry == nil {
+		entry = testSampleEntry(handler, m.timescale)
+	}
+	trak := testTrak(m.version, m.time, testTrack{
+		id: 1, handler: handler, timescale: m.timescale, duration: m.duration(), edits: m.edits,
+		stbl: testStbl(entry, m.samples, m.delta, m.sync, m.cto, data_offset, m.co64),
+	})
+	boxes := append([][]byte{testMvhd(m.version, m.time, m.duration()*1000/uint64(m.timescale), 2), trak}, m.moov_tail...)
+	return testBox("moov", boxes...)
+}
+
+// build returns the bytes of the file.
+func (m *testMovie) build() []byte {
+	ftyp := testBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	data := bytes.Join(m.samples, nil)
+	switch m.mdat {
+	case "large":
+		mdat := append(append(u32(1), "mdat"...), u64(uint64(16+len(data)))...)
+		return bytes.Join([][]byte{ftyp, mdat, data, m.moov(uint64(len(ftyp) + 16))}, nil)
+	case "zero":
+		moov_size := len(m.moov(0))
+		mdat := append(u32(0), "mdat"...)
+		return bytes.Join([][]byte{ftyp, m.moov(uint64(len(ftyp) + moov_size + 8)), mdat, data}, nil)
+	}
+	return bytes.Join([][]byte{ftyp, testBox("mdat", data), m.moov(uint64(len(ftyp) + 8))}, nil)
+}
+
+// openBytes writes data to a temporary file and parses it.
+func openBytes(t *testing.T, data []byte) *File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// writeAndOpen writes a file to a temporary path with write and parses it.
+func writeAndOpen(t *testing.T, name string, write func(out *os.File) error) *File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(out); err != nil {
+		t.Fatalf("Writing %v: %v", name, err)
+	}
+	out.Close()
+	f, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open %v: %v", name, err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// testSamples returns n samples of different sizes and contents.
+func testSamples(n int) [][]byte {
+	samples := [][]byte{}
+	for i := 0; i < n; i++ {
+		s := make([]byte, 10+i%7)
+		for j := range s {
+			s[j] = byte(i*31 + j)
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// testAVFile returns a file with a reordered video track, a sync sample
+// every 5 frames, and an audio track, each stored as a single chunk.
+func testAVFile() []byte {
+	video, audio := testSamples(20), testSamples(30)
+	sync, cto := []uint32{}, []uint32{}
+	for i := range video {
+		if i%5 == 0 {
+			sync = append(sync, uint32(i+1))
+		}
+		cto = append(cto, []uint32{3000, 9000, 0, 3000, 3000}[i%5])
+	}
+	ftyp := testBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	video_offset := uint64(len(ftyp) + 8)
+	audio_offset := video_offset + uint64(len(bytes.Join(video, nil)))
+	mdat := testBox("mdat", append(video, audio...)...)
+
+	traks := [][]byte{
+		testTrak(0, 0, testTrack{id: 1, handler: "vide", timescale: 90000, duration: 60000, edits: []testEdit{{666, 3000}},
+			stbl: testStbl(testSampleEntry("vide", 90000), video, 3000, sync, cto, video_offset, false)}),
+		testTrak(0, 0, testTrack{id: 2, handler: "soun", timescale: 48000, duration: 30720,
+			stbl: testStbl(testSampleEntry("soun", 48000), audio, 1024, nil, nil, audio_offset, false)}),
+	}
+	moov := testBox("moov", append([][]byte{testMvhd(0, 0, 666, 3)}, traks...)...)
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+var testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+
+// testH264AACFile returns a file with an H.264 track of 10 reordered
+// frames, a sync sample every 5, and an AAC track of 30 frames.
+func testH264AACFile() (video, audio [][]byte, cto []uint32, file []byte) {
+	sync := []uint32{}
+	for i, s := range testSamples(10) {
+		nal := append([]byte{0x41}, s...)
+		if i%5 == 0 {
+			nal[0] = 0x65
+			sync = append(sync, uint32(i+1))
+		}
+		video = append(video, append(u32(uint32(len(nal))), nal...))
+		cto = append(cto, []uint32{3000, 9000, 0, 3000, 3000}[i%5])
+	}
+	audio = testSamples(30)
+	avcc := testBox("avcC", []byte{1, 0x42, 0xc0, 0x1e, 0xff, 0xe1}, u16(uint16(len(testSPS))), testSPS, []byte{1}, u16(uint16(len(testPPS))), testPPS)
+
+	ftyp := testBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	video_offset := uint64(len(ftyp) + 8)
+	audio_offset := video_offset + uint64(len(bytes.Join(video, nil)))
+	mdat := testBox("mdat", append(video, audio...)...)
+	traks := [][]byte{
+		testTrak(0, 0, testTrack{id: 1, handler: "vide", timescale: 90000, duration: 30000, edits: []testEdit{{333, 3000}},
+			stbl: testStbl(testVisualEntry("avc1", avcc), video, 3000, sync, cto, video_offset, false)}),
+		testTrak(0, 0, testTrack{id: 2, handler: "soun", timescale: 48000, duration: 30720,
+			stbl: testStbl(testAudioEntry("mp4a", 48000, testEsds), audio, 1024, nil, nil, audio_offset, false)}),
+	}
+	moov := testBox("moov", append([][]byte{testMvhd(0, 0, 640, 3)}, traks...)...)
+	return video, audio, cto, bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
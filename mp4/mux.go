@@ -0,0 +1,451 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+const (
+	MOVIE_TIMESCALE = uint32(1000)
+	LANGUAGE_UND    = uint16(0x55c4) // ISO-639-2/T "und" packed in 3 x 5 bits
+	MAX_CHUNK_BYTES = 1 << 20
+	// Media span each track gets in turn when copying samples, so that
+	// players read the tracks from nearby offsets
+	INTERLEAVE_SECONDS = 0.5
+)
+
+// trackSpec describes a track written from scratch. Samples are added
+// through an mdatWriter, which fills in their Offset and Chunk; their
+// Start_time is the decoding time.
+type trackSpec struct {
+	Handler       string // "vide" or "soun"
+	Timescale     uint32
+	Entries       []*SampleEntry
+	Samples       []Sample
+	Media_time    uint64 // media time of the first presented sample, written as an edit list if not 0
+	Width, Height uint32
+	// Presented duration in the track timescale, 0 means the media duration
+	Presentation_duration uint64
+	// Time in the movie timescale before the track is presented, written as
+	// an empty edit
+	Delay uint64
+	// Edits in the movie timescale written instead of the ones above, e.g.
+	// one per concatenated file
+	Edits []trackEdit
+
+	chunk_samples int // samples per chunk, 0 means 1
+	chunk_bytes   int64
+}
+
+// trackEdit is an edit list entry.
+type trackEdit struct {
+	Duration   uint64 // in the movie timescale
+	Media_time int64  // -1 for an empty edit
+}
+
+// mdatWriter writes ftyp and a growing mdat, deciding the chunk layout of
+// the samples as they come in.
+type mdatWriter struct {
+	w          io.WriteSeeker
+	free_start int64 // a free box reserved for a largesize mdat header
+	pos        int64
+	last       *trackSpec
+}
+
+func newMdatWriter(w io.WriteSeeker, ftyp *FtypBox) (*mdatWriter, error) {
+	if err := ftyp.Write(w); err != nil {
+		return nil, err
+	}
+	m := &mdatWriter{w: w, free_start: ftyp.EncodedSize()}
+	header := []byte{0, 0, 0, 8, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 'm', 'd', 'a', 't'}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	m.pos = m.free_start + int64(len(header))
+	return m, nil
+}
+
+// writeSample appends a sample made of the concatenation of data to the
+// track.
+func (m *mdatWriter) writeSample(t *trackSpec, s Sample, data ...[]byte) error {
+	s.Size = 0
+	for _, d := range data {
+		if _, err := m.w.Write(d); err != nil {
+			return err
+		}
+		s.Size += uint32(len(d))
+	}
+	s.Offset = uint64(m.pos)
+	m.pos += int64(s.Size)
+
+	n := len(t.Samples)
+	limit := t.chunk_samples
+	if limit < 1 {
+		limit = 1
+	}
+	s.Chunk = 1
+	if n > 0 {
+		prev := t.Samples[n-1]
+		s.Chunk = prev.Chunk
+		run := 0
+		for i := n - 1; i >= 0 && t.Samples[i].Chunk == prev.Chunk; i-- {
+			run++
+		}
+		if m.last != t || run >= limit || t.chunk_bytes+int64(s.Size) > MAX_CHUNK_BYTES || prev.Sample_description_index != s.Sample_description_index {
+			s.Chunk++
+			t.chunk_bytes = 0
+		}
+	}
+	t.chunk_bytes += int64(s.Size)
+	t.Samples = append(t.Samples, s)
+	m.last = t
+	return nil
+}
+
+// sourceSample is a sample to copy from a parsed file.
+type sourceSample struct {
+	file *File
+	Sample
+}
+
+// copyInterleaved copies samples[i] into tracks[i], interleaving the tracks
+// by decoding time. The Start_time of the samples must already be the one
+// of the new track.
+func (m *mdatWriter) copyInterleaved(tracks []*trackSpec, samples [][]sourceSample) error {
+	type ref struct {
+		block int64
+		track int
+		index int
+	}
+	refs := []ref{}
+	for i, t := range tracks {
+		if t.chunk_samples == 0 {
+			t.chunk_samples = math.MaxInt32
+		}
+		for j, s := range samples[i] {
+			block := int64(float64(s.Start_time) / float64(t.Timescale) / INTERLEAVE_SECONDS)
+			refs = append(refs, ref{block, i, j})
+		}
+	}
+	sort.SliceStable(refs, func(a, b int) bool {
+		if refs[a].block != refs[b].block {
+			return refs[a].block < refs[b].block
+		}
+		return refs[a].track < refs[b].track
+	})
+	for _, r := range refs {
+		s := samples[r.track][r.index]
+		data := make([]byte, s.Size)
+		if _, err := s.file.ReadAt(data, int64(s.Offset)); err != nil {
+			return fmt.Errorf("Reading track %d sample %d: %v", r.track, r.index+1, err)
+		}
+		if err := m.writeSample(tracks[r.track], s.Sample, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish patches the mdat size, turning the free box in front of it into a
+// largesize header if needed, and leaves the writer at the end of the mdat.
+func (m *mdatWriter) finish() error {
+	header := []byte{}
+	at := m.free_start + 8
+	if size := m.pos - at; size > math.MaxUint32 {
+		at = m.free_start
+		header = binary.BigEndian.AppendUint32(header, 1)
+		header = append(header, "mdat"...)
+		header = binary.BigEndian.AppendUint64(header, uint64(m.pos-at))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, uint32(size))
+	}
+	if _, err := m.w.Seek(at, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := m.w.Write(header); err != nil {
+		return err
+	}
+	_, err := m.w.Seek(m.pos, io.SeekStart)
+	return err
+}
+
+// duration returns the media duration of the track.
+func (t *trackSpec) duration() uint64 {
+	d := uint64(0)
+	for _, s := range t.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+// movieDuration returns the presented duration in the given timescale.
+func (t *trackSpec) movieDuration(movie_timescale uint32) uint64 {
+	duration := t.Presentation_duration
+	if duration == 0 {
+		duration = t.duration()
+	}
+	return duration * uint64(movie_timescale) / uint64(t.Timescale)
+}
+
+// tkhdDuration returns the duration of the track in the movie timescale,
+// empty edits included.
+func (t *trackSpec) tkhdDuration(movie_timescale uint32) uint64 {
+	if len(t.Edits) > 0 {
+		d := uint64(0)
+		for _, e := range t.Edits {
+			d += e.Duration
+		}
+		return d
+	}
+	return t.Delay + t.movieDuration(movie_timescale)
+}
+
+// versionFor returns the version of a full box whose times or durations
+// are values: 1 if one of them needs 64 bits.
+func versionFor(values ...uint64) uint8 {
+	for _, v := range values {
+		if v > math.MaxUint32 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// edts returns Edits, or else the edit list presenting the track from
+// Media_time on after Delay, or nil if none is needed.
+func (t *trackSpec) edts(movie_timescale uint32) *EdtsBox {
+	if t.Media_time == 0 && t.Presentation_duration == 0 && t.Delay == 0 && len(t.Edits) == 0 {
+		return nil
+	}
+	elst := &ElstBox{Box: newBox("elst")}
+	add := func(duration uint64, media_time int64) {
+		elst.Entry_count++
+		elst.Segment_duration = append(elst.Segment_duration, duration)
+		elst.Media_time = append(elst.Media_time, media_time)
+		elst.Media_rate_integer = append(elst.Media_rate_integer, 1)
+		elst.Media_rate_fraction = append(elst.Media_rate_fraction, 0)
+		if media_time >= 0 {
+			elst.Version |= versionFor(uint64(media_time))
+		}
+		elst.Version |= versionFor(duration)
+	}
+	if len(t.Edits) > 0 {
+		for _, e := range t.Edits {
+			add(e.Duration, e.Media_time)
+		}
+		return &EdtsBox{Box: newBox("edts"), Elst: elst}
+	}
+	if t.Delay > 0 {
+		add(t.Delay, -1) // empty edit
+	}
+	add(t.movieDuration(movie_timescale), int64(t.Media_time))
+	return &EdtsBox{Box: newBox("edts"), Elst: elst}
+}
+
+// apply replaces the sample tables, durations and edit list of a parsed
+// trak with the ones of the track, keeping its sample descriptions.
+func (t *trackSpec) apply(trak *TrakBox, movie_timescale uint32) {
+	stbl := t.stbl()
+	stbl.Stsd = trak.Mdia.Minf.Stbl.Stsd
+	trak.Mdia.Minf.Stbl = stbl
+	trak.Mdia.Mdhd.Duration = t.duration()
+	trak.Mdia.Mdhd.Version = versionFor(trak.Mdia.Mdhd.Creation_time, trak.Mdia.Mdhd.Modification_time, trak.Mdia.Mdhd.Duration)
+	trak.Tkhd.Duration = t.tkhdDuration(movie_timescale)
+	trak.Tkhd.Version = versionFor(trak.Tkhd.Creation_time, trak.Tkhd.Modification_time, trak.Tkhd.Duration)
+	trak.Edts = t.edts(movie_timescale)
+	trak.buildTables()
+}
+
+// applyTracks applies each track to the trak of the same index and sets
+// the movie duration to the longest track.
+func applyTracks(moov *MoovBox, tracks []*trackSpec, movie_timescale uint32) {
+	mvhd := moov.Mvhd
+	mvhd.Duration = 0
+	for i, trak := range moov.Traks {
+		tracks[i].apply(trak, movie_timescale)
+		if trak.Tkhd.Duration > mvhd.Duration {
+			mvhd.Duration = trak.Tkhd.Duration
+		}
+	}
+	mvhd.Version = versionFor(mvhd.Creation_time, mvhd.Modification_time, mvhd.Duration)
+}
+
+// trak builds the trak box of the track, sample tables included.
+func (t *trackSpec) trak(id uint32) *TrakBox {
+	trak := &TrakBox{Box: newBox("trak")}
+	trak.Tkhd = &TkhdBox{
+		Box:      newBox("tkhd"),
+		Flags:    [3]byte{0, 0, 3}, // enabled, in movie
+		Version:  versionFor(t.tkhdDuration(MOVIE_TIMESCALE)),
+		Track_id: id,
+		Duration: t.tkhdDuration(MOVIE_TIMESCALE),
+		Width:    Fixed32(t.Width << 16),
+		Height:   Fixed32(t.Height << 16),
+	}
+	trak.Edts = t.edts(MOVIE_TIMESCALE)
+
+	minf := &MinfBox{
+		Box:  newBox("minf"),
+		Dinf: &DinfBox{Box: newBox("dinf"), Dref: &DrefBox{Box: newBox("dref")}},
+		Stbl: t.stbl(),
+	}
+	name := "VideoHandler\x00"
+	if t.Handler == "soun" {
+		name = "SoundHandler\x00"
+		trak.Tkhd.Volume = 0x100
+		minf.Smhd = &SmhdBox{Box: newBox("smhd")}
+	} else {
+		minf.Vmhd = &VmhdBox{Box: newBox("vmhd"), Flags: [3]byte{0, 0, 1}}
+	}
+	trak.Mdia = &MdiaBox{
+		Box: newBox("mdia"),
+		Mdhd: &MdhdBox{
+			Box:       newBox("mdhd"),
+			Version:   versionFor(t.duration()),
+			Timescale: t.Timescale,
+			Duration:  t.duration(),
+			Language:  LANGUAGE_UND,
+		},
+		Hdlr: &HdlrBox{Box: newBox("hdlr"), Handler_type: t.Handler, Track_name: name},
+		Minf: minf,
+	}
+	return trak
+}
+
+// stbl builds the sample tables, run-length encoding them where the format
+// allows.
+func (t *trackSpec) stbl() *StblBox {
+	stbl := &StblBox{
+		Box:  newBox("stbl"),
+		Stsd: &StsdBox{Box: newBox("stsd"), Entries: t.Entries},
+		Stts: &SttsBox{Box: newBox("stts")},
+		Stsc: &StscBox{Box: newBox("stsc")},
+		Stsz: &StszBox{Box: newBox("stsz")},
+		Stco: &StcoBox{Box: newBox("stco")},
+	}
+	ctts := &CttsBox{Box: newBox("ctts")}
+	stss := &StssBox{Box: newBox("stss")}
+	has_cto, all_sync, same_size := false, true, true
+	samples_in_chunk := uint32(0)
+	for i, s := range t.Samples {
+		if n := len(stbl.Stts.Sample_count); n > 0 && stbl.Stts.Sample_delta[n-1] == s.Duration {
+			stbl.Stts.Sample_count[n-1]++
+		} else {
+			stbl.Stts.Sample_count = append(stbl.Stts.Sample_count, 1)
+			stbl.Stts.Sample_delta = append(stbl.Stts.Sample_delta, s.Duration)
+		}
+		if n := len(ctts.Sample_count); n > 0 && ctts.Sample_offset[n-1] == s.Cto {
+			ctts.Sample_count[n-1]++
+		} else {
+			ctts.Sample_count = append(ctts.Sample_count, 1)
+			ctts.Sample_offset = append(ctts.Sample_offset, s.Cto)
+		}
+		has_cto = has_cto || s.Cto != 0
+		if int32(s.Cto) < 0 {
+			ctts.Version = 1 // signed offsets
+		}
+		if s.Sync {
+			stss.Sample_number = append(stss.Sample_number, uint32(i+1))
+		} else {
+			all_sync = false
+		}
+		same_size = same_size && s.Size == t.Samples[0].Size
+		stbl.Stsz.Entry_size = append(stbl.Stsz.Entry_size, s.Size)
+
+		samples_in_chunk++
+		if i+1 < len(t.Samples) && t.Samples[i+1].Chunk == s.Chunk {
+			continue
+		}
+		// Last sample of its chunk
+		stbl.Stco.Chunk_offset = append(stbl.Stco.Chunk_offset, t.Samples[i+1-int(samples_in_chunk)].Offset)
+		stsc := stbl.Stsc
+		if n := len(stsc.First_chunk); n == 0 || stsc.Samples_per_chunk[n-1] != samples_in_chunk || stsc.Sample_description_index[n-1] != s.Sample_description_index {
+			stsc.First_chunk = append(stsc.First_chunk, uint32(len(stbl.Stco.Chunk_offset)))
+			stsc.Samples_per_chunk = append(stsc.Samples_per_chunk, samples_in_chunk)
+			stsc.Sample_description_index = append(stsc.Sample_description_index, s.Sample_description_index)
+		}
+		samples_in_chunk = 0
+	}
+	if has_cto {
+		stbl.Ctts = ctts
+	}
+	if !all_sync {
+		stbl.Stss = stss
+	}
+	stbl.Stsz.Sample_count = uint32(len(t.Samples))
+	if n := len(stbl.Stco.Chunk_offset); n > 0 && stbl.Stco.Chunk_offset[n-1] > math.MaxUint32 {
+		stbl.Stco.Box = newBox("co64")
+	}
+	if same_size && len(t.Samples) > 0 {
+		stbl.Stsz.Sample_size = t.Samples[0].Size
+		stbl.Stsz.Entry_size = nil
+	}
+	return stbl
+}
+
+// newMoov builds the moov box of tracks written from scratch.
+func newMoov(tracks []*trackSpec) *MoovBox {
+	moov := &MoovBox{Box: newBox("moov")}
+	duration := uint64(0)
+	for i, t := range tracks {
+		trak := t.trak(uint32(i + 1))
+		if trak.Tkhd.Duration > duration {
+			duration = trak.Tkhd.Duration
+		}
+		moov.Traks = append(moov.Traks, trak)
+	}
+	moov.Mvhd = &MvhdBox{
+		Box:           newBox("mvhd"),
+		Version:       versionFor(duration),
+		Timescale:     MOVIE_TIMESCALE,
+		Duration:      duration,
+		Rate:          0x10000,
+		Volume:        0x100,
+		Next_track_id: uint32(len(tracks) + 1),
+	}
+	return moov
+}
+
+// newFtyp returns an ftyp box with the isom major brand and the given
+// compatible brands.
+func newFtyp(brands ...string) *FtypBox {
+	return &FtypBox{
+		Box:               newBox("ftyp"),
+		Major_brand:       "isom",
+		Minor_version:     "\x00\x00\x02\x00",
+		Compatible_brands: append([]string{"isom", "iso2"}, brands...),
+	}
+}
+
+// setTimestamps fills in the decoding times, durations and composition
+// offsets of samples given their presentation times in decoding order.
+// Decoding times are the sorted presentation times, delayed so that no
+// sample is decoded after it is presented. It returns that delay, which
+// becomes the media time of the edit list.
+func setTimestamps(samples []Sample, pts []int64, last_duration uint32) uint32 {
+	if len(pts) == 0 {
+		return 0
+	}
+	sorted := append([]int64{}, pts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	first := sorted[0]
+	delay := int64(0)
+	for i := range pts {
+		if d := sorted[i] - pts[i]; d > delay {
+			delay = d
+		}
+	}
+	for i := range samples {
+		samples[i].Start_time = uint32(sorted[i] - first)
+		samples[i].Cto = uint32(pts[i] - sorted[i] + delay)
+		if i+1 < len(samples) {
+			samples[i].Duration = uint32(sorted[i+1] - sorted[i])
+		} else {
+			samples[i].Duration = last_duration
+		}
+	}
+	return uint32(delay)
+}
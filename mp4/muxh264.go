@@ -0,0 +1,275 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// H264MuxOptions sets the timing of the frames of an Annex-B stream, which
+// carries none itself.
+type H264MuxOptions struct {
+	// Frame rate as a fraction, e.g. 30000/1001. Used when there are no
+	// Timestamps; frames are presented in picture order count order.
+	Frame_rate_num, Frame_rate_den uint32
+	// Presentation time in milliseconds of each frame, in decoding order.
+	Timestamps []float64
+	// Track timescale used with Timestamps, 0 means 90000.
+	Timescale uint32
+}
+
+// h264Muxer groups the NAL units of an Annex-B stream into access units and
+// writes them as samples.
+type h264Muxer struct {
+	mdat  *mdatWriter
+	track *trackSpec
+
+	sps, pps   map[uint32][]byte // first parameter set of each id, stored in avcC
+	sps_order  [][]byte
+	pps_order  [][]byte
+	parsed_sps map[uint32]*H264SPS // latest SPS of each id, for slice parsing
+	pps_sps    map[uint32]uint32
+
+	au     [][]byte
+	au_vcl *h264SliceHeader // first slice of the current access unit
+
+	// picture order count state, see H.264 8.2.1.1
+	prev_poc_msb, prev_poc_lsb int64
+	period                     int        // number of IDR pictures so far
+	order                      [][2]int64 // (period, poc) of each sample
+}
+
+// MuxH264 reads an H.264 Annex-B elementary stream from r and writes it to
+// w as an MP4 file with a single video track. The parameter sets go to the
+// avcC box, access unit delimiters and filler data are dropped.
+func MuxH264(r io.Reader, w io.WriteSeeker, opts H264MuxOptions) error {
+	timescale, delta := opts.Timescale, uint32(0)
+	if len(opts.Timestamps) == 0 {
+		if opts.Frame_rate_num == 0 || opts.Frame_rate_den == 0 {
+			return fmt.Errorf("Need a frame rate or timestamps")
+		}
+		timescale, delta = opts.Frame_rate_num, opts.Frame_rate_den
+		// Leave room for timestamp precision like ffmpeg does, 30 fps gets 15360
+		for timescale < 10000 {
+			timescale, delta = timescale*2, delta*2
+		}
+	} else if timescale == 0 {
+		timescale = 90000
+	}
+
+	mdat, err := newMdatWriter(w, newFtyp("avc1", "mp41"))
+	if err != nil {
+		return err
+	}
+	m := &h264Muxer{
+		mdat:       mdat,
+		track:      &trackSpec{Handler: "vide", Timescale: timescale, chunk_samples: 30},
+		sps:        map[uint32][]byte{},
+		pps:        map[uint32][]byte{},
+		parsed_sps: map[uint32]*H264SPS{},
+		pps_sps:    map[uint32]uint32{},
+	}
+	if len(opts.Timestamps) == 0 {
+		m.track.chunk_samples = int((opts.Frame_rate_num + opts.Frame_rate_den - 1) / opts.Frame_rate_den)
+	}
+
+	nals := newAnnexBReader(r)
+	for {
+		nal, err := nals.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = m.addNal(nal); err != nil {
+			return err
+		}
+	}
+	if err = m.flush(); err != nil {
+		return err
+	}
+	samples := m.track.Samples
+	if len(samples) == 0 {
+		return fmt.Errorf("No pictures found in the stream")
+	}
+	if len(m.sps_order) == 0 || len(m.pps_order) == 0 {
+		return fmt.Errorf("No SPS/PPS found in the stream")
+	}
+
+	pts := make([]int64, len(samples))
+	last_duration := delta
+	if len(opts.Timestamps) > 0 {
+		if len(opts.Timestamps) < len(samples) {
+			return fmt.Errorf("%d timestamps for %d frames", len(opts.Timestamps), len(samples))
+		}
+		if len(opts.Timestamps) > len(samples) {
+			logf("%d timestamps for %d frames, ignoring the last ones\n", len(opts.Timestamps), len(samples))
+		}
+		for i := range pts {
+			pts[i] = int64(math.Round(opts.Timestamps[i] * float64(timescale) / 1000))
+		}
+		if n := len(pts); n > 1 {
+			last_duration = uint32((pts[n-1] - pts[0]) / int64(n-1))
+		}
+	} else {
+		// Presentation order is picture order count order within each IDR period
+		rank := make([]int, len(samples))
+		for i := range rank {
+			rank[i] = i
+		}
+		sort.SliceStable(rank, func(i, j int) bool {
+			a, b := m.order[rank[i]], m.order[rank[j]]
+			return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+		})
+		for presented, i := range rank {
+			pts[i] = int64(presented) * int64(delta)
+		}
+	}
+	m.track.Media_time = uint64(setTimestamps(samples, pts, last_duration))
+
+	entry, sps, err := h264SampleEntry(m.sps_order, m.pps_order)
+	if err != nil {
+		return err
+	}
+	m.track.Width, m.track.Height = sps.Width, sps.Height
+	m.track.Entries = []*SampleEntry{entry}
+
+	if err = mdat.finish(); err != nil {
+		return err
+	}
+	return newMoov([]*trackSpec{m.track}).Write(w)
+}
+
+// h264SampleEntry builds the avc1 sample entry of a stream from its
+// parameter sets, the first SPS describing the stream.
+func h264SampleEntry(sps_order, pps_order [][]byte) (*SampleEntry, *H264SPS, error) {
+	sps, err := ParseH264SPS(sps_order[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	avcc := &AvcCBox{
+		Box:                   newBox("avcC"),
+		Configuration_version: 1,
+		Profile:               sps.Profile_idc,
+		Profile_compatibility: sps.Constraint_set_flags,
+		Level:                 sps.Level_idc,
+		Length_size_minus_one: 3,
+		Sps:                   sps_order,
+		Pps:                   pps_order,
+	}
+	if h264HighProfiles[sps.Profile_idc] {
+		avcc.Ext = []byte{0xfc | uint8(sps.Chroma_format_idc), 0xf8 | uint8(sps.Bit_depth_luma_minus8), 0xf8 | uint8(sps.Bit_depth_chroma_minus8), 0}
+	}
+	return &SampleEntry{
+		Box:                  newBox("avc1"),
+		Data_reference_index: 1,
+		Width:                uint16(sps.Width),
+		Height:               uint16(sps.Height),
+		Horizresolution:      0x480000, // 72 dpi
+		Vertresolution:       0x480000,
+		Frame_count:          1,
+		Depth:                0x18,
+		Avcc:                 avcc,
+	}, sps, nil
+}
+
+// addNal adds a NAL unit to the current access unit, first writing out the
+// previous one if the NAL unit starts a new one (H.264 7.4.1.2.3).
+func (m *h264Muxer) addNal(nal []byte) error {
+	t := h264NalType(nal)
+	switch {
+	case t == H264_NAL_SLICE || t == H264_NAL_IDR_SLICE:
+		header, err := parseH264SliceHeader(nal, func(pps_id uint32) *H264SPS {
+			return m.parsed_sps[m.pps_sps[pps_id]]
+		})
+		if err != nil {
+			return err
+		}
+		if m.au_vcl != nil && header.first_mb_in_slice == 0 {
+			if err = m.flush(); err != nil {
+				return err
+			}
+		}
+		if m.au_vcl == nil {
+			m.au_vcl = header
+		}
+	case t == H264_NAL_AUD || t == H264_NAL_SEI || t == H264_NAL_SPS || t == H264_NAL_PPS || (t >= 14 && t <= 18):
+		if m.au_vcl != nil {
+			if err := m.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch t {
+	case H264_NAL_AUD, H264_NAL_FILLER:
+		return nil
+	case H264_NAL_SPS, H264_NAL_PPS:
+		id, sps_id, err := h264ParameterSetId(nal)
+		if err != nil {
+			return err
+		}
+		stored, order := m.pps, &m.pps_order
+		if t == H264_NAL_SPS {
+			sps, err := ParseH264SPS(nal)
+			if err != nil {
+				return err
+			}
+			m.parsed_sps[id] = sps
+			stored, order = m.sps, &m.sps_order
+		} else {
+			m.pps_sps[id] = sps_id
+		}
+		if first, ok := stored[id]; !ok {
+			stored[id] = nal
+			*order = append(*order, nal)
+			return nil
+		} else if bytes.Equal(first, nal) {
+			return nil
+		}
+		// A changed parameter set stays in band
+	}
+	m.au = append(m.au, nal)
+	return nil
+}
+
+// flush writes the current access unit as a sample with 4 byte NAL unit
+// lengths. NAL units not followed by a picture are dropped.
+func (m *h264Muxer) flush() error {
+	header := m.au_vcl
+	if header == nil {
+		m.au = nil
+		return nil
+	}
+	data := make([][]byte, 0, 2*len(m.au))
+	for _, nal := range m.au {
+		data = append(data, binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal)
+	}
+	m.au, m.au_vcl = nil, nil
+
+	if header.idr {
+		m.period++
+		m.prev_poc_msb, m.prev_poc_lsb = 0, 0
+	}
+	poc := int64(len(m.order)) // decoding order without picture order counts
+	if sps := m.parsed_sps[m.pps_sps[header.pps_id]]; sps != nil && header.has_pic_order_lsb {
+		lsb, max_lsb := int64(header.pic_order_cnt_lsb), int64(1)<<(sps.Log2_max_pic_order_cnt_lsb_minus4+4)
+		msb := m.prev_poc_msb
+		if lsb < m.prev_poc_lsb && m.prev_poc_lsb-lsb >= max_lsb/2 {
+			msb += max_lsb
+		} else if lsb > m.prev_poc_lsb && lsb-m.prev_poc_lsb > max_lsb/2 {
+			msb -= max_lsb
+		}
+		poc = msb + lsb
+		if header.nal_ref_idc != 0 {
+			m.prev_poc_msb, m.prev_poc_lsb = msb, lsb
+		}
+	}
+	m.order = append(m.order, [2]int64{int64(m.period), poc})
+
+	return m.mdat.writeSample(m.track, Sample{Sample_description_index: 1, Sync: header.idr}, data...)
+}
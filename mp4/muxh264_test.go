@@ -0,0 +1,139 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testBitString packs a string of 0 and 1 characters, spaces ignored, into
+// bytes padded with zero bits.
+func testBitString(s string) []byte {
+	s = strings.ReplaceAll(s, " ", "")
+	b := make([]byte, (len(s)+7)/8)
+	for i, c := range s {
+		if c == '1' {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return b
+}
+
+// ue returns the Exp-Golomb code of v as a bit string.
+func ue(v uint32) string {
+	code := fmt.Sprintf("%b", v+1)
+	return strings.Repeat("0", len(code)-1) + code
+}
+
+var testPPS = []byte{0x68, 0xce, 0x38, 0x80}
+
+// testPOCSPS is a 320x240 baseline SPS with 4-bit frame_num and
+// pic_order_cnt_lsb.
+var testPOCSPS = append([]byte{0x67, 66, 0xc0, 30},
+	testBitString(ue(0)+ue(0)+ue(0)+ue(0)+ue(1)+"0"+ue(19)+ue(14)+"1 1 0 0 1")...)
+
+// testSlice returns a slice NAL unit of the picture with the given
+// pic_order_cnt_lsb, referenced unless it is a B slice.
+func testSlice(first_mb uint32, kind string, poc_lsb uint32) []byte {
+	header := map[string]byte{"I": 0x65, "P": 0x41, "B": 0x01}[kind]
+	slice_type := map[string]uint32{"I": 7, "P": 5, "B": 6}[kind]
+	bits := ue(first_mb) + ue(slice_type) + ue(0) + "0000"
+	if kind == "I" {
+		bits += ue(0) // idr_pic_id
+	}
+	bits += fmt.Sprintf("%04b", poc_lsb) + "1"
+	return append([]byte{header}, testBitString(bits)...)
+}
+
+func TestParseH264SPS(t *testing.T) {
+	sps, err := ParseH264SPS(testPOCSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != 320 || sps.Height != 240 || sps.Pic_order_cnt_type != 0 || sps.Log2_max_pic_order_cnt_lsb_minus4 != 0 || !sps.Frame_mbs_only_flag {
+		t.Errorf("SPS = %+v", sps)
+	}
+	// 1920x1080 is coded as 1088 lines cropped by 4 chroma lines
+	hd := append([]byte{0x67, 100, 0, 40}, testBitString(ue(0)+ue(1)+ue(0)+ue(0)+"0 0"+ue(0)+ue(2)+ue(4)+"0"+ue(119)+ue(67)+"1 1 1"+ue(0)+ue(0)+ue(0)+ue(4)+"0 1")...)
+	if sps, err = ParseH264SPS(hd); err != nil || sps.Width != 1920 || sps.Height != 1080 {
+		t.Errorf("High profile SPS = %+v, %v, want 1920x1080", sps, err)
+	}
+}
+
+func TestMuxH264(t *testing.T) {
+	type frame struct {
+		nals [][]byte
+		pts  int64 // in frames
+	}
+	frames := []frame{
+		// An IDR picture of two slices after an access unit delimiter
+		{[][]byte{{0x09, 0xf0}, testPOCSPS, testPPS, testSlice(0, "I", 0), testSlice(10, "I", 0)}, 0},
+		{[][]byte{testSlice(0, "P", 6)}, 3},
+		{[][]byte{testSlice(0, "B", 2)}, 1},
+		{[][]byte{testSlice(0, "B", 4)}, 2},
+		// A new IDR period, pic_order_cnt_lsb wrapping after 14
+		{[][]byte{testSlice(0, "I", 0)}, 4},
+	}
+	for i, lsb := range []uint32{2, 4, 6, 8, 10, 12, 14, 0, 2} {
+		frames = append(frames, frame{[][]byte{testSlice(0, "P", lsb)}, int64(5 + i)})
+	}
+	var stream bytes.Buffer
+	for _, fr := range frames {
+		for _, nal := range fr.nals {
+			stream.Write([]byte{0, 0, 0, 1})
+			stream.Write(nal)
+		}
+	}
+
+	f := writeAndOpen(t, "muxed.mp4", func(out *os.File) error {
+		return MuxH264(bytes.NewReader(stream.Bytes()), out, H264MuxOptions{Frame_rate_num: 25, Frame_rate_den: 1})
+	})
+	trak := f.Moov.Traks[0]
+	// 25 fps doubles up to a timescale of 12800
+	if trak.Mdia.Mdhd.Timescale != 12800 {
+		t.Errorf("Timescale = %d, want 12800", trak.Mdia.Mdhd.Timescale)
+	}
+	if len(trak.Samples) != len(frames) {
+		t.Fatalf("%d samples, want %d", len(trak.Samples), len(frames))
+	}
+	media_time := trak.GetMediaTime()
+	for i, s := range trak.Samples {
+		if pts := int64(s.Start_time) + int64(s.Cto) - media_time; pts != frames[i].pts*512 {
+			t.Errorf("Sample %d presented at %d, want %d", i+1, pts, frames[i].pts*512)
+		}
+		if sync := i == 0 || i == 4; s.Sync != sync {
+			t.Errorf("Sample %d sync = %v", i+1, s.Sync)
+		}
+	}
+	// The parameter sets go to avcC, the delimiter is dropped
+	want := bytes.Join([][]byte{u32(uint32(len(frames[0].nals[3]))), frames[0].nals[3], u32(uint32(len(frames[0].nals[4]))), frames[0].nals[4]}, nil)
+	data := make([]byte, trak.Samples[0].Size)
+	if _, err := f.ReadAt(data, int64(trak.Samples[0].Offset)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("First sample = %x, want %x", data, want)
+	}
+	entry := trak.GetSampleEntry(1)
+	if entry == nil || entry.Avcc == nil || len(entry.Avcc.Sps) != 1 || !bytes.Equal(entry.Avcc.Sps[0], testPOCSPS) || entry.Width != 320 || entry.Height != 240 {
+		t.Errorf("Sample entry = %+v", entry)
+	}
+}
+
+func TestMuxH264Timestamps(t *testing.T) {
+	var stream bytes.Buffer
+	for _, nal := range [][]byte{testPOCSPS, testPPS, testSlice(0, "I", 0), testSlice(0, "P", 4), testSlice(0, "B", 2)} {
+		stream.Write(append([]byte{0, 0, 1}, nal...))
+	}
+	f := writeAndOpen(t, "muxed.mp4", func(out *os.File) error {
+		return MuxH264(&stream, out, H264MuxOptions{Timestamps: []float64{0, 80, 40}})
+	})
+	trak := f.Moov.Traks[0]
+	for i, want := range []int64{0, 7200, 3600} {
+		if pts := int64(trak.Samples[i].Start_time) + int64(trak.Samples[i].Cto) - trak.GetMediaTime(); pts != want {
+			t.Errorf("Sample %d presented at %d, want %d", i+1, pts, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	OGG_CONTINUED = 0x01 // header type flags
+	OGG_BOS       = 0x02
+	OGG_EOS       = 0x04
+
+	OGG_MAX_SEGMENTS   = 255
+	OGG_PAGE_DURATION  = 48000 // samples at 48 kHz buffered in a page at most
+	OPUS_SAMPLE_RATE   = 48000
+	OGG_NO_GRANULE_POS = -1
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggCRC returns the page checksum: CRC-32 with polynomial 0x04c11db7,
+// neither reflected nor inverted.
+func oggCRC(data []byte) uint32 {
+	crc := uint32(0)
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggWriter packs the packets of a logical stream into pages.
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+	flags    byte   // of the next page
+	segments []byte // lacing values of the pending page
+	data     []byte
+	granule  int64 // of the last packet ending in the pending page
+	written  int64 // granule position of the last page written
+	err      error
+}
+
+// page writes the pending page, even if empty.
+func (o *oggWriter) page(flags byte) {
+	header := make([]byte, 27, 27+len(o.segments))
+	copy(header, "OggS")
+	header[5] = o.flags | flags
+	binary.LittleEndian.PutUint64(header[6:], uint64(o.granule))
+	binary.LittleEndian.PutUint32(header[14:], o.serial)
+	binary.LittleEndian.PutUint32(header[18:], o.sequence)
+	header[26] = byte(len(o.segments))
+	page := append(append(header, o.segments...), o.data...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	if o.err == nil {
+		_, o.err = o.w.Write(page)
+	}
+	o.sequence++
+	if o.granule != OGG_NO_GRANULE_POS {
+		o.written = o.granule
+	}
+	o.flags = 0
+	o.segments, o.data = o.segments[:0], o.data[:0]
+	o.granule = OGG_NO_GRANULE_POS
+}
+
+// flush writes the pending page if it holds any segment.
+func (o *oggWriter) flush() {
+	if len(o.segments) > 0 {
+		o.page(0)
+	}
+}
+
+// packet adds a packet ending at granule position granule. A packet that
+// does not fit the pending page continues on the next one.
+func (o *oggWriter) packet(data []byte, granule int64) {
+	for continued := false; ; continued = true {
+		n := len(data)
+		if n >= OGG_MAX_SEGMENTS {
+			n = OGG_MAX_SEGMENTS
+		}
+		if len(o.segments) == OGG_MAX_SEGMENTS {
+			o.page(0)
+			if continued {
+				o.flags = OGG_CONTINUED
+			}
+		}
+		o.segments = append(o.segments, byte(n))
+		o.data = append(o.data, data[:n]...)
+		data = data[n:]
+		if n < OGG_MAX_SEGMENTS {
+			o.granule = granule
+			return
+		}
+	}
+}
+
+// WriteOgg writes an Opus track as Ogg Opus (RFC 7845): the OpusHead and
+// OpusTags pages, then the packets in pages of at most a second, with
+// granule positions counting 48 kHz samples from the sample durations. The
+// last page ends at the end of the edit list, trimming the padding of the
+// last packets as RFC 7845 section 4.4 describes.
+func (f *File) WriteOgg(w io.Writer, trak int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	first := t.GetSampleEntry(1)
+	if first == nil || first.Dops == nil {
+		return fmt.Errorf("Not an Opus track")
+	}
+	timescale := t.Mdia.Mdhd.Timescale
+	if timescale == 0 {
+		return fmt.Errorf("Track %d has a zero timescale", trak)
+	}
+
+	o := &oggWriter{w: w, serial: uint32(trak + 1)}
+	if t.Tkhd != nil {
+		o.serial = t.Tkhd.Track_id
+	}
+	o.packet(first.Dops.OpusHead(), 0)
+	o.page(OGG_BOS)
+	tags := append([]byte("OpusTags"), 9, 0, 0, 0)
+	tags = append(tags, "mp4reader"...)
+	tags = append(tags, 0, 0, 0, 0) // no user comment
+	o.packet(tags, 0)
+	o.page(0)
+
+	end := int64(-1) // granule position the edit ends at
+	if d := t.editDuration(); d > 0 && f.Moov.Mvhd != nil && f.Moov.Mvhd.Timescale > 0 {
+		end = int64(math.Round(float64(t.GetMediaTime())*OPUS_SAMPLE_RATE/float64(timescale) +
+			float64(d)*OPUS_SAMPLE_RATE/float64(f.Moov.Mvhd.Timescale)))
+	}
+	elapsed := uint64(0) // in the media timescale
+	page_start := int64(0)
+	err := f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+		if entry.Dops == nil {
+			return fmt.Errorf("Sample description %d changes the codec", s.Sample_description_index)
+		}
+		elapsed += uint64(s.Duration)
+		granule := int64(math.Round(float64(elapsed) * OPUS_SAMPLE_RATE / float64(timescale)))
+		o.packet(data, granule)
+		// Packets past the end of the edit stay in the last page
+		if granule-page_start >= OGG_PAGE_DURATION && (end < 0 || granule < end) {
+			o.flush()
+			page_start = granule
+		}
+		return o.err
+	})
+	if err != nil {
+		return err
+	}
+	// Ends the stream with an empty page if already flushed
+	o.granule = int64(math.Round(float64(elapsed) * OPUS_SAMPLE_RATE / float64(timescale)))
+	if end >= 0 && end < o.granule {
+		if end < o.written {
+			logf("Edit list ends at granule position %d, before the last page, end not trimmed\n", end)
+		} else {
+			o.granule = end
+		}
+	}
+	o.page(OGG_EOS)
+	return o.err
+}
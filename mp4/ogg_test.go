@@ -0,0 +1,162 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testOggPage is a page read back by readOggPages.
+type testOggPage struct {
+	flags    byte
+	granule  int64
+	sequence uint32
+	lacing   []byte
+	data     []byte
+}
+
+// readOggPages splits an Ogg stream into pages, checking their CRCs.
+func readOggPages(t *testing.T, stream []byte) []testOggPage {
+	t.Helper()
+	pages := []testOggPage{}
+	for len(stream) > 0 {
+		if len(stream) < 27 || string(stream[:4]) != "OggS" {
+			t.Fatalf("No page at byte %d", len(stream))
+		}
+		n := int(stream[26])
+		size := 27 + n
+		for _, l := range stream[27 : 27+n] {
+			size += int(l)
+		}
+		page := append([]byte{}, stream[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if got := oggCRC(page); got != crc {
+			t.Errorf("Page %d CRC = %08x, computed %08x", len(pages), crc, got)
+		}
+		pages = append(pages, testOggPage{
+			flags:    page[5],
+			granule:  int64(binary.LittleEndian.Uint64(page[6:])),
+			sequence: binary.LittleEndian.Uint32(page[18:]),
+			lacing:   page[27 : 27+n],
+			data:     page[27+n:],
+		})
+		stream = stream[size:]
+	}
+	return pages
+}
+
+func TestOggCRC(t *testing.T) {
+	if got := oggCRC([]byte("123456789")); got != 0x89a1897f {
+		t.Errorf("oggCRC = %08x, want 89a1897f", got)
+	}
+}
+
+func TestOggLacing(t *testing.T) {
+	tests := []struct {
+		name      string
+		sizes     []int
+		lacing    [][]byte // of each page
+		granules  []int64
+		continued int // index of the page continuing a packet, 0 if none
+	}{
+		{"short", []int{10}, [][]byte{{10}}, []int64{960}, 0},
+		{"255 bytes", []int{255}, [][]byte{{255, 0}}, []int64{960}, 0},
+		{"510 bytes", []int{510, 1}, [][]byte{{255, 255, 0, 1}}, []int64{1920}, 0},
+		{"continued", []int{10, 300 * 255}, [][]byte{append([]byte{10}, bytes.Repeat([]byte{255}, 254)...), append(bytes.Repeat([]byte{255}, 46), 0)},
+			[]int64{960, 1920}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			o := &oggWriter{w: &buf, serial: 7}
+			packets := [][]byte{}
+			for i, size := range tt.sizes {
+				packets = append(packets, bytes.Repeat([]byte{byte(i + 1)}, size))
+				o.packet(packets[i], int64(i+1)*960)
+			}
+			o.page(OGG_EOS)
+			pages := readOggPages(t, buf.Bytes())
+			if len(pages) != len(tt.lacing) {
+				t.Fatalf("%d pages, want %d", len(pages), len(tt.lacing))
+			}
+			data := []byte{}
+			for i, p := range pages {
+				if !bytes.Equal(p.lacing, tt.lacing[i]) {
+					t.Errorf("Page %d lacing = %v, want %v", i, p.lacing, tt.lacing[i])
+				}
+				if p.granule != tt.granules[i] || p.sequence != uint32(i) {
+					t.Errorf("Page %d granule %d sequence %d, want %d and %d", i, p.granule, p.sequence, tt.granules[i], i)
+				}
+				if continued := p.flags&OGG_CONTINUED != 0; continued != (i > 0 && i == tt.continued) {
+					t.Errorf("Page %d continued flag = %v", i, continued)
+				}
+				data = append(data, p.data...)
+			}
+			if !bytes.Equal(data, bytes.Join(packets, nil)) {
+				t.Error("Page data differs from the packets")
+			}
+			if pages[len(pages)-1].flags&OGG_EOS == 0 {
+				t.Error("No EOS flag on the last page")
+			}
+		})
+	}
+}
+
+// testOpusMovie returns 100 Opus packets of 20 ms with a pre-skip of 312.
+func testOpusMovie(edits []testEdit) *testMovie {
+	dops := testBox("dOps", []byte{0, 2}, u16(312), u32(48000), u16(0), []byte{0})
+	return &testMovie{handler: "soun", timescale: 48000, samples: testSamples(100), delta: 960, edits: edits,
+		entry: testAudioEntry("Opus", 48000, dops)}
+}
+
+func TestWriteOgg(t *testing.T) {
+	tests := []struct {
+		name     string
+		edits    []testEdit
+		granules []int64 // of the audio pages
+	}{
+		// The last packet fills the page, an empty one ends the stream
+		{"no edit list", nil, []int64{48000, 96000, 96000}},
+		// The edit hides the pre-skip and ends 1.9 s later, 2 packets
+		// before the end of the media
+		{"end trimmed", []testEdit{{1900, 312}}, []int64{48000, 312 + 1900*48}},
+		{"edit past the end", []testEdit{{2500, 312}}, []int64{48000, 96000, 96000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testOpusMovie(tt.edits)
+			f := openBytes(t, m.build())
+			var buf bytes.Buffer
+			if err := f.WriteOgg(&buf, 0); err != nil {
+				t.Fatalf("WriteOgg: %v", err)
+			}
+			pages := readOggPages(t, buf.Bytes())
+			if len(pages) != 2+len(tt.granules) {
+				t.Fatalf("%d pages, want %d", len(pages), 2+len(tt.granules))
+			}
+			if !bytes.HasPrefix(pages[0].data, []byte("OpusHead")) || pages[0].flags != OGG_BOS {
+				t.Errorf("First page flags %x data %q, want the OpusHead", pages[0].flags, pages[0].data)
+			} else if pre_skip := binary.LittleEndian.Uint16(pages[0].data[10:]); pre_skip != 312 {
+				t.Errorf("Pre-skip = %d, want 312", pre_skip)
+			}
+			if !bytes.HasPrefix(pages[1].data, []byte("OpusTags")) {
+				t.Errorf("Second page data %q, want OpusTags", pages[1].data)
+			}
+			data := []byte{}
+			for i, want := range tt.granules {
+				p := pages[2+i]
+				if p.granule != want {
+					t.Errorf("Page %d granule = %d, want %d", 2+i, p.granule, want)
+				}
+				data = append(data, p.data...)
+			}
+			if pages[len(pages)-1].flags != OGG_EOS {
+				t.Errorf("Last page flags = %x, want EOS", pages[len(pages)-1].flags)
+			}
+			if !bytes.Equal(data, bytes.Join(m.samples, nil)) {
+				t.Error("Page data differs from the samples")
+			}
+		})
+	}
+}
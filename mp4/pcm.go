@@ -0,0 +1,288 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// QuickTime lpcm format specific flags
+const (
+	LPCM_FLAG_FLOAT        = 0x01
+	LPCM_FLAG_BIG_ENDIAN   = 0x02
+	LPCM_FLAG_SIGNED       = 0x04
+	LPCM_FLAG_PACKED       = 0x08
+	LPCM_FLAG_ALIGNED_HIGH = 0x10
+)
+
+// WAVE format tags
+const (
+	WAVE_FORMAT_PCM        = 0x0001
+	WAVE_FORMAT_IEEE_FLOAT = 0x0003
+	WAVE_FORMAT_ALAW       = 0x0006
+	WAVE_FORMAT_MULAW      = 0x0007
+	WAVE_FORMAT_EXTENSIBLE = 0xfffe
+)
+
+// PCMFormat describes the uncompressed or G.711 samples of an audio entry.
+type PCMFormat struct {
+	Channels, Sample_rate int
+	Bits                  int // significant bits of a sample
+	Container             int // bytes of a sample
+	Float                 bool
+	Signed                bool
+	Little_endian         bool
+	Law                   string // "ulaw" or "alaw" for G.711, "" otherwise
+}
+
+// PCMFormat returns the sample format of an lpcm, sowt, twos, ulaw, alaw,
+// ipcm or fpcm entry, from the QuickTime sound description fields or the
+// pcmC box.
+func (b *SampleEntry) PCMFormat() (*PCMFormat, error) {
+	p := &PCMFormat{
+		Channels:    int(b.Channel_count),
+		Sample_rate: int(uint32(b.Sample_rate) >> 16),
+		Bits:        int(b.Sample_size),
+		Signed:      true,
+	}
+	if b.Sound_version == 2 {
+		p.Channels = int(b.Audio_channels)
+		p.Sample_rate = int(math.Round(b.Audio_sample_rate))
+		if b.Bits_per_channel > 0 {
+			p.Bits = int(b.Bits_per_channel)
+		}
+	}
+	switch b.Name {
+	case "sowt":
+		p.Little_endian = true
+	case "twos":
+	case "ulaw", "alaw":
+		p.Law = b.Name
+		p.Bits = 8
+	case "lpcm":
+		if b.Sound_version != 2 {
+			return nil, fmt.Errorf("lpcm entry without a version 2 sound description")
+		}
+		flags := b.Format_specific_flags
+		p.Float = flags&LPCM_FLAG_FLOAT != 0
+		p.Little_endian = flags&LPCM_FLAG_BIG_ENDIAN == 0
+		p.Signed = p.Float || flags&LPCM_FLAG_SIGNED != 0
+		if b.Frames_per_audio_packet == 1 && p.Channels > 0 {
+			p.Container = int(b.Bytes_per_audio_packet) / p.Channels
+		}
+		if p.Container*8 > p.Bits && flags&LPCM_FLAG_PACKED == 0 && flags&LPCM_FLAG_ALIGNED_HIGH == 0 {
+			return nil, fmt.Errorf("lpcm samples aligned low in their container not supported")
+		}
+	case "ipcm", "fpcm":
+		if b.Pcmc == nil {
+			return nil, fmt.Errorf("%v entry without a pcmC box", b.Name)
+		}
+		p.Float = b.Name == "fpcm"
+		p.Little_endian = b.Pcmc.Format_flags&1 != 0
+		p.Bits = int(b.Pcmc.Pcm_sample_size)
+	default:
+		return nil, fmt.Errorf("%v is not PCM audio", b.Name)
+	}
+	if p.Container == 0 {
+		p.Container = (p.Bits + 7) / 8
+	}
+	if p.Channels == 0 || p.Bits == 0 || p.Bits > p.Container*8 || p.Container > 8 {
+		return nil, fmt.Errorf("Invalid %v format: %d channels of %d bits in %d bytes", b.Name, p.Channels, p.Bits, p.Container)
+	}
+	if p.Float && p.Bits != 32 && p.Bits != 64 {
+		return nil, fmt.Errorf("%d-bit floating point samples not supported", p.Bits)
+	}
+	return p, nil
+}
+
+// FrameSize returns the bytes of a sample of every channel.
+func (p *PCMFormat) FrameSize() int {
+	return p.Channels * p.Container
+}
+
+// CodecName returns the ffmpeg codec name and long name of the format,
+// e.g. "pcm_s16le".
+func (p *PCMFormat) CodecName() (string, string) {
+	switch p.Law {
+	case "ulaw":
+		return "pcm_mulaw", "PCM mu-law / G.711 mu-law"
+	case "alaw":
+		return "pcm_alaw", "PCM A-law / G.711 A-law"
+	}
+	bits := p.Container * 8
+	kind, long := "s", "signed"
+	switch {
+	case p.Float:
+		kind, long = "f", "floating point"
+	case !p.Signed:
+		kind, long = "u", "unsigned"
+	}
+	if bits == 8 {
+		return fmt.Sprintf("pcm_%s8", kind), fmt.Sprintf("PCM %s 8-bit", long)
+	}
+	order, long_order := "be", "big-endian"
+	if p.Little_endian {
+		order, long_order = "le", "little-endian"
+	}
+	if p.Float {
+		return fmt.Sprintf("pcm_f%d%s", bits, order), fmt.Sprintf("PCM %d-bit floating point %s", bits, long_order)
+	}
+	return fmt.Sprintf("pcm_%s%d%s", kind, bits, order), fmt.Sprintf("PCM %s %d-bit %s", long, bits, long_order)
+}
+
+// wavFmt returns the body of the WAVE fmt chunk. WAVE_FORMAT_EXTENSIBLE is
+// used for more than two channels, samples over 16 bits or samples not
+// filling their container.
+func (p *PCMFormat) wavFmt() []byte {
+	tag := uint16(WAVE_FORMAT_PCM)
+	switch {
+	case p.Law == "ulaw":
+		tag = WAVE_FORMAT_MULAW
+	case p.Law == "alaw":
+		tag = WAVE_FORMAT_ALAW
+	case p.Float:
+		tag = WAVE_FORMAT_IEEE_FLOAT
+	}
+	extensible := p.Law == "" && (p.Channels > 2 || p.Bits > 16 || p.Bits != p.Container*8)
+
+	buf := []byte{}
+	if extensible {
+		buf = binary.LittleEndian.AppendUint16(buf, WAVE_FORMAT_EXTENSIBLE)
+	} else {
+		buf = binary.LittleEndian.AppendUint16(buf, tag)
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(p.Channels))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(p.Sample_rate))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(p.Sample_rate*p.FrameSize())) // average bytes per second
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(p.FrameSize()))               // block align
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(p.Container*8))
+	if !extensible {
+		if tag != WAVE_FORMAT_PCM {
+			buf = binary.LittleEndian.AppendUint16(buf, 0) // extension size
+		}
+		return buf
+	}
+	buf = binary.LittleEndian.AppendUint16(buf, 22) // extension size
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(p.Bits))
+	buf = binary.LittleEndian.AppendUint32(buf, 0) // channel mask, unspecified
+	// Sub-format GUID: the format tag then the KSDATAFORMAT_SUBTYPE suffix
+	buf = binary.LittleEndian.AppendUint16(buf, tag)
+	return append(buf, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71)
+}
+
+// toWAV converts samples in place to the WAVE layout: little-endian, and
+// unsigned for 8-bit samples, signed for wider ones.
+func (p *PCMFormat) toWAV(data []byte) {
+	if p.Law != "" {
+		return
+	}
+	n := p.Container
+	for i := 0; i+n <= len(data); i += n {
+		sample := data[i : i+n]
+		if !p.Little_endian {
+			for j := 0; j < n/2; j++ {
+				sample[j], sample[n-1-j] = sample[n-1-j], sample[j]
+			}
+		}
+		if !p.Float && (n == 1) == p.Signed {
+			sample[n-1] ^= 0x80
+		}
+	}
+}
+
+// pcmRange is a run of samples read at once.
+type pcmRange struct {
+	offset                   uint64
+	size                     uint64
+	sample_description_index uint32
+}
+
+// pcmRanges returns where the samples of a PCM track are. QuickTime tracks
+// often give every frame a size of 1 in stsz; their chunks are then read
+// whole, a frame per sample.
+func pcmRanges(t *TrakBox, frame int) []pcmRange {
+	per_frame := frame > 1 && len(t.Samples) > 0
+	for _, s := range t.Samples {
+		per_frame = per_frame && s.Size == 1
+	}
+	ranges := []pcmRange{}
+	if per_frame {
+		for _, c := range t.Chunks {
+			ranges = append(ranges, pcmRange{c.Offset, uint64(c.Sample_count) * uint64(frame), c.Sample_description_index})
+		}
+		return ranges
+	}
+	for _, s := range t.Samples {
+		ranges = append(ranges, pcmRange{s.Offset, uint64(s.Size), s.Sample_description_index})
+	}
+	return ranges
+}
+
+// WriteWAV writes a PCM or G.711 track as a RIFF/WAVE file, converting the
+// samples to little-endian and 8-bit ones to unsigned.
+func (f *File) WriteWAV(w io.Writer, trak int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	first := t.GetSampleEntry(1)
+	if first == nil {
+		return fmt.Errorf("Track %d has no sample description", trak)
+	}
+	p, err := first.PCMFormat()
+	if err != nil {
+		return err
+	}
+
+	ranges := pcmRanges(t, p.FrameSize())
+	data_size := uint64(0)
+	for _, r := range ranges {
+		if r.sample_description_index != 1 {
+			entry := t.GetSampleEntry(r.sample_description_index)
+			if entry == nil {
+				return fmt.Errorf("Sample description %d not found", r.sample_description_index)
+			}
+			if other, err := entry.PCMFormat(); err != nil || *other != *p {
+				return fmt.Errorf("Sample description %d changes the sample format", r.sample_description_index)
+			}
+		}
+		data_size += r.size
+	}
+	format := p.wavFmt()
+	header := append([]byte("WAVEfmt "), binary.LittleEndian.AppendUint32(nil, uint32(len(format)))...)
+	header = append(header, format...)
+	if binary.LittleEndian.Uint16(format) != WAVE_FORMAT_PCM {
+		// Formats other than PCM give their length in a fact chunk
+		header = append(header, "fact"...)
+		header = binary.LittleEndian.AppendUint32(header, 4)
+		header = binary.LittleEndian.AppendUint32(header, uint32(data_size/uint64(p.FrameSize())))
+	}
+	riff_size := uint64(len(header)) + 8 + data_size + data_size%2
+	if riff_size > math.MaxUint32 {
+		return fmt.Errorf("%d bytes of samples do not fit a WAVE file", data_size)
+	}
+	header = append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(riff_size))...), header...)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(data_size))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		data := make([]byte, r.size)
+		if _, err := f.ReadAt(data, int64(r.offset)); err != nil {
+			return fmt.Errorf("Reading samples at %d: %v", r.offset, err)
+		}
+		p.toWAV(data)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if data_size%2 == 1 {
+		_, err = w.Write([]byte{0}) // pad byte of the data chunk
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func u16le(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+func u32le(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+
+// testLPCMEntry returns an lpcm entry with a version 2 sound description
+// of one frame per packet.
+func testLPCMEntry(channels, bits, flags uint32) []byte {
+	return testBox("lpcm", make([]byte, 6), u16(1), u16(2), make([]byte, 6), u16(3), u16(16), u16(0xfffe), u16(0), u32(0x10000),
+		u32(72), u64(math.Float64bits(48000)), u32(channels), u32(0x7f000000), u32(bits), u32(flags), u32(channels*bits/8), u32(1))
+}
+
+// testWAV returns a WAVE file of the given fmt, fact and data chunk bodies.
+func testWAV(format, fact, data []byte) []byte {
+	chunk := func(id string, body []byte) []byte {
+		return append(append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+	}
+	body := append([]byte("WAVE"), chunk("fmt ", format)...)
+	if fact != nil {
+		body = append(body, chunk("fact", fact)...)
+	}
+	body = append(body, chunk("data", data)...)
+	if len(data)%2 == 1 {
+		body = append(body, 0)
+	}
+	return chunk("RIFF", body)
+}
+
+func TestWriteWAV(t *testing.T) {
+	fields := func(f ...[]byte) []byte { return bytes.Join(f, nil) }
+	guid := []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71}
+	tests := []struct {
+		name   string
+		entry  []byte
+		frame  int    // bytes per frame, samples of 1 byte in stsz if set
+		data   []byte // samples in the track
+		codec  string
+		format []byte
+		fact   []byte
+		want   []byte
+	}{
+		{
+			name:   "twos 16-bit stereo",
+			entry:  testAudioEntry("twos", 8000),
+			data:   []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0},
+			codec:  "pcm_s16be",
+			format: fields(u16le(WAVE_FORMAT_PCM), u16le(2), u32le(8000), u32le(32000), u16le(4), u16le(16)),
+			want:   []byte{0x34, 0x12, 0x78, 0x56, 0xbc, 0x9a, 0xf0, 0xde},
+		},
+		{
+			name:   "twos 8-bit mono",
+			entry:  testBox("twos", make([]byte, 6), u16(1), make([]byte, 8), u16(1), u16(8), u32(0), u32(8000<<16)),
+			data:   []byte{0x00, 0x7f, 0x80},
+			codec:  "pcm_s8",
+			format: fields(u16le(WAVE_FORMAT_PCM), u16le(1), u32le(8000), u32le(8000), u16le(1), u16le(8)),
+			want:   []byte{0x80, 0xff, 0x00},
+		},
+		{
+			name:  "lpcm 24-bit big-endian in frames of 1 byte",
+			entry: testLPCMEntry(3, 24, LPCM_FLAG_BIG_ENDIAN|LPCM_FLAG_SIGNED|LPCM_FLAG_PACKED),
+			frame: 9,
+			data:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18},
+			codec: "pcm_s24be",
+			format: fields(u16le(WAVE_FORMAT_EXTENSIBLE), u16le(3), u32le(48000), u32le(48000*9), u16le(9), u16le(24),
+				u16le(22), u16le(24), u32le(0), guid),
+			fact: u32le(2),
+			want: []byte{3, 2, 1, 6, 5, 4, 9, 8, 7, 12, 11, 10, 15, 14, 13, 18, 17, 16},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := [][]byte{}
+			if tt.frame > 0 {
+				// QuickTime gives every frame a size of 1
+				for i := 0; i < len(tt.data)/tt.frame; i++ {
+					samples = append(samples, []byte{0})
+				}
+			} else {
+				samples = [][]byte{tt.data}
+			}
+			ftyp := testBox("ftyp", []byte("qt  "), u32(0), []byte("qt  "))
+			trak := testTrak(0, 0, testTrack{id: 1, handler: "soun", timescale: 8000, duration: uint64(len(samples)),
+				stbl: testStbl(tt.entry, samples, 1, nil, nil, uint64(len(ftyp)+8), false)})
+			f := openBytes(t, bytes.Join([][]byte{ftyp, testBox("mdat", tt.data), testBox("moov", testMvhd(0, 0, 1000, 2), trak)}, nil))
+
+			p, err := f.Moov.Traks[0].GetSampleEntry(1).PCMFormat()
+			if err != nil {
+				t.Fatalf("PCMFormat: %v", err)
+			}
+			if codec, _ := p.CodecName(); codec != tt.codec {
+				t.Errorf("Codec %v, want %v", codec, tt.codec)
+			}
+			out := &bytes.Buffer{}
+			if err := f.WriteWAV(out, 0); err != nil {
+				t.Fatalf("WriteWAV: %v", err)
+			}
+			if want := testWAV(tt.format, tt.fact, tt.want); !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("WAVE file\n%x\nwant\n%x", out.Bytes(), want)
+			}
+		})
+	}
+}
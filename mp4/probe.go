@@ -0,0 +1,471 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Seconds between the MP4 epoch (1904-01-01) and the Unix epoch.
+const MP4_EPOCH_OFFSET = int64(2082844800)
+
+// Stream describes one track using ffprobe's -show_streams field names.
+type Stream struct {
+	Index            int               `json:"index"`
+	Codec_name       string            `json:"codec_name,omitempty"`
+	Codec_long_name  string            `json:"codec_long_name,omitempty"`
+	Profile          string            `json:"profile,omitempty"`
+	Codec_type       string            `json:"codec_type"`
+	Codec_tag_string string            `json:"codec_tag_string"`
+	Codec_tag        string            `json:"codec_tag"`
+	Width            int               `json:"width,omitempty"`
+	Height           int               `json:"height,omitempty"`
+	Level            int               `json:"level,omitempty"`
+	Sample_rate      string            `json:"sample_rate,omitempty"`
+	Channels         int               `json:"channels,omitempty"`
+	Id               string            `json:"id"`
+	R_frame_rate     string            `json:"r_frame_rate"`
+	Avg_frame_rate   string            `json:"avg_frame_rate"`
+	Time_base        string            `json:"time_base"`
+	Start_pts        int64             `json:"start_pts"`
+	Start_time       string            `json:"start_time"`
+	Duration_ts      uint64            `json:"duration_ts"`
+	Duration         string            `json:"duration"`
+	Bit_rate         string            `json:"bit_rate,omitempty"`
+	Nb_frames        string            `json:"nb_frames"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+// Format describes the container using ffprobe's -show_format field names.
+type Format struct {
+	Filename         string            `json:"filename"`
+	Nb_streams       int               `json:"nb_streams"`
+	Format_name      string            `json:"format_name"`
+	Format_long_name string            `json:"format_long_name"`
+	Start_time       string            `json:"start_time"`
+	Duration         string            `json:"duration"`
+	Size             string            `json:"size"`
+	Bit_rate         string            `json:"bit_rate,omitempty"`
+	Probe_score      int               `json:"probe_score"`
+	Tags             map[string]string `json:"tags,omitempty"`
+}
+
+// BoxNode is one box of the parsed box tree.
+type BoxNode struct {
+	Type     string    `json:"type"`
+	Offset   int64     `json:"offset"`
+	Size     int64     `json:"size"`
+	Children []BoxNode `json:"children,omitempty"`
+}
+
+// Codec names and descriptions as reported by ffprobe, keyed by sample entry format.
+var codecNames = map[string][2]string{
+	"avc1": {"h264", "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"},
+	"avc3": {"h264", "H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10"},
+	"hvc1": {"hevc", "H.265 / HEVC (High Efficiency Video Coding)"},
+	"hev1": {"hevc", "H.265 / HEVC (High Efficiency Video Coding)"},
+	"av01": {"av1", "Alliance for Open Media AV1"},
+	"vp09": {"vp9", "Google VP9"},
+	"mp4v": {"mpeg4", "MPEG-4 part 2"},
+	"jpeg": {"mjpeg", "Motion JPEG"},
+	"mjpa": {"mjpeg", "Motion JPEG"},
+	"mjpb": {"mjpegb", "Apple MJPEG-B"},
+	"mp4a": {"aac", "AAC (Advanced Audio Coding)"},
+	"Opus": {"opus", "Opus (Opus Interactive Audio Codec)"},
+	"ac-3": {"ac3", "ATSC A/52A (AC-3)"},
+	"ec-3": {"eac3", "ATSC A/52B (AC-3, E-AC-3)"},
+	"tx3g": {"mov_text", "3GPP Timed Text subtitle"},
+	"wvtt": {"webvtt", "WebVTT subtitle"},
+	"stpp": {"ttml", "Timed Text Markup Language"},
+}
+
+var handlerCodecTypes = map[string]string{
+	"vide": "video",
+	"soun": "audio",
+	"text": "subtitle",
+	"sbtl": "subtitle",
+	"subt": "subtitle",
+}
+
+// MP4Time converts a time in seconds since 1904-01-01, as used by mvhd, tkhd
+// and mdhd, to a time.Time.
+func MP4Time(t uint64) time.Time {
+	return time.Unix(int64(t)-MP4_EPOCH_OFFSET, 0).UTC()
+}
+
+func formatCreationTime(t uint64) string {
+	return MP4Time(t).Format("2006-01-02T15:04:05.000000Z")
+}
+
+// GetLanguage returns the ISO-639-2/T language code packed in the mdhd box.
+func (b *MdhdBox) GetLanguage() string {
+	l := b.Language
+	return string([]byte{
+		byte((l>>10)&31) + 0x60,
+		byte((l>>5)&31) + 0x60,
+		byte(l&31) + 0x60,
+	})
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func formatRational(num, den uint64) string {
+	if num == 0 || den == 0 {
+		return "0/0"
+	}
+	g := gcd(num, den)
+	return fmt.Sprintf("%d/%d", num/g, den/g)
+}
+
+func formatSeconds(t float64) string {
+	return fmt.Sprintf("%.6f", t)
+}
+
+func avcProfileName(profile, compatibility uint8) string {
+	switch profile {
+	case 66:
+		if compatibility&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	case 44:
+		return "CAVLC 4:4:4"
+	}
+	return ""
+}
+
+func hevcProfileName(profile uint8) string {
+	switch profile {
+	case 1:
+		return "Main"
+	case 2:
+		return "Main 10"
+	case 3:
+		return "Main Still Picture"
+	case 4:
+		return "Rext"
+	}
+	return ""
+}
+
+func av1ProfileName(profile uint8) string {
+	switch profile {
+	case 0:
+		return "Main"
+	case 1:
+		return "High"
+	case 2:
+		return "Professional"
+	}
+	return ""
+}
+
+func aacProfileName(objectType uint8) string {
+	switch objectType {
+	case 1:
+		return "Main"
+	case 2:
+		return "LC"
+	case 3:
+		return "SSR"
+	case 4:
+		return "LTP"
+	case 5:
+		return "HE-AAC"
+	case 23:
+		return "LD"
+	case 29:
+		return "HE-AACv2"
+	case 39:
+		return "ELD"
+	}
+	return ""
+}
+
+// GetDuration returns the media duration in mdhd timescale units, falling
+// back to the sum of the sample durations if mdhd does not carry one.
+func (b *TrakBox) GetDuration() uint64 {
+	if b.Mdia.Mdhd.Duration != 0 {
+		return uint64(b.Mdia.Mdhd.Duration)
+	}
+	d := uint64(0)
+	for _, s := range b.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+func (b *TrakBox) stream(index int) Stream {
+	timescale := uint64(b.Mdia.Mdhd.Timescale)
+	duration := b.GetDuration()
+	s := Stream{
+		Index:          index,
+		Codec_type:     handlerCodecTypes[b.GetHandlerType()],
+		Id:             fmt.Sprintf("0x%x", b.Tkhd.Track_id),
+		R_frame_rate:   "0/0",
+		Avg_frame_rate: "0/0",
+		Time_base:      formatRational(1, timescale),
+		Duration_ts:    duration,
+		Nb_frames:      fmt.Sprintf("%d", len(b.Samples)),
+		Tags:           map[string]string{},
+	}
+	if s.Codec_type == "" {
+		s.Codec_type = "data"
+	}
+	if timescale != 0 {
+		s.Duration = formatSeconds(float64(duration) / float64(timescale))
+	}
+
+	if entry := b.GetSampleEntry(1); entry != nil {
+		s.Codec_tag_string = entry.Name
+		s.Codec_tag = fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32([]byte(entry.Name)))
+		names := codecNames[entry.Name]
+		s.Codec_name, s.Codec_long_name = names[0], names[1]
+		switch entry.Kind() {
+		case "vide":
+			s.Width, s.Height = int(entry.Width), int(entry.Height)
+		case "soun":
+			s.Sample_rate = fmt.Sprintf("%d", uint32(entry.Sample_rate)>>16)
+			s.Channels = int(entry.Channel_count)
+		}
+		switch {
+		case entry.Avcc != nil:
+			s.Profile = avcProfileName(entry.Avcc.Profile, entry.Avcc.Profile_compatibility)
+			s.Level = int(entry.Avcc.Level)
+		case entry.Hvcc != nil:
+			s.Profile = hevcProfileName(entry.Hvcc.General_profile_idc)
+			s.Level = int(entry.Hvcc.General_level_idc)
+		case entry.Av1c != nil:
+			s.Profile = av1ProfileName(entry.Av1c.Seq_profile)
+			s.Level = int(entry.Av1c.Seq_level_idx_0)
+		case entry.Vpcc != nil:
+			s.Profile = fmt.Sprintf("Profile %d", entry.Vpcc.Profile)
+			s.Level = int(entry.Vpcc.Level)
+		case entry.Dops != nil:
+			s.Channels = int(entry.Dops.Output_channel_count)
+		case entry.Dac3 != nil:
+			s.Sample_rate = fmt.Sprintf("%d", entry.Dac3.SampleRate())
+			s.Channels = entry.Dac3.Channels()
+		case entry.Dec3 != nil:
+			s.Sample_rate = fmt.Sprintf("%d", entry.Dec3.SampleRate())
+			s.Channels = entry.Dec3.Channels()
+		case entry.Kind() == "soun":
+			if p, err := entry.PCMFormat(); err == nil {
+				s.Codec_name, s.Codec_long_name = p.CodecName()
+				s.Sample_rate = fmt.Sprintf("%d", p.Sample_rate)
+				s.Channels = p.Channels
+			}
+		case entry.Esds != nil:
+			switch entry.Esds.Object_type_indication {
+			case 0x69, 0x6B:
+				s.Codec_name, s.Codec_long_name = "mp3", "MP3 (MPEG audio layer 3)"
+			case 0x40, 0x66, 0x67, 0x68:
+				if asc, err := entry.Esds.AudioSpecificConfig(); err == nil {
+					s.Profile = aacProfileName(asc.Object_type)
+					if asc.Sampling_frequency != 0 {
+						s.Sample_rate = fmt.Sprintf("%d", asc.Sampling_frequency)
+					}
+					if asc.Channel_configuration != 0 {
+						s.Channels = int(asc.Channel_configuration)
+					}
+				}
+			}
+		}
+	}
+
+	if s.Codec_type == "video" && len(b.Samples) > 0 {
+		// The most common sample delta gives the real base frame rate
+		deltas := map[uint32]int{}
+		common := uint32(0)
+		for _, sample := range b.Samples {
+			deltas[sample.Duration]++
+			if deltas[sample.Duration] > deltas[common] {
+				common = sample.Duration
+			}
+		}
+		s.R_frame_rate = formatRational(timescale, uint64(common))
+		s.Avg_frame_rate = formatRational(uint64(len(b.Samples))*timescale, duration)
+	}
+
+	bytes := uint64(0)
+	for _, sample := range b.Samples {
+		bytes += uint64(sample.Size)
+	}
+	s.Start_pts = b.GetStartPts()
+	if timescale != 0 {
+		s.Start_time = formatSeconds(float64(s.Start_pts) / float64(timescale))
+		if duration != 0 {
+			s.Bit_rate = fmt.Sprintf("%d", bytes*8*timescale/duration)
+		}
+	}
+
+	if b.Mdia.Mdhd.Creation_time != 0 {
+		s.Tags["creation_time"] = formatCreationTime(b.Mdia.Mdhd.Creation_time)
+	}
+	s.Tags["language"] = b.Mdia.Mdhd.GetLanguage()
+	if b.Mdia.Hdlr != nil {
+		if name := strings.TrimRight(b.Mdia.Hdlr.Track_name, "\x00"); name != "" {
+			s.Tags["handler_name"] = name
+		}
+	}
+	return s
+}
+
+// GetStartPts returns the presentation time of the earliest sample after
+// applying the edit list, in mdhd timescale units.
+func (b *TrakBox) GetStartPts() int64 {
+	first_pts := int64(-1)
+	for _, sample := range b.Samples {
+		pts := int64(sample.Start_time) + int64(int32(sample.Cto))
+		if first_pts < 0 || pts < first_pts {
+			first_pts = pts
+		}
+	}
+	if first_pts < 0 {
+		first_pts = 0
+	}
+	return first_pts - b.GetMediaTime()
+}
+
+// GetMediaTime returns the media time the first non-empty edit starts at,
+// i.e. the amount of media hidden from presentation, in mdhd timescale units
+// on the timeline of the sample times.
+func (b *TrakBox) GetMediaTime() int64 {
+	media_time := int64(0)
+	if b.Edts != nil && b.Edts.Elst != nil {
+		for _, mt := range b.Edts.Elst.Media_time {
+			if mt != -1 {
+				media_time = mt
+				break
+			}
+		}
+	}
+	return media_time - int64(b.decode_time_base)
+}
+
+// editDuration returns the duration of the first non-empty edit in the
+// movie timescale, 0 if the track has none.
+func (b *TrakBox) editDuration() uint64 {
+	if b.Edts != nil && b.Edts.Elst != nil {
+		for i, mt := range b.Edts.Elst.Media_time {
+			if mt != -1 && i < len(b.Edts.Elst.Segment_duration) {
+				return b.Edts.Elst.Segment_duration[i]
+			}
+		}
+	}
+	return 0
+}
+
+// editMediaTime returns GetMediaTime for writing an edit list on the sample
+// timeline: 0 if the edit starts before the samples, as it does for
+// fragmented tracks rebased onto their first fragment.
+func (b *TrakBox) editMediaTime() uint64 {
+	if media_time := b.GetMediaTime(); media_time > 0 {
+		return uint64(media_time)
+	}
+	return 0
+}
+
+// Streams returns a summary of every track, in trak order.
+func (f *File) Streams() []Stream {
+	streams := []Stream{}
+	for i, trak := range f.Moov.Traks {
+		streams = append(streams, trak.stream(i))
+	}
+	return streams
+}
+
+// Format returns a summary of the whole file.
+func (f *File) Format() Format {
+	format := Format{
+		Filename:         f.Name(),
+		Nb_streams:       len(f.Moov.Traks),
+		Format_name:      "mov,mp4,m4a,3gp,3g2,mj2",
+		Format_long_name: "QuickTime / MOV",
+		Start_time:       formatSeconds(0),
+		Size:             fmt.Sprintf("%d", f.Size),
+		Probe_score:      100,
+		Tags:             map[string]string{},
+	}
+
+	start := 0.0
+	for i, trak := range f.Moov.Traks {
+		if trak.Mdia.Mdhd.Timescale == 0 {
+			continue
+		}
+		t := float64(trak.GetStartPts()) / float64(trak.Mdia.Mdhd.Timescale)
+		if i == 0 || t < start {
+			start = t
+		}
+	}
+	format.Start_time = formatSeconds(start)
+
+	if mvhd := f.Moov.Mvhd; mvhd != nil && mvhd.Timescale != 0 {
+		duration := float64(mvhd.Duration) / float64(mvhd.Timescale)
+		format.Duration = formatSeconds(duration)
+		if duration > 0 {
+			format.Bit_rate = fmt.Sprintf("%d", int64(float64(f.Size*8)/duration))
+		}
+		if mvhd.Creation_time != 0 {
+			format.Tags["creation_time"] = formatCreationTime(mvhd.Creation_time)
+		}
+	}
+
+	if f.Ftyp != nil {
+		format.Tags["major_brand"] = f.Ftyp.Major_brand
+		format.Tags["minor_version"] = fmt.Sprintf("%d", binary.BigEndian.Uint32([]byte(f.Ftyp.Minor_version)))
+		format.Tags["compatible_brands"] = strings.Join(f.Ftyp.Compatible_brands, "")
+	}
+	return format
+}
+
+func boxTree(boxes []*Box) []BoxNode {
+	nodes := []BoxNode{}
+	for _, b := range boxes {
+		nodes = append(nodes, BoxNode{
+			Type:     b.Name,
+			Offset:   b.Start,
+			Size:     b.Size,
+			Children: boxTree(b.children),
+		})
+	}
+	return nodes
+}
+
+// BoxTree returns every box found while parsing, in file order.
+func (f *File) BoxTree() []BoxNode {
+	return boxTree(f.boxes)
+}
+
+// MarshalJSON emits the ffprobe compatible streams and format summary
+// together with the box tree.
+func (f *File) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Streams []Stream  `json:"streams"`
+		Format  Format    `json:"format"`
+		Boxes   []BoxNode `json:"boxes"`
+	}{
+		Streams: f.Streams(),
+		Format:  f.Format(),
+		Boxes:   f.BoxTree(),
+	})
+}
@@ -0,0 +1,954 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	VISUAL_SAMPLE_ENTRY_SIZE = int64(78) // SampleEntry + VisualSampleEntry fields
+	AUDIO_SAMPLE_ENTRY_SIZE  = int64(28) // SampleEntry + AudioSampleEntry fields
+	TEXT_SAMPLE_ENTRY_SIZE   = int64(38) // SampleEntry + 3GPP TextSampleEntry fields
+
+	// Fields a QuickTime sound description adds after the AudioSampleEntry
+	// ones, by version
+	SOUND_DESCRIPTION_V1_SIZE = int64(16)
+	SOUND_DESCRIPTION_V2_SIZE = int64(36)
+)
+
+// Handler type of the sample entry formats whose fields we know how to parse.
+var sampleEntryKinds = map[string]string{
+	"avc1": "vide",
+	"avc3": "vide",
+	"hvc1": "vide",
+	"hev1": "vide",
+	"av01": "vide",
+	"vp09": "vide",
+	"jpeg": "vide",
+	"mjpa": "vide",
+	"mjpb": "vide",
+	"mp4v": "vide",
+	"mp4a": "soun",
+	"Opus": "soun",
+	"lpcm": "soun",
+	"sowt": "soun",
+	"twos": "soun",
+	"ulaw": "soun",
+	"alaw": "soun",
+	"ipcm": "soun",
+	"fpcm": "soun",
+	"ac-3": "soun",
+	"ec-3": "soun",
+	"tx3g": "text",
+	"wvtt": "text",
+	"stpp": "subt",
+}
+
+// SampleEntry is one entry of the stsd box, e.g. avc1 or mp4a. Visual fields
+// are only filled in for video entries and audio fields for audio entries.
+type SampleEntry struct {
+	*Box
+	Data_reference_index uint16
+
+	// VisualSampleEntry
+	Width, Height                   uint16
+	Horizresolution, Vertresolution Fixed32
+	Frame_count                     uint16
+	Compressorname                  string
+	Depth                           uint16
+
+	// AudioSampleEntry
+	Channel_count, Sample_size uint16
+	Sample_rate                Fixed32
+
+	// QuickTime sound description, version 1 and 2 fields
+	Sound_version                                                           uint16
+	Samples_per_packet, Bytes_per_packet, Bytes_per_frame, Bytes_per_sample uint32
+	Audio_sample_rate                                                       float64
+	Audio_channels, Bits_per_channel, Format_specific_flags                 uint32
+	Bytes_per_audio_packet, Frames_per_audio_packet                         uint32
+
+	// 3GPP TextSampleEntry
+	Display_flags                                    uint32
+	Horizontal_justification, Vertical_justification int8
+	Background_color                                 [4]byte  // RGBA
+	Default_text_box                                 [4]int16 // top, left, bottom, right
+	Default_style                                    [12]byte // StyleRecord
+
+	// XMLSubtitleSampleEntry
+	Namespace, Schema_location, Auxiliary_mime_types string
+
+	Vtt_config string // WebVTT file header of a wvtt entry, from vttC
+
+	Avcc *AvcCBox
+	Hvcc *HvcCBox
+	Av1c *Av1CBox
+	Vpcc *VpcCBox
+	Esds *EsdsBox
+	Dops *DOpsBox
+	Pcmc *PcmCBox
+	Dac3 *Dac3Box
+	Dec3 *Dec3Box
+	Pasp *PaspBox
+
+	fields       []byte // fixed fields as read, so reserved bytes are written back unchanged
+	stsd_version uint8  // of the stsd box, telling ISO and QuickTime audio entries apart
+	// The entry or some of its children failed to parse and are written back
+	// as read
+	raw          bool
+	raw_children []*Box
+}
+
+// Kind returns the handler type ("vide", "soun", ...) the entry format
+// belongs to, or "" if the format is unknown.
+func (b *SampleEntry) Kind() string {
+	return sampleEntryKinds[b.Name]
+}
+
+// soundDescriptionSize returns the size of the QuickTime sound description
+// fields following the AudioSampleEntry ones and sets Sound_version. An
+// ISO entry in a version 1 stsd carries its own version 1 with no extra
+// fields.
+func (b *SampleEntry) soundDescriptionSize(version uint16) int64 {
+	if b.stsd_version != 0 {
+		return 0
+	}
+	b.Sound_version = version
+	switch version {
+	case 1:
+		return SOUND_DESCRIPTION_V1_SIZE
+	case 2:
+		return SOUND_DESCRIPTION_V2_SIZE
+	}
+	return 0
+}
+
+func (b *SampleEntry) parse() (err error) {
+	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("Sample entry %v too short: %d bytes", b.Name, len(data))
+	}
+	// Skip 6 bytes for reserved space
+	b.Data_reference_index = binary.BigEndian.Uint16(data[6:8])
+
+	var fieldsSize int64
+	switch b.Kind() {
+	case "vide":
+		fieldsSize = VISUAL_SAMPLE_ENTRY_SIZE
+		if int64(len(data)) < fieldsSize {
+			return fmt.Errorf("Visual sample entry %v too short: %d bytes", b.Name, len(data))
+		}
+		// Skip 16 bytes for pre_defined and reserved space
+		b.Width = binary.BigEndian.Uint16(data[24:26])
+		b.Height = binary.BigEndian.Uint16(data[26:28])
+		b.Horizresolution, _ = MakeFixed32(data[28:32])
+		b.Vertresolution, _ = MakeFixed32(data[32:36])
+		// Skip 4 bytes for reserved space
+		b.Frame_count = binary.BigEndian.Uint16(data[40:42])
+		// compressorname is a pascal string padded to 32 bytes
+		n := int(data[42])
+		if n > 31 {
+			n = 31
+		}
+		b.Compressorname = string(data[43 : 43+n])
+		b.Depth = binary.BigEndian.Uint16(data[74:76])
+		b.fields = data[:fieldsSize]
+	case "soun":
+		fieldsSize = AUDIO_SAMPLE_ENTRY_SIZE
+		if int64(len(data)) < fieldsSize {
+			return fmt.Errorf("Audio sample entry %v too short: %d bytes", b.Name, len(data))
+		}
+		// Skip 8 bytes for reserved space
+		b.Channel_count = binary.BigEndian.Uint16(data[16:18])
+		b.Sample_size = binary.BigEndian.Uint16(data[18:20])
+		// Skip 4 bytes for pre_defined and reserved space
+		b.Sample_rate, _ = MakeFixed32(data[24:28])
+		fieldsSize += b.soundDescriptionSize(binary.BigEndian.Uint16(data[8:10]))
+		if int64(len(data)) < fieldsSize {
+			return fmt.Errorf("Sound description %v too short: %d bytes", b.Name, len(data))
+		}
+		switch b.Sound_version {
+		case 1:
+			b.Samples_per_packet = binary.BigEndian.Uint32(data[28:32])
+			b.Bytes_per_packet = binary.BigEndian.Uint32(data[32:36])
+			b.Bytes_per_frame = binary.BigEndian.Uint32(data[36:40])
+			b.Bytes_per_sample = binary.BigEndian.Uint32(data[40:44])
+		case 2:
+			// Skip 4 bytes for sizeOfStructOnly
+			b.Audio_sample_rate = math.Float64frombits(binary.BigEndian.Uint64(data[32:40]))
+			b.Audio_channels = binary.BigEndian.Uint32(data[40:44])
+			// Skip 4 bytes for always7F000000
+			b.Bits_per_channel = binary.BigEndian.Uint32(data[48:52])
+			b.Format_specific_flags = binary.BigEndian.Uint32(data[52:56])
+			b.Bytes_per_audio_packet = binary.BigEndian.Uint32(data[56:60])
+			b.Frames_per_audio_packet = binary.BigEndian.Uint32(data[60:64])
+		}
+		b.fields = data[:fieldsSize]
+	case "text":
+		fieldsSize = 8
+		if b.Name == "tx3g" {
+			fieldsSize = TEXT_SAMPLE_ENTRY_SIZE
+		}
+		if int64(len(data)) < fieldsSize {
+			return fmt.Errorf("Text sample entry %v too short: %d bytes", b.Name, len(data))
+		}
+		if b.Name == "tx3g" {
+			b.Display_flags = binary.BigEndian.Uint32(data[8:12])
+			b.Horizontal_justification = int8(data[12])
+			b.Vertical_justification = int8(data[13])
+			copy(b.Background_color[:], data[14:18])
+			for i := range b.Default_text_box {
+				b.Default_text_box[i] = int16(binary.BigEndian.Uint16(data[18+2*i:]))
+			}
+			copy(b.Default_style[:], data[26:38])
+		}
+		b.fields = data[:fieldsSize]
+	case "subt":
+		// namespace, schema_location and auxiliary_mime_types are null
+		// terminated strings
+		fieldsSize = 8
+		strs := []*string{&b.Namespace, &b.Schema_location, &b.Auxiliary_mime_types}
+		for _, str := range strs {
+			n := bytes.IndexByte(data[fieldsSize:], 0)
+			if n < 0 {
+				return fmt.Errorf("XML subtitle sample entry %v: unterminated string", b.Name)
+			}
+			*str = string(data[fieldsSize : fieldsSize+int64(n)])
+			fieldsSize += int64(n) + 1
+		}
+		b.fields = data[:fieldsSize]
+	default:
+		logf("Unknown sample entry format %v, skip parsing\n", b.Name)
+		return nil
+	}
+
+	boxes := readBoxes(b.File, b.Start+BOX_HEADER_SIZE+fieldsSize, b.Size-BOX_HEADER_SIZE-fieldsSize)
+	for subBox := range boxes {
+		b.children = append(b.children, subBox)
+		switch subBox.Name {
+		case "avcC":
+			if avcc := (&AvcCBox{Box: subBox}); b.parseChild(avcc) {
+				b.Avcc = avcc
+			}
+		case "hvcC":
+			if hvcc := (&HvcCBox{Box: subBox}); b.parseChild(hvcc) {
+				b.Hvcc = hvcc
+			}
+		case "av1C":
+			if av1c := (&Av1CBox{Box: subBox}); b.parseChild(av1c) {
+				b.Av1c = av1c
+			}
+		case "vpcC":
+			if vpcc := (&VpcCBox{Box: subBox}); b.parseChild(vpcc) {
+				b.Vpcc = vpcc
+			}
+		case "esds":
+			if esds := (&EsdsBox{Box: subBox}); b.parseChild(esds) {
+				b.Esds = esds
+			}
+		case "dOps":
+			if dops := (&DOpsBox{Box: subBox}); b.parseChild(dops) {
+				b.Dops = dops
+			}
+		case "dac3":
+			if dac3 := (&Dac3Box{Box: subBox}); b.parseChild(dac3) {
+				b.Dac3 = dac3
+			}
+		case "dec3":
+			if dec3 := (&Dec3Box{Box: subBox}); b.parseChild(dec3) {
+				b.Dec3 = dec3
+			}
+		case "pcmC":
+			if pcmc := (&PcmCBox{Box: subBox}); b.parseChild(pcmc) {
+				b.Pcmc = pcmc
+			}
+		case "pasp":
+			if pasp := (&PaspBox{Box: subBox}); b.parseChild(pasp) {
+				b.Pasp = pasp
+			}
+		case "vttC":
+			b.Vtt_config = string(subBox.ReadBoxData())
+		default:
+			logf("Unhandled %v Sub-Box: %v \n", b.Name, subBox.Name)
+		}
+	}
+	return nil
+}
+
+// parseChild parses a child box of the entry. A box which fails to parse
+// is logged and kept as read, so that the entry remains usable.
+func (b *SampleEntry) parseChild(child interface {
+	boxWriter
+	parse() error
+}) bool {
+	if err := child.parse(); err != nil {
+		logf("%v entry: %v box ignored: %v\n", b.Name, child.box().Name, err)
+		b.raw_children = append(b.raw_children, child.box())
+		return false
+	}
+	return true
+}
+
+// PaspBox holds the pixel aspect ratio of a visual sample entry.
+type PaspBox struct {
+	*Box
+	H_spacing, V_spacing uint32
+}
+
+func (b *PaspBox) parse() error {
+	data := b.ReadBoxData()
+	if len(data) < 8 {
+		return fmt.Errorf("pasp box too short: %d bytes", len(data))
+	}
+	b.H_spacing = binary.BigEndian.Uint32(data[0:4])
+	b.V_spacing = binary.BigEndian.Uint32(data[4:8])
+	return nil
+}
+
+// AvcCBox holds the AVCDecoderConfigurationRecord of an avc1/avc3 entry.
+type AvcCBox struct {
+	*Box
+	Configuration_version uint8
+	Profile               uint8
+	Profile_compatibility uint8
+	Level                 uint8
+	Length_size_minus_one uint8
+	Sps, Pps              [][]byte
+	Ext                   []byte // High profile chroma format and bit depth fields, if any
+
+	reserved []byte // reserved bits of the length size and SPS count bytes as read
+}
+
+func (b *AvcCBox) parse() error {
+	data := b.ReadBoxData()
+	if len(data) < 6 {
+		return fmt.Errorf("avcC box too short: %d bytes", len(data))
+	}
+	b.Configuration_version = data[0]
+	b.Profile = data[1]
+	b.Profile_compatibility = data[2]
+	b.Level = data[3]
+	b.Length_size_minus_one = data[4] & 3
+	b.reserved = []byte{data[4] &^ 3, data[5] &^ 31}
+	sps, offset, err := readNalArray(data, 6, int(data[5]&31))
+	if err != nil {
+		return err
+	}
+	b.Sps = sps
+	if offset >= len(data) {
+		return fmt.Errorf("avcC box too short, missing pps")
+	}
+	b.Pps, offset, err = readNalArray(data, offset+1, int(data[offset]))
+	if err != nil {
+		return err
+	}
+	b.Ext = data[offset:]
+	return nil
+}
+
+// readNalArray reads count 16-bit length prefixed NAL units starting at
+// data[offset]. It returns the NAL units and the offset just past them.
+func readNalArray(data []byte, offset, count int) ([][]byte, int, error) {
+	nals := [][]byte{}
+	for i := 0; i < count; i++ {
+		if offset+2 > len(data) {
+			return nil, offset, fmt.Errorf("NAL array truncated at %d", offset)
+		}
+		n := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+		offset += 2
+		if offset+n > len(data) {
+			return nil, offset, fmt.Errorf("NAL unit truncated at %d, need %d bytes", offset, n)
+		}
+		nals = append(nals, data[offset:offset+n])
+		offset += n
+	}
+	return nals, offset, nil
+}
+
+// HvcCBox holds the HEVCDecoderConfigurationRecord of a hvc1/hev1 entry.
+type HvcCBox struct {
+	*Box
+	Configuration_version               uint8
+	General_profile_space               uint8
+	General_tier_flag                   uint8
+	General_profile_idc                 uint8
+	General_profile_compatibility_flags uint32
+	General_constraint_indicator_flags  uint64 // 48 bits
+	General_level_idc                   uint8
+	Min_spatial_segmentation_idc        uint16
+	Parallelism_type                    uint8
+	Chroma_format_idc                   uint8
+	Bit_depth_luma_minus8               uint8
+	Bit_depth_chroma_minus8             uint8
+	Avg_frame_rate                      uint16
+	Constant_frame_rate                 uint8
+	Num_temporal_layers                 uint8
+	Temporal_id_nested                  uint8
+	Length_size_minus_one               uint8
+	Arrays                              []HvcCArray
+
+	reserved []byte // reserved bits of bytes 13 to 18 as read
+}
+
+// HvcCArray is a list of parameter set NAL units of a single type.
+type HvcCArray struct {
+	Array_completeness uint8
+	Nal_unit_type      uint8
+	Nalus              [][]byte
+
+	reserved uint8 // as read
+}
+
+func (b *HvcCBox) parse() (err error) {
+	data := b.ReadBoxData()
+	if len(data) < 23 {
+		return fmt.Errorf("hvcC box too short: %d bytes", len(data))
+	}
+	b.Configuration_version = data[0]
+	b.General_profile_space = data[1] >> 6
+	b.General_tier_flag = (data[1] >> 5) & 1
+	b.General_profile_idc = data[1] & 31
+	b.General_profile_compatibility_flags = binary.BigEndian.Uint32(data[2:6])
+	b.General_constraint_indicator_flags = uint64(binary.BigEndian.Uint16(data[6:8]))<<32 | uint64(binary.BigEndian.Uint32(data[8:12]))
+	b.General_level_idc = data[12]
+	b.Min_spatial_segmentation_idc = binary.BigEndian.Uint16(data[13:15]) & 0x0fff
+	b.Parallelism_type = data[15] & 3
+	b.Chroma_format_idc = data[16] & 3
+	b.Bit_depth_luma_minus8 = data[17] & 7
+	b.Bit_depth_chroma_minus8 = data[18] & 7
+	b.Avg_frame_rate = binary.BigEndian.Uint16(data[19:21])
+	b.Constant_frame_rate = data[21] >> 6
+	b.Num_temporal_layers = (data[21] >> 3) & 7
+	b.Temporal_id_nested = (data[21] >> 2) & 1
+	b.Length_size_minus_one = data[21] & 3
+	b.reserved = []byte{data[13] & 0xf0, 0, data[15] &^ 3, data[16] &^ 3, data[17] &^ 7, data[18] &^ 7}
+
+	num_arrays := int(data[22])
+	offset := 23
+	for i := 0; i < num_arrays; i++ {
+		if offset+3 > len(data) {
+			return fmt.Errorf("hvcC array %d truncated", i)
+		}
+		array := HvcCArray{
+			Array_completeness: data[offset] >> 7,
+			Nal_unit_type:      data[offset] & 63,
+			reserved:           data[offset] >> 6 & 1,
+		}
+		num_nalus := int(binary.BigEndian.Uint16(data[offset+1 : offset+3]))
+		offset += 3
+		for j := 0; j < num_nalus; j++ {
+			if offset+2 > len(data) {
+				return fmt.Errorf("hvcC nal unit %d of array %d truncated", j, i)
+			}
+			n := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+			offset += 2
+			if offset+n > len(data) {
+				return fmt.Errorf("hvcC nal unit %d of array %d truncated", j, i)
+			}
+			array.Nalus = append(array.Nalus, data[offset:offset+n])
+			offset += n
+		}
+		b.Arrays = append(b.Arrays, array)
+	}
+	return nil
+}
+
+// ParameterSets returns the VPS, SPS and PPS NAL units in that order.
+func (b *HvcCBox) ParameterSets() [][]byte {
+	nals := [][]byte{}
+	for _, t := range []uint8{32, 33, 34} {
+		for _, a := range b.Arrays {
+			if a.Nal_unit_type == t {
+				nals = append(nals, a.Nalus...)
+			}
+		}
+	}
+	return nals
+}
+
+// Av1CBox holds the AV1CodecConfigurationRecord of an av01 entry.
+type Av1CBox struct {
+	*Box
+	Version                              uint8
+	Seq_profile                          uint8
+	Seq_level_idx_0                      uint8
+	Seq_tier_0                           uint8
+	High_bitdepth                        uint8
+	Twelve_bit                           uint8
+	Monochrome                           uint8
+	Chroma_subsampling_x                 uint8
+	Chroma_subsampling_y                 uint8
+	Chroma_sample_position               uint8
+	Initial_presentation_delay_present   uint8
+	Initial_presentation_delay_minus_one uint8
+	Config_obus                          []byte // sequence header and metadata OBUs, low overhead format
+
+	no_marker bool // the marker bit is not set, kept so the box is written back unchanged
+}
+
+func (b *Av1CBox) parse() error {
+	data := b.ReadBoxData()
+	if len(data) < 4 {
+		return fmt.Errorf("av1C box too short: %d bytes", len(data))
+	}
+	if data[0]>>7 != 1 {
+		logf("av1C marker bit not set\n")
+		b.no_marker = true
+	}
+	b.Version = data[0] & 0x7f
+	b.Seq_profile = data[1] >> 5
+	b.Seq_level_idx_0 = data[1] & 31
+	b.Seq_tier_0 = data[2] >> 7
+	b.High_bitdepth = (data[2] >> 6) & 1
+	b.Twelve_bit = (data[2] >> 5) & 1
+	b.Monochrome = (data[2] >> 4) & 1
+	b.Chroma_subsampling_x = (data[2] >> 3) & 1
+	b.Chroma_subsampling_y = (data[2] >> 2) & 1
+	b.Chroma_sample_position = data[2] & 3
+	b.Initial_presentation_delay_present = (data[3] >> 4) & 1
+	if b.Initial_presentation_delay_present == 1 {
+		b.Initial_presentation_delay_minus_one = data[3] & 15
+	}
+	b.Config_obus = data[4:]
+	return nil
+}
+
+// BitDepth returns the sample bit depth, 8, 10 or 12.
+func (b *Av1CBox) BitDepth() int {
+	switch {
+	case b.Twelve_bit == 1:
+		return 12
+	case b.High_bitdepth == 1:
+		return 10
+	}
+	return 8
+}
+
+// VpcCBox holds the VPCodecConfigurationRecord of a vp09 entry, version 1
+// of the VP codec ISO media file format binding. Version 0 records, from
+// drafts of the binding, have no colour fields but a colour space and a
+// transfer function instead.
+type VpcCBox struct {
+	*Box
+	Version                   uint8
+	Flags                     [3]byte
+	Profile                   uint8
+	Level                     uint8
+	Bit_depth                 uint8
+	Chroma_subsampling        uint8 // 0 and 1 4:2:0 vertical and colocated, 2 4:2:2, 3 4:4:4
+	Video_full_range_flag     uint8
+	Colour_primaries          uint8
+	Transfer_characteristics  uint8
+	Matrix_coefficients       uint8
+	Codec_initialization_data []byte
+
+	color_space, transfer_function uint8 // version 0
+}
+
+func (b *VpcCBox) parse() error {
+	r := &fieldReader{name: "vpcC", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Profile = r.u8()
+	b.Level = r.u8()
+	v := r.u8()
+	b.Bit_depth = v >> 4
+	if b.Version == 0 {
+		b.color_space = v & 15
+		v = r.u8()
+		b.Chroma_subsampling = v >> 4
+		b.transfer_function = (v >> 1) & 7
+		b.Video_full_range_flag = v & 1
+		b.Codec_initialization_data = r.next(int(r.u16()))
+		return r.err
+	}
+	if b.Version != 1 {
+		logf("vpcC version %d, reading it as version 1\n", b.Version)
+	}
+	b.Chroma_subsampling = (v >> 1) & 7
+	b.Video_full_range_flag = v & 1
+	b.Colour_primaries = r.u8()
+	b.Transfer_characteristics = r.u8()
+	b.Matrix_coefficients = r.u8()
+	b.Codec_initialization_data = r.next(int(r.u16()))
+	return r.err
+}
+
+// EsdsBox holds the MPEG-4 elementary stream descriptor of an mp4a entry.
+type EsdsBox struct {
+	*Box
+	Version                uint8
+	Flags                  [3]byte
+	Es_id                  uint16
+	Object_type_indication uint8
+	Stream_type            uint8
+	Buffer_size_db         uint32
+	Max_bitrate            uint32
+	Avg_bitrate            uint32
+	Decoder_specific_info  []byte
+
+	// Parts of the descriptors kept as read so the box can be written back
+	// unchanged: the size field widths of the ES, DecoderConfig and
+	// DecoderSpecificInfo descriptors, the ES_Descriptor flags and the
+	// optional fields they announce, the stream type flags, anything
+	// following the
+	// DecoderSpecificInfo and anything following the DecoderConfigDescriptor
+	// (usually the SLConfigDescriptor).
+	sizeWidths  [3]int
+	esFlags     uint8
+	streamBits  uint8 // upStream and reserved bits of the DecoderConfigDescriptor
+	esOptional  []byte
+	configExtra []byte
+	esExtra     []byte
+}
+
+const (
+	ES_DESCRIPTOR_TAG             = 0x03
+	DECODER_CONFIG_DESCRIPTOR_TAG = 0x04
+	DECODER_SPECIFIC_INFO_TAG     = 0x05
+)
+
+// readDescriptor reads an MPEG-4 descriptor tag and its variable length size.
+func readDescriptor(data []byte, offset int) (tag uint8, size int, next int, err error) {
+	if offset >= len(data) {
+		return 0, 0, offset, fmt.Errorf("Descriptor truncated at %d", offset)
+	}
+	tag = data[offset]
+	offset++
+	for i := 0; i < 4; i++ {
+		if offset >= len(data) {
+			return 0, 0, offset, fmt.Errorf("Descriptor size truncated at %d", offset)
+		}
+		b := data[offset]
+		offset++
+		size = size<<7 | int(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if offset+size > len(data) {
+		return 0, 0, offset, fmt.Errorf("Descriptor 0x%x truncated, need %d bytes", tag, size)
+	}
+	return tag, size, offset, nil
+}
+
+func (b *EsdsBox) parse() (err error) {
+	data := b.ReadBoxData()
+	if len(data) < 4 {
+		return fmt.Errorf("esds box too short: %d bytes", len(data))
+	}
+	b.Version = data[0]
+	b.Flags = [3]byte{data[1], data[2], data[3]}
+
+	tag, size, offset, err := readDescriptor(data, 4)
+	if err != nil {
+		return err
+	}
+	if tag != ES_DESCRIPTOR_TAG || size < 3 {
+		return fmt.Errorf("Invalid ES_Descriptor, tag 0x%x size %d", tag, size)
+	}
+	b.sizeWidths[0] = offset - 5
+	end := offset + size
+	b.Es_id = binary.BigEndian.Uint16(data[offset : offset+2])
+	flags := data[offset+2]
+	b.esFlags = flags
+	offset += 3
+	optional := offset
+	if flags&0x80 != 0 { // streamDependenceFlag
+		offset += 2
+	}
+	if flags&0x40 != 0 && offset < end { // URL_Flag
+		offset += 1 + int(data[offset])
+	}
+	if flags&0x20 != 0 { // OCRstreamFlag
+		offset += 2
+	}
+	if offset > end {
+		return fmt.Errorf("Invalid ES_Descriptor, optional fields overrun size %d", size)
+	}
+	b.esOptional = data[optional:offset]
+
+	for offset < end {
+		start := offset
+		tag, size, offset, err = readDescriptor(data, offset)
+		if err != nil {
+			return err
+		}
+		if tag == DECODER_CONFIG_DESCRIPTOR_TAG && size >= 13 {
+			b.sizeWidths[1] = offset - start - 1
+			dcd := data[offset : offset+size]
+			b.Object_type_indication = dcd[0]
+			b.Stream_type = dcd[1] >> 2
+			b.streamBits = dcd[1] & 3
+			b.Buffer_size_db = uint32(dcd[2])<<16 | uint32(dcd[3])<<8 | uint32(dcd[4])
+			b.Max_bitrate = binary.BigEndian.Uint32(dcd[5:9])
+			b.Avg_bitrate = binary.BigEndian.Uint32(dcd[9:13])
+			dsiTag, dsiSize, dsiOffset, err := readDescriptor(dcd, 13)
+			if err == nil && dsiTag == DECODER_SPECIFIC_INFO_TAG {
+				b.sizeWidths[2] = dsiOffset - 14
+				b.Decoder_specific_info = dcd[dsiOffset : dsiOffset+dsiSize]
+				b.configExtra = dcd[dsiOffset+dsiSize:]
+			} else {
+				b.configExtra = dcd[13:]
+			}
+		} else {
+			b.esExtra = append(b.esExtra, data[start:offset+size]...)
+		}
+		offset += size
+	}
+	return nil
+}
+
+// Sampling frequencies indexed by AudioSpecificConfig samplingFrequencyIndex.
+var aacSampleRates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AudioSpecificConfig is the MPEG-4 audio decoder configuration carried in
+// the esds DecoderSpecificInfo.
+type AudioSpecificConfig struct {
+	Object_type              uint8
+	Sampling_frequency_index uint8
+	Sampling_frequency       uint32
+	Channel_configuration    uint8
+}
+
+// AudioSpecificConfig parses the decoder specific info of an AAC stream.
+func (b *EsdsBox) AudioSpecificConfig() (*AudioSpecificConfig, error) {
+	if len(b.Decoder_specific_info) == 0 {
+		return nil, fmt.Errorf("esds has no decoder specific info")
+	}
+	r := newBitReader(b.Decoder_specific_info)
+	asc := &AudioSpecificConfig{}
+	v, err := r.readBits(5)
+	if err != nil {
+		return nil, err
+	}
+	if v == 31 {
+		ext, err := r.readBits(6)
+		if err != nil {
+			return nil, err
+		}
+		v = 32 + ext
+	}
+	asc.Object_type = uint8(v)
+	if v, err = r.readBits(4); err != nil {
+		return nil, err
+	}
+	asc.Sampling_frequency_index = uint8(v)
+	if v == 15 {
+		if asc.Sampling_frequency, err = r.readBits(24); err != nil {
+			return nil, err
+		}
+	} else if int(v) < len(aacSampleRates) {
+		asc.Sampling_frequency = aacSampleRates[v]
+	}
+	if v, err = r.readBits(4); err != nil {
+		return nil, err
+	}
+	asc.Channel_configuration = uint8(v)
+	return asc, nil
+}
+
+// DOpsBox holds the OpusSpecificBox of an Opus entry. Its fields are those
+// of the OpusHead header, stored big-endian.
+type DOpsBox struct {
+	*Box
+	Version                uint8
+	Output_channel_count   uint8
+	Pre_skip               uint16
+	Input_sample_rate      uint32
+	Output_gain            int16 // Q7.8 dB
+	Channel_mapping_family uint8
+	Stream_count           uint8
+	Coupled_count          uint8
+	Channel_mapping        []byte // for a channel mapping family other than 0
+}
+
+func (b *DOpsBox) parse() error {
+	r := &fieldReader{name: "dOps", data: b.ReadBoxData()}
+	b.Version = r.u8()
+	b.Output_channel_count = r.u8()
+	b.Pre_skip = r.u16()
+	b.Input_sample_rate = r.u32()
+	b.Output_gain = int16(r.u16())
+	b.Channel_mapping_family = r.u8()
+	if r.err == nil && b.Channel_mapping_family != 0 {
+		b.Stream_count = r.u8()
+		b.Coupled_count = r.u8()
+		b.Channel_mapping = r.next(int(b.Output_channel_count))
+	}
+	return r.err
+}
+
+// OpusHead returns the identification header of an Ogg Opus stream, as
+// laid out in RFC 7845 section 5.1.
+func (b *DOpsBox) OpusHead() []byte {
+	buf := append([]byte("OpusHead"), 1, b.Output_channel_count)
+	buf = binary.LittleEndian.AppendUint16(buf, b.Pre_skip)
+	buf = binary.LittleEndian.AppendUint32(buf, b.Input_sample_rate)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(b.Output_gain))
+	buf = append(buf, b.Channel_mapping_family)
+	if b.Channel_mapping_family != 0 {
+		buf = append(buf, b.Stream_count, b.Coupled_count)
+		buf = append(buf, b.Channel_mapping...)
+	}
+	return buf
+}
+
+// PcmCBox holds the PCMConfig of an ipcm or fpcm entry (ISO/IEC 23003-5).
+type PcmCBox struct {
+	*Box
+	Version         uint8
+	Flags           [3]byte
+	Format_flags    uint8 // bit 0 set for little-endian samples
+	Pcm_sample_size uint8
+}
+
+func (b *PcmCBox) parse() error {
+	r := &fieldReader{name: "pcmC", data: b.ReadBoxData()}
+	b.Version, b.Flags = r.fullBox()
+	b.Format_flags = r.u8()
+	b.Pcm_sample_size = r.u8()
+	return r.err
+}
+
+var (
+	ac3SampleRates = []int{48000, 44100, 32000}
+	ac3Channels    = []int{2, 1, 2, 3, 3, 4, 4, 5} // by acmod, LFE excluded
+	ac3BitRates    = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640}
+	// Channels of the chan_loc bits of an E-AC-3 dependent substream, from
+	// the most significant one: Lc/Rc, Lrs/Rrs, Cs, Ts, Lsd/Rsd, Lw/Rw,
+	// Lvh/Rvh, Cvh and LFE2
+	eac3ChanLocChannels = []int{2, 2, 1, 1, 2, 2, 2, 1, 1}
+)
+
+// Dac3Box holds the AC3SpecificBox of an ac-3 entry (ETSI TS 102 366 F.4).
+type Dac3Box struct {
+	*Box
+	Fscod         uint8
+	Bsid          uint8
+	Bsmod         uint8
+	Acmod         uint8
+	Lfeon         uint8
+	Bit_rate_code uint8
+	Reserved      uint8
+}
+
+func (b *Dac3Box) parse() error {
+	data := b.ReadBoxData()
+	if len(data) < 3 {
+		return fmt.Errorf("dac3 box too short: %d bytes", len(data))
+	}
+	v := uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2])
+	b.Fscod = uint8(v >> 22)
+	b.Bsid = uint8(v>>17) & 31
+	b.Bsmod = uint8(v>>14) & 7
+	b.Acmod = uint8(v>>11) & 7
+	b.Lfeon = uint8(v>>10) & 1
+	b.Bit_rate_code = uint8(v>>5) & 31
+	b.Reserved = uint8(v) & 31
+	return nil
+}
+
+// SampleRate returns the sample rate of fscod, 0 if reserved.
+func (b *Dac3Box) SampleRate() int {
+	if int(b.Fscod) < len(ac3SampleRates) {
+		return ac3SampleRates[b.Fscod]
+	}
+	return 0
+}
+
+// Channels returns the number of channels, LFE included.
+func (b *Dac3Box) Channels() int {
+	return ac3Channels[b.Acmod] + int(b.Lfeon)
+}
+
+// BitRate returns the nominal bit rate in kbit/s, 0 if unknown.
+func (b *Dac3Box) BitRate() int {
+	if int(b.Bit_rate_code) < len(ac3BitRates) {
+		return ac3BitRates[b.Bit_rate_code]
+	}
+	return 0
+}
+
+// Dec3Box holds the EC3SpecificBox of an ec-3 entry (ETSI TS 102 366 F.6).
+type Dec3Box struct {
+	*Box
+	Data_rate   uint16 // kbit/s
+	Substreams  []Dec3Substream
+	Extra_bytes []byte // after the independent substreams, e.g. the Atmos extension
+}
+
+// Dec3Substream describes an independent substream and its dependent ones.
+type Dec3Substream struct {
+	Fscod       uint8
+	Bsid        uint8
+	Asvc        uint8
+	Bsmod       uint8
+	Acmod       uint8
+	Lfeon       uint8
+	Num_dep_sub uint8
+	Chan_loc    uint16 // channels of the dependent substreams
+}
+
+func (b *Dec3Box) parse() error {
+	r := newBitReader(b.ReadBoxData())
+	var err error
+	read := func(n int) uint32 {
+		v, e := r.readBits(n)
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+	b.Data_rate = uint16(read(13))
+	num_ind_sub := int(read(3)) + 1
+	b.Substreams = nil
+	for i := 0; i < num_ind_sub && err == nil; i++ {
+		s := Dec3Substream{}
+		s.Fscod = uint8(read(2))
+		s.Bsid = uint8(read(5))
+		read(1) // reserved
+		s.Asvc = uint8(read(1))
+		s.Bsmod = uint8(read(3))
+		s.Acmod = uint8(read(3))
+		s.Lfeon = uint8(read(1))
+		read(3) // reserved
+		s.Num_dep_sub = uint8(read(4))
+		if s.Num_dep_sub > 0 {
+			s.Chan_loc = uint16(read(9))
+		} else {
+			read(1) // reserved
+		}
+		b.Substreams = append(b.Substreams, s)
+	}
+	if err != nil {
+		return fmt.Errorf("dec3 box: %v", err)
+	}
+	b.Extra_bytes = r.data[r.pos/8:]
+	return nil
+}
+
+// SampleRate returns the sample rate of the first independent substream.
+func (b *Dec3Box) SampleRate() int {
+	if len(b.Substreams) > 0 && int(b.Substreams[0].Fscod) < len(ac3SampleRates) {
+		return ac3SampleRates[b.Substreams[0].Fscod]
+	}
+	return 0
+}
+
+// Channels returns the number of channels of the first independent
+// substream and its dependent ones, LFE included.
+func (b *Dec3Box) Channels() int {
+	if len(b.Substreams) == 0 {
+		return 0
+	}
+	s := b.Substreams[0]
+	n := ac3Channels[s.Acmod] + int(s.Lfeon)
+	for i, channels := range eac3ChanLocChannels {
+		if s.Chan_loc&(1<<uint(8-i)) != 0 {
+			n += channels
+		}
+	}
+	return n
+}
@@ -0,0 +1,110 @@
+package mp4
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestStsdBrokenCodecConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{"truncated avcC", testVisualEntry("avc1", testBox("avcC", []byte{1, 0x64}))},
+		{"truncated esds", testAudioEntry("mp4a", 48000, testFullBox("esds", 0, 0, []byte{ES_DESCRIPTOR_TAG, 0x80}))},
+		{"short pasp", testVisualEntry("avc1", testBox("pasp", u16(1)))},
+		{"short entry", testBox("avc1", make([]byte, 6), u16(1), make([]byte, 8))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(5), entry: tt.entry}
+			f := openBytes(t, m.build())
+			trak := f.Moov.Traks[0]
+			if len(trak.Samples) != 5 {
+				t.Errorf("Track has %d samples, want 5", len(trak.Samples))
+			}
+			if entry := trak.GetSampleEntry(1); entry == nil || entry.Avcc != nil || entry.Esds != nil || entry.Pasp != nil {
+				t.Errorf("Sample entry %+v, want one without the broken box", entry)
+			}
+		})
+	}
+}
+
+func TestStsdSampleEntries(t *testing.T) {
+	pasp := testBox("pasp", u32(4), u32(3))
+	m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(2), entry: testVisualEntry("avc1", pasp)}
+	entry := openBytes(t, m.build()).Moov.Traks[0].GetSampleEntry(1)
+	if entry.Width != 320 || entry.Height != 240 || entry.Depth != 0x18 || entry.Data_reference_index != 1 {
+		t.Errorf("Visual entry %dx%d depth %d, want 320x240 depth 24", entry.Width, entry.Height, entry.Depth)
+	}
+	if entry.Pasp == nil || entry.Pasp.H_spacing != 4 || entry.Pasp.V_spacing != 3 {
+		t.Errorf("pasp = %+v, want 4:3", entry.Pasp)
+	}
+
+	m = testMovie{handler: "soun", timescale: 44100, delta: 1024, samples: testSamples(2)}
+	entry = openBytes(t, m.build()).Moov.Traks[0].GetSampleEntry(1)
+	if entry.Channel_count != 2 || entry.Sample_size != 16 || entry.Sample_rate>>16 != 44100 {
+		t.Errorf("Audio entry %d channels %d bits at %d Hz, want 2 16 44100", entry.Channel_count, entry.Sample_size, entry.Sample_rate>>16)
+	}
+}
+
+func TestDolbySpecificBoxes(t *testing.T) {
+	// fscod 48 kHz, bsid 8, bsmod 0, acmod 3/2, LFE, 448 kbit/s, reserved bits set
+	dac3 := testBox("dac3", testBitString("00 01000 000 111 1 01111 00101"))
+	// 1536 kbit/s, one independent substream of bsid 16 in 3/2 with LFE and
+	// a dependent one adding Lrs/Rrs, then an extension byte
+	dec3 := testBox("dec3", testBitString("0011000000000 000 00 10000 0 0 000 111 1 000 0001 010000000"), []byte{0x01})
+	tests := []struct {
+		name     string
+		entry    []byte
+		format   string
+		rate     int
+		channels int
+	}{
+		{"ac-3", testAudioEntry("ac-3", 48000, dac3), EXTRACT_AC3, 48000, 6},
+		{"ec-3", testAudioEntry("ec-3", 48000, dec3), EXTRACT_EAC3, 48000, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			samples := testSamples(3)
+			m := testMovie{handler: "soun", timescale: 48000, delta: 1536, samples: samples, entry: tt.entry}
+			data := m.build()
+			f := openBytes(t, data)
+			entry := f.Moov.Traks[0].GetSampleEntry(1)
+			switch {
+			case entry.Dac3 != nil:
+				d := entry.Dac3
+				if d.Fscod != 0 || d.Bsid != 8 || d.Bsmod != 0 || d.Acmod != 7 || d.Lfeon != 1 || d.Bit_rate_code != 15 || d.Reserved != 5 {
+					t.Errorf("dac3 = %+v", d)
+				}
+				if d.BitRate() != 448 {
+					t.Errorf("Bit rate %d, want 448", d.BitRate())
+				}
+			case entry.Dec3 != nil:
+				d := entry.Dec3
+				want := Dec3Substream{Fscod: 0, Bsid: 16, Acmod: 7, Lfeon: 1, Num_dep_sub: 1, Chan_loc: 0x80}
+				if d.Data_rate != 1536 || len(d.Substreams) != 1 || d.Substreams[0] != want || !bytes.Equal(d.Extra_bytes, []byte{0x01}) {
+					t.Errorf("dec3 = %+v", d)
+				}
+			default:
+				t.Fatalf("No dac3 or dec3 in %v", entry.Name)
+			}
+			if s := f.Streams()[0]; s.Sample_rate != fmt.Sprint(tt.rate) || s.Channels != tt.channels {
+				t.Errorf("Stream at %v Hz with %d channels, want %d %d", s.Sample_rate, s.Channels, tt.rate, tt.channels)
+			}
+
+			out := &bytes.Buffer{}
+			if err := f.Write(out); err != nil || !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("File not written back unchanged, %v", err)
+			}
+			out.Reset()
+			if err := f.Extract(out, 0, ""); err != nil || !bytes.Equal(out.Bytes(), bytes.Join(samples, nil)) {
+				t.Errorf("Extracted %x, %v, want the samples", out.Bytes(), err)
+			}
+			if format := defaultExtractFormat(entry); format != tt.format {
+				t.Errorf("Extract format %v, want %v", format, tt.format)
+			}
+		})
+	}
+}
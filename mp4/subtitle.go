@@ -0,0 +1,470 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// subtitleCue is a cue of a timed text track, timed in milliseconds of the
+// presentation timeline.
+type subtitleCue struct {
+	start, end   int64
+	id, settings string // WebVTT cue identifier and settings
+	text         string
+	markup       bool // text is WebVTT cue text rather than plain text
+}
+
+// cueClock converts media times of a track to the presentation timeline
+// following its edit list: empty edits before the first non-empty one
+// delay the track, and media outside that edit is cut.
+type cueClock struct {
+	media_time float64 // seconds
+	delay      int64   // milliseconds
+	end        int64   // milliseconds, -1 if the edit has no duration
+}
+
+func newCueClock(f *File, t *TrakBox) cueClock {
+	c := cueClock{media_time: float64(t.GetMediaTime()) / float64(t.Mdia.Mdhd.Timescale), end: -1}
+	if t.Edts == nil || t.Edts.Elst == nil || f.Moov.Mvhd == nil || f.Moov.Mvhd.Timescale == 0 {
+		return c
+	}
+	elst := t.Edts.Elst
+	for i, mt := range elst.Media_time {
+		d := int64(elst.Segment_duration[i]) * 1000 / int64(f.Moov.Mvhd.Timescale)
+		if mt == -1 {
+			c.delay += d
+			continue
+		}
+		if d > 0 {
+			c.end = c.delay + d
+		}
+		break
+	}
+	return c
+}
+
+// ms returns the presentation time of a media time in seconds.
+func (c cueClock) ms(seconds float64) int64 {
+	return c.delay + int64(math.Round((seconds-c.media_time)*1000))
+}
+
+// clip limits a cue to the edit. It returns false if nothing is left.
+func (c cueClock) clip(cue *subtitleCue) bool {
+	if cue.start < c.delay {
+		cue.start = c.delay
+	}
+	if c.end >= 0 && cue.end > c.end {
+		cue.end = c.end
+	}
+	return cue.end > cue.start
+}
+
+// tx3gText returns the text of a 3GPP timed text sample, UTF-8 or UTF-16
+// with a byte order mark. Modifier boxes after the text are ignored.
+func tx3gText(data []byte) (string, error) {
+	if len(data) < 2 {
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if 2+n > len(data) {
+		return "", fmt.Errorf("tx3g text of %d bytes overruns the sample", n)
+	}
+	text := data[2 : 2+n]
+	if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+		units := make([]uint16, (len(text)-2)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(text[2+2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return string(text), nil
+}
+
+// sampleBox is a box stored inside sample data.
+type sampleBox struct {
+	name    string
+	payload []byte
+}
+
+func splitSampleBoxes(data []byte) ([]sampleBox, error) {
+	boxes := []sampleBox{}
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			return nil, fmt.Errorf("Box header truncated at %d", offset)
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || size > len(data)-offset {
+			return nil, fmt.Errorf("Box of %d bytes at %d overruns the sample", size, offset)
+		}
+		boxes = append(boxes, sampleBox{string(data[offset+4 : offset+8]), data[offset+8 : offset+size]})
+		offset += size
+	}
+	return boxes, nil
+}
+
+// wvttCues returns the cues of a WebVTT sample, all sharing the sample
+// timing. A vtte box marks a sample without cues.
+func wvttCues(data []byte) ([]subtitleCue, error) {
+	boxes, err := splitSampleBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	cues := []subtitleCue{}
+	for _, b := range boxes {
+		if b.name != "vttc" {
+			continue
+		}
+		children, err := splitSampleBoxes(b.payload)
+		if err != nil {
+			return nil, fmt.Errorf("vttc: %v", err)
+		}
+		cue := subtitleCue{markup: true}
+		for _, c := range children {
+			switch c.name {
+			case "iden":
+				cue.id = string(c.payload)
+			case "sttg":
+				cue.settings = string(c.payload)
+			case "payl":
+				cue.text = string(c.payload)
+			}
+		}
+		cues = append(cues, cue)
+	}
+	return cues, nil
+}
+
+var ttmlOffsetTime = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)(h|m|s|ms|f|t)$`)
+
+// ttmlTime parses a TTML time expression into seconds.
+func ttmlTime(expr string, frame_rate, tick_rate float64) (float64, error) {
+	expr = strings.TrimSpace(expr)
+	if m := ttmlOffsetTime.FindStringSubmatch(expr); m != nil {
+		v, _ := strconv.ParseFloat(m[1], 64)
+		switch m[2] {
+		case "h":
+			return v * 3600, nil
+		case "m":
+			return v * 60, nil
+		case "s":
+			return v, nil
+		case "ms":
+			return v / 1000, nil
+		case "f":
+			return v / frame_rate, nil
+		default:
+			return v / tick_rate, nil
+		}
+	}
+	// Clock time: hours:minutes:seconds[.fraction] or hours:minutes:seconds:frames
+	parts := strings.Split(expr, ":")
+	if len(parts) == 3 || len(parts) == 4 {
+		v := 0.0
+		for i, part := range parts {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil || n < 0 {
+				break
+			}
+			switch i {
+			case 0:
+				v += n * 3600
+			case 1:
+				v += n * 60
+			case 2:
+				v += n
+			case 3:
+				v += n / frame_rate
+			}
+			if i == len(parts)-1 {
+				return v, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Invalid TTML time expression %q", expr)
+}
+
+// ttmlCues returns the paragraphs of a TTML document as cues timed in
+// seconds of the media timeline, which the document times are relative
+// to. Nested elements time their children from their own begin. Styling
+// is dropped and only line breaks are kept.
+func ttmlCues(data []byte) ([]subtitleCue, []float64, error) {
+	type element struct{ begin, end float64 }
+	frame_rate, tick_rate := 30.0, 1.0
+	stack := []element{{0, math.Inf(1)}}
+	cues := []subtitleCue{}
+	times := []float64{} // begin and end of each cue
+	var text *strings.Builder
+
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("TTML: %v", err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			attrs := map[string]string{}
+			for _, a := range token.Attr {
+				attrs[a.Name.Local] = a.Value
+			}
+			if token.Name.Local == "tt" {
+				if v, err := strconv.ParseFloat(attrs["frameRate"], 64); err == nil && v > 0 {
+					frame_rate = v
+				}
+				if v, err := strconv.ParseFloat(attrs["tickRate"], 64); err == nil && v > 0 {
+					tick_rate = v
+				}
+			}
+			parent := stack[len(stack)-1]
+			e := element{parent.begin, parent.end}
+			if v, ok := attrs["begin"]; ok {
+				t, err := ttmlTime(v, frame_rate, tick_rate)
+				if err != nil {
+					return nil, nil, err
+				}
+				e.begin = parent.begin + t
+			}
+			if v, ok := attrs["end"]; ok {
+				t, err := ttmlTime(v, frame_rate, tick_rate)
+				if err != nil {
+					return nil, nil, err
+				}
+				e.end = math.Min(parent.end, parent.begin+t)
+			} else if v, ok := attrs["dur"]; ok {
+				t, err := ttmlTime(v, frame_rate, tick_rate)
+				if err != nil {
+					return nil, nil, err
+				}
+				e.end = math.Min(parent.end, e.begin+t)
+			}
+			stack = append(stack, e)
+			switch {
+			case token.Name.Local == "p" && text == nil:
+				text = &strings.Builder{}
+			case token.Name.Local == "br" && text != nil:
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(token)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if token.Name.Local != "p" || text == nil {
+				continue
+			}
+			// Collapse white space as xml:space="default" does, keeping
+			// the line breaks
+			lines := strings.Split(text.String(), "\n")
+			for i, line := range lines {
+				lines[i] = strings.Join(strings.Fields(line), " ")
+			}
+			text = nil
+			cues = append(cues, subtitleCue{text: strings.Join(lines, "\n")})
+			times = append(times, e.begin, e.end)
+		}
+	}
+	return cues, times, nil
+}
+
+// subtitleCues returns the cues of a timed text track in presentation
+// order. A cue repeated in consecutive samples is merged into one.
+func (f *File) subtitleCues(trak int) ([]subtitleCue, error) {
+	if f.Moov == nil {
+		return nil, fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks([]int{trak}); err != nil {
+		return nil, err
+	}
+	t := f.Moov.Traks[trak]
+	if t.Mdia.Mdhd.Timescale == 0 {
+		return nil, fmt.Errorf("Track %d: timescale is 0", trak)
+	}
+	scale := float64(t.Mdia.Mdhd.Timescale)
+	clock := newCueClock(f, t)
+
+	cues := []subtitleCue{}
+	last := map[subtitleCue]int{} // index of the latest cue with the same content
+	add := func(cue subtitleCue) {
+		if !clock.clip(&cue) {
+			return
+		}
+		key := cue
+		key.start, key.end = 0, 0
+		if i, ok := last[key]; ok && cues[i].end == cue.start {
+			cues[i].end = cue.end
+			return
+		}
+		last[key] = len(cues)
+		cues = append(cues, cue)
+	}
+	err := f.eachSample(trak, func(entry *SampleEntry, s Sample, data []byte) error {
+		start := float64(int64(s.Start_time)+int64(int32(s.Cto))) / scale
+		end := start + float64(s.Duration)/scale
+		switch entry.Name {
+		case "tx3g":
+			text, err := tx3gText(data)
+			if err != nil {
+				return fmt.Errorf("Sample at %d: %v", s.Offset, err)
+			}
+			text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+			if text != "" {
+				add(subtitleCue{start: clock.ms(start), end: clock.ms(end), text: text})
+			}
+		case "wvtt":
+			sample, err := wvttCues(data)
+			if err != nil {
+				return fmt.Errorf("Sample at %d: %v", s.Offset, err)
+			}
+			for _, cue := range sample {
+				cue.start, cue.end = clock.ms(start), clock.ms(end)
+				add(cue)
+			}
+		case "stpp":
+			sample, times, err := ttmlCues(data)
+			if err != nil {
+				return fmt.Errorf("Sample at %d: %v", s.Offset, err)
+			}
+			// A document only applies during its sample
+			for i, cue := range sample {
+				cue.start = clock.ms(math.Max(times[2*i], start))
+				cue.end = clock.ms(math.Min(times[2*i+1], end))
+				add(cue)
+			}
+		default:
+			return fmt.Errorf("Track %d: %v is not a timed text format", trak, entry.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].start < cues[j].start })
+	return cues, nil
+}
+
+func formatCueTime(ms int64, separator string) string {
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+var vttTag = regexp.MustCompile(`</?([a-z]*)[^>]*>`)
+
+// plainText returns the text of a cue without WebVTT markup. The bold,
+// italic and underline tags SubRip also knows are kept if keep is set.
+func (c *subtitleCue) plainText(keep bool) string {
+	if !c.markup {
+		return c.text
+	}
+	text := vttTag.ReplaceAllStringFunc(c.text, func(tag string) string {
+		name := vttTag.FindStringSubmatch(tag)[1]
+		if keep && (name == "b" || name == "i" || name == "u") {
+			if strings.HasPrefix(tag, "</") {
+				return "</" + name + ">"
+			}
+			return "<" + name + ">"
+		}
+		return ""
+	})
+	return html.UnescapeString(text)
+}
+
+// cueLines drops blank lines, which would end the cue in SubRip and WebVTT.
+func cueLines(text string) string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func writeSRT(w io.Writer, cues []subtitleCue) error {
+	buf := &bytes.Buffer{}
+	for i, cue := range cues {
+		fmt.Fprintf(buf, "%d\n%s --> %s\n%s\n\n", i+1, formatCueTime(cue.start, ","), formatCueTime(cue.end, ","), cueLines(cue.plainText(true)))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeVTT(w io.Writer, header string, cues []subtitleCue) error {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "WEBVTT") {
+		header = "WEBVTT"
+	}
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	buf := bytes.NewBufferString(header + "\n\n")
+	for _, cue := range cues {
+		if cue.id != "" {
+			buf.WriteString(cue.id + "\n")
+		}
+		fmt.Fprintf(buf, "%s --> %s", formatCueTime(cue.start, "."), formatCueTime(cue.end, "."))
+		if cue.settings != "" {
+			buf.WriteString(" " + cue.settings)
+		}
+		text := cue.text
+		if !cue.markup {
+			text = escaper.Replace(text)
+		}
+		fmt.Fprintf(buf, "\n%s\n\n", cueLines(text))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeTTML(w io.Writer, lang string, cues []subtitleCue) error {
+	buf := bytes.NewBufferString(xml.Header)
+	fmt.Fprintf(buf, "<tt xmlns=\"http://www.w3.org/ns/ttml\" xml:lang=\"%s\">\n  <body>\n    <div>\n", lang)
+	for _, cue := range cues {
+		fmt.Fprintf(buf, "      <p begin=\"%s\" end=\"%s\">", formatCueTime(cue.start, "."), formatCueTime(cue.end, "."))
+		for i, line := range strings.Split(cue.plainText(false), "\n") {
+			if i > 0 {
+				buf.WriteString("<br/>")
+			}
+			xml.EscapeText(buf, []byte(line))
+		}
+		buf.WriteString("</p>\n")
+	}
+	buf.WriteString("    </div>\n  </body>\n</tt>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteSubtitles writes a tx3g, wvtt or stpp track as SubRip, WebVTT or
+// TTML. Cues are timed on the presentation timeline of the track's edit
+// list; TTML output keeps the text and line breaks but not the styling.
+func (f *File) WriteSubtitles(w io.Writer, trak int, format string) error {
+	cues, err := f.subtitleCues(trak)
+	if err != nil {
+		return err
+	}
+	t := f.Moov.Traks[trak]
+	switch format {
+	case EXTRACT_SRT:
+		return writeSRT(w, cues)
+	case EXTRACT_VTT:
+		header := ""
+		if entry := t.GetSampleEntry(1); entry != nil {
+			header = entry.Vtt_config
+		}
+		return writeVTT(w, header, cues)
+	case EXTRACT_TTML:
+		return writeTTML(w, manifestLanguage(t), cues)
+	}
+	return fmt.Errorf("Unknown subtitle format %v", format)
+}
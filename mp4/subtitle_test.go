@@ -0,0 +1,74 @@
+package mp4
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestTTMLTime(t *testing.T) {
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1.5s", 1.5},
+		{"90ms", 0.09},
+		{"2m", 120},
+		{"1h", 3600},
+		{"30f", 1.2},
+		{"100t", 10},
+		{"00:01:02.5", 62.5},
+		{"00:00:01:12", 1.48},
+		{" 01:00:00 ", 3600},
+	}
+	for _, tt := range tests {
+		got, err := ttmlTime(tt.expr, 25, 10)
+		if err != nil || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("ttmlTime(%q) = %v, %v, want %v", tt.expr, got, err, tt.want)
+		}
+	}
+	for _, expr := range []string{"", "1x", "1:2", "00:-1:00", "s"} {
+		if _, err := ttmlTime(expr, 25, 10); err == nil {
+			t.Errorf("ttmlTime(%q) accepted", expr)
+		}
+	}
+}
+
+func TestWriteSubtitlesTTML(t *testing.T) {
+	// Document times are on the media timeline, whatever sample carries
+	// them; the tick rate makes 25t 2.5 seconds
+	doc := func(body string) []byte {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?><tt xmlns="http://www.w3.org/ns/ttml" ttp:tickRate="10"><body>` + body + `</body></tt>`)
+	}
+	hello := `<div begin="0.5s"><p begin="0.5s" end="3s">Hello<br/>   <span>world</span></p></div>`
+	samples := [][]byte{
+		doc(`<div><p begin="0s" end="0.6s">Early</p></div>` + hello),
+		doc(hello + `<div><p begin="25t" dur="1s">Later &amp; last</p></div>`),
+	}
+	entry := testBox("stpp", make([]byte, 6), u16(1), []byte("http://www.w3.org/ns/ttml\x00\x00\x00"))
+	// A second of empty edit, then media from 0.5s for 2.8s
+	m := testMovie{handler: "subt", timescale: 1000, delta: 2000, samples: samples, entry: entry, edits: []testEdit{{1000, -1}, {2800, 500}}}
+	f := openBytes(t, m.build())
+
+	// Hello is repeated in both samples and merged, each copy limited to
+	// its sample
+	srt := "1\n00:00:01,000 --> 00:00:01,100\nEarly\n\n" +
+		"2\n00:00:01,500 --> 00:00:03,800\nHello\nworld\n\n" +
+		"3\n00:00:03,000 --> 00:00:03,800\nLater & last\n\n"
+	out := &bytes.Buffer{}
+	if err := f.WriteSubtitles(out, 0, EXTRACT_SRT); err != nil || out.String() != srt {
+		t.Errorf("SubRip, %v\n%v\nwant\n%v", err, out.String(), srt)
+	}
+
+	// An unknown language is an empty xml:lang
+	ttml := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<tt xmlns="http://www.w3.org/ns/ttml" xml:lang="">` + "\n  <body>\n    <div>\n" +
+		`      <p begin="00:00:01.000" end="00:00:01.100">Early</p>` + "\n" +
+		`      <p begin="00:00:01.500" end="00:00:03.800">Hello<br/>world</p>` + "\n" +
+		`      <p begin="00:00:03.000" end="00:00:03.800">Later &amp; last</p>` + "\n" +
+		"    </div>\n  </body>\n</tt>\n"
+	out.Reset()
+	if err := f.WriteSubtitles(out, 0, EXTRACT_TTML); err != nil || out.String() != ttml {
+		t.Errorf("TTML, %v\n%v\nwant\n%v", err, out.String(), ttml)
+	}
+}
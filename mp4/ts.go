@@ -0,0 +1,549 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MPEG-TS (ISO/IEC 13818-1) constants
+const (
+	TS_PACKET_SIZE = 188
+	TS_PID_PAT     = 0x0000
+	TS_PID_PMT     = 0x1000
+	TS_PID_FIRST   = 0x0100 // PID of the first elementary stream
+	TS_CLOCK       = 90000
+	// Added to every timestamp so that samples shown before the start of
+	// the edit list keep positive times, and the PCR runs ahead of them.
+	TS_OFFSET    = 126000
+	TS_PCR_DELAY = 63000
+	// Longest time between two PAT and PMT in a whole file
+	TS_TABLE_INTERVAL = TS_CLOCK / 10
+)
+
+// MPEG-TS stream types
+const (
+	TS_STREAM_TYPE_MPEG1_AUDIO = 0x03
+	TS_STREAM_TYPE_MPEG2_AUDIO = 0x04
+	TS_STREAM_TYPE_AAC         = 0x0f
+	TS_STREAM_TYPE_H264        = 0x1b
+	TS_STREAM_TYPE_H265        = 0x24
+)
+
+// tsStreamType returns the MPEG-TS stream type and PES stream id carrying
+// the samples of entry.
+func tsStreamType(entry *SampleEntry) (stream_type, stream_id uint8, err error) {
+	switch {
+	case entry == nil:
+		return 0, 0, fmt.Errorf("No sample description")
+	case entry.Avcc != nil:
+		return TS_STREAM_TYPE_H264, 0xe0, nil
+	case entry.Hvcc != nil:
+		return TS_STREAM_TYPE_H265, 0xe0, nil
+	case entry.Esds != nil:
+		switch entry.Esds.Object_type_indication {
+		case 0x40, 0x66, 0x67, 0x68:
+			return TS_STREAM_TYPE_AAC, 0xc0, nil
+		case 0x6b:
+			return TS_STREAM_TYPE_MPEG1_AUDIO, 0xc0, nil
+		case 0x69:
+			return TS_STREAM_TYPE_MPEG2_AUDIO, 0xc0, nil
+		}
+		return 0, 0, fmt.Errorf("Object type 0x%02x cannot be carried in MPEG-TS", entry.Esds.Object_type_indication)
+	}
+	return 0, 0, fmt.Errorf("%v cannot be carried in MPEG-TS", entry.Name)
+}
+
+// tsStream is an elementary stream of the transport stream.
+type tsStream struct {
+	trak        *TrakBox
+	pid         uint16
+	stream_type uint8
+	stream_id   uint8
+	cc          uint8 // continuity counter
+}
+
+// timestamp converts a time of the track to the 90 kHz clock.
+func (st *tsStream) timestamp(t int64) int64 {
+	t -= st.trak.GetMediaTime()
+	return t*TS_CLOCK/int64(st.trak.Mdia.Mdhd.Timescale) + TS_OFFSET
+}
+
+// tsMuxer writes samples of a file as a single program transport stream.
+type tsMuxer struct {
+	f       *File
+	streams []*tsStream
+	pcr     *tsStream // the first video stream, else the first stream
+	pat_cc  uint8
+	pmt_cc  uint8
+}
+
+func (f *File) newTSMuxer(indexes []int) (*tsMuxer, error) {
+	if f.Moov == nil {
+		return nil, fmt.Errorf("No moov box")
+	}
+	if err := f.checkTraks(indexes); err != nil {
+		return nil, err
+	}
+	m := &tsMuxer{f: f}
+	ids := map[uint8]uint8{} // next stream id of each kind
+	for _, i := range indexes {
+		trak := f.Moov.Traks[i]
+		stream_type, stream_id, err := tsStreamType(trak.GetSampleEntry(1))
+		if err != nil {
+			return nil, fmt.Errorf("Track %d: %v", i, err)
+		}
+		st := &tsStream{
+			trak:        trak,
+			pid:         uint16(TS_PID_FIRST + len(m.streams)),
+			stream_type: stream_type,
+			stream_id:   stream_id + ids[stream_id],
+		}
+		ids[stream_id]++
+		if m.pcr == nil || (st.stream_id >= 0xe0 && m.pcr.stream_id < 0xe0) {
+			m.pcr = st
+		}
+		m.streams = append(m.streams, st)
+	}
+	if len(m.streams) == 0 {
+		return nil, fmt.Errorf("No track to write")
+	}
+	return m, nil
+}
+
+// tsSample is a sample of one of the streams.
+type tsSample struct {
+	stream *tsStream
+	index  int // in the track
+	Sample
+}
+
+// interleave returns the samples in spans[t] of each stream in decoding
+// order.
+func (m *tsMuxer) interleave(spans [][2]int) []tsSample {
+	samples := []tsSample{}
+	for t, st := range m.streams {
+		for i := spans[t][0]; i < spans[t][1]; i++ {
+			samples = append(samples, tsSample{st, i, st.trak.Samples[i]})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].stream.timestamp(int64(samples[i].Start_time)) < samples[j].stream.timestamp(int64(samples[j].Start_time))
+	})
+	return samples
+}
+
+// crc32MPEG computes the CRC of PSI sections: polynomial 0x04c11db7, most
+// significant bit first, no final inversion.
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// section completes a PSI section: the length field after table_id and the
+// CRC at the end.
+func section(table_id uint8, body []byte) []byte {
+	length := len(body) + 4
+	s := []byte{table_id, 0xb0 | byte(length>>8), byte(length)}
+	s = append(s, body...)
+	return binary.BigEndian.AppendUint32(s, crc32MPEG(s))
+}
+
+// writeTables writes the PAT and PMT of the single program.
+func (m *tsMuxer) writeTables(w io.Writer) error {
+	pat := section(0x00, []byte{
+		0x00, 0x01, // transport_stream_id
+		0xc1, 0x00, 0x00, // version 0, current, section 0 of 0
+		0x00, 0x01, // program_number
+		0xe0 | TS_PID_PMT>>8, TS_PID_PMT & 0xff,
+	})
+	body := []byte{
+		0x00, 0x01, // program_number
+		0xc1, 0x00, 0x00,
+		0xe0 | byte(m.pcr.pid>>8), byte(m.pcr.pid),
+		0xf0, 0x00, // no program descriptors
+	}
+	for _, st := range m.streams {
+		body = append(body, st.stream_type, 0xe0|byte(st.pid>>8), byte(st.pid), 0xf0, 0x00)
+	}
+	pmt := section(0x02, body)
+
+	for _, t := range []struct {
+		pid     uint16
+		cc      *uint8
+		section []byte
+	}{{TS_PID_PAT, &m.pat_cc, pat}, {TS_PID_PMT, &m.pmt_cc, pmt}} {
+		packet := []byte{0x47, 0x40 | byte(t.pid>>8), byte(t.pid), 0x10 | *t.cc, 0x00}
+		*t.cc = (*t.cc + 1) & 0x0f
+		packet = append(packet, t.section...)
+		for len(packet) < TS_PACKET_SIZE {
+			packet = append(packet, 0xff)
+		}
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTimestamp appends a 33-bit PES timestamp with its 4-bit prefix.
+func appendTimestamp(b []byte, prefix uint8, t int64) []byte {
+	t &= 1<<33 - 1
+	return append(b,
+		prefix<<4|byte(t>>29)&0x0e|1,
+		byte(t>>22),
+		byte(t>>14)|1,
+		byte(t>>7),
+		byte(t<<1)|1,
+	)
+}
+
+// writeSample writes a sample as a PES packet split into transport packets.
+func (m *tsMuxer) writeSample(w io.Writer, s tsSample) error {
+	st := s.stream
+	data := make([]byte, s.Size)
+	if _, err := m.f.ReadAt(data, int64(s.Offset)); err != nil {
+		return fmt.Errorf("Reading sample at %d: %v", s.Offset, err)
+	}
+	entry := st.trak.GetSampleEntry(s.Sample_description_index)
+	if entry == nil {
+		return fmt.Errorf("Sample description %d not found", s.Sample_description_index)
+	}
+	var err error
+	switch st.stream_type {
+	case TS_STREAM_TYPE_H264, TS_STREAM_TYPE_H265:
+		data, err = annexBSample(entry, data, s.Sync)
+	case TS_STREAM_TYPE_AAC:
+		data, err = adtsFrame(entry, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	dts := st.timestamp(int64(s.Start_time))
+	pts := st.timestamp(int64(s.Start_time) + int64(int32(s.Cto)))
+	pes := []byte{0x00, 0x00, 0x01, st.stream_id, 0, 0, 0x84}
+	if pts != dts {
+		pes = append(pes, 0xc0, 10)
+		pes = appendTimestamp(pes, 3, pts)
+		pes = appendTimestamp(pes, 1, dts)
+	} else {
+		pes = append(pes, 0x80, 5)
+		pes = appendTimestamp(pes, 2, pts)
+	}
+	// Video PES packets may leave their length unset
+	if n := len(pes) - 6 + len(data); n <= 0xffff && st.stream_id < 0xe0 {
+		binary.BigEndian.PutUint16(pes[4:6], uint16(n))
+	}
+	pes = append(pes, data...)
+
+	pcr := int64(-1)
+	if st == m.pcr {
+		pcr = (dts - TS_PCR_DELAY) * 300
+	}
+	random_access := s.Sync && (st.stream_id >= 0xe0 || st == m.pcr)
+	return writePES(w, st, pes, pcr, random_access)
+}
+
+// writePES splits a PES packet into transport packets, the first one
+// carrying the PCR and random access indicator if given in its adaptation
+// field, the last one padded by adaptation field stuffing.
+func writePES(w io.Writer, st *tsStream, pes []byte, pcr int64, random_access bool) error {
+	for first := true; len(pes) > 0; first = false {
+		var af []byte // adaptation field after its length byte, nil if none
+		if first && (pcr >= 0 || random_access) {
+			af = []byte{0x00}
+			if random_access {
+				af[0] |= 0x40
+			}
+			if pcr >= 0 {
+				base, ext := pcr/300, pcr%300
+				af[0] |= 0x10
+				af = append(af, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7e|byte(ext>>8), byte(ext))
+			}
+		}
+		room := TS_PACKET_SIZE - 4
+		if af != nil {
+			room -= 1 + len(af)
+		}
+		n := len(pes)
+		if n > room {
+			n = room
+		}
+		if stuffing := room - n; stuffing > 0 {
+			if af == nil {
+				// The length byte takes the first byte of stuffing
+				af = []byte{}
+				if stuffing--; stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				af = append(af, 0xff)
+			}
+		}
+
+		packet := make([]byte, 4, TS_PACKET_SIZE)
+		packet[0] = 0x47
+		packet[1] = byte(st.pid >> 8)
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(st.pid)
+		packet[3] = 0x10 | st.cc
+		if af != nil {
+			packet[3] |= 0x20
+			packet = append(packet, byte(len(af)))
+			packet = append(packet, af...)
+		}
+		st.cc = (st.cc + 1) & 0x0f
+		packet = append(packet, pes[:n]...)
+		pes = pes[n:]
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annexBSample converts a length prefixed H.264 or H.265 sample to an
+// Annex-B access unit: an access unit delimiter, then the parameter sets of
+// entry if the sample is a sync sample that does not carry them, then the
+// NAL units of the sample.
+func annexBSample(entry *SampleEntry, data []byte, sync bool) ([]byte, error) {
+	hevc := entry.Hvcc != nil
+	length_size := 0
+	var parameter_sets [][]byte
+	if hevc {
+		length_size = int(entry.Hvcc.Length_size_minus_one) + 1
+		parameter_sets = entry.Hvcc.ParameterSets()
+	} else {
+		length_size = int(entry.Avcc.Length_size_minus_one) + 1
+		parameter_sets = append(append([][]byte{}, entry.Avcc.Sps...), entry.Avcc.Pps...)
+	}
+	nalType := h264NalType
+	if hevc {
+		nalType = h265NalType
+	}
+
+	nals := [][]byte{}
+	has_parameter_sets := false
+	for offset := 0; offset < len(data); {
+		if offset+length_size > len(data) {
+			return nil, fmt.Errorf("NAL unit length truncated at %d", offset)
+		}
+		n := 0
+		for _, b := range data[offset : offset+length_size] {
+			n = n<<8 | int(b)
+		}
+		offset += length_size
+		if n > len(data)-offset {
+			return nil, fmt.Errorf("NAL unit of %d bytes overruns the sample at %d", n, offset)
+		}
+		nal := data[offset : offset+n]
+		offset += n
+		if n == 0 {
+			continue
+		}
+		switch t := nalType(nal); {
+		case hevc && t == H265_NAL_AUD, !hevc && t == H264_NAL_AUD:
+			continue
+		case hevc && t == H265_NAL_SPS, !hevc && t == H264_NAL_SPS:
+			has_parameter_sets = true
+		}
+		nals = append(nals, nal)
+	}
+
+	au := []byte{0, 0, 0, 1}
+	if hevc {
+		au = append(au, H265_NAL_AUD<<1, 0x01, 0x50)
+	} else {
+		au = append(au, H264_NAL_AUD, 0xf0)
+	}
+	if sync && !has_parameter_sets {
+		nals = append(parameter_sets, nals...)
+	}
+	for _, nal := range nals {
+		au = append(au, 0, 0, 0, 1)
+		au = append(au, nal...)
+	}
+	return au, nil
+}
+
+// adtsFrame prefixes a raw AAC frame with the ADTS header described by the
+// AudioSpecificConfig of entry. HE-AAC streams are signalled by their AAC
+// LC core, which ADTS can carry.
+func adtsFrame(entry *SampleEntry, data []byte) ([]byte, error) {
+	asc, err := entry.Esds.AudioSpecificConfig()
+	if err != nil {
+		return nil, err
+	}
+	profile := asc.Object_type
+	switch {
+	case profile == 5 || profile == 29:
+		profile = 2
+	case profile < 1 || profile > 4:
+		return nil, fmt.Errorf("AAC object type %d cannot be carried in ADTS", asc.Object_type)
+	}
+	index := asc.Sampling_frequency_index
+	if index == 15 {
+		for i, rate := range aacSampleRates {
+			if rate == asc.Sampling_frequency {
+				index = uint8(i)
+			}
+		}
+		if index == 15 {
+			return nil, fmt.Errorf("Sampling frequency %d cannot be carried in ADTS", asc.Sampling_frequency)
+		}
+	}
+	length := 7 + len(data)
+	if length >= 1<<13 {
+		return nil, fmt.Errorf("AAC frame of %d bytes too long for ADTS", len(data))
+	}
+	channels := asc.Channel_configuration
+	frame := []byte{
+		0xff, 0xf1, // sync word, MPEG-4, layer 0, no CRC
+		(profile-1)<<6 | index<<2 | channels>>2,
+		channels<<6 | byte(length>>11),
+		byte(length >> 3),
+		byte(length<<5) | 0x1f, // buffer fullness 0x7ff, VBR
+		0xfc,                   // one raw data block
+	}
+	return append(frame, data...), nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeTSSegments writes the tracks of opts as transport stream segments,
+// each opened with create and starting with the PAT and PMT, which are
+// repeated before every keyframe of the reference track so that the
+// keyframes can be fetched on their own. Segments are cut as by
+// WriteSegments.
+func (f *File) writeTSSegments(create func(number int) (io.WriteCloser, error), opts FragmentOptions) ([]Segment, error) {
+	fr, err := f.newFragmenter(opts)
+	if err != nil {
+		return nil, err
+	}
+	indexes := opts.Tracks
+	if indexes == nil {
+		indexes = f.AllTraks()
+	}
+	m, err := f.newTSMuxer(indexes)
+	if err != nil {
+		return nil, err
+	}
+	ref := fr.traks[fr.ref]
+
+	segments := []Segment{}
+	for n, span := range fr.segments {
+		seg := Segment{Number: n + 1, Timescale: ref.Mdia.Mdhd.Timescale}
+		seg.Time, _, _ = fr.refTimes(span[0])
+		seg.Presentation_time = seg.Time
+		out, err := create(seg.Number)
+		if err != nil {
+			return nil, err
+		}
+		w := &countingWriter{w: out}
+		err = m.writeTables(w)
+		for k := span[0]; k < span[1] && err == nil; k++ {
+			_, duration, first_pts := fr.refTimes(k)
+			seg.Duration += duration
+			if first_pts >= 0 && (k == span[0] || uint64(first_pts) < seg.Presentation_time) {
+				seg.Presentation_time = uint64(first_pts)
+			}
+			first := fr.spans[k][fr.ref][0]
+			for _, s := range m.interleave(fr.spans[k]) {
+				keyframe := s.stream.trak == ref && s.index == first && s.Sync
+				start := w.n
+				if keyframe && k == span[0] {
+					start = 0
+				} else if keyframe {
+					if err = m.writeTables(w); err != nil {
+						break
+					}
+				}
+				if err = m.writeSample(w, s); err != nil {
+					break
+				}
+				if keyframe {
+					seg.Keyframes = append(seg.Keyframes, Keyframe{
+						Time:     uint64(s.Start_time),
+						Duration: duration,
+						Offset:   start,
+						Size:     w.n - start,
+					})
+				}
+			}
+		}
+		if e := out.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return nil, err
+		}
+		seg.Size = w.n
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// WriteTS writes the given tracks, or every audio and video track MPEG-TS
+// can carry if traks is nil, as a single program transport stream. The PAT
+// and PMT are repeated before every video keyframe and at least every
+// TS_TABLE_INTERVAL.
+func (f *File) WriteTS(w io.Writer, traks []int) error {
+	if f.Moov == nil {
+		return fmt.Errorf("No moov box")
+	}
+	if traks == nil {
+		if traks = f.mediaTraks(true); len(traks) == 0 {
+			return fmt.Errorf("No track MPEG-TS can carry")
+		}
+	}
+	m, err := f.newTSMuxer(traks)
+	if err != nil {
+		return err
+	}
+	spans := [][2]int{}
+	for _, st := range m.streams {
+		spans = append(spans, [2]int{0, len(st.trak.Samples)})
+	}
+	tables := int64(-1) // time the tables were last written
+	for _, s := range m.interleave(spans) {
+		t := s.stream.timestamp(int64(s.Start_time))
+		keyframe := s.Sync && s.stream.stream_id >= 0xe0
+		if tables < 0 || keyframe || t-tables >= TS_TABLE_INTERVAL {
+			if err = m.writeTables(w); err != nil {
+				return err
+			}
+			tables = t
+		}
+		if err = m.writeSample(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
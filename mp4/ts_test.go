@@ -0,0 +1,72 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestWriteTSMuxTS(t *testing.T) {
+	video, audio, cto, file := testH264AACFile()
+	f := openBytes(t, file)
+	var ts bytes.Buffer
+	if err := f.WriteTS(&ts, nil); err != nil {
+		t.Fatalf("WriteTS: %v", err)
+	}
+	if ts.Len()%TS_PACKET_SIZE != 0 {
+		t.Fatalf("%d bytes, not whole packets", ts.Len())
+	}
+	m := writeAndOpen(t, "muxed.mp4", func(out *os.File) error { return MuxTS(&ts, out) })
+	if len(m.Moov.Traks) != 2 {
+		t.Fatalf("%d tracks, want 2", len(m.Moov.Traks))
+	}
+
+	tracks := []struct {
+		handler   string
+		timescale uint32
+		samples   [][]byte
+		duration  uint32
+	}{
+		{"vide", 90000, video, 3000},
+		{"soun", 48000, audio, 1024},
+	}
+	for i, want := range tracks {
+		trak := m.Moov.Traks[i]
+		if trak.GetHandlerType() != want.handler || trak.Mdia.Mdhd.Timescale != want.timescale {
+			t.Errorf("Track %d: %v at %d Hz, want %v at %d Hz", i, trak.GetHandlerType(), trak.Mdia.Mdhd.Timescale, want.handler, want.timescale)
+			continue
+		}
+		if len(trak.Samples) != len(want.samples) {
+			t.Errorf("Track %d: %d samples, want %d", i, len(trak.Samples), len(want.samples))
+			continue
+		}
+		for j, s := range trak.Samples {
+			data := make([]byte, s.Size)
+			if _, err := m.ReadAt(data, int64(s.Offset)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, want.samples[j]) {
+				t.Errorf("Track %d sample %d = %x, want %x", i, j+1, data, want.samples[j])
+			}
+			if s.Start_time != uint32(j)*want.duration || s.Duration != want.duration {
+				t.Errorf("Track %d sample %d at %d for %d, want %d for %d", i, j+1, s.Start_time, s.Duration, uint32(j)*want.duration, want.duration)
+			}
+			if want.handler == "vide" && (s.Cto != cto[j] || s.Sync != (j%5 == 0)) {
+				t.Errorf("Track %d sample %d cto %d sync %v, want %d and %v", i, j+1, s.Cto, s.Sync, cto[j], j%5 == 0)
+			}
+		}
+		// Both tracks are presented from the start
+		if got := trak.GetStartPts(); got != 0 {
+			t.Errorf("Track %d starts at %d, want 0", i, got)
+		}
+	}
+	entry := m.Moov.Traks[0].GetSampleEntry(1)
+	if entry == nil || entry.Avcc == nil || len(entry.Avcc.Sps) != 1 || !bytes.Equal(entry.Avcc.Sps[0], testSPS) ||
+		len(entry.Avcc.Pps) != 1 || !bytes.Equal(entry.Avcc.Pps[0], testPPS) {
+		t.Errorf("Video sample entry = %+v, want the parameter sets in avcC", entry)
+	}
+	entry = m.Moov.Traks[1].GetSampleEntry(1)
+	if entry == nil || entry.Esds == nil || !bytes.Equal(entry.Esds.Decoder_specific_info, []byte{0x11, 0x90}) {
+		t.Errorf("Audio sample entry = %+v, want the AudioSpecificConfig 1190", entry)
+	}
+}
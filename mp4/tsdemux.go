@@ -0,0 +1,619 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	TS_SYNC_BYTE      = 0x47
+	TS_TIMESTAMP_WRAP = int64(1) << 33
+	AAC_FRAME_SAMPLES = 1024
+)
+
+// tsDemuxer reads the elementary streams of the first program of a
+// transport stream and writes their access units as samples.
+type tsDemuxer struct {
+	mdat    *mdatWriter
+	pmt_pid int // -1 until the PAT is read
+	streams map[uint16]*tsInput
+	order   []*tsInput // in PMT order
+	skipped map[uint16]bool
+	last    int64 // latest unwrapped timestamp
+	started bool  // a timestamp was read
+}
+
+// tsInput is an elementary stream being demuxed into a track.
+type tsInput struct {
+	pid         uint16
+	stream_type uint8
+	track       *trackSpec
+	cc          int // continuity counter of the last packet, -1 before the first
+	pes         []byte
+
+	// Video: the access unit waiting for PES packets without timestamps
+	// continuing it, the presentation and decoding time of every sample
+	// and the parameter sets kept for the sample entry
+	au          []byte
+	au_pts      int64
+	au_dts      int64
+	times       [][2]int64
+	param_sets  map[[2]uint32][]byte // first one of each (NAL unit type, id)
+	param_order [][]byte
+	in_band     bool // a changed parameter set stays in the samples
+	dropped     int  // samples before the first sync sample
+
+	// Audio: bytes of an ADTS frame continued in the next PES packet, the
+	// first ADTS header, the time of the first frame and the number of
+	// audio samples before the next one
+	rest     []byte
+	adts     []byte
+	first    int64
+	has_time bool
+	next     int64
+}
+
+// MuxTS reads an MPEG-TS stream from r and writes its H.264, H.265 and AAC
+// elementary streams to w as an MP4 file with a track each. Access units
+// are written as samples with 4 byte NAL unit lengths, the parameter sets
+// going to the sample entry, and ADTS frames without their headers. Tracks
+// starting after the others get an empty edit keeping them in sync, and
+// audio frames lost in the stream lengthen the frame before them.
+func MuxTS(r io.Reader, w io.WriteSeeker) error {
+	mdat, err := newMdatWriter(w, newFtyp("avc1", "mp41"))
+	if err != nil {
+		return err
+	}
+	d := &tsDemuxer{
+		mdat:    mdat,
+		pmt_pid: -1,
+		streams: map[uint16]*tsInput{},
+		skipped: map[uint16]bool{},
+	}
+	br := bufio.NewReaderSize(r, 64*TS_PACKET_SIZE)
+	offset, skipped := int64(0), 0
+	for {
+		packet, err := br.Peek(TS_PACKET_SIZE + 1)
+		if err == io.EOF && len(packet) == TS_PACKET_SIZE {
+			err = nil // last packet
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		// Resynchronize on a sync byte followed by another one a packet later
+		if packet[0] != TS_SYNC_BYTE || len(packet) > TS_PACKET_SIZE && packet[TS_PACKET_SIZE] != TS_SYNC_BYTE {
+			br.Discard(1)
+			offset++
+			skipped++
+			continue
+		}
+		if skipped > 0 {
+			logf("Lost sync, skipped %d bytes before byte %d\n", skipped, offset)
+			skipped = 0
+		}
+		if err = d.packet(packet[:TS_PACKET_SIZE]); err != nil {
+			return err
+		}
+		br.Discard(TS_PACKET_SIZE)
+		offset += TS_PACKET_SIZE
+	}
+	for _, st := range d.order {
+		if err = d.endPES(st); err != nil {
+			return err
+		}
+		if err = d.flushAU(st); err != nil {
+			return err
+		}
+	}
+
+	tracks := []*trackSpec{}
+	start := int64(math.MaxInt64)
+	starts := []int64{}
+	for _, st := range d.order {
+		if len(st.track.Samples) == 0 {
+			logf("PID %d skipped: no samples\n", st.pid)
+			continue
+		}
+		first, err := st.finish()
+		if err != nil {
+			return fmt.Errorf("PID %d: %v", st.pid, err)
+		}
+		if first < start {
+			start = first
+		}
+		tracks = append(tracks, st.track)
+		starts = append(starts, first)
+	}
+	if len(tracks) == 0 {
+		return fmt.Errorf("No H.264, H.265 or AAC stream found")
+	}
+	for i, t := range tracks {
+		t.Delay = uint64((starts[i] - start) * int64(MOVIE_TIMESCALE) / TS_CLOCK)
+	}
+
+	if err = mdat.finish(); err != nil {
+		return err
+	}
+	return newMoov(tracks).Write(w)
+}
+
+// packet handles a transport stream packet.
+func (d *tsDemuxer) packet(p []byte) error {
+	if p[1]&0x80 != 0 {
+		return nil // transport_error_indicator
+	}
+	unit_start := p[1]&0x40 != 0
+	pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+	control := p[3] >> 4 & 3
+	payload := p[4:]
+	if control&2 != 0 {
+		if int(p[4]) >= len(payload) {
+			return nil // adaptation field only
+		}
+		payload = payload[1+int(p[4]):]
+	}
+	if control&1 == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == TS_PID_PAT || int(pid) == d.pmt_pid:
+		if unit_start {
+			d.table(pid, payload)
+		}
+		return nil
+	case d.streams[pid] == nil:
+		return nil
+	}
+	st := d.streams[pid]
+	cc := int(p[3] & 15)
+	if st.cc >= 0 && cc != (st.cc+1)&15 {
+		if cc == st.cc {
+			return nil // duplicate packet
+		}
+		if st.pes != nil {
+			logf("PID %d: continuity counter jumps from %d to %d, dropping a PES packet\n", pid, st.cc, cc)
+			st.pes = nil
+		}
+	}
+	st.cc = cc
+	if unit_start {
+		if err := d.endPES(st); err != nil {
+			return err
+		}
+		st.pes = append([]byte{}, payload...)
+	} else if st.pes != nil {
+		st.pes = append(st.pes, payload...)
+	}
+	return nil
+}
+
+// table reads the PAT or the first PMT starting in a packet payload.
+// Sections continued in a next packet are not supported.
+func (d *tsDemuxer) table(pid uint16, payload []byte) {
+	if len(payload) == 0 || 1+int(payload[0]) >= len(payload) {
+		return
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return
+	}
+	length := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+length > len(s) || length < 9 {
+		logf("PID %d: table section of %d bytes truncated\n", pid, length)
+		return
+	}
+	s = s[:3+length]
+	if crc32MPEG(s) != 0 {
+		logf("PID %d: table section CRC mismatch\n", pid)
+		return
+	}
+	body := s[8 : len(s)-4]
+
+	if pid == TS_PID_PAT {
+		if s[0] != 0x00 || d.pmt_pid >= 0 {
+			return
+		}
+		for i := 0; i+4 <= len(body); i += 4 {
+			if program := binary.BigEndian.Uint16(body[i:]); program != 0 {
+				d.pmt_pid = int(binary.BigEndian.Uint16(body[i+2:]) & 0x1fff)
+				return
+			}
+		}
+		return
+	}
+	if s[0] != 0x02 || len(body) < 4 || d.order != nil {
+		return
+	}
+	d.order = []*tsInput{}
+	info := int(binary.BigEndian.Uint16(body[2:]) & 0x0fff)
+	for i := 4 + info; i+5 <= len(body); {
+		stream_type := body[i]
+		es_pid := binary.BigEndian.Uint16(body[i+1:]) & 0x1fff
+		i += 5 + int(binary.BigEndian.Uint16(body[i+3:])&0x0fff)
+
+		st := &tsInput{pid: es_pid, stream_type: stream_type, cc: -1, param_sets: map[[2]uint32][]byte{}}
+		switch stream_type {
+		case TS_STREAM_TYPE_H264, TS_STREAM_TYPE_H265:
+			st.track = &trackSpec{Handler: "vide", Timescale: TS_CLOCK}
+		case TS_STREAM_TYPE_AAC:
+			st.track = &trackSpec{Handler: "soun"}
+		default:
+			if !d.skipped[es_pid] {
+				logf("PID %d skipped: stream type 0x%02x is not supported\n", es_pid, stream_type)
+				d.skipped[es_pid] = true
+			}
+			continue
+		}
+		st.track.chunk_samples = math.MaxInt32 // chunks follow the interleaving of the stream
+		d.streams[es_pid] = st
+		d.order = append(d.order, st)
+	}
+}
+
+// unwrap returns the 33 bit timestamp t extended to the value closest to
+// the latest timestamp.
+func (d *tsDemuxer) unwrap(t int64) int64 {
+	if d.started {
+		wraps := d.last - t + TS_TIMESTAMP_WRAP/2
+		if wraps < 0 {
+			wraps -= TS_TIMESTAMP_WRAP - 1 // round down
+		}
+		t += wraps / TS_TIMESTAMP_WRAP * TS_TIMESTAMP_WRAP
+	}
+	d.last, d.started = t, true
+	return t
+}
+
+// readTimestamp decodes a PTS or DTS field.
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// endPES handles the PES packet reassembled so far for the stream.
+func (d *tsDemuxer) endPES(st *tsInput) error {
+	pes := st.pes
+	st.pes = nil
+	if len(pes) == 0 {
+		return nil
+	}
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		logf("PID %d: invalid PES packet start\n", st.pid)
+		return nil
+	}
+	header := 9 + int(pes[8])
+	if length := int(binary.BigEndian.Uint16(pes[4:6])); length > 0 && 6+length < len(pes) {
+		pes = pes[:6+length]
+	}
+	if header > len(pes) {
+		logf("PID %d: PES header truncated\n", st.pid)
+		return nil
+	}
+	flags := pes[7] >> 6
+	pts, dts := int64(-1), int64(-1)
+	if flags&2 != 0 && header >= 14 {
+		pts = d.unwrap(readTimestamp(pes[9:14]))
+		dts = pts
+		if flags == 3 && header >= 19 {
+			dts = d.unwrap(readTimestamp(pes[14:19]))
+		}
+	}
+	payload := pes[header:]
+
+	if st.track.Handler == "soun" {
+		return d.addADTS(st, payload, pts)
+	}
+	if pts < 0 {
+		// Continues the access unit of the previous PES packet
+		if st.au != nil {
+			st.au = append(st.au, payload...)
+		}
+		return nil
+	}
+	if err := d.flushAU(st); err != nil {
+		return err
+	}
+	st.au, st.au_pts, st.au_dts = payload, pts, dts
+	return nil
+}
+
+// flushAU writes the pending access unit of a video stream as a sample.
+// Access unit delimiters and filler data are dropped, and parameter sets
+// seen for the first time go to the sample entry.
+func (d *tsDemuxer) flushAU(st *tsInput) error {
+	au := st.au
+	st.au = nil
+	if au == nil {
+		return nil
+	}
+	hevc := st.stream_type == TS_STREAM_TYPE_H265
+	data := [][]byte{}
+	sync := false
+	for _, nal := range splitAnnexB(au) {
+		var id uint32
+		var err error
+		t := h264NalType(nal)
+		if hevc {
+			t = h265NalType(nal)
+		}
+		switch {
+		case !hevc && (t == H264_NAL_AUD || t == H264_NAL_FILLER),
+			hevc && (t == H265_NAL_AUD || t == H265_NAL_FILLER):
+			continue
+		case !hevc && t == H264_NAL_IDR_SLICE,
+			hevc && t >= H265_NAL_BLA_W_LP && t <= H265_NAL_CRA:
+			sync = true
+			data = append(data, binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal)
+			continue
+		case !hevc && (t == H264_NAL_SPS || t == H264_NAL_PPS):
+			id, _, err = h264ParameterSetId(nal)
+		case hevc && (t == H265_NAL_VPS || t == H265_NAL_SPS || t == H265_NAL_PPS):
+			id, err = h265ParameterSetId(nal)
+		default:
+			data = append(data, binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		key := [2]uint32{uint32(t), id}
+		if first, ok := st.param_sets[key]; !ok {
+			st.param_sets[key] = nal
+			st.param_order = append(st.param_order, nal)
+			continue
+		} else if bytes.Equal(first, nal) {
+			continue
+		}
+		// A changed parameter set stays in band
+		st.in_band = true
+		data = append(data, binary.BigEndian.AppendUint32(nil, uint32(len(nal))), nal)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if len(st.track.Samples) == 0 && !sync {
+		st.dropped++
+		return nil
+	}
+	st.times = append(st.times, [2]int64{st.au_pts, st.au_dts})
+	return d.mdat.writeSample(st.track, Sample{Sample_description_index: 1, Sync: sync}, data...)
+}
+
+// addADTS writes the ADTS frames of a PES payload as samples, pts being
+// the time of the first frame starting in it.
+func (d *tsDemuxer) addADTS(st *tsInput, payload []byte, pts int64) error {
+	data := append(st.rest, payload...)
+	st.rest = nil
+	for len(data) >= 7 {
+		if data[0] != 0xff || data[1]&0xf6 != 0xf0 {
+			// Skip to the next sync word
+			i := bytes.IndexByte(data[1:], 0xff) + 1
+			if i == 0 {
+				i = len(data)
+			}
+			logf("PID %d: skipping %d bytes before an ADTS sync word\n", st.pid, i)
+			data = data[i:]
+			continue
+		}
+		length := int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5])>>5
+		header := 7
+		if data[1]&1 == 0 {
+			header = 9 // with CRC
+		}
+		if length < header {
+			data = data[1:]
+			continue
+		}
+		if length > len(data) {
+			break
+		}
+		frame := data[:length]
+		data = data[length:]
+		time := int64(-1)
+		if len(data)+length <= len(payload) {
+			// The first frame starting in this PES packet has its timestamp
+			time, pts = pts, -1
+		}
+		if frame[6]&3 != 0 {
+			logf("PID %d: ADTS frame with %d raw data blocks dropped\n", st.pid, frame[6]&3+1)
+			continue
+		}
+		if st.adts == nil {
+			st.adts = append([]byte{}, frame[:7]...)
+		} else if frame[2]&0xfd != st.adts[2]&0xfd || frame[3]>>6 != st.adts[3]>>6 {
+			logf("PID %d: ADTS frame with a changed configuration dropped\n", st.pid)
+			continue
+		}
+		if time >= 0 {
+			st.syncADTS(time)
+		}
+		sample := Sample{Sample_description_index: 1, Sync: true, Duration: AAC_FRAME_SAMPLES}
+		if err := d.mdat.writeSample(st.track, sample, frame[header:]); err != nil {
+			return err
+		}
+		st.next += AAC_FRAME_SAMPLES
+	}
+	if len(data) > 0 {
+		st.rest = append([]byte{}, data...)
+	}
+	return nil
+}
+
+// syncADTS compares the PES timestamp pts with the time of the next frame.
+// A gap, from frames lost in the capture, lengthens the previous frame so
+// the following ones keep their time. Frames are never moved earlier: going
+// back in time only moves the reference the following frames are checked
+// against.
+func (st *tsInput) syncADTS(pts int64) {
+	index := int(st.adts[2] >> 2 & 15)
+	if index >= len(aacSampleRates) {
+		return // rejected by finishAAC
+	}
+	rate := int64(aacSampleRates[index])
+	if !st.has_time {
+		// Frames of earlier PES packets without timestamps come before
+		st.first, st.has_time = pts-st.next*TS_CLOCK/rate, true
+		return
+	}
+	diff := pts - (st.first + st.next*TS_CLOCK/rate)
+	if diff*2 > -AAC_FRAME_SAMPLES*TS_CLOCK/rate && diff*2 < AAC_FRAME_SAMPLES*TS_CLOCK/rate {
+		return // within half a frame
+	}
+	n := len(st.track.Samples)
+	gap := diff * rate / TS_CLOCK
+	if diff < 0 || n == 0 || int64(st.track.Samples[n-1].Duration)+gap > math.MaxUint32 {
+		logf("PID %d: audio timestamp %d jumps by %d ms, frames kept back to back\n", st.pid, pts, diff/(TS_CLOCK/1000))
+		st.first += diff
+		return
+	}
+	logf("PID %d: %d ms gap in the audio before timestamp %d\n", st.pid, diff/(TS_CLOCK/1000), pts)
+	st.track.Samples[n-1].Duration += uint32(gap)
+	st.next += gap
+}
+
+// finish fills in the sample times and the sample entry of the track once
+// all samples are written. It returns the presentation time the track
+// starts at, in 90 kHz units.
+func (st *tsInput) finish() (int64, error) {
+	t := st.track
+	if t.Handler == "soun" {
+		return st.finishAAC()
+	}
+	if st.dropped > 0 {
+		logf("PID %d: %d samples before the first sync sample dropped\n", st.pid, st.dropped)
+	}
+
+	vps, sps, pps := [][]byte{}, [][]byte{}, [][]byte{}
+	for _, nal := range st.param_order {
+		if st.stream_type == TS_STREAM_TYPE_H265 {
+			switch h265NalType(nal) {
+			case H265_NAL_VPS:
+				vps = append(vps, nal)
+			case H265_NAL_SPS:
+				sps = append(sps, nal)
+			case H265_NAL_PPS:
+				pps = append(pps, nal)
+			}
+		} else if h264NalType(nal) == H264_NAL_SPS {
+			sps = append(sps, nal)
+		} else {
+			pps = append(pps, nal)
+		}
+	}
+	if len(sps) == 0 || len(pps) == 0 {
+		return 0, fmt.Errorf("No SPS/PPS found in the stream")
+	}
+	if st.stream_type == TS_STREAM_TYPE_H265 {
+		if len(vps) == 0 {
+			return 0, fmt.Errorf("No VPS found in the stream")
+		}
+		entry, parsed, err := h265SampleEntry(vps, sps, pps, st.in_band)
+		if err != nil {
+			return 0, err
+		}
+		t.Entries, t.Width, t.Height = []*SampleEntry{entry}, parsed.Width, parsed.Height
+	} else {
+		entry, parsed, err := h264SampleEntry(sps, pps)
+		if err != nil {
+			return 0, err
+		}
+		if st.in_band {
+			entry.Box = newBox("avc3")
+		}
+		t.Entries, t.Width, t.Height = []*SampleEntry{entry}, parsed.Width, parsed.Height
+	}
+
+	first_dts := st.times[0][1]
+	first_pts := st.times[0][0]
+	duration := uint32(0)
+	for i := range t.Samples {
+		pts, dts := st.times[i][0], st.times[i][1]
+		if pts < first_pts {
+			first_pts = pts
+		}
+		if i+1 < len(t.Samples) {
+			if next := st.times[i+1][1]; next > dts {
+				duration = uint32(next - dts)
+			} else {
+				logf("PID %d: decoding time of sample %d does not increase\n", st.pid, i+2)
+			}
+		}
+		if dts-first_dts > math.MaxUint32 {
+			return 0, fmt.Errorf("Sample %d decodes %d ticks after the first one, more than 32 bits", i+1, dts-first_dts)
+		}
+		t.Samples[i].Start_time = uint32(dts - first_dts)
+		t.Samples[i].Cto = uint32(pts - dts)
+		t.Samples[i].Duration = duration // the last sample repeats the previous duration
+	}
+	t.Media_time = uint64(first_pts - first_dts)
+	return first_pts, nil
+}
+
+// finishAAC builds the mp4a sample entry from the first ADTS header and
+// times the frames by their durations.
+func (st *tsInput) finishAAC() (int64, error) {
+	t := st.track
+	h := st.adts
+	object_type := h[2]>>6 + 1
+	index := h[2] >> 2 & 15
+	channels := (h[2]&1)<<2 | h[3]>>6
+	if int(index) >= len(aacSampleRates) {
+		return 0, fmt.Errorf("Invalid ADTS sampling frequency index %d", index)
+	}
+	t.Timescale = aacSampleRates[index]
+
+	size, max_size := int64(0), uint32(0)
+	second, second_size, peak := uint32(0), int64(0), int64(0)
+	start := int64(0)
+	for i := range t.Samples {
+		s := &t.Samples[i]
+		if start > math.MaxUint32 {
+			return 0, fmt.Errorf("Frame %d starts %d samples in, more than 32 bits", i+1, start)
+		}
+		s.Start_time = uint32(start)
+		start += int64(s.Duration)
+		if s.Size > max_size {
+			max_size = s.Size
+		}
+		size += int64(s.Size)
+		if s.Start_time/t.Timescale != second {
+			second, second_size = s.Start_time/t.Timescale, 0
+		}
+		if second_size += int64(s.Size) * 8; second_size > peak {
+			peak = second_size
+		}
+	}
+	esds := &EsdsBox{
+		Box:                    newBox("esds"),
+		Object_type_indication: 0x40, // MPEG-4 audio
+		Stream_type:            5,    // audio stream
+		Buffer_size_db:         max_size,
+		Max_bitrate:            uint32(peak),
+		Avg_bitrate:            uint32(bitRate(size, t.duration(), t.Timescale)),
+		Decoder_specific_info:  []byte{object_type<<3 | index>>1, index<<7 | channels<<3},
+	}
+	count := uint16(channels)
+	switch channels {
+	case 0:
+		count = 2 // defined in a program_config_element
+	case 7:
+		count = 8
+	}
+	t.Entries = []*SampleEntry{{
+		Box:                  newBox("mp4a"),
+		Data_reference_index: 1,
+		Channel_count:        count,
+		Sample_size:          16,
+		Sample_rate:          Fixed32(t.Timescale << 16),
+		Esds:                 esds,
+	}}
+	if !st.has_time {
+		return 0, fmt.Errorf("No timestamp found in the stream")
+	}
+	return st.first, nil
+}
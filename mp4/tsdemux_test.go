@@ -0,0 +1,119 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTSFinishLongStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		last    int64 // decoding time of the last sample after the first one
+		wantErr bool
+	}{
+		{"13 hours", 13 * 3600 * TS_CLOCK, false},
+		{"14 hours", 14 * 3600 * TS_CLOCK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := TS_TIMESTAMP_WRAP - 3600 // unwrapped times keep increasing
+			st := &tsInput{
+				stream_type: TS_STREAM_TYPE_H264,
+				track:       &trackSpec{Handler: "vide", Timescale: TS_CLOCK, Samples: make([]Sample, 3)},
+				times:       [][2]int64{{first, first}, {first + 3600, first + 3600}, {first + tt.last, first + tt.last}},
+				param_order: [][]byte{testSPS, testPPS},
+			}
+			_, err := st.finish()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("finish() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && int64(st.track.Samples[2].Start_time) != tt.last {
+				t.Errorf("Last sample decoding time = %d, want %d", st.track.Samples[2].Start_time, tt.last)
+			}
+		})
+	}
+}
+
+// testADTS returns an AAC LC stereo ADTS frame at 48 kHz.
+func testADTS(payload []byte) []byte {
+	length := 7 + len(payload)
+	header := []byte{0xff, 0xf1, 1<<6 | 3<<2, 2<<6 | byte(length>>11), byte(length >> 3), byte(length)<<5 | 0x1f, 0xfc}
+	return append(header, payload...)
+}
+
+func TestMuxTSAudioGaps(t *testing.T) {
+	const frame = AAC_FRAME_SAMPLES * TS_CLOCK / 48000
+	const first = 10 * TS_CLOCK
+	payloads := testSamples(8)
+	frames := [][]byte{}
+	for _, p := range payloads {
+		frames = append(frames, testADTS(p))
+	}
+	split := len(frames[2]) / 2
+	pes := []struct {
+		pts  int64
+		data [][]byte
+	}{
+		{first, [][]byte{frames[0], frames[1], frames[2][:split]}},
+		// The timestamp is the one of frame 3, the first starting in the packet
+		{first + 3*frame, [][]byte{frames[2][split:], frames[3]}},
+		{first + 9*frame, [][]byte{frames[4], frames[5]}}, // 5 frames lost
+		{first + 9*frame, [][]byte{frames[6]}},            // 2 frames back
+		{first + 10*frame, [][]byte{frames[7]}},
+	}
+
+	st := &tsStream{pid: TS_PID_FIRST, stream_type: TS_STREAM_TYPE_AAC, stream_id: 0xc0}
+	m := &tsMuxer{streams: []*tsStream{st}, pcr: st}
+	var ts bytes.Buffer
+	if err := m.writeTables(&ts); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pes {
+		data := bytes.Join(p.data, nil)
+		header := appendTimestamp([]byte{0x00, 0x00, 0x01, 0xc0, 0, 0, 0x84, 0x80, 5}, 2, p.pts)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(header)-6+len(data)))
+		if err := writePES(&ts, st, append(header, data...), -1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+	f := writeAndOpen(t, "audio.mp4", func(out *os.File) error {
+		Log = &log
+		defer func() { Log = io.Discard }()
+		return MuxTS(&ts, out)
+	})
+
+	trak := f.Moov.Traks[0]
+	if got := trak.Mdia.Mdhd.Timescale; got != 48000 {
+		t.Fatalf("Timescale = %d, want 48000", got)
+	}
+	starts := []uint32{0, 1024, 2048, 3072, 9216, 10240, 11264, 12288}
+	if len(trak.Samples) != len(starts) {
+		t.Fatalf("%d samples, want %d", len(trak.Samples), len(starts))
+	}
+	for i, s := range trak.Samples {
+		if s.Start_time != starts[i] {
+			t.Errorf("Sample %d starts at %d, want %d", i+1, s.Start_time, starts[i])
+		}
+		data := make([]byte, s.Size)
+		if _, err := f.ReadAt(data, int64(s.Offset)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, payloads[i]) {
+			t.Errorf("Sample %d = %x, want %x", i+1, data, payloads[i])
+		}
+	}
+	for _, want := range []string{"106 ms gap in the audio", "jumps by -42 ms"} {
+		if !strings.Contains(log.String(), want) {
+			t.Errorf("Log %q does not contain %q", log.String(), want)
+		}
+	}
+	if n := strings.Count(log.String(), "PID"); n != 2 {
+		t.Errorf("%d log lines about the stream, want 2", n)
+	}
+}
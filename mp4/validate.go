@@ -0,0 +1,435 @@
+package mp4
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_INFO    = "info"
+)
+
+// Finding is one problem reported by Validate. Path locates the offending
+// box, e.g. "moov/trak[1]/mdia/minf/stbl/stsz".
+type Finding struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%-7s %v: %v", f.Severity, f.Path, f.Message)
+}
+
+type validator struct {
+	file     *File
+	findings []Finding
+}
+
+func (v *validator) report(severity, path, format string, a ...interface{}) {
+	v.findings = append(v.findings, Finding{
+		Severity: severity,
+		Path:     path,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// Validate checks the parsed file against the structural rules of
+// ISO/IEC 14496-12: boxes nest, required boxes exist, the sample tables
+// agree with each other, samples lie inside mdat without overlapping and
+// the movie, track and media durations match. It can be run on a file for
+// which Open returned an error, as long as the file itself was returned.
+func (f *File) Validate() []Finding {
+	v := &validator{file: f}
+	v.checkBoxes("", f.boxes, 0, f.Size)
+	v.checkTopLevel()
+	if f.Moov != nil {
+		v.checkMovie()
+		for i, trak := range f.Moov.Traks {
+			v.checkTrak(f.trakPath(i), trak)
+		}
+		v.checkSampleRanges()
+	}
+	return v.findings
+}
+
+// HasErrors reports whether any of the findings is an error.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// boxPaths names boxes by type, adding an index when siblings share a type.
+func boxPaths(parent string, boxes []*Box) []string {
+	counts := map[string]int{}
+	for _, b := range boxes {
+		counts[b.Name]++
+	}
+	seen := map[string]int{}
+	paths := make([]string, len(boxes))
+	for i, b := range boxes {
+		name := b.Name
+		if counts[b.Name] > 1 {
+			name = fmt.Sprintf("%v[%d]", b.Name, seen[b.Name])
+			seen[b.Name]++
+		}
+		if parent == "" {
+			paths[i] = name
+		} else {
+			paths[i] = parent + "/" + name
+		}
+	}
+	return paths
+}
+
+func (f *File) trakPath(index int) string {
+	if len(f.Moov.Traks) > 1 {
+		return fmt.Sprintf("moov/trak[%d]", index)
+	}
+	return "moov/trak"
+}
+
+// checkBoxes verifies that every box lies within its parent and that the
+// children fill the parent without gaps.
+func (v *validator) checkBoxes(parent string, boxes []*Box, start, end int64) {
+	paths := boxPaths(parent, boxes)
+	last := start
+	for i, b := range boxes {
+		if b.Start+b.Size > end {
+			v.report(SEVERITY_ERROR, paths[i], "box ends at %d, beyond its parent which ends at %d", b.Start+b.Size, end)
+		}
+		if b.Start > last && i > 0 {
+			v.report(SEVERITY_WARNING, paths[i], "%d unused bytes before the box", b.Start-last)
+		}
+		last = b.Start + b.Size
+		if len(b.children) > 0 {
+			v.checkBoxes(paths[i], b.children, b.children[0].Start, b.Start+b.Size)
+		}
+	}
+	if len(boxes) > 0 && last < end {
+		name := parent
+		if name == "" {
+			name = "/"
+		}
+		v.report(SEVERITY_WARNING, name, "%d trailing bytes are not a box", end-last)
+	}
+}
+
+func (v *validator) checkTopLevel() {
+	f := v.file
+	counts := map[string]int{}
+	for _, b := range f.boxes {
+		counts[b.Name]++
+	}
+	for _, name := range []string{"ftyp", "moov", "mdat"} {
+		if counts[name] == 0 {
+			v.report(SEVERITY_ERROR, name, "required box is missing")
+		}
+	}
+	if counts["ftyp"] > 1 {
+		v.report(SEVERITY_ERROR, "ftyp", "%d ftyp boxes, expected one", counts["ftyp"])
+	}
+	if counts["moov"] > 1 {
+		v.report(SEVERITY_ERROR, "moov", "%d moov boxes, expected one", counts["moov"])
+	}
+	if len(f.boxes) > 0 && f.boxes[0].Name != "ftyp" && counts["ftyp"] > 0 {
+		v.report(SEVERITY_WARNING, "ftyp", "ftyp is not the first box")
+	}
+}
+
+func (v *validator) checkMovie() {
+	moov := v.file.Moov
+	if moov.Mvhd == nil {
+		v.report(SEVERITY_ERROR, "moov/mvhd", "required box is missing")
+		return
+	}
+	if len(moov.Traks) == 0 {
+		v.report(SEVERITY_WARNING, "moov", "movie has no tracks")
+	}
+	if moov.Mvhd.Timescale == 0 {
+		v.report(SEVERITY_ERROR, "moov/mvhd", "timescale is 0")
+	}
+
+	ids := map[uint32]int{}
+	longest := uint64(0)
+	for i, trak := range moov.Traks {
+		if trak.Tkhd == nil {
+			continue
+		}
+		path := v.file.trakPath(i) + "/tkhd"
+		id := trak.Tkhd.Track_id
+		if id == 0 {
+			v.report(SEVERITY_ERROR, path, "track_ID is 0")
+		}
+		if other, ok := ids[id]; ok {
+			v.report(SEVERITY_ERROR, path, "track_ID %d already used by track %d", id, other)
+		}
+		ids[id] = i
+		if id >= moov.Mvhd.Next_track_id && moov.Mvhd.Next_track_id != 0xffffffff {
+			v.report(SEVERITY_WARNING, "moov/mvhd", "next_track_ID %d is not larger than track_ID %d", moov.Mvhd.Next_track_id, id)
+		}
+		if trak.Tkhd.Duration > longest {
+			longest = trak.Tkhd.Duration
+		}
+	}
+	if len(ids) > 0 && moov.Mvhd.Duration != longest {
+		v.report(SEVERITY_WARNING, "moov/mvhd", "duration %d differs from the longest track duration %d", moov.Mvhd.Duration, longest)
+	}
+}
+
+func (v *validator) checkTrak(path string, trak *TrakBox) {
+	if trak.Tkhd == nil {
+		v.report(SEVERITY_ERROR, path+"/tkhd", "required box is missing")
+	}
+	if missing := trak.missingTables(); missing != "" {
+		v.report(SEVERITY_ERROR, path, "required box %v is missing", missing)
+		return
+	}
+	mdia := trak.Mdia
+	if mdia.Hdlr == nil {
+		v.report(SEVERITY_ERROR, path+"/mdia/hdlr", "required box is missing")
+	}
+	minf := mdia.Minf
+	switch trak.GetHandlerType() {
+	case "vide":
+		if minf.Vmhd == nil {
+			v.report(SEVERITY_ERROR, path+"/mdia/minf/vmhd", "video track without vmhd")
+		}
+	case "soun":
+		if minf.Smhd == nil {
+			v.report(SEVERITY_ERROR, path+"/mdia/minf/smhd", "audio track without smhd")
+		}
+	}
+	if minf.Dinf == nil || minf.Dinf.Dref == nil {
+		v.report(SEVERITY_ERROR, path+"/mdia/minf/dinf/dref", "required box is missing")
+	}
+	if mdia.Mdhd.Timescale == 0 {
+		v.report(SEVERITY_ERROR, path+"/mdia/mdhd", "timescale is 0")
+	}
+
+	v.checkSampleTables(path+"/mdia/minf/stbl", trak)
+	v.checkDurations(path, trak)
+}
+
+func (v *validator) checkSampleTables(path string, trak *TrakBox) {
+	stbl := trak.Mdia.Minf.Stbl
+
+	if stbl.Stsd == nil {
+		v.report(SEVERITY_ERROR, path+"/stsd", "required box is missing")
+	} else if int(stbl.Stsd.Entry_count) != len(stbl.Stsd.Entries) {
+		v.report(SEVERITY_ERROR, path+"/stsd", "entry_count %d but %d sample entries found", stbl.Stsd.Entry_count, len(stbl.Stsd.Entries))
+	} else if stbl.Stsd.Entry_count == 0 {
+		v.report(SEVERITY_ERROR, path+"/stsd", "no sample entries")
+	}
+
+	for _, t := range []struct {
+		name         string
+		count, found int
+	}{
+		{"stts", int(stbl.Stts.Entry_count), len(stbl.Stts.Sample_count)},
+		{"stsc", int(stbl.Stsc.Entry_count), len(stbl.Stsc.First_chunk)},
+		{stbl.Stco.Name, int(stbl.Stco.Entry_count), len(stbl.Stco.Chunk_offset)},
+	} {
+		if t.count != t.found {
+			v.report(SEVERITY_ERROR, path+"/"+t.name, "box truncated: entry_count %d, %d entries present", t.count, t.found)
+		}
+	}
+	if stbl.Stsz.Sample_size == 0 && int(stbl.Stsz.Sample_count) != len(stbl.Stsz.Entry_size) {
+		v.report(SEVERITY_ERROR, path+"/stsz", "box truncated: sample_count %d, %d entries present", stbl.Stsz.Sample_count, len(stbl.Stsz.Entry_size))
+	}
+
+	sample_count := uint64(stbl.Stsz.Sample_count)
+
+	stts_count := uint64(0)
+	for i, n := range stbl.Stts.Sample_count {
+		stts_count += uint64(n)
+		if stbl.Stts.Sample_delta[i] == 0 && (i+1 < len(stbl.Stts.Sample_count) || n > 1) {
+			v.report(SEVERITY_WARNING, path+"/stts", "entry %d has a sample delta of 0", i)
+		}
+	}
+	if stts_count != sample_count {
+		v.report(SEVERITY_ERROR, path+"/stts", "describes %d samples, stsz has %d", stts_count, sample_count)
+	}
+
+	if stbl.Ctts != nil {
+		ctts_count := uint64(0)
+		for _, n := range stbl.Ctts.Sample_count {
+			ctts_count += uint64(n)
+		}
+		if ctts_count != sample_count {
+			v.report(SEVERITY_ERROR, path+"/ctts", "describes %d samples, stsz has %d", ctts_count, sample_count)
+		}
+	}
+
+	chunk_count := uint32(len(stbl.Stco.Chunk_offset))
+	stsc_count := uint64(0)
+	for i, first := range stbl.Stsc.First_chunk {
+		if i == 0 && first != 1 {
+			v.report(SEVERITY_ERROR, path+"/stsc", "first entry starts at chunk %d, expected 1", first)
+		}
+		if i > 0 && first <= stbl.Stsc.First_chunk[i-1] {
+			v.report(SEVERITY_ERROR, path+"/stsc", "entry %d first_chunk %d is not ascending", i, first)
+		}
+		if first > chunk_count {
+			v.report(SEVERITY_ERROR, path+"/stsc", "entry %d first_chunk %d beyond the %d chunks in %v", i, first, chunk_count, stbl.Stco.Name)
+		}
+		if stbl.Stsc.Samples_per_chunk[i] == 0 {
+			v.report(SEVERITY_WARNING, path+"/stsc", "entry %d has 0 samples per chunk", i)
+		}
+		sdi := stbl.Stsc.Sample_description_index[i]
+		if stbl.Stsd != nil && (sdi == 0 || sdi > uint32(len(stbl.Stsd.Entries))) {
+			v.report(SEVERITY_ERROR, path+"/stsc", "entry %d sample_description_index %d out of range", i, sdi)
+		}
+		last := chunk_count + 1
+		if i+1 < len(stbl.Stsc.First_chunk) {
+			last = stbl.Stsc.First_chunk[i+1]
+		}
+		if last > first {
+			stsc_count += uint64(last-first) * uint64(stbl.Stsc.Samples_per_chunk[i])
+		}
+	}
+	if stsc_count != sample_count {
+		v.report(SEVERITY_ERROR, path+"/stsc", "chunks hold %d samples, stsz has %d", stsc_count, sample_count)
+	}
+
+	if stbl.Stss != nil {
+		if int(stbl.Stss.Entry_count) != len(stbl.Stss.Sample_number) {
+			v.report(SEVERITY_ERROR, path+"/stss", "box truncated: entry_count %d, %d entries present", stbl.Stss.Entry_count, len(stbl.Stss.Sample_number))
+		}
+		for i, n := range stbl.Stss.Sample_number {
+			if n == 0 || uint64(n) > sample_count {
+				v.report(SEVERITY_ERROR, path+"/stss", "entry %d sample number %d out of range 1..%d", i, n, sample_count)
+			}
+			if i > 0 && n <= stbl.Stss.Sample_number[i-1] {
+				v.report(SEVERITY_ERROR, path+"/stss", "entry %d sample number %d is not ascending", i, n)
+			}
+		}
+		if len(stbl.Stss.Sample_number) == 0 && sample_count > 0 {
+			v.report(SEVERITY_WARNING, path+"/stss", "track has no sync samples")
+		} else if len(stbl.Stss.Sample_number) > 0 && stbl.Stss.Sample_number[0] != 1 {
+			v.report(SEVERITY_WARNING, path+"/stss", "first sample is not a sync sample")
+		}
+	}
+}
+
+func (v *validator) checkDurations(path string, trak *TrakBox) {
+	mdhd := trak.Mdia.Mdhd
+	stts_duration := uint64(0)
+	for i, n := range trak.Mdia.Minf.Stbl.Stts.Sample_count {
+		stts_duration += uint64(n) * uint64(trak.Mdia.Minf.Stbl.Stts.Sample_delta[i])
+	}
+	if uint64(mdhd.Duration) != stts_duration {
+		v.report(SEVERITY_WARNING, path+"/mdia/mdhd", "duration %d differs from the sum of sample durations %d", mdhd.Duration, stts_duration)
+	}
+
+	mvhd := v.file.Moov.Mvhd
+	if trak.Tkhd == nil || mvhd == nil || mvhd.Timescale == 0 || mdhd.Timescale == 0 {
+		return
+	}
+	if trak.Edts != nil && trak.Edts.Elst != nil {
+		edits := uint64(0)
+		for _, d := range trak.Edts.Elst.Segment_duration {
+			edits += uint64(d)
+		}
+		if uint64(trak.Tkhd.Duration) != edits {
+			v.report(SEVERITY_WARNING, path+"/tkhd", "duration %d differs from the edit list duration %d", trak.Tkhd.Duration, edits)
+		}
+		return
+	}
+	// Without an edit list the track duration is the media duration in movie timescale
+	expected := uint64(mdhd.Duration) * uint64(mvhd.Timescale) / uint64(mdhd.Timescale)
+	diff := int64(trak.Tkhd.Duration) - int64(expected)
+	if diff > 1 || diff < -1 {
+		v.report(SEVERITY_WARNING, path+"/tkhd", "duration %d differs from the media duration %d (in movie timescale)", trak.Tkhd.Duration, expected)
+	}
+}
+
+type sampleRange struct {
+	trak, index int
+	start, end  int64
+}
+
+// checkSampleRanges verifies every sample lies inside an mdat payload and
+// that no two samples share bytes.
+func (v *validator) checkSampleRanges() {
+	f := v.file
+	mdats := []*Box{}
+	for _, b := range f.boxes {
+		if b.Name == "mdat" {
+			mdats = append(mdats, b)
+		}
+	}
+
+	ranges := []sampleRange{}
+	for t, trak := range f.Moov.Traks {
+		if trak.missingTables() != "" {
+			continue // reported by checkTrak
+		}
+		path := f.trakPath(t) + "/mdia/minf/stbl/" + trak.Mdia.Minf.Stbl.Stco.Name
+		outside := 0
+		for i, s := range trak.Samples {
+			r := sampleRange{trak: t, index: i, start: int64(s.Offset), end: int64(s.Offset) + int64(s.Size)}
+			ranges = append(ranges, r)
+			inside := false
+			for _, m := range mdats {
+				if r.start >= m.Start+BOX_HEADER_SIZE && r.end <= m.Start+m.Size {
+					inside = true
+					break
+				}
+			}
+			if !inside {
+				if outside == 0 {
+					v.report(SEVERITY_ERROR, path, "sample %d at %d..%d lies outside mdat", i, r.start, r.end)
+				}
+				outside++
+			}
+		}
+		if outside > 1 {
+			v.report(SEVERITY_ERROR, path, "%d samples in total lie outside mdat", outside)
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	overlaps := []string{}
+	// prev is the range reaching furthest so far
+	for i, prev := 1, 0; i < len(ranges); i++ {
+		cur := ranges[i]
+		if cur.start < ranges[prev].end && cur.end > cur.start {
+			overlaps = append(overlaps, fmt.Sprintf("track %d sample %d overlaps track %d sample %d", cur.trak, cur.index, ranges[prev].trak, ranges[prev].index))
+		}
+		if cur.end > ranges[prev].end {
+			prev = i
+		}
+	}
+	if len(overlaps) > 0 {
+		msg := overlaps[0]
+		if len(overlaps) > 1 {
+			msg += fmt.Sprintf(" (%d overlaps in total)", len(overlaps))
+		}
+		v.report(SEVERITY_ERROR, "mdat", "%v", msg)
+	}
+}
+
+// FormatFindings renders findings one per line, errors first.
+func FormatFindings(findings []Finding) string {
+	sorted := make([]Finding, len(findings))
+	copy(sorted, findings)
+	rank := map[string]int{SEVERITY_ERROR: 0, SEVERITY_WARNING: 1, SEVERITY_INFO: 2}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank[sorted[i].Severity] < rank[sorted[j].Severity]
+	})
+	lines := []string{}
+	for _, f := range sorted {
+		lines = append(lines, f.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,61 @@
+package mp4
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateTruncatedTrak(t *testing.T) {
+	ftyp := testBox("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"))
+	tkhd := testFullBox("tkhd", 0, 3, u32(0), u32(0), u32(1), u32(0), u32(0),
+		make([]byte, 8), u16(0), u16(0), u16(0), u16(0), testMatrix, u32(0), u32(0))
+	moov := testBox("moov", testMvhd(0, 0, 0, 2), testBox("trak", tkhd))
+	path := filepath.Join(t.TempDir(), "truncated.mp4")
+	if err := os.WriteFile(path, bytes.Join([][]byte{ftyp, testBox("mdat", []byte("data")), moov}, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if f == nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	findings := f.Validate()
+	if !HasErrors(findings) || !strings.Contains(FormatFindings(findings), "required box mdia is missing") {
+		t.Errorf("Findings do not report the missing mdia box:\n%v", FormatFindings(findings))
+	}
+}
+
+func TestValidateValidFile(t *testing.T) {
+	m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(5)}
+	if findings := openBytes(t, m.build()).Validate(); len(findings) > 0 {
+		t.Errorf("Findings for a valid file:\n%v", FormatFindings(findings))
+	}
+}
+
+func TestValidateSampleTables(t *testing.T) {
+	m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(5), sync: []uint32{2, 1}}
+	data := m.build()
+	// Move the chunk past the end of the file
+	stco := bytes.Index(data, []byte("stco")) + 12
+	copy(data[stco:], u32(uint32(len(data))))
+	path := filepath.Join(t.TempDir(), "bad.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Open(path)
+	if f == nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	out := FormatFindings(f.Validate())
+	for _, want := range []string{"entry 1 sample number 1 is not ascending", "first sample is not a sync sample", "lies outside mdat"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Findings miss %q:\n%v", want, out)
+		}
+	}
+}
@@ -0,0 +1,870 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// boxWriter is implemented by every box type that can be serialized.
+// EncodedSize is the size Write will produce, header included.
+type boxWriter interface {
+	box() *Box
+	EncodedSize() int64
+	Write(w io.Writer) error
+}
+
+// Identity matrix used by mvhd and tkhd boxes created from scratch.
+var unityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// newBox returns the Box of a box created in memory rather than parsed.
+func newBox(name string) *Box {
+	return &Box{Name: name}
+}
+
+func (b *Box) box() *Box {
+	return b
+}
+
+// EncodedSize of a box without a dedicated writer is its size in the file.
+func (b *Box) EncodedSize() int64 {
+	return b.Size
+}
+
+// Write copies a box without a dedicated writer, e.g. mdat or free, as is
+// from the file it was read from.
+func (b *Box) Write(w io.Writer) error {
+	if b.File == nil {
+		return fmt.Errorf("Box %v has no data to write", b.Name)
+	}
+	_, err := io.Copy(w, io.NewSectionReader(b.File, b.Start, b.Size))
+	return err
+}
+
+// encodedSize returns the size of a box holding payload followed by children,
+// using a 64-bit largesize header when needed.
+func encodedSize(payload []byte, children []boxWriter) int64 {
+	size := BOX_HEADER_SIZE + int64(len(payload))
+	for _, c := range children {
+		size += c.EncodedSize()
+	}
+	if size > math.MaxUint32 {
+		size += 8
+	}
+	return size
+}
+
+// writeBox writes the header, payload and children of a box.
+func writeBox(w io.Writer, name string, payload []byte, children []boxWriter) error {
+	if len(name) != 4 {
+		return fmt.Errorf("Invalid box type %q", name)
+	}
+	size := encodedSize(payload, children)
+	header := make([]byte, 0, 16)
+	if size > math.MaxUint32 {
+		header = binary.BigEndian.AppendUint32(header, 1)
+		header = append(header, name...)
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, uint32(size))
+		header = append(header, name...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := c.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// present drops the nil boxes from a list of a container's fields.
+func present(boxes ...boxWriter) []boxWriter {
+	out := []boxWriter{}
+	for _, b := range boxes {
+		if b != nil && !reflect.ValueOf(b).IsNil() {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// childWriters lists the children a container writes: its parsed children
+// in file order, where children of a handled type are replaced by the boxes
+// currently in the container's fields. Children of other types are copied
+// as is. A handled child that is no longer referenced is dropped, and a new
+// box takes the place of the first dropped child of the same type. Other
+// boxes added since parsing go before the first box that follows them in
+// current, or at the end.
+func childWriters(parsed []*Box, handled []string, current ...boxWriter) []boxWriter {
+	current = present(current...)
+	isHandled := map[string]bool{}
+	for _, name := range handled {
+		isHandled[name] = true
+	}
+	isParsed := map[*Box]bool{}
+	remaining := map[string]int{} // parsed children of each type not reached yet
+	for _, c := range parsed {
+		isParsed[c] = true
+		remaining[c.Name]++
+	}
+
+	used := make([]bool, len(current))
+	out := []boxWriter{}
+	take := func(match func(b *Box) bool) {
+		for i, c := range current {
+			if used[i] || !match(c.box()) {
+				continue
+			}
+			for j := 0; j < i; j++ {
+				if b := current[j].box(); !used[j] && !isParsed[b] && remaining[b.Name] == 0 {
+					used[j] = true
+					out = append(out, current[j])
+				}
+			}
+			used[i] = true
+			out = append(out, c)
+			return
+		}
+	}
+	for _, child := range parsed {
+		remaining[child.Name]--
+		if !isHandled[child.Name] {
+			out = append(out, child)
+			continue
+		}
+		n := len(out)
+		take(func(b *Box) bool { return b == child })
+		if len(out) == n {
+			take(func(b *Box) bool { return b.Name == child.Name && !isParsed[b] })
+		}
+	}
+	for i, c := range current {
+		if !used[i] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func appendFullBox(buf []byte, version uint8, flags [3]byte) []byte {
+	buf = append(buf, version)
+	return append(buf, flags[:]...)
+}
+
+// appendVersioned appends a time or duration field, 64-bit in version 1.
+func appendVersioned(buf []byte, version uint8, v uint64) []byte {
+	if version == 1 {
+		return binary.BigEndian.AppendUint64(buf, v)
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(v))
+}
+
+// appendFourCC appends s padded or cut to 4 bytes.
+func appendFourCC(buf []byte, s string) []byte {
+	var cc [4]byte
+	copy(cc[:], s)
+	return append(buf, cc[:]...)
+}
+
+// Write serializes the file: known boxes from their fields, everything else,
+// including the media data, copied from the original file.
+func (f *File) Write(w io.Writer) error {
+	for _, b := range f.topBoxes() {
+		if err := b.Write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodedSize returns the number of bytes Write produces.
+func (f *File) EncodedSize() int64 {
+	size := int64(0)
+	for _, b := range f.topBoxes() {
+		size += b.EncodedSize()
+	}
+	return size
+}
+
+// topBoxes lists the top-level boxes to write. Media data boxes, including
+// every mdat of a fragmented file, are copied as is.
+func (f *File) topBoxes() []boxWriter {
+	var ftyp, moov boxWriter
+	if f.Ftyp != nil {
+		ftyp = f.Ftyp
+	}
+	if f.Moov != nil {
+		moov = f.Moov
+	}
+	return childWriters(f.boxes, []string{"ftyp", "moov"}, ftyp, moov)
+}
+
+func (b *FtypBox) payload() []byte {
+	buf := appendFourCC(nil, b.Major_brand)
+	buf = appendFourCC(buf, b.Minor_version)
+	for _, brand := range b.Compatible_brands {
+		buf = appendFourCC(buf, brand)
+	}
+	return buf
+}
+
+func (b *FtypBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *FtypBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MoovBox) boxes() []boxWriter {
+	current := []boxWriter{b.Mvhd, b.Iods}
+	for _, trak := range b.Traks {
+		current = append(current, trak)
+	}
+	current = append(current, b.Mvex, b.Udta)
+	return childWriters(b.children, []string{"mvhd", "iods", "trak", "mvex", "udta"}, current...)
+}
+
+func (b *MoovBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MoovBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *MvhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = appendVersioned(buf, b.Version, b.Creation_time)
+	buf = appendVersioned(buf, b.Version, b.Modification_time)
+	buf = binary.BigEndian.AppendUint32(buf, b.Timescale)
+	buf = appendVersioned(buf, b.Version, b.Duration)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(b.Rate))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(b.Volume))
+	other := b.Other_data
+	if len(other) < 74 {
+		// 10 bytes reserved, matrix, 24 bytes pre_defined and next_track_id
+		other = make([]byte, 74)
+		copy(other[10:46], unityMatrix)
+	}
+	start := len(buf)
+	buf = append(buf, other...)
+	binary.BigEndian.PutUint32(buf[start+70:start+74], b.Next_track_id)
+	return buf
+}
+
+func (b *MvhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *MvhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *IodsBox) EncodedSize() int64 { return encodedSize(b.Data, nil) }
+
+func (b *IodsBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.Data, nil) }
+
+func (b *TrakBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"tkhd", "edts", "mdia"}, b.Tkhd, b.Edts, b.Mdia)
+}
+
+func (b *TrakBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *TrakBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *TkhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = appendVersioned(buf, b.Version, b.Creation_time)
+	buf = appendVersioned(buf, b.Version, b.Modification_time)
+	buf = binary.BigEndian.AppendUint32(buf, b.Track_id)
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = appendVersioned(buf, b.Version, b.Duration)
+	buf = binary.BigEndian.AppendUint64(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, b.Layer)
+	buf = binary.BigEndian.AppendUint16(buf, b.Alternate_group)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(b.Volume))
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	if len(b.Matrix) == len(unityMatrix) {
+		buf = append(buf, b.Matrix...)
+	} else {
+		buf = append(buf, unityMatrix...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(b.Width))
+	return binary.BigEndian.AppendUint32(buf, uint32(b.Height))
+}
+
+func (b *TkhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *TkhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *EdtsBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"elst"}, b.Elst)
+}
+
+func (b *EdtsBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *EdtsBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *ElstBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Segment_duration)))
+	for i := range b.Segment_duration {
+		buf = appendVersioned(buf, b.Version, b.Segment_duration[i])
+		buf = appendVersioned(buf, b.Version, uint64(b.Media_time[i]))
+		buf = binary.BigEndian.AppendUint16(buf, b.Media_rate_integer[i])
+		buf = binary.BigEndian.AppendUint16(buf, b.Media_rate_fraction[i])
+	}
+	return buf
+}
+
+func (b *ElstBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *ElstBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MdiaBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"mdhd", "hdlr", "minf"}, b.Mdhd, b.Hdlr, b.Minf)
+}
+
+func (b *MdiaBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MdiaBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *MdhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = appendVersioned(buf, b.Version, b.Creation_time)
+	buf = appendVersioned(buf, b.Version, b.Modification_time)
+	buf = binary.BigEndian.AppendUint32(buf, b.Timescale)
+	buf = appendVersioned(buf, b.Version, b.Duration)
+	buf = binary.BigEndian.AppendUint16(buf, b.Language)
+	return binary.BigEndian.AppendUint16(buf, b.Pre_defined)
+}
+
+func (b *MdhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *MdhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *HdlrBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Pre_defined)
+	buf = appendFourCC(buf, b.Handler_type)
+	buf = append(buf, b.Reserved[:]...)
+	return append(buf, b.Track_name...)
+}
+
+func (b *HdlrBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *HdlrBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *MinfBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"vmhd", "smhd", "hdlr", "dinf", "stbl"}, b.Vmhd, b.Smhd, b.Hdlr, b.Dinf, b.Stbl)
+}
+
+func (b *MinfBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *MinfBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *VmhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint16(buf, b.Graphicsmode)
+	for _, c := range b.Opcolor {
+		buf = binary.BigEndian.AppendUint16(buf, c)
+	}
+	return buf
+}
+
+func (b *VmhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *VmhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *SmhdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint16(buf, b.Balance)
+	return binary.BigEndian.AppendUint16(buf, 0)
+}
+
+func (b *SmhdBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *SmhdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *DinfBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"dref"}, b.Dref)
+}
+
+func (b *DinfBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *DinfBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *DrefBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	if b.Entry_count == 0 && len(b.Other_data) == 0 {
+		// A single self-contained url entry: media data is in this file
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		return append(buf, 0, 0, 0, 12, 'u', 'r', 'l', ' ', 0, 0, 0, 1)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, b.Entry_count)
+	return append(buf, b.Other_data...)
+}
+
+func (b *DrefBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *DrefBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *StblBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"stsd", "stts", "ctts", "stss", "stsc", "stsz", "stco", "co64"},
+		b.Stsd, b.Stts, b.Ctts, b.Stss, b.Stsc, b.Stsz, b.Stco)
+}
+
+func (b *StblBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *StblBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *StsdBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return binary.BigEndian.AppendUint32(buf, uint32(len(b.Entries)))
+}
+
+func (b *StsdBox) boxes() []boxWriter {
+	entries := []boxWriter{}
+	for _, e := range b.Entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (b *StsdBox) EncodedSize() int64 { return encodedSize(b.payload(), b.boxes()) }
+
+func (b *StsdBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), b.boxes()) }
+
+func (b *SampleEntry) payload() []byte {
+	var fields []byte
+	switch b.Kind() {
+	case "vide":
+		fields = make([]byte, VISUAL_SAMPLE_ENTRY_SIZE)
+		if len(b.fields) == len(fields) {
+			copy(fields, b.fields)
+		} else {
+			binary.BigEndian.PutUint16(fields[76:78], 0xffff) // pre_defined = -1
+		}
+		binary.BigEndian.PutUint16(fields[24:26], b.Width)
+		binary.BigEndian.PutUint16(fields[26:28], b.Height)
+		binary.BigEndian.PutUint32(fields[28:32], uint32(b.Horizresolution))
+		binary.BigEndian.PutUint32(fields[32:36], uint32(b.Vertresolution))
+		binary.BigEndian.PutUint16(fields[40:42], b.Frame_count)
+		name := fields[42:74]
+		if n := int(name[0]); n > 31 || string(name[1:1+n]) != b.Compressorname {
+			for i := range name {
+				name[i] = 0
+			}
+			name[0] = byte(copy(name[1:], b.Compressorname))
+		}
+		binary.BigEndian.PutUint16(fields[74:76], b.Depth)
+	case "soun":
+		size := AUDIO_SAMPLE_ENTRY_SIZE
+		switch b.Sound_version {
+		case 1:
+			size += SOUND_DESCRIPTION_V1_SIZE
+		case 2:
+			size += SOUND_DESCRIPTION_V2_SIZE
+		}
+		fields = make([]byte, size)
+		if len(b.fields) == len(fields) {
+			copy(fields, b.fields)
+		}
+		if b.Sound_version != 0 {
+			binary.BigEndian.PutUint16(fields[8:10], b.Sound_version)
+		}
+		binary.BigEndian.PutUint16(fields[16:18], b.Channel_count)
+		binary.BigEndian.PutUint16(fields[18:20], b.Sample_size)
+		binary.BigEndian.PutUint32(fields[24:28], uint32(b.Sample_rate))
+		switch b.Sound_version {
+		case 1:
+			binary.BigEndian.PutUint32(fields[28:32], b.Samples_per_packet)
+			binary.BigEndian.PutUint32(fields[32:36], b.Bytes_per_packet)
+			binary.BigEndian.PutUint32(fields[36:40], b.Bytes_per_frame)
+			binary.BigEndian.PutUint32(fields[40:44], b.Bytes_per_sample)
+		case 2:
+			if len(b.fields) != len(fields) {
+				binary.BigEndian.PutUint32(fields[28:32], uint32(size+BOX_HEADER_SIZE)) // sizeOfStructOnly
+				binary.BigEndian.PutUint32(fields[44:48], 0x7f000000)
+			}
+			binary.BigEndian.PutUint64(fields[32:40], math.Float64bits(b.Audio_sample_rate))
+			binary.BigEndian.PutUint32(fields[40:44], b.Audio_channels)
+			binary.BigEndian.PutUint32(fields[48:52], b.Bits_per_channel)
+			binary.BigEndian.PutUint32(fields[52:56], b.Format_specific_flags)
+			binary.BigEndian.PutUint32(fields[56:60], b.Bytes_per_audio_packet)
+			binary.BigEndian.PutUint32(fields[60:64], b.Frames_per_audio_packet)
+		}
+	case "text":
+		fields = make([]byte, 8)
+		if b.Name == "tx3g" {
+			fields = make([]byte, TEXT_SAMPLE_ENTRY_SIZE)
+			binary.BigEndian.PutUint32(fields[8:12], b.Display_flags)
+			fields[12] = byte(b.Horizontal_justification)
+			fields[13] = byte(b.Vertical_justification)
+			copy(fields[14:18], b.Background_color[:])
+			for i, v := range b.Default_text_box {
+				binary.BigEndian.PutUint16(fields[18+2*i:], uint16(v))
+			}
+			copy(fields[26:38], b.Default_style[:])
+		}
+	case "subt":
+		fields = make([]byte, 8)
+		for _, str := range []string{b.Namespace, b.Schema_location, b.Auxiliary_mime_types} {
+			fields = append(append(fields, str...), 0)
+		}
+	}
+	binary.BigEndian.PutUint16(fields[6:8], b.Data_reference_index)
+	return fields
+}
+
+func (b *SampleEntry) boxes() []boxWriter {
+	current := []boxWriter{b.Avcc, b.Hvcc, b.Av1c, b.Vpcc, b.Esds, b.Dops, b.Pcmc, b.Dac3, b.Dec3, b.Pasp}
+	for _, c := range b.raw_children {
+		current = append(current, c)
+	}
+	return childWriters(b.children, []string{"avcC", "hvcC", "av1C", "vpcC", "esds", "dOps", "pcmC", "dac3", "dec3", "pasp"}, current...)
+}
+
+func (b *SampleEntry) EncodedSize() int64 {
+	if b.Kind() == "" || b.raw {
+		return b.Box.EncodedSize()
+	}
+	return encodedSize(b.payload(), b.boxes())
+}
+
+// Write serializes the entry. Formats whose fields are not parsed, or
+// failed to parse, are copied as is.
+func (b *SampleEntry) Write(w io.Writer) error {
+	if b.Kind() == "" || b.raw {
+		return b.Box.Write(w)
+	}
+	return writeBox(w, b.Name, b.payload(), b.boxes())
+}
+
+func (b *PaspBox) payload() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, b.H_spacing)
+	return binary.BigEndian.AppendUint32(buf, b.V_spacing)
+}
+
+func (b *PaspBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *PaspBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+// appendNalArray appends NAL units each prefixed with a 16-bit length.
+func appendNalArray(buf []byte, nals [][]byte) []byte {
+	for _, nal := range nals {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(nal)))
+		buf = append(buf, nal...)
+	}
+	return buf
+}
+
+func (b *AvcCBox) payload() []byte {
+	reserved := []byte{0xfc, 0xe0}
+	if len(b.reserved) == len(reserved) {
+		reserved = b.reserved
+	}
+	buf := []byte{b.Configuration_version, b.Profile, b.Profile_compatibility, b.Level}
+	buf = append(buf, reserved[0]|b.Length_size_minus_one, reserved[1]|uint8(len(b.Sps)))
+	buf = appendNalArray(buf, b.Sps)
+	buf = append(buf, uint8(len(b.Pps)))
+	buf = appendNalArray(buf, b.Pps)
+	return append(buf, b.Ext...)
+}
+
+func (b *AvcCBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *AvcCBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *HvcCBox) payload() []byte {
+	reserved := []byte{0xf0, 0, 0xfc, 0xfc, 0xf8, 0xf8}
+	if len(b.reserved) == len(reserved) {
+		reserved = b.reserved
+	}
+	buf := []byte{b.Configuration_version, b.General_profile_space<<6 | b.General_tier_flag<<5 | b.General_profile_idc}
+	buf = binary.BigEndian.AppendUint32(buf, b.General_profile_compatibility_flags)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(b.General_constraint_indicator_flags>>32))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(b.General_constraint_indicator_flags))
+	buf = append(buf, b.General_level_idc)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(reserved[0])<<8|b.Min_spatial_segmentation_idc)
+	buf = append(buf, reserved[2]|b.Parallelism_type, reserved[3]|b.Chroma_format_idc)
+	buf = append(buf, reserved[4]|b.Bit_depth_luma_minus8, reserved[5]|b.Bit_depth_chroma_minus8)
+	buf = binary.BigEndian.AppendUint16(buf, b.Avg_frame_rate)
+	buf = append(buf, b.Constant_frame_rate<<6|b.Num_temporal_layers<<3|b.Temporal_id_nested<<2|b.Length_size_minus_one)
+	buf = append(buf, uint8(len(b.Arrays)))
+	for _, a := range b.Arrays {
+		buf = append(buf, a.Array_completeness<<7|a.reserved<<6|a.Nal_unit_type)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(a.Nalus)))
+		buf = appendNalArray(buf, a.Nalus)
+	}
+	return buf
+}
+
+func (b *HvcCBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *HvcCBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *Av1CBox) payload() []byte {
+	marker := byte(0x80)
+	if b.no_marker {
+		marker = 0
+	}
+	buf := []byte{
+		marker | b.Version,
+		b.Seq_profile<<5 | b.Seq_level_idx_0,
+		b.Seq_tier_0<<7 | b.High_bitdepth<<6 | b.Twelve_bit<<5 | b.Monochrome<<4 |
+			b.Chroma_subsampling_x<<3 | b.Chroma_subsampling_y<<2 | b.Chroma_sample_position,
+		b.Initial_presentation_delay_present<<4 | b.Initial_presentation_delay_minus_one,
+	}
+	return append(buf, b.Config_obus...)
+}
+
+func (b *Av1CBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *Av1CBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *VpcCBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	if b.Version == 0 {
+		buf = append(buf, b.Profile, b.Level, b.Bit_depth<<4|b.color_space,
+			b.Chroma_subsampling<<4|b.transfer_function<<1|b.Video_full_range_flag)
+	} else {
+		buf = append(buf, b.Profile, b.Level, b.Bit_depth<<4|b.Chroma_subsampling<<1|b.Video_full_range_flag,
+			b.Colour_primaries, b.Transfer_characteristics, b.Matrix_coefficients)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b.Codec_initialization_data)))
+	return append(buf, b.Codec_initialization_data...)
+}
+
+func (b *VpcCBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *VpcCBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *DOpsBox) payload() []byte {
+	buf := []byte{b.Version, b.Output_channel_count}
+	buf = binary.BigEndian.AppendUint16(buf, b.Pre_skip)
+	buf = binary.BigEndian.AppendUint32(buf, b.Input_sample_rate)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(b.Output_gain))
+	buf = append(buf, b.Channel_mapping_family)
+	if b.Channel_mapping_family != 0 {
+		buf = append(buf, b.Stream_count, b.Coupled_count)
+		buf = append(buf, b.Channel_mapping...)
+	}
+	return buf
+}
+
+func (b *DOpsBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *DOpsBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *PcmCBox) payload() []byte {
+	return append(appendFullBox(nil, b.Version, b.Flags), b.Format_flags, b.Pcm_sample_size)
+}
+
+func (b *PcmCBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *PcmCBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *Dac3Box) payload() []byte {
+	v := uint32(b.Fscod)<<22 | uint32(b.Bsid)<<17 | uint32(b.Bsmod)<<14 | uint32(b.Acmod)<<11 |
+		uint32(b.Lfeon)<<10 | uint32(b.Bit_rate_code)<<5 | uint32(b.Reserved)
+	return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func (b *Dac3Box) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *Dac3Box) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *Dec3Box) payload() []byte {
+	bw := &bitWriter{}
+	bw.writeBits(uint32(b.Data_rate), 13)
+	bw.writeBits(uint32(len(b.Substreams)-1), 3)
+	for _, s := range b.Substreams {
+		bw.writeBits(uint32(s.Fscod), 2)
+		bw.writeBits(uint32(s.Bsid), 5)
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(s.Asvc), 1)
+		bw.writeBits(uint32(s.Bsmod), 3)
+		bw.writeBits(uint32(s.Acmod), 3)
+		bw.writeBits(uint32(s.Lfeon), 1)
+		bw.writeBits(0, 3)
+		bw.writeBits(uint32(s.Num_dep_sub), 4)
+		if s.Num_dep_sub > 0 {
+			bw.writeBits(uint32(s.Chan_loc), 9)
+		} else {
+			bw.writeBits(0, 1)
+		}
+	}
+	return append(bw.data, b.Extra_bytes...)
+}
+
+func (b *Dec3Box) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *Dec3Box) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+// appendDescriptor appends an MPEG-4 descriptor, writing its size with at
+// least width bytes.
+func appendDescriptor(buf []byte, tag uint8, width int, body []byte) []byte {
+	size := len(body)
+	for n := 1; n < 4 && size>>(7*n) > 0; n++ {
+		if width < n+1 {
+			width = n + 1
+		}
+	}
+	if width < 1 {
+		width = 1
+	}
+	buf = append(buf, tag)
+	for i := width - 1; i >= 0; i-- {
+		b := byte(size>>(7*i)) & 0x7f
+		if i > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+	}
+	return append(buf, body...)
+}
+
+func (b *EsdsBox) payload() []byte {
+	stream_bits := uint8(1) // reserved bit set
+	if b.sizeWidths[1] > 0 {
+		stream_bits = b.streamBits
+	}
+	dcd := []byte{b.Object_type_indication, b.Stream_type<<2 | stream_bits}
+	dcd = append(dcd, byte(b.Buffer_size_db>>16), byte(b.Buffer_size_db>>8), byte(b.Buffer_size_db))
+	dcd = binary.BigEndian.AppendUint32(dcd, b.Max_bitrate)
+	dcd = binary.BigEndian.AppendUint32(dcd, b.Avg_bitrate)
+	if b.Decoder_specific_info != nil {
+		dcd = appendDescriptor(dcd, DECODER_SPECIFIC_INFO_TAG, b.sizeWidths[2], b.Decoder_specific_info)
+	}
+	dcd = append(dcd, b.configExtra...)
+
+	es := binary.BigEndian.AppendUint16(nil, b.Es_id)
+	es = append(es, b.esFlags)
+	es = append(es, b.esOptional...)
+	es = appendDescriptor(es, DECODER_CONFIG_DESCRIPTOR_TAG, b.sizeWidths[1], dcd)
+	if b.sizeWidths[0] > 0 {
+		es = append(es, b.esExtra...)
+	} else {
+		// SLConfigDescriptor with the predefined MP4 settings
+		es = append(es, 0x06, 0x01, 0x02)
+	}
+
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	return appendDescriptor(buf, ES_DESCRIPTOR_TAG, b.sizeWidths[0], es)
+}
+
+func (b *EsdsBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *EsdsBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *SttsBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Sample_count)))
+	for i := range b.Sample_count {
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_count[i])
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_delta[i])
+	}
+	return buf
+}
+
+func (b *SttsBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *SttsBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *StssBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Sample_number)))
+	for _, n := range b.Sample_number {
+		buf = binary.BigEndian.AppendUint32(buf, n)
+	}
+	return buf
+}
+
+func (b *StssBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *StssBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *StscBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.First_chunk)))
+	for i := range b.First_chunk {
+		buf = binary.BigEndian.AppendUint32(buf, b.First_chunk[i])
+		buf = binary.BigEndian.AppendUint32(buf, b.Samples_per_chunk[i])
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_description_index[i])
+	}
+	return buf
+}
+
+func (b *StscBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *StscBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *StszBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, b.Sample_size)
+	if b.Sample_size != 0 {
+		return binary.BigEndian.AppendUint32(buf, b.Sample_count)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Entry_size)))
+	for _, size := range b.Entry_size {
+		buf = binary.BigEndian.AppendUint32(buf, size)
+	}
+	return buf
+}
+
+func (b *StszBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *StszBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *StcoBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Chunk_offset)))
+	for _, offset := range b.Chunk_offset {
+		if b.Name == "co64" {
+			buf = binary.BigEndian.AppendUint64(buf, offset)
+		} else {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(offset))
+		}
+	}
+	return buf
+}
+
+func (b *StcoBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *StcoBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *CttsBox) payload() []byte {
+	buf := appendFullBox(nil, b.Version, b.Flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Sample_count)))
+	for i := range b.Sample_count {
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_count[i])
+		buf = binary.BigEndian.AppendUint32(buf, b.Sample_offset[i])
+	}
+	return buf
+}
+
+func (b *CttsBox) EncodedSize() int64 { return encodedSize(b.payload(), nil) }
+
+func (b *CttsBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), nil) }
+
+func (b *UdtaBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"meta"}, b.Meta)
+}
+
+func (b *UdtaBox) EncodedSize() int64 { return encodedSize(nil, b.boxes()) }
+
+func (b *UdtaBox) Write(w io.Writer) error { return writeBox(w, b.Name, nil, b.boxes()) }
+
+func (b *MetaBox) boxes() []boxWriter {
+	return childWriters(b.children, []string{"hdlr"}, b.Hdlr)
+}
+
+func (b *MetaBox) payload() []byte {
+	return appendFullBox(nil, b.Version, b.Flags)
+}
+
+func (b *MetaBox) EncodedSize() int64 { return encodedSize(b.payload(), b.boxes()) }
+
+func (b *MetaBox) Write(w io.Writer) error { return writeBox(w, b.Name, b.payload(), b.boxes()) }
@@ -0,0 +1,110 @@
+package mp4
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Codec configuration boxes with reserved bits and flags that differ from
+// the values written for new boxes
+var (
+	testAvcC = testBox("avcC", []byte{1, 0x64, 0, 0x1f, 0x03, 0x01}, u16(4), []byte{0x67, 0x64, 0, 0x1f}, []byte{1}, u16(4), []byte{0x68, 0xee, 0x3c, 0x80})
+	testHvcC = testBox("hvcC", []byte{1, 0x01}, u32(0x60000000), u16(0x9000), u32(0), []byte{93}, u16(0), []byte{0, 1, 0, 0}, u16(0), []byte{0x0f, 1},
+		[]byte{0x40 | 33}, u16(1), u16(3), []byte{0x42, 1, 1})
+	testEsds = testFullBox("esds", 0, 0, []byte{ES_DESCRIPTOR_TAG, 25}, u16(1), []byte{0},
+		[]byte{DECODER_CONFIG_DESCRIPTOR_TAG, 17, 0x40, 5<<2 | 2, 0, 0x18, 0}, u32(128000), u32(96000), []byte{DECODER_SPECIFIC_INFO_TAG, 2, 0x11, 0x90},
+		[]byte{6, 1, 2})
+)
+
+func TestWriteRoundTrip(t *testing.T) {
+	large := uint64(1)<<33 + 5
+	tests := []struct {
+		name  string
+		movie testMovie
+	}{
+		{"version 0", testMovie{time: 3600, edits: []testEdit{{500, -1}, {1000, 1024}}}},
+		{"version 1", testMovie{version: 1, time: 1<<32 + 7, edits: []testEdit{{large, -1}, {large, 1<<32 + 3}}}},
+		{"version 1 small values", testMovie{version: 1, time: 3600, edits: []testEdit{{500, -1}, {1000, 0}}}},
+		{"co64", testMovie{co64: true}},
+		{"largesize mdat", testMovie{mdat: "large"}},
+		{"size 0 mdat", testMovie{mdat: "zero", co64: true}},
+		{"avcC", testMovie{entry: testVisualEntry("avc1", testAvcC, testBox("pasp", u32(1), u32(1)))}},
+		{"hvcC", testMovie{entry: testVisualEntry("hvc1", testHvcC)}},
+		{"esds", testMovie{handler: "soun", entry: testAudioEntry("mp4a", 48000, testEsds)}},
+		{"udta", testMovie{moov_tail: [][]byte{testBox("udta", testBox("cprt", []byte("2019")), testBox("free", make([]byte, 5)))}}},
+		{"broken avcC", testMovie{entry: testVisualEntry("avc1", testBox("avcC", []byte{1, 0x64}), testBox("btrt", u32(0), u32(0), u32(0)))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.movie
+			m.timescale, m.delta, m.samples = 90000, 3000, testSamples(5)
+			if m.version == 1 && m.time > 1<<32 {
+				// A duration over 32 bits, in both timescales
+				m.delta = uint32(large / 5)
+			}
+			data := m.build()
+			f := openBytes(t, data)
+
+			out := &bytes.Buffer{}
+			if err := f.Write(out); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				for i := range data {
+					if i >= out.Len() || out.Bytes()[i] != data[i] {
+						t.Fatalf("Output differs at byte %d of %d (%d written)", i, len(data), out.Len())
+					}
+				}
+				t.Fatalf("Output has %d bytes, want %d", out.Len(), len(data))
+			}
+			if size := f.EncodedSize(); size != int64(len(data)) {
+				t.Errorf("EncodedSize() = %d, want %d", size, len(data))
+			}
+		})
+	}
+}
+
+func TestVersion1Fields(t *testing.T) {
+	duration := uint64(1)<<33 + 5
+	m := testMovie{version: 1, time: 1<<32 + 7, timescale: 1000, delta: uint32(duration / 5), samples: testSamples(5),
+		edits: []testEdit{{1 << 33, -1}, {duration, 1<<32 + 3}}}
+	f := openBytes(t, m.build())
+
+	want := m.duration()
+	if got := f.Moov.Mvhd.Duration; got != want {
+		t.Errorf("mvhd duration = %d, want %d", got, want)
+	}
+	trak := f.Moov.Traks[0]
+	if trak.Tkhd.Duration != want || trak.Mdia.Mdhd.Duration != want {
+		t.Errorf("tkhd/mdhd duration = %d/%d, want %d", trak.Tkhd.Duration, trak.Mdia.Mdhd.Duration, want)
+	}
+	if got := f.Moov.Mvhd.Creation_time; got != m.time {
+		t.Errorf("mvhd creation time = %d, want %d", got, m.time)
+	}
+	elst := trak.Edts.Elst
+	if elst.Media_time[0] != -1 || elst.Media_time[1] != 1<<32+3 || elst.Segment_duration[0] != 1<<33 {
+		t.Errorf("elst = %v %v", elst.Segment_duration, elst.Media_time)
+	}
+	if got := trak.GetMediaTime(); got != 1<<32+3 {
+		t.Errorf("GetMediaTime() = %d, want %d", got, int64(1<<32+3))
+	}
+}
+
+func TestCodecConfigFields(t *testing.T) {
+	m := testMovie{timescale: 90000, delta: 3000, samples: testSamples(2), entry: testVisualEntry("hvc1", testHvcC)}
+	hvcc := openBytes(t, m.build()).Moov.Traks[0].GetSampleEntry(1).Hvcc
+	if hvcc == nil || hvcc.General_profile_idc != 1 || hvcc.General_level_idc != 93 || hvcc.Chroma_format_idc != 1 ||
+		len(hvcc.Arrays) != 1 || hvcc.Arrays[0].Nal_unit_type != 33 || len(hvcc.ParameterSets()) != 1 {
+		t.Errorf("hvcC = %+v", hvcc)
+	}
+
+	m = testMovie{handler: "soun", timescale: 48000, delta: 1024, samples: testSamples(2), entry: testAudioEntry("mp4a", 48000, testEsds)}
+	esds := openBytes(t, m.build()).Moov.Traks[0].GetSampleEntry(1).Esds
+	if esds == nil || esds.Object_type_indication != 0x40 || esds.Stream_type != 5 || esds.Buffer_size_db != 0x1800 ||
+		esds.Max_bitrate != 128000 || esds.Avg_bitrate != 96000 || !bytes.Equal(esds.Decoder_specific_info, []byte{0x11, 0x90}) {
+		t.Fatalf("esds = %+v", esds)
+	}
+	if asc, err := esds.AudioSpecificConfig(); err != nil || asc.Object_type != 2 || asc.Sampling_frequency != 48000 || asc.Channel_configuration != 2 {
+		t.Errorf("AudioSpecificConfig = %+v, %v", asc, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runMux(args []string) error {
+	fs := flag.NewFlagSet("mux", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.264, an H.264 Annex-B elementary stream")
+	output := fs.String("o", "", "-o output_file.mp4")
+	fps := fs.String("fps", "25", "-fps frame rate, e.g. 25, 29.97 or 30000/1001")
+	timestamps := fs.String("timestamps", "", "-timestamps file with the presentation time in milliseconds of each frame, one per line in decoding order")
+	timescale := fs.Uint("timescale", 90000, "-timescale track timescale used with -timestamps")
+	fs.Parse(args)
+
+	if *input == "" || *output == "" {
+		return fmt.Errorf("Need an input and an output file, use -i input_file.264 -o output_file.mp4")
+	}
+	mp4.Log = os.Stderr
+	opts := mp4.H264MuxOptions{Timescale: uint32(*timescale)}
+	if *timestamps != "" {
+		ts, err := readTimestamps(*timestamps)
+		if err != nil {
+			return err
+		}
+		opts.Timestamps = ts
+	} else {
+		rate, ok := new(big.Rat).SetString(*fps)
+		if !ok || rate.Sign() <= 0 || !rate.Num().IsUint64() || !rate.Denom().IsUint64() {
+			return fmt.Errorf("Invalid frame rate %v", *fps)
+		}
+		opts.Frame_rate_num, opts.Frame_rate_den = uint32(rate.Num().Uint64()), uint32(rate.Denom().Uint64())
+	}
+
+	in, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return mp4.MuxH264(in, out, opts)
+}
+
+// readTimestamps reads one number per line, skipping blank lines and lines
+// starting with #.
+func readTimestamps(path string) ([]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ts := []float64{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: invalid timestamp %q", path, line, text)
+		}
+		ts = append(ts, v)
+	}
+	return ts, scanner.Err()
+}
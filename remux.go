@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runRemux(args []string) error {
+	fs := flag.NewFlagSet("remux", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.ts, an MPEG-TS stream with H.264, H.265 or AAC")
+	output := fs.String("o", "", "-o output_file.mp4")
+	fs.Parse(args)
+
+	if *input == "" || *output == "" {
+		return fmt.Errorf("Need an input and an output file, use -i input_file.ts -o output_file.mp4")
+	}
+	mp4.Log = os.Stderr
+	in, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return mp4.MuxTS(in, out)
+}
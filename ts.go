@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+)
+
+func runTs(args []string) error {
+	fs := flag.NewFlagSet("ts", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	output := fs.String("o", "", "-o output_file.ts, stdout if empty")
+	track := fs.Int("track", -1, "-track index of the track to keep, all audio and video tracks if -1")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var traks []int
+	if *track >= 0 {
+		traks = []int{*track}
+	}
+
+	out, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteTS(out, traks)
+}
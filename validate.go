@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/matthewgao/mp4reader/mp4"
+)
+
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	input := fs.String("i", inputFile, "-i input_file.mp4")
+	format := fs.String("format", "text", "-format text or json")
+	fs.Parse(args)
+
+	f, err := openInput(*input)
+	if f == nil {
+		return err
+	}
+	defer f.Close()
+
+	findings := []mp4.Finding{}
+	if err != nil {
+		findings = append(findings, mp4.Finding{Severity: mp4.SEVERITY_ERROR, Path: "/", Message: err.Error()})
+	}
+	findings = append(findings, f.Validate()...)
+
+	switch *format {
+	case "text":
+		if len(findings) == 0 {
+			fmt.Println("OK")
+		} else {
+			fmt.Println(mp4.FormatFindings(findings))
+		}
+	case "json":
+		data, err := json.MarshalIndent(findings, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	default:
+		return fmt.Errorf("Unknown format %v, use text or json", *format)
+	}
+
+	if mp4.HasErrors(findings) {
+		return fmt.Errorf("%v is not valid", *input)
+	}
+	return nil
+}